@@ -12,6 +12,11 @@ CREATE TABLE `users` (
   `vip_exp` bigint unsigned DEFAULT '0' COMMENT 'VIP经验值',
   `vip_start_time` datetime DEFAULT NULL COMMENT 'VIP开始时间',
   `status` tinyint unsigned DEFAULT '1' COMMENT '状态(1:正常 0:禁用)',
+  `role` varchar(20) DEFAULT '' COMMENT '系统角色(空:普通用户 admin/moderator/support)',
+  `email_verified` tinyint unsigned DEFAULT '0' COMMENT '邮箱是否已验证(0:未验证 1:已验证)',
+  `mute_until` datetime DEFAULT NULL COMMENT '全局禁言结束时间',
+  `friends_only_until` datetime DEFAULT NULL COMMENT '仅限好友发送结束时间',
+  `shadow_ban_until` datetime DEFAULT NULL COMMENT '影子封禁结束时间',
   `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
   PRIMARY KEY (`id`),
@@ -47,6 +52,7 @@ CREATE TABLE `groups` (
   `vip_exp` bigint unsigned DEFAULT '0' COMMENT '群VIP经验值',
   `vip_start_time` datetime DEFAULT NULL COMMENT '群VIP开始时间',
   `status` tinyint unsigned DEFAULT '1' COMMENT '状态(1:正常 0:解散)',
+  `key_epoch` bigint unsigned DEFAULT '0' COMMENT '端到端加密发送者密钥版本',
   `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
   PRIMARY KEY (`id`),
@@ -62,6 +68,7 @@ CREATE TABLE `group_members` (
   `role` tinyint unsigned DEFAULT '0' COMMENT '角色(0:普通 1:群主 2:管理)',
   `mute_end_time` datetime DEFAULT NULL COMMENT '禁言结束时间',
   `status` tinyint unsigned DEFAULT '1' COMMENT '状态(1:正常 0:已退出/踢出)',
+  `join_seq` bigint unsigned DEFAULT '0' COMMENT '加入时群会话的最新序号(只能拉取之后的消息)',
   `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
   PRIMARY KEY (`id`),
@@ -77,13 +84,18 @@ CREATE TABLE `messages` (
   `sender_fuid` varchar(64) NOT NULL COMMENT '发送者FUID',
   `receiver_type` tinyint unsigned NOT NULL COMMENT '接收类型(1:单聊 2:群聊)',
   `receiver_id` varchar(64) NOT NULL COMMENT '接收者ID(单聊:好友FUID 群聊:群QUID)',
+  `conv_id` varchar(160) DEFAULT '' COMMENT '会话ID(单聊:single:<fuid>:<fuid> 群聊:group:<quid>)',
+  `seq` bigint unsigned DEFAULT '0' COMMENT '会话内递增序号',
   `content_type` tinyint unsigned NOT NULL COMMENT '内容类型(1:文字 2:图片 3:文件 4:表情 5:系统消息)',
   `content` text NOT NULL COMMENT '加密后的内容',
+  `encryption` tinyint unsigned DEFAULT '0' COMMENT '加密方式(0:传输加密 1:端到端加密)',
+  `content_key_id` varchar(32) DEFAULT '' COMMENT '静态加密密钥ID(空:未加密存储)',
   `font_style` varchar(64) DEFAULT '' COMMENT '字体样式',
   `font_size` int DEFAULT '14' COMMENT '字体大小',
   `font_color` varchar(16) DEFAULT '#000000' COMMENT '字体颜色',
   `is_recalled` tinyint(1) DEFAULT '0' COMMENT '是否撤回(0:否 1:是)',
   `is_read` tinyint(1) DEFAULT '0' COMMENT '是否已读(0:否 1:是)',
+  `shadow` tinyint(1) DEFAULT '0' COMMENT '影子消息(0:否 1:是，发送者被影子封禁，只有发送者可见)',
   `send_time` datetime NOT NULL COMMENT '发送时间',
   `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
@@ -91,6 +103,7 @@ CREATE TABLE `messages` (
   UNIQUE KEY `idx_msg_id` (`msg_id`),
   KEY `idx_sender_fuid` (`sender_fuid`),
   KEY `idx_receiver` (`receiver_type`,`receiver_id`),
+  KEY `idx_conv_seq` (`conv_id`,`seq`),
   KEY `idx_send_time` (`send_time`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='消息表';
 
@@ -128,13 +141,264 @@ CREATE TABLE `offline_messages` (
 -- 群公告表
 CREATE TABLE `group_notices` (
   `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `notice_id` varchar(64) DEFAULT '' COMMENT '公告ID(静态加密关联数据)',
   `group_quid` varchar(64) NOT NULL COMMENT '群QUID',
   `content` text NOT NULL COMMENT '公告内容',
+  `content_key_id` varchar(32) DEFAULT '' COMMENT '静态加密密钥ID(空:未加密存储)',
   `publisher_fuid` varchar(64) NOT NULL COMMENT '发布者FUID',
   `publish_time` datetime NOT NULL COMMENT '发布时间',
   `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
   `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
   PRIMARY KEY (`id`),
+  KEY `idx_notice_id` (`notice_id`),
   KEY `idx_group_quid` (`group_quid`),
   KEY `idx_publish_time` (`publish_time`)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='群公告表';
\ No newline at end of file
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='群公告表';
+
+-- 设备身份密钥表（端到端加密）
+CREATE TABLE `device_identity_keys` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `device_id` varchar(64) NOT NULL COMMENT '设备ID',
+  `identity_key` varchar(64) NOT NULL COMMENT '身份公钥(X25519, base64)',
+  `signing_key` varchar(64) NOT NULL COMMENT '签名公钥(Ed25519, base64)',
+  `identity_signature` varchar(128) NOT NULL COMMENT '签名公钥对身份公钥的签名',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_user_device` (`user_fuid`,`device_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='设备身份密钥表';
+
+-- 签名预密钥表
+CREATE TABLE `signed_prekeys` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `device_id` varchar(64) NOT NULL COMMENT '设备ID',
+  `key_id` int unsigned NOT NULL COMMENT '客户端密钥ID',
+  `public_key` varchar(64) NOT NULL COMMENT '预密钥公钥(X25519, base64)',
+  `signature` varchar(128) NOT NULL COMMENT '签名公钥对预密钥的签名',
+  `status` tinyint unsigned DEFAULT '1' COMMENT '状态(1:当前使用 0:已轮换)',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_user_device` (`user_fuid`,`device_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='签名预密钥表';
+
+-- 一次性预密钥表
+CREATE TABLE `one_time_prekeys` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `device_id` varchar(64) NOT NULL COMMENT '设备ID',
+  `key_id` int unsigned NOT NULL COMMENT '客户端密钥ID',
+  `public_key` varchar(64) NOT NULL COMMENT '预密钥公钥(X25519, base64)',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_user_device_key` (`user_fuid`,`device_id`,`key_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='一次性预密钥表';
+
+-- 发送者密钥分发表（群聊端到端加密）
+CREATE TABLE `sender_key_distributions` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `group_quid` varchar(64) NOT NULL COMMENT '群QUID',
+  `epoch` bigint unsigned NOT NULL COMMENT '密钥版本',
+  `sender_fuid` varchar(64) NOT NULL COMMENT '发送方FUID',
+  `sender_device_id` varchar(64) NOT NULL COMMENT '发送方设备ID',
+  `recipient_fuid` varchar(64) NOT NULL COMMENT '接收方FUID',
+  `recipient_device_id` varchar(64) NOT NULL COMMENT '接收方设备ID',
+  `payload` text NOT NULL COMMENT '不透明密文(确认接收后清空)',
+  `status` tinyint unsigned DEFAULT '0' COMMENT '状态(0:待接收 1:已接收)',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_dist_unique` (`group_quid`,`epoch`,`sender_fuid`,`sender_device_id`,`recipient_fuid`,`recipient_device_id`),
+  KEY `idx_dist_recipient` (`recipient_fuid`,`recipient_device_id`,`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='发送者密钥分发表';
+
+-- 登录设备表
+CREATE TABLE `devices` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `device_id` varchar(64) NOT NULL COMMENT '设备ID',
+  `device_name` varchar(64) NOT NULL COMMENT '设备名称',
+  `device_type` varchar(32) NOT NULL COMMENT '设备类型(phone/pc/web/app)',
+  `login_ip` varchar(64) NOT NULL COMMENT '登录IP',
+  `login_time` datetime NOT NULL COMMENT '登录时间',
+  `last_active` datetime NOT NULL COMMENT '最后活跃时间',
+  `refresh_token` varchar(256) NOT NULL DEFAULT '' COMMENT '已废弃(刷新令牌哈希存储于refresh_tokens表，启动时清空旧值)',
+  `status` tinyint unsigned DEFAULT '1' COMMENT '状态(1:在线 0:离线)',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_user_fuid` (`user_fuid`),
+  KEY `idx_device_id` (`device_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='登录设备表';
+
+-- 刷新令牌表（只保存哈希，每次刷新轮换）
+CREATE TABLE `refresh_tokens` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `token_hash` char(64) NOT NULL COMMENT '令牌SHA-256哈希(hex)',
+  `family_id` varchar(64) NOT NULL COMMENT '令牌族ID（一次登录一个）',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `device_id` varchar(64) NOT NULL COMMENT '设备ID',
+  `status` tinyint unsigned DEFAULT '1' COMMENT '状态(1:有效 2:已轮换 3:已吊销)',
+  `expires_at` datetime NOT NULL COMMENT '过期时间',
+  `rotated_at` datetime DEFAULT NULL COMMENT '轮换时间',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_token_hash` (`token_hash`),
+  KEY `idx_family_id` (`family_id`),
+  KEY `idx_user_device` (`user_fuid`,`device_id`),
+  KEY `idx_expires_at` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='刷新令牌表';
+
+-- 两步验证（TOTP）表
+CREATE TABLE `user_totp` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `secret` varchar(256) NOT NULL COMMENT 'TOTP密钥(base32，静态加密)',
+  `secret_key_id` varchar(64) DEFAULT '' COMMENT '静态加密密钥ID(空为明文)',
+  `status` tinyint unsigned DEFAULT '0' COMMENT '状态(0:待确认 1:已启用)',
+  `last_used_step` bigint DEFAULT '0' COMMENT '最近一次使用的时间步(防重放)',
+  `confirmed_at` datetime DEFAULT NULL COMMENT '启用时间',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_user_fuid` (`user_fuid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='两步验证表';
+
+-- 两步验证恢复码表（只保存哈希，单次有效）
+CREATE TABLE `recovery_codes` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `code_hash` char(64) NOT NULL COMMENT '恢复码SHA-256哈希(hex)',
+  `used_at` datetime DEFAULT NULL COMMENT '使用时间',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_user_fuid` (`user_fuid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='两步验证恢复码表';
+
+-- 通行密钥（WebAuthn凭证）表
+CREATE TABLE `webauthn_credentials` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `credential_id` varchar(1368) CHARACTER SET ascii NOT NULL COMMENT '凭证ID(base64url)',
+  `public_key` text NOT NULL COMMENT 'COSE公钥(base64)',
+  `algorithm` int NOT NULL COMMENT 'COSE算法(-7:ES256 -8:EdDSA -257:RS256)',
+  `sign_count` int unsigned DEFAULT '0' COMMENT '签名计数器',
+  `name` varchar(64) DEFAULT '' COMMENT '名称',
+  `transports` varchar(128) DEFAULT '' COMMENT '传输方式(逗号分隔)',
+  `last_used_at` datetime DEFAULT NULL COMMENT '最近使用时间',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_credential_id` (`credential_id`),
+  KEY `idx_user_fuid` (`user_fuid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='通行密钥表';
+
+-- 账号注销申请表（冷静期结束后由后台任务执行）
+CREATE TABLE `account_deletions` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `status` tinyint unsigned DEFAULT '1' COMMENT '状态(1:冷静期中 2:已撤销 3:已执行)',
+  `requested_at` datetime NOT NULL COMMENT '申请时间',
+  `execute_at` datetime NOT NULL COMMENT '冷静期结束时间',
+  `completed_at` datetime DEFAULT NULL COMMENT '执行时间',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_user_fuid` (`user_fuid`),
+  KEY `idx_execute_at` (`execute_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='账号注销申请表';
+
+-- 个人数据导出表
+CREATE TABLE `data_exports` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `export_id` varchar(64) NOT NULL COMMENT '导出ID',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `status` tinyint unsigned DEFAULT '0' COMMENT '状态(0:生成中 1:可下载 2:失败 3:已过期)',
+  `file_key` varchar(256) DEFAULT '' COMMENT '存储后端中的路径',
+  `file_url` varchar(512) DEFAULT '' COMMENT '下载地址',
+  `file_size` bigint DEFAULT '0' COMMENT '文件大小(字节)',
+  `error` varchar(512) DEFAULT '' COMMENT '失败原因',
+  `expires_at` datetime DEFAULT NULL COMMENT '过期时间',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_export_id` (`export_id`),
+  KEY `idx_user_fuid` (`user_fuid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='个人数据导出表';
+
+-- 登录历史表（登录风险评估、用户查询登录记录）
+CREATE TABLE `login_history` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `user_fuid` varchar(64) NOT NULL COMMENT '用户FUID',
+  `device_id` varchar(64) DEFAULT '' COMMENT '设备ID(登录成功时)',
+  `device_name` varchar(64) DEFAULT '' COMMENT '设备名称',
+  `device_type` varchar(16) DEFAULT '' COMMENT '设备类型',
+  `ip` varchar(64) DEFAULT '' COMMENT '登录IP',
+  `user_agent` varchar(256) DEFAULT '' COMMENT 'User-Agent',
+  `method` varchar(20) DEFAULT '' COMMENT '登录方式(password/totp/recovery_code/passkey)',
+  `result` tinyint unsigned DEFAULT '0' COMMENT '结果(0:失败 1:成功)',
+  `reason` varchar(64) DEFAULT '' COMMENT '失败原因',
+  `risk` varchar(128) DEFAULT '' COMMENT '风险标记(逗号分隔)',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '登录时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_user_created` (`user_fuid`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='登录历史表';
+
+-- 审计事件表（只追加）
+CREATE TABLE `audit_events` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `actor_fuid` varchar(64) DEFAULT '' COMMENT '操作者FUID(系统任务为空)',
+  `actor_role` varchar(20) DEFAULT '' COMMENT '操作者系统角色',
+  `action` varchar(64) NOT NULL COMMENT '动作',
+  `target_type` varchar(20) DEFAULT '' COMMENT '对象类型(user/group/message/device/report/system)',
+  `target_id` varchar(64) DEFAULT '' COMMENT '对象ID',
+  `group_quid` varchar(64) DEFAULT '' COMMENT '所属群聊QUID(群聊相关事件)',
+  `ip` varchar(64) DEFAULT '' COMMENT '操作IP',
+  `payload` text COMMENT '附加数据(JSON)',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `idx_actor_fuid` (`actor_fuid`),
+  KEY `idx_action` (`action`),
+  KEY `idx_target` (`target_type`,`target_id`),
+  KEY `idx_group_quid` (`group_quid`),
+  KEY `idx_created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='审计事件表';
+
+-- 举报表
+CREATE TABLE `reports` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `report_id` varchar(64) NOT NULL COMMENT '举报ID',
+  `reporter_fuid` varchar(64) NOT NULL COMMENT '举报人FUID',
+  `target_type` tinyint unsigned NOT NULL COMMENT '对象类型(1:用户 2:消息 3:群聊)',
+  `target_id` varchar(64) NOT NULL COMMENT '对象ID(fuid/msg_id/quid)',
+  `reason` varchar(32) NOT NULL COMMENT '举报原因',
+  `detail` varchar(512) DEFAULT '' COMMENT '补充说明',
+  `evidence` text COMMENT '证据快照(JSON，静态加密)',
+  `evidence_key_id` varchar(32) DEFAULT '' COMMENT '证据静态加密密钥ID(空为明文)',
+  `status` tinyint unsigned DEFAULT '0' COMMENT '状态(0:待处理 1:处理中 2:已处理 3:已驳回)',
+  `open_key` varchar(160) DEFAULT NULL COMMENT '未结案唯一键(举报人|对象类型|对象ID，结案后为NULL)',
+  `handler_fuid` varchar(64) DEFAULT '' COMMENT '处理人FUID',
+  `action` varchar(20) DEFAULT '' COMMENT '处理措施',
+  `result` varchar(512) DEFAULT '' COMMENT '处理说明',
+  `handled_at` datetime DEFAULT NULL COMMENT '处理时间',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_report_id` (`report_id`),
+  UNIQUE KEY `idx_reports_open_key` (`open_key`),
+  KEY `idx_reporter_fuid` (`reporter_fuid`),
+  KEY `idx_target_id` (`target_id`),
+  KEY `idx_status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='举报表';
+
+-- 群聊消息过滤设置表（群主配置，未设置的项沿用全局配置）
+CREATE TABLE `group_filter_settings` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+  `group_quid` varchar(64) NOT NULL COMMENT '群QUID',
+  `config` text COMMENT '过滤设置(JSON)',
+  `updated_by` varchar(64) DEFAULT '' COMMENT '最后修改人FUID',
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_group_quid` (`group_quid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='群聊消息过滤设置表';
@@ -1,41 +1,65 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math/big"
+	"mime"
 	"net"
 	"net/http"
+	"net/smtp"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 	"net/url"
 	"gopkg.in/yaml.v3"
 	"crypto/tls"
 
 	"github.com/gin-contrib/cors"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	redis "github.com/go-redis/redis/v8"
 	"golang.org/x/time/rate"
 	gorillaWs "github.com/gorilla/websocket"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
 	"github.com/minio/minio-go/v7"
@@ -96,6 +120,11 @@ type Config struct {
 		OfflineMsgExpire int   `yaml:"offline_msg_expire"`
 		LimitCacheExpire int  `yaml:"limit_cache_expire"`
 	} `yaml:"redis"`
+	Cluster struct {
+		NodeID           string `yaml:"node_id"`
+		BroadcastChannel string `yaml:"broadcast_channel"`
+		PresenceTTL      int    `yaml:"presence_ttl"`
+	} `yaml:"cluster"`
 	Storage struct {
 		Type string `yaml:"type"`
 		Local struct {
@@ -110,6 +139,11 @@ type Config struct {
 			UseSSL    bool   `yaml:"use_ssl"`
 			Domain    string `yaml:"domain"`
 		} `yaml:"minio"`
+		// 非公开存储（数据导出等，只能通过鉴权接口下载）
+		Private struct {
+			LocalPath   string `yaml:"local_path"`
+			MinIOBucket string `yaml:"minio_bucket"`
+		} `yaml:"private"`
 		File struct {
 			MaxSize   int      `yaml:"max_size"`
 			AllowTypes []string `yaml:"allow_types"`
@@ -121,14 +155,47 @@ type Config struct {
 	} `yaml:"storage"`
 	Crypto struct {
 		JWT struct {
-			Secret       string `yaml:"secret"`
-			Expire       int    `yaml:"expire"`
-			RefreshExpire int   `yaml:"refresh_expire"`
+			Secret             string `yaml:"secret"`
+			Expire             int    `yaml:"expire"`
+			RefreshExpire      int    `yaml:"refresh_expire"`
+			RefreshGrace       int    `yaml:"refresh_grace"`
+			SocketTicketExpire int    `yaml:"socket_ticket_expire"`
+			Algorithm          string `yaml:"algorithm"`
+			KeyDir             string `yaml:"key_dir"`
+			ActiveKID          string `yaml:"active_kid"`
+			AcceptLegacyHS256  bool   `yaml:"accept_legacy_hs256"`
 		} `yaml:"jwt"`
 		RSA struct {
             PublicKeyPath  string `yaml:"public_key_path"`
             PrivateKeyPath string `yaml:"private_key_path"`
 		} `yaml:"rsa"`
+		Envelope struct {
+			Version              int    `yaml:"version"`
+			X25519PrivateKeyPath string `yaml:"x25519_private_key_path"`
+		} `yaml:"envelope"`
+		AtRest struct {
+			Enable            bool   `yaml:"enable"`
+			KeyringPath       string `yaml:"keyring_path"`
+			ReencryptInterval int    `yaml:"reencrypt_interval"`
+			ReencryptBatch    int    `yaml:"reencrypt_batch"`
+		} `yaml:"at_rest"`
+		E2EE struct {
+			MaxOneTimePreKeys  int `yaml:"max_one_time_prekeys"`
+			PreKeyLowThreshold int `yaml:"prekey_low_threshold"`
+		} `yaml:"e2ee"`
+		WebAuthn struct {
+			RPID             string   `yaml:"rp_id"`
+			RPName           string   `yaml:"rp_name"`
+			Origins          []string `yaml:"origins"`
+			ChallengeExpire  int      `yaml:"challenge_expire"`
+			UserVerification string   `yaml:"user_verification"`
+		} `yaml:"webauthn"`
+		TOTP struct {
+			Issuer           string `yaml:"issuer"`
+			LoginTokenExpire int    `yaml:"login_token_expire"`
+			MaxAttempts      int    `yaml:"max_attempts"`
+			RecoveryCodes    int    `yaml:"recovery_codes"`
+		} `yaml:"totp"`
 	} `yaml:"crypto"`
 	CFTurnstile struct {
 		SiteKey   string `yaml:"site_key"`
@@ -159,11 +226,51 @@ type Config struct {
 			Period int `yaml:"period"`
 		} `yaml:"group_user"`
 	} `yaml:"rate_limit"`
+	Audit struct {
+		RetentionDays int `yaml:"retention_days"`
+	} `yaml:"audit"`
+	MessageFilter struct {
+		Enable         bool `yaml:"enable"`
+		SensitiveWords struct {
+			Enable      bool     `yaml:"enable"`
+			Action      string   `yaml:"action"`
+			Replacement string   `yaml:"replacement"`
+			Words       []string `yaml:"words"`
+			DictPath    string   `yaml:"dict_path"`
+		} `yaml:"sensitive_words"`
+		Link struct {
+			Enable       bool     `yaml:"enable"`
+			Action       string   `yaml:"action"`
+			AllowDomains []string `yaml:"allow_domains"`
+		} `yaml:"link"`
+		Flood struct {
+			Enable       bool `yaml:"enable"`
+			Window       int  `yaml:"window"`
+			MaxMessages  int  `yaml:"max_messages"`
+			RepeatWindow int  `yaml:"repeat_window"`
+			MaxRepeats   int  `yaml:"max_repeats"`
+		} `yaml:"flood"`
+	} `yaml:"message_filter"`
+	LoginRisk struct {
+		Enable          bool `yaml:"enable"`
+		NotifyNewDevice bool `yaml:"notify_new_device"`
+		FailureWindow   int  `yaml:"failure_window"`
+		FailureAlert    int  `yaml:"failure_alert"`
+		HistoryDays     int  `yaml:"history_days"`
+		Lockout         struct {
+			Enable      bool `yaml:"enable"`
+			MaxFailures int  `yaml:"max_failures"`
+			Duration    int  `yaml:"duration"`
+		} `yaml:"lockout"`
+	} `yaml:"login_risk"`
 	Business struct {
 		User struct {
 			FUIDLen     int `yaml:"fuid_len"`
 			PasswordCost int `yaml:"password_cost"`
 			FriendMax   int `yaml:"friend_max"`
+			DeletionGraceDays     int    `yaml:"deletion_grace_days"`
+			DeletionMessagePolicy string `yaml:"deletion_message_policy"`
+			ExportExpireDays      int    `yaml:"export_expire_days"`
 		} `yaml:"user"`
 		Group struct {
 			QUIDLen        int `yaml:"quid_len"`
@@ -196,6 +303,9 @@ type Config struct {
 				SendTimes int    `yaml:"send_times"`
 			} `yaml:"system_msg"`
 		} `yaml:"message"`
+		Report struct {
+			DailyLimit int `yaml:"daily_limit"`
+		} `yaml:"report"`
 		Notify struct {
 			Ntfy struct {
 				URL    string `yaml:"url"`
@@ -204,6 +314,22 @@ type Config struct {
 			} `yaml:"ntfy"`
 		} `yaml:"notify"`
 	} `yaml:"business"`
+	Mail struct {
+		Driver string `yaml:"driver"`
+		From   string `yaml:"from"`
+		SMTP   struct {
+			Host        string `yaml:"host"`
+			Port        int    `yaml:"port"`
+			Username    string `yaml:"username"`
+			Password    string `yaml:"password"`
+			ImplicitTLS bool   `yaml:"implicit_tls"`
+		} `yaml:"smtp"`
+		LogDir       string `yaml:"log_dir"`
+		TokenSecret  string `yaml:"token_secret"`
+		VerifyExpire int    `yaml:"verify_expire"`
+		ResetExpire  int    `yaml:"reset_expire"`
+		LinkBase     string `yaml:"link_base"`
+	} `yaml:"mail"`
 	Log struct {
 		Path          string `yaml:"path"`
 		FileNameFormat string `yaml:"file_name_format"`
@@ -225,9 +351,7 @@ var (
 	minioClient *minio.Client
 	log        *logrus.Logger
 	upgrader   = gorillaWs.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin: checkWebSocketOrigin,
 	}
 	// 并发控制
 	msgChan    = make(chan interface{}, 1000)
@@ -235,6 +359,9 @@ var (
 	// RSA密钥
 	rsaPublicKey  *rsa.PublicKey
 	rsaPrivateKey *rsa.PrivateKey
+	x25519PrivateKey *ecdh.PrivateKey
+	// 集群节点ID
+	nodeID string
 )
 
 var (
@@ -252,20 +379,25 @@ var (
 
 // User 用户表
 type User struct {
-	ID        uint64 `gorm:"primarykey;autoIncrement"`
-	FUID      string `gorm:"column:fuid;type:varchar(64);uniqueIndex;not null"`
-	Username  string `gorm:"column:username;type:varchar(64);uniqueIndex;not null"`
-	Nickname  string `gorm:"column:nickname;type:varchar(64);not null"`
-	Email     string `gorm:"column:email;type:varchar(128);uniqueIndex;not null"`
-	Password  string `gorm:"column:password;type:varchar(128);not null"` // bcrypt加密
-	Avatar    string `gorm:"column:avatar;type:varchar(256);default:''"`
-	Signature string `gorm:"column:signature;type:varchar(256);default:''"`
-	VIPLevel  uint8  `gorm:"column:vip_level;type:tinyint;default:0"`
-	VIPExp    uint64 `gorm:"column:vip_exp;type:bigint;default:0"`
-	VIPStartTime time.Time `gorm:"column:vip_start_time;type:datetime;default:null"`
-	Status    uint8  `gorm:"column:status;type:tinyint;default:1"` // 1:正常 0:禁用
-	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
-	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+	ID               uint64     `gorm:"primarykey;autoIncrement"`
+	FUID             string     `gorm:"column:fuid;type:varchar(64);uniqueIndex;not null"`
+	Username         string     `gorm:"column:username;type:varchar(64);uniqueIndex;not null"`
+	Nickname         string     `gorm:"column:nickname;type:varchar(64);not null"`
+	Email            string     `gorm:"column:email;type:varchar(128);uniqueIndex;not null"`
+	Password         string     `gorm:"column:password;type:varchar(128);not null"` // bcrypt加密
+	Avatar           string     `gorm:"column:avatar;type:varchar(256);default:''"`
+	Signature        string     `gorm:"column:signature;type:varchar(256);default:''"`
+	VIPLevel         uint8      `gorm:"column:vip_level;type:tinyint;default:0"`
+	VIPExp           uint64     `gorm:"column:vip_exp;type:bigint;default:0"`
+	VIPStartTime     time.Time  `gorm:"column:vip_start_time;type:datetime;default:null"`
+	Status           uint8      `gorm:"column:status;type:tinyint;default:1"`                 // 1:正常 0:禁用
+	Role             string     `gorm:"column:role;type:varchar(20);default:''"`              // 系统角色（空:普通用户 admin/moderator/support）
+	EmailVerified    uint8      `gorm:"column:email_verified;type:tinyint;default:0"`         // 邮箱是否已验证 0:未验证 1:已验证
+	MuteUntil        *time.Time `gorm:"column:mute_until;type:datetime;default:null"`         // 全局禁言结束时间
+	FriendsOnlyUntil *time.Time `gorm:"column:friends_only_until;type:datetime;default:null"` // 仅限好友发送结束时间
+	ShadowBanUntil   *time.Time `gorm:"column:shadow_ban_until;type:datetime;default:null"`   // 影子封禁结束时间
+	CreatedAt        time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt        time.Time  `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
 }
 
 func (u *User) TableName() string {
@@ -289,24 +421,44 @@ func (f *Friend) TableName() string {
 
 // Group 群聊表
 type Group struct {
-	ID        uint64 `gorm:"primarykey;autoIncrement"`
-	QUID      string `gorm:"column:quid;type:varchar(64);uniqueIndex;not null"`
-	Name      string `gorm:"column:name;type:varchar(64);not null"`
-	OwnerFUID string `gorm:"column:owner_fuid;type:varchar(64);index;not null"` // 群主fuid
-	Avatar    string `gorm:"column:avatar;type:varchar(256);default:''"`
-	Desc      string `gorm:"column:desc;type:varchar(256);default:''"`
-	VIPLevel  uint8  `gorm:"column:vip_level;type:tinyint;default:0"`
-	VIPExp    uint64 `gorm:"column:vip_exp;type:bigint;default:0"`
+	ID           uint64    `gorm:"primarykey;autoIncrement"`
+	QUID         string    `gorm:"column:quid;type:varchar(64);uniqueIndex;not null"`
+	Name         string    `gorm:"column:name;type:varchar(64);not null"`
+	OwnerFUID    string    `gorm:"column:owner_fuid;type:varchar(64);index;not null"` // 群主fuid
+	Avatar       string    `gorm:"column:avatar;type:varchar(256);default:''"`
+	Desc         string    `gorm:"column:desc;type:varchar(256);default:''"`
+	VIPLevel     uint8     `gorm:"column:vip_level;type:tinyint;default:0"`
+	VIPExp       uint64    `gorm:"column:vip_exp;type:bigint;default:0"`
 	VIPStartTime time.Time `gorm:"column:vip_start_time;type:datetime;default:null"`
-	Status    uint8  `gorm:"column:status;type:tinyint;default:1"` // 1:正常 0:解散
-	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
-	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+	Status       uint8     `gorm:"column:status;type:tinyint;default:1"`   // 1:正常 0:解散
+	KeyEpoch     uint64    `gorm:"column:key_epoch;type:bigint;default:0"` // 端到端加密发送者密钥版本（成员变动时递增）
+	CreatedAt    time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt    time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
 }
 
 func (g *Group) TableName() string {
 	return "groups"
 }
 
+// SenderKeyDistribution 发送者密钥分发表（群聊端到端加密，payload为发送方用与接收设备的会话加密后的密文）
+type SenderKeyDistribution struct {
+	ID                uint64    `gorm:"primarykey;autoIncrement"`
+	GroupQUID         string    `gorm:"column:group_quid;type:varchar(64);uniqueIndex:idx_dist_unique,priority:1;not null"`                                              // 群quid
+	Epoch             uint64    `gorm:"column:epoch;type:bigint;uniqueIndex:idx_dist_unique,priority:2;not null"`                                                        // 密钥版本
+	SenderFUID        string    `gorm:"column:sender_fuid;type:varchar(64);uniqueIndex:idx_dist_unique,priority:3;not null"`                                             // 发送方fuid
+	SenderDeviceID    string    `gorm:"column:sender_device_id;type:varchar(64);uniqueIndex:idx_dist_unique,priority:4;not null"`                                        // 发送方设备
+	RecipientFUID     string    `gorm:"column:recipient_fuid;type:varchar(64);uniqueIndex:idx_dist_unique,priority:5;index:idx_dist_recipient,priority:1;not null"`      // 接收方fuid
+	RecipientDeviceID string    `gorm:"column:recipient_device_id;type:varchar(64);uniqueIndex:idx_dist_unique,priority:6;index:idx_dist_recipient,priority:2;not null"` // 接收方设备
+	Payload           string    `gorm:"column:payload;type:text;not null"`                                                                                               // 不透明密文（确认接收后清空）
+	Status            uint8     `gorm:"column:status;type:tinyint;index:idx_dist_recipient,priority:3;default:0"`                                                        // 0:待接收 1:已接收
+	CreatedAt         time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt         time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+}
+
+func (d *SenderKeyDistribution) TableName() string {
+	return "sender_key_distributions"
+}
+
 // GroupMember 群成员表
 type GroupMember struct {
 	ID        uint64 `gorm:"primarykey;autoIncrement"`
@@ -315,6 +467,7 @@ type GroupMember struct {
 	Role      uint8  `gorm:"column:role;type:tinyint;default:0"` // 0:普通 1:群主 2:管理
 	MuteEndTime time.Time `gorm:"column:mute_end_time;type:datetime;default:null"` // 禁言结束时间
 	Status    uint8  `gorm:"column:status;type:tinyint;default:1"` // 1:正常 0:已退出/踢出
+	JoinSeq   uint64 `gorm:"column:join_seq;type:bigint;default:0"` // 加入时群会话的最新序号（只能拉取之后的消息）
 	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
 	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
 }
@@ -324,28 +477,65 @@ func (gm *GroupMember) TableName() string {
 }
 
 // Message 消息表
+
 type Message struct {
-	ID        uint64 `gorm:"primarykey;autoIncrement"`
-	MsgID     string `gorm:"column:msg_id;type:varchar(64);uniqueIndex;not null"` // 消息唯一ID
-	SenderFUID string `gorm:"column:sender_fuid;type:varchar(64);index;not null"` // 发送者fuid
-	ReceiverType uint8 `gorm:"column:receiver_type;type:tinyint;not null"` // 1:单聊 2:群聊
-	ReceiverID string `gorm:"column:receiver_id;type:varchar(64);index;not null"` // 单聊:好友fuid 群聊:群quid
-	ContentType uint8 `gorm:"column:content_type;type:tinyint;not null"` // 1:文字 2:图片 3:文件 4:表情 5:系统消息
-	Content   string `gorm:"column:content;type:text;not null"` // 加密后的内容
-	FontStyle string `gorm:"column:font_style;type:varchar(64);default:''"` // 字体样式
-	FontSize  int    `gorm:"column:font_size;type:int;default:14"` // 字体大小
-	FontColor string `gorm:"column:font_color;type:varchar(16);default:'#000000'"` // 字体颜色
-	IsRecalled bool  `gorm:"column:is_recalled;type:tinyint;default:0"` // 是否撤回
-	IsRead    bool  `gorm:"column:is_read;type:tinyint;default:0"` // 是否已读
-	SendTime  time.Time `gorm:"column:send_time;type:datetime;not null"`
-	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
-	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+	ID           uint64    `gorm:"primarykey;autoIncrement"`
+	MsgID        string    `gorm:"column:msg_id;type:varchar(64);uniqueIndex;not null"`                       // 消息唯一ID
+	SenderFUID   string    `gorm:"column:sender_fuid;type:varchar(64);index;not null"`                        // 发送者fuid
+	ReceiverType uint8     `gorm:"column:receiver_type;type:tinyint;not null"`                                // 1:单聊 2:群聊
+	ReceiverID   string    `gorm:"column:receiver_id;type:varchar(64);index;not null"`                        // 单聊:好友fuid 群聊:群quid
+	ConvID       string    `gorm:"column:conv_id;type:varchar(160);index:idx_conv_seq,priority:1;default:''"` // 会话ID 单聊:single:<fuid>:<fuid> 群聊:group:<quid>
+	Seq          uint64    `gorm:"column:seq;type:bigint;index:idx_conv_seq,priority:2;default:0"`            // 会话内递增序号
+	ContentType  uint8     `gorm:"column:content_type;type:tinyint;not null"`                                 // 1:文字 2:图片 3:文件 4:表情 5:系统消息
+	Content      string    `gorm:"column:content;type:text;not null"`                                         // 加密后的内容
+	Encryption   uint8     `gorm:"column:encryption;type:tinyint;default:0"`                                  // 0:传输加密 1:端到端加密（服务端不可解密）
+	ContentKeyID string    `gorm:"column:content_key_id;type:varchar(32);default:''"`                         // 静态加密密钥ID（空表示未加密存储）
+	FontStyle    string    `gorm:"column:font_style;type:varchar(64);default:''"`                             // 字体样式
+	FontSize     int       `gorm:"column:font_size;type:int;default:14"`                                      // 字体大小
+	FontColor    string    `gorm:"column:font_color;type:varchar(16);default:'#000000'"`                      // 字体颜色
+	IsRecalled   bool      `gorm:"column:is_recalled;type:tinyint;default:0"`                                 // 是否撤回
+	IsRead       bool      `gorm:"column:is_read;type:tinyint;default:0"`                                     // 是否已读
+	Shadow       bool      `gorm:"column:shadow;type:tinyint;default:0"`                                      // 影子消息（发送者被影子封禁，只有发送者可见）
+	SendTime     time.Time `gorm:"column:send_time;type:datetime;not null"`
+	CreatedAt    time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt    time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+
+	plainContent string // 加密前的明文（仅内存）
 }
 
 func (m *Message) TableName() string {
 	return "messages"
 }
 
+// 静态加密关联数据
+func (m *Message) atRestAD() string {
+	return "messages|" + m.MsgID
+}
+
+// 落库前加密内容
+func (m *Message) BeforeCreate(tx *gorm.DB) error {
+	sealed, keyID, err := sealAtRest(m.Content, m.atRestAD())
+	if err != nil {
+		return err
+	}
+	m.plainContent, m.Content, m.ContentKeyID = m.Content, sealed, keyID
+	return nil
+}
+
+// 落库后恢复明文（调用方继续用于推送）
+func (m *Message) AfterCreate(tx *gorm.DB) error {
+	if m.ContentKeyID != "" {
+		m.Content = m.plainContent
+	}
+	return nil
+}
+
+// 查询后解密内容
+func (m *Message) AfterFind(tx *gorm.DB) error {
+	m.Content = openAtRestOrKeep(m.Content, m.ContentKeyID, m.atRestAD())
+	return nil
+}
+
 // SystemMessage 系统消息表
 type SystemMessage struct {
 	ID        uint64 `gorm:"primarykey;autoIncrement"`
@@ -382,19 +572,58 @@ func (om *OfflineMessage) TableName() string {
 
 // GroupNotice 群公告表
 type GroupNotice struct {
-	ID        uint64 `gorm:"primarykey;autoIncrement"`
-	GroupQUID string `gorm:"column:group_quid;type:varchar(64);index;not null"`
-	Content   string `gorm:"column:content;type:text;not null"`
-	PublisherFUID string `gorm:"column:publisher_fuid;type:varchar(64);not null"` // 发布者fuid
-	PublishTime time.Time `gorm:"column:publish_time;type:datetime;not null"`
-	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
-	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+	ID            uint64    `gorm:"primarykey;autoIncrement"`
+	NoticeID      string    `gorm:"column:notice_id;type:varchar(64);index;default:''"` // 公告ID（静态加密关联数据，空为旧数据）
+	GroupQUID     string    `gorm:"column:group_quid;type:varchar(64);index;not null"`
+	Content       string    `gorm:"column:content;type:text;not null"`
+	ContentKeyID  string    `gorm:"column:content_key_id;type:varchar(32);default:''"` // 静态加密密钥ID（空表示未加密存储）
+	PublisherFUID string    `gorm:"column:publisher_fuid;type:varchar(64);not null"`   // 发布者fuid
+	PublishTime   time.Time `gorm:"column:publish_time;type:datetime;not null"`
+	CreatedAt     time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt     time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+
+	plainContent string // 加密前的明文（仅内存）
 }
 
 func (gn *GroupNotice) TableName() string {
 	return "group_notices"
 }
 
+// 静态加密关联数据（绑定公告ID，密文不能在同群公告间互换；旧数据无公告ID时只绑定群，由重新加密任务补齐）
+func (gn *GroupNotice) atRestAD() string {
+	if gn.NoticeID == "" {
+		return "group_notices|" + gn.GroupQUID
+	}
+	return "group_notices|" + gn.NoticeID + "|" + gn.GroupQUID
+}
+
+// 落库前加密内容
+func (gn *GroupNotice) BeforeCreate(tx *gorm.DB) error {
+	if gn.NoticeID == "" {
+		return errors.New("群公告ID不能为空")
+	}
+	sealed, keyID, err := sealAtRest(gn.Content, gn.atRestAD())
+	if err != nil {
+		return err
+	}
+	gn.plainContent, gn.Content, gn.ContentKeyID = gn.Content, sealed, keyID
+	return nil
+}
+
+// 落库后恢复明文
+func (gn *GroupNotice) AfterCreate(tx *gorm.DB) error {
+	if gn.ContentKeyID != "" {
+		gn.Content = gn.plainContent
+	}
+	return nil
+}
+
+// 查询后解密内容
+func (gn *GroupNotice) AfterFind(tx *gorm.DB) error {
+	gn.Content = openAtRestOrKeep(gn.Content, gn.ContentKeyID, gn.atRestAD())
+	return nil
+}
+
 // 通话记录模型
 type Call struct {
 	CallID        string    `gorm:"primaryKey;size:64" json:"call_id"` // 通话ID
@@ -419,7 +648,7 @@ type Device struct {
 	LoginIP      string    `gorm:"column:login_ip;type:varchar(64);not null"`        // 登录IP
 	LoginTime    time.Time `gorm:"column:login_time;type:datetime;not null"`         // 登录时间
 	LastActive   time.Time `gorm:"column:last_active;type:datetime;not null"`        // 最后活跃时间
-	RefreshToken string    `gorm:"column:refresh_token;type:varchar(256);not null"`  // 刷新令牌
+	RefreshToken string    `gorm:"column:refresh_token;type:varchar(256);not null"`  // 已废弃（刷新令牌改为哈希存储于refresh_tokens表），保持为空
 	Status       uint8     `gorm:"column:status;type:tinyint;default:1"`             // 1:在线 0:离线
 	CreatedAt    time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
 	UpdatedAt    time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
@@ -429,12 +658,237 @@ func (d *Device) TableName() string {
 	return "devices"
 }
 
+// RefreshToken 刷新令牌表（只保存SHA-256哈希；每次刷新轮换，同一登录会话的令牌属于同一family）
+type RefreshToken struct {
+	ID        uint64     `gorm:"primarykey;autoIncrement"`
+	TokenHash string     `gorm:"column:token_hash;type:char(64);uniqueIndex;not null"` // 令牌SHA-256哈希(hex)
+	FamilyID  string     `gorm:"column:family_id;type:varchar(64);index;not null"`     // 令牌族ID（一次登录一个）
+	UserFUID  string     `gorm:"column:user_fuid;type:varchar(64);index:idx_user_device;not null"`
+	DeviceID  string     `gorm:"column:device_id;type:varchar(64);index:idx_user_device;not null"`
+	Status    uint8      `gorm:"column:status;type:tinyint;default:1"` // 1:有效 2:已轮换 3:已吊销
+	ExpiresAt time.Time  `gorm:"column:expires_at;type:datetime;index;not null"`
+	RotatedAt *time.Time `gorm:"column:rotated_at;type:datetime;default:null"`
+	CreatedAt time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+}
+
+func (rt *RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
+
+// UserTOTP 两步验证（TOTP）表
+type UserTOTP struct {
+	ID           uint64     `gorm:"primarykey;autoIncrement"`
+	UserFUID     string     `gorm:"column:user_fuid;type:varchar(64);uniqueIndex;not null"`
+	Secret       string     `gorm:"column:secret;type:varchar(256);not null"`         // TOTP密钥（base32，静态加密）
+	SecretKeyID  string     `gorm:"column:secret_key_id;type:varchar(64);default:''"` // 静态加密密钥ID（空为明文）
+	Status       uint8      `gorm:"column:status;type:tinyint;default:0"`             // 0:待确认 1:已启用
+	LastUsedStep int64      `gorm:"column:last_used_step;type:bigint;default:0"`      // 最近一次使用的时间步（防重放）
+	ConfirmedAt  *time.Time `gorm:"column:confirmed_at;type:datetime;default:null"`
+	CreatedAt    time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt    time.Time  `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+}
+
+func (ut *UserTOTP) TableName() string {
+	return "user_totp"
+}
+
+// RecoveryCode 两步验证恢复码表（只保存哈希，单次有效）
+type RecoveryCode struct {
+	ID        uint64     `gorm:"primarykey;autoIncrement"`
+	UserFUID  string     `gorm:"column:user_fuid;type:varchar(64);index;not null"`
+	CodeHash  string     `gorm:"column:code_hash;type:char(64);not null"` // 恢复码SHA-256哈希(hex)
+	UsedAt    *time.Time `gorm:"column:used_at;type:datetime;default:null"`
+	CreatedAt time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+}
+
+func (rc *RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// WebAuthnCredential 通行密钥（WebAuthn凭证）表
+type WebAuthnCredential struct {
+	ID           uint64     `gorm:"primarykey;autoIncrement"`
+	UserFUID     string     `gorm:"column:user_fuid;type:varchar(64);index;not null"`
+	CredentialID string     `gorm:"column:credential_id;type:varchar(1368) CHARACTER SET ascii;uniqueIndex;not null"` // 凭证ID(base64url)
+	PublicKey    string     `gorm:"column:public_key;type:text;not null"`                                             // COSE公钥(base64)
+	Algorithm    int        `gorm:"column:algorithm;type:int;not null"`                                               // COSE算法(-7:ES256 -8:EdDSA -257:RS256)
+	SignCount    uint32     `gorm:"column:sign_count;type:int unsigned;default:0"`
+	Name         string     `gorm:"column:name;type:varchar(64);default:''"`
+	Transports   string     `gorm:"column:transports;type:varchar(128);default:''"` // 逗号分隔
+	LastUsedAt   *time.Time `gorm:"column:last_used_at;type:datetime;default:null"`
+	CreatedAt    time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+}
+
+func (wc *WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+// GroupFilterSetting 群聊消息过滤设置表（群主配置）
+type GroupFilterSetting struct {
+	ID        uint64    `gorm:"primarykey;autoIncrement"`
+	GroupQUID string    `gorm:"column:group_quid;type:varchar(64);uniqueIndex;not null"`
+	Config    string    `gorm:"column:config;type:text"` // groupFilterConfig JSON
+	UpdatedBy string    `gorm:"column:updated_by;type:varchar(64);default:''"`
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+}
+
+func (gfs *GroupFilterSetting) TableName() string {
+	return "group_filter_settings"
+}
+
+// LoginHistory 登录历史表
+type LoginHistory struct {
+	ID         uint64    `gorm:"primarykey;autoIncrement"`
+	UserFUID   string    `gorm:"column:user_fuid;type:varchar(64);index:idx_user_created,priority:1;not null"`
+	DeviceID   string    `gorm:"column:device_id;type:varchar(64);default:''"` // 登录成功时创建的设备ID
+	DeviceName string    `gorm:"column:device_name;type:varchar(64);default:''"`
+	DeviceType string    `gorm:"column:device_type;type:varchar(16);default:''"`
+	IP         string    `gorm:"column:ip;type:varchar(64);default:''"`
+	UserAgent  string    `gorm:"column:user_agent;type:varchar(256);default:''"`
+	Method     string    `gorm:"column:method;type:varchar(20);default:''"` // password/totp/recovery_code/passkey
+	Result     uint8     `gorm:"column:result;type:tinyint;default:0"`      // 0:失败 1:成功
+	Reason     string    `gorm:"column:reason;type:varchar(64);default:''"` // 失败原因
+	Risk       string    `gorm:"column:risk;type:varchar(128);default:''"`  // 风险标记，逗号分隔
+	CreatedAt  time.Time `gorm:"column:created_at;type:datetime;index:idx_user_created,priority:2;autoCreateTime"`
+}
+
+func (lh *LoginHistory) TableName() string {
+	return "login_history"
+}
+
+// AuditEvent 审计事件表（只追加）
+type AuditEvent struct {
+	ID         uint64    `gorm:"primarykey;autoIncrement"`
+	ActorFUID  string    `gorm:"column:actor_fuid;type:varchar(64);index;default:''"` // 操作者（系统任务为空）
+	ActorRole  string    `gorm:"column:actor_role;type:varchar(20);default:''"`
+	Action     string    `gorm:"column:action;type:varchar(64);index;not null"`
+	TargetType string    `gorm:"column:target_type;type:varchar(20);index:idx_target,priority:1;default:''"` // user/group/message/device/report/system
+	TargetID   string    `gorm:"column:target_id;type:varchar(64);index:idx_target,priority:2;default:''"`
+	GroupQUID  string    `gorm:"column:group_quid;type:varchar(64);index;default:''"` // 群聊相关事件所属群
+	IP         string    `gorm:"column:ip;type:varchar(64);default:''"`
+	Payload    string    `gorm:"column:payload;type:text"` // JSON
+	CreatedAt  time.Time `gorm:"column:created_at;type:datetime;index;autoCreateTime"`
+}
+
+func (ae *AuditEvent) TableName() string {
+	return "audit_events"
+}
+
+// Report 举报表
+
+type Report struct {
+	ID            uint64     `gorm:"primarykey;autoIncrement"`
+	ReportID      string     `gorm:"column:report_id;type:varchar(64);uniqueIndex;not null"`
+	ReporterFUID  string     `gorm:"column:reporter_fuid;type:varchar(64);index;not null"`
+	TargetType    uint8      `gorm:"column:target_type;type:tinyint;not null"` // 1:用户 2:消息 3:群聊
+	TargetID      string     `gorm:"column:target_id;type:varchar(64);index;not null"`
+	Reason        string     `gorm:"column:reason;type:varchar(32);not null"`
+	Detail        string     `gorm:"column:detail;type:varchar(512);default:''"`
+	Evidence      string     `gorm:"column:evidence;type:text"`                          // 被举报消息快照（JSON，静态加密）
+	EvidenceKeyID string     `gorm:"column:evidence_key_id;type:varchar(32);default:''"` // 静态加密密钥ID（空为明文）
+	Status        uint8      `gorm:"column:status;type:tinyint;index;default:0"`         // 0:待处理 1:处理中 2:已处理 3:已驳回
+	OpenKey       *string    `gorm:"column:open_key;type:varchar(160);uniqueIndex"`      // 未结案时为举报人+对象，结案后置空（唯一索引防止并发重复举报）
+	HandlerFUID   string     `gorm:"column:handler_fuid;type:varchar(64);default:''"`
+	Action        string     `gorm:"column:action;type:varchar(20);default:''"`  // 处理措施
+	Result        string     `gorm:"column:result;type:varchar(512);default:''"` // 处理说明
+	HandledAt     *time.Time `gorm:"column:handled_at;type:datetime;default:null"`
+	CreatedAt     time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt     time.Time  `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+}
+
+func (r *Report) TableName() string {
+	return "reports"
+}
+
+// AccountDeletion 账号注销申请表
+type AccountDeletion struct {
+	ID          uint64     `gorm:"primarykey;autoIncrement"`
+	UserFUID    string     `gorm:"column:user_fuid;type:varchar(64);uniqueIndex;not null"`
+	Status      uint8      `gorm:"column:status;type:tinyint;default:1"` // 1:冷静期中 2:已撤销 3:已执行
+	RequestedAt time.Time  `gorm:"column:requested_at;type:datetime;not null"`
+	ExecuteAt   time.Time  `gorm:"column:execute_at;type:datetime;index;not null"` // 冷静期结束时间
+	CompletedAt *time.Time `gorm:"column:completed_at;type:datetime;default:null"`
+	CreatedAt   time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt   time.Time  `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+}
+
+func (ad *AccountDeletion) TableName() string {
+	return "account_deletions"
+}
+
+// DataExport 个人数据导出表
+type DataExport struct {
+	ID        uint64     `gorm:"primarykey;autoIncrement"`
+	ExportID  string     `gorm:"column:export_id;type:varchar(64);uniqueIndex;not null"`
+	UserFUID  string     `gorm:"column:user_fuid;type:varchar(64);index;not null"`
+	Status    uint8      `gorm:"column:status;type:tinyint;default:0"`         // 0:生成中 1:可下载 2:失败 3:已过期
+	FileKey   string     `gorm:"column:file_key;type:varchar(256);default:''"` // 存储后端中的路径
+	FileURL   string     `gorm:"column:file_url;type:varchar(512);default:''"`
+	FileSize  int64      `gorm:"column:file_size;type:bigint;default:0"`
+	Error     string     `gorm:"column:error;type:varchar(512);default:''"`
+	ExpiresAt *time.Time `gorm:"column:expires_at;type:datetime;default:null"`
+	CreatedAt time.Time  `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt time.Time  `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+}
+
+func (de *DataExport) TableName() string {
+	return "data_exports"
+}
+
+// DeviceIdentityKey 设备身份密钥表（端到端加密，服务端只保存公钥）
+type DeviceIdentityKey struct {
+	ID                uint64    `gorm:"primarykey;autoIncrement"`
+	UserFUID          string    `gorm:"column:user_fuid;type:varchar(64);uniqueIndex:idx_user_device;not null"` // 所属用户FUID
+	DeviceID          string    `gorm:"column:device_id;type:varchar(64);uniqueIndex:idx_user_device;not null"` // 设备唯一标识
+	IdentityKey       string    `gorm:"column:identity_key;type:varchar(64);not null"`                          // 身份公钥(X25519, base64)
+	SigningKey        string    `gorm:"column:signing_key;type:varchar(64);not null"`                           // 签名公钥(Ed25519, base64)
+	IdentitySignature string    `gorm:"column:identity_signature;type:varchar(128);not null"`                   // 签名公钥对身份公钥的签名(base64)
+	CreatedAt         time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+	UpdatedAt         time.Time `gorm:"column:updated_at;type:datetime;autoUpdateTime"`
+}
+
+func (k *DeviceIdentityKey) TableName() string {
+	return "device_identity_keys"
+}
+
+// SignedPreKey 签名预密钥表
+type SignedPreKey struct {
+	ID        uint64    `gorm:"primarykey;autoIncrement"`
+	UserFUID  string    `gorm:"column:user_fuid;type:varchar(64);index:idx_user_device;not null"` // 所属用户FUID
+	DeviceID  string    `gorm:"column:device_id;type:varchar(64);index:idx_user_device;not null"` // 设备唯一标识
+	KeyID     uint32    `gorm:"column:key_id;type:int unsigned;not null"`                         // 客户端生成的密钥ID
+	PublicKey string    `gorm:"column:public_key;type:varchar(64);not null"`                      // 预密钥公钥(X25519, base64)
+	Signature string    `gorm:"column:signature;type:varchar(128);not null"`                      // 签名公钥对预密钥的签名(base64)
+	Status    uint8     `gorm:"column:status;type:tinyint;default:1"`                             // 1:当前使用 0:已轮换
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+}
+
+func (k *SignedPreKey) TableName() string {
+	return "signed_prekeys"
+}
+
+// OneTimePreKey 一次性预密钥表（被获取后即删除）
+type OneTimePreKey struct {
+	ID        uint64    `gorm:"primarykey;autoIncrement"`
+	UserFUID  string    `gorm:"column:user_fuid;type:varchar(64);uniqueIndex:idx_user_device_key;not null"` // 所属用户FUID
+	DeviceID  string    `gorm:"column:device_id;type:varchar(64);uniqueIndex:idx_user_device_key;not null"` // 设备唯一标识
+	KeyID     uint32    `gorm:"column:key_id;type:int unsigned;uniqueIndex:idx_user_device_key;not null"`   // 客户端生成的密钥ID
+	PublicKey string    `gorm:"column:public_key;type:varchar(64);not null"`                                // 预密钥公钥(X25519, base64)
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;autoCreateTime"`
+}
+
+func (k *OneTimePreKey) TableName() string {
+	return "one_time_prekeys"
+}
+
 // 扩展JWT Claims以包含设备信息
 type CustomClaims struct {
 	FUID     string `json:"fuid"`
 	Username string `json:"username"`
 	Nickname string `json:"nickname"`
 	DeviceID string `json:"device_id"` // 新增设备ID
+	Scope    string `json:"scope,omitempty"` // 权限范围（空格分隔）
 	jwt.RegisteredClaims
 }
 
@@ -582,11 +1036,153 @@ func initMinIO() error {
 			return fmt.Errorf("create bucket failed: %v", err)
 		}
 	}
+	// 非公开桶（不设置公开读策略）
+	if bucket := privateMinIOBucket(); bucket != cfg.Storage.MinIO.Bucket {
+		exists, err := client.BucketExists(ctx, bucket)
+		if err != nil {
+			return fmt.Errorf("check private bucket exists failed: %v", err)
+		}
+		if !exists {
+			if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+				return fmt.Errorf("create private bucket failed: %v", err)
+			}
+		}
+	}
 	minioClient = client
 	log.Info("MinIO初始化成功")
 	return nil
 }
 
+// 文件存储后端（本地目录或MinIO），key为相对路径，如 image/<文件名>
+type storageBackend interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) // 返回访问URL
+	Delete(ctx context.Context, key string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Key(fileURL string) (string, bool) // 由访问URL还原key（不是本后端生成的URL时返回false）
+}
+
+// 本地存储（由Web服务器按domain对外提供访问）
+type localStorage struct {
+	root   string
+	domain string
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	filePath := filepath.Join(s.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", fmt.Errorf("创建存储目录失败: %v", err)
+	}
+	outFile, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("创建文件失败: %v", err)
+	}
+	defer outFile.Close()
+	if _, err := io.Copy(outFile, r); err != nil {
+		return "", fmt.Errorf("保存文件失败: %v", err)
+	}
+	return fmt.Sprintf("%s/%s", s.domain, key), nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(s.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.root, filepath.FromSlash(key)))
+}
+
+func (s *localStorage) Key(fileURL string) (string, bool) {
+	return storageKeyFromURL(fileURL, s.domain+"/")
+}
+
+// MinIO存储
+type minioStorage struct {
+	client *minio.Client
+	bucket string
+	domain string
+}
+
+func (s *minioStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return "", fmt.Errorf("MinIO上传失败: %v", err)
+	}
+	return fmt.Sprintf("%s/%s/%s", s.domain, s.bucket, key), nil
+}
+
+func (s *minioStorage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *minioStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+func (s *minioStorage) Key(fileURL string) (string, bool) {
+	return storageKeyFromURL(fileURL, s.domain+"/"+s.bucket+"/")
+}
+
+// 去掉URL前缀得到key（拒绝包含..的路径）
+func storageKeyFromURL(fileURL, prefix string) (string, bool) {
+	if !strings.HasPrefix(fileURL, prefix) {
+		return "", false
+	}
+	key := strings.TrimPrefix(fileURL, prefix)
+	if key == "" || strings.Contains(key, "..") {
+		return "", false
+	}
+	return key, true
+}
+
+// 当前文件存储后端
+var fileStorage storageBackend
+
+// 非公开存储后端（数据导出等；不对外提供访问，只能经鉴权接口读取）
+var privateStorage storageBackend
+
+// 非公开MinIO桶
+func privateMinIOBucket() string {
+	if cfg.Storage.Private.MinIOBucket != "" {
+		return cfg.Storage.Private.MinIOBucket
+	}
+	return cfg.Storage.MinIO.Bucket + "-private"
+}
+
+// 初始化文件存储后端（须在initMinIO之后）
+func initStorage() {
+	if cfg.Storage.Type == "minio" {
+		fileStorage = &minioStorage{client: minioClient, bucket: cfg.Storage.MinIO.Bucket, domain: cfg.Storage.MinIO.Domain}
+		privateStorage = &minioStorage{client: minioClient, bucket: privateMinIOBucket()}
+		return
+	}
+	fileStorage = &localStorage{root: cfg.Storage.Local.Path, domain: cfg.Storage.Local.Domain}
+	privatePath := cfg.Storage.Private.LocalPath
+	if privatePath == "" {
+		privatePath = "./private"
+	}
+	privateStorage = &localStorage{root: privatePath}
+}
+
+// 按扩展名推断内容类型
+func contentTypeByExt(ext string) string {
+	if t := mime.TypeByExtension("." + ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
 // 初始化RSA密钥
 func initRSA() error {
     // 读取公钥文件
@@ -625,6 +1221,52 @@ func initRSA() error {
     return nil
 }
 
+// 初始化内容信封X25519密钥（文件不存在时自动生成）
+func initEnvelopeKey() error {
+	keyPath := cfg.Crypto.Envelope.X25519PrivateKeyPath
+	if keyPath == "" {
+		keyPath = "./rsa/x25519.pem"
+	}
+	keyData, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("生成X25519密钥失败: %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("编码X25519密钥失败: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			return fmt.Errorf("创建密钥目录失败: %v", err)
+		}
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return fmt.Errorf("保存X25519密钥失败: %v", err)
+		}
+		x25519PrivateKey = key
+		log.Infof("已生成内容信封X25519密钥: %s", keyPath)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取X25519密钥文件失败: %v", err)
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return errors.New("解析X25519密钥PEM格式失败")
+	}
+	privKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("解析X25519密钥内容失败: %v", err)
+	}
+	key, ok := privKey.(*ecdh.PrivateKey)
+	if !ok || key.Curve() != ecdh.X25519() {
+		return errors.New("密钥文件不是X25519私钥")
+	}
+	x25519PrivateKey = key
+	log.Info("内容信封X25519密钥加载成功")
+	return nil
+}
+
 // 校验并加载TLS证书（仅生产模式）
 func loadTLSCerts() (tls.Certificate, error) {
 	// 检查证书文件是否存在
@@ -770,16 +1412,7 @@ func pkcs7Unpadding(data []byte) ([]byte, error) {
 	return data[:length-padding], nil
 }
 
-// RSA加密
-func rsaEncrypt(data []byte) ([]byte, error) {
-	cipherText, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublicKey, data, nil)
-	if err != nil {
-		return nil, err
-	}
-	return []byte(base64.StdEncoding.EncodeToString(cipherText)), nil
-}
-
-// RSA解密
+// RSA解密（旧版内容格式：整段明文直接RSA-OAEP加密，长度受密钥限制）
 func rsaDecrypt(data []byte) ([]byte, error) {
 	decodedData, err := base64.StdEncoding.DecodeString(string(data))
 	if err != nil {
@@ -792,1200 +1425,8689 @@ func rsaDecrypt(data []byte) ([]byte, error) {
 	return plainText, nil
 }
 
-// 获取客户端真实IP
-func getRealIP(c *gin.Context) string {
-	// 常见CDN代理头
-	headers := []string{
-		"X-Forwarded-For",
-		"X-Real-IP",
-		"CF-Connecting-IP",
-		"X-Forwarded",
-		"Forwarded-For",
-		"Forwarded",
-		"Proxy-Client-IP",
-		"WL-Proxy-Client-IP",
-	}
-	for _, header := range headers {
-		ipStr := c.GetHeader(header)
-		if ipStr != "" {
-			// 多个IP时取第一个
-			ips := strings.Split(ipStr, ",")
-			ip := strings.TrimSpace(ips[0])
-			if net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
-	}
-	// 最后取远程IP
-	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
-	if err != nil {
-		return c.Request.RemoteAddr
-	}
-	return ip
+// 内容信封（替代整段RSA加密，base64编码后存入content）
+//
+//	v1: 0x01 | 包裹密钥长度(2字节大端) | RSA-OAEP(SHA-256)包裹的AES-256数据密钥 | nonce(12) | AES-GCM密文
+//	v2: 0x02 | 临时X25519公钥(32) | nonce(12) | AES-GCM密文
+//	    数据密钥 = HKDF-SHA256(X25519(临时私钥, 服务端公钥), salt = 临时公钥 || 服务端公钥, info = "openchat envelope v2")
+//
+// 关联数据为 "openchat-envelope|v<版本>|<msg_id>|<conv_id>"，密文无法被挪用到其他消息或会话。
+// 不带版本字节的旧数据（base64解码后长度等于RSA密钥长度）按整段RSA-OAEP解密。
+const (
+	envelopeV1        byte = 1
+	envelopeV2        byte = 2
+	envelopeNonceSize      = 12
+	envelopeKDFInfo        = "openchat envelope v2"
+)
+
+var errEnvelopeFormat = errors.New("内容信封格式错误")
+
+// 信封关联数据
+func envelopeAD(version byte, msgID, convID string) []byte {
+	return []byte(fmt.Sprintf("openchat-envelope|v%d|%s|%s", version, msgID, convID))
 }
 
-// 健康检查接口
-func healthHandler(c *gin.Context) {
-    // 计算服务已运行时间
-    uptime := time.Since(startTime)
-    
-    // 格式化运行时间为友好显示格式
-    uptimeStr := fmt.Sprintf(
-        "%d小时%d分钟%d秒",
-        int(uptime.Hours()),
-        int(uptime.Minutes())%60,
-        int(uptime.Seconds())%60,
-    )
-    
-    // 构建响应数据
-    data := map[string]interface{}{
-        "status":  "success",
-        "message": "服务运行正常",
-        "uptime":  uptimeStr,
-        "start_at": startTime.Format("2006-01-02 15:04:05"),
-    }
-    
-    success(c, data)
+// 服务端生成信封时使用的版本
+func defaultEnvelopeVersion() byte {
+	if cfg.Crypto.Envelope.Version == int(envelopeV1) {
+		return envelopeV1
+	}
+	return envelopeV2
 }
 
-// 创建基于令牌桶的限流器
-// rate: 每秒生成的令牌数
-// burst: 令牌桶容量
-func newTokenBucketLimiter(r rate.Limit, burst int) *rate.Limiter {
-    return rate.NewLimiter(r, burst)
+// 派生v2数据密钥
+func deriveEnvelopeKey(shared, ephemeralPub, serverPub []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPub...), serverPub...)
+	return hkdf.Key(sha256.New, shared, salt, envelopeKDFInfo, 32)
 }
 
-// 获取注册登录IP限流器
-func getRegisterLoginIPLimiter(ip string) *rate.Limiter {
-    if limiter, ok := registerLoginIPLimiters.Load(ip); ok {
-        return limiter.(*rate.Limiter)
-    }
-    
-    // 从配置转换：周期内限制数 -> 每秒令牌数
-    limit := cfg.RateLimit.RegisterLoginIP.Limit
-    period := cfg.RateLimit.RegisterLoginIP.Period
-    r := rate.Limit(limit) / rate.Limit(period) // 每秒生成的令牌数
-    burst := limit                             // 令牌桶容量
-    
-    newLimiter := newTokenBucketLimiter(r, burst)
-    limiter, _ := registerLoginIPLimiters.LoadOrStore(ip, newLimiter)
-    return limiter.(*rate.Limiter)
+// AES-256-GCM加密（返回nonce||密文）
+func gcmSeal(key, plainText, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plainText, ad), nil
 }
 
-// 获取注册登录用户限流器
-func getRegisterLoginUserLimiter(username string) *rate.Limiter {
-    if limiter, ok := registerLoginUserLimiters.Load(username); ok {
-        return limiter.(*rate.Limiter)
-    }
-    
-    limit := cfg.RateLimit.RegisterLoginUser.Limit
-    period := cfg.RateLimit.RegisterLoginUser.Period
-    r := rate.Limit(limit) / rate.Limit(period)
-    burst := limit
-    
-    newLimiter := newTokenBucketLimiter(r, burst)
-    limiter, _ := registerLoginUserLimiters.LoadOrStore(username, newLimiter)
-    return limiter.(*rate.Limiter)
+// AES-256-GCM解密（输入nonce||密文）
+func gcmOpen(key, sealed, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errEnvelopeFormat
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], ad)
 }
 
-// 获取消息频率限流器
-func getMessageConnLimiter(ip string) *rate.Limiter {
-    if limiter, ok := messageConnLimiters.Load(ip); ok {
-        return limiter.(*rate.Limiter)
-    }
-    
-    limit := cfg.RateLimit.MessageConn.Limit
-    period := cfg.RateLimit.MessageConn.Period
-    r := rate.Limit(limit) / rate.Limit(period)
-    burst := limit
-    
-    newLimiter := newTokenBucketLimiter(r, burst)
-    limiter, _ := messageConnLimiters.LoadOrStore(ip, newLimiter)
-    return limiter.(*rate.Limiter)
+// 生成内容信封
+func sealEnvelope(version byte, plainText []byte, msgID, convID string) (string, error) {
+	ad := envelopeAD(version, msgID, convID)
+	var out []byte
+	switch version {
+	case envelopeV1:
+		dataKey := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+			return "", err
+		}
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublicKey, dataKey, nil)
+		if err != nil {
+			return "", err
+		}
+		sealed, err := gcmSeal(dataKey, plainText, ad)
+		if err != nil {
+			return "", err
+		}
+		out = make([]byte, 3, 3+len(wrapped)+len(sealed))
+		out[0] = envelopeV1
+		binary.BigEndian.PutUint16(out[1:3], uint16(len(wrapped)))
+		out = append(append(out, wrapped...), sealed...)
+	case envelopeV2:
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		shared, err := ephemeral.ECDH(x25519PrivateKey.PublicKey())
+		if err != nil {
+			return "", err
+		}
+		ephemeralPub := ephemeral.PublicKey().Bytes()
+		dataKey, err := deriveEnvelopeKey(shared, ephemeralPub, x25519PrivateKey.PublicKey().Bytes())
+		if err != nil {
+			return "", err
+		}
+		sealed, err := gcmSeal(dataKey, plainText, ad)
+		if err != nil {
+			return "", err
+		}
+		out = append(append([]byte{envelopeV2}, ephemeralPub...), sealed...)
+	default:
+		return "", fmt.Errorf("不支持的信封版本: %d", version)
+	}
+	return base64.StdEncoding.EncodeToString(out), nil
 }
 
-// 获取房间用户限流器
-func getGroupUserLimiter(key string) *rate.Limiter {
-    if limiter, ok := GroupUserLimiters.Load(key); ok {
-        return limiter.(*rate.Limiter)
-    }
-    
-    limit := cfg.RateLimit.GroupUser.Limit
-    period := cfg.RateLimit.GroupUser.Period
-    r := rate.Limit(limit) / rate.Limit(period)
-    burst := limit
-    
-    newLimiter := newTokenBucketLimiter(r, burst)
-    limiter, _ := GroupUserLimiters.LoadOrStore(key, newLimiter)
-    return limiter.(*rate.Limiter)
+// 是否为旧版整段RSA密文
+func isLegacyRSAContent(raw []byte) bool {
+	return rsaPrivateKey != nil && len(raw) == rsaPrivateKey.Size()
 }
 
-// 初始化限流中间件（基于官方令牌桶算法）
-func initRateLimiters() map[string]gin.HandlerFunc {
-    limiters := make(map[string]gin.HandlerFunc)
-    
-    // 注册/登录IP限流中间件
-    limiters["register_login_ip"] = func(c *gin.Context) {
-        ip := getRealIP(c)
-        limiter := getRegisterLoginIPLimiter(ip)
-        if !limiter.Allow() {
-            fail(c, 429, "IP请求过于频繁，请稍后再试")
-            c.Abort()
-            return
-        }
-        c.Next()
-    }
-    
-    // 注册/登录用户限流中间件
-    limiters["register_login_user"] = func(c *gin.Context) {
-        username := c.PostForm("username")
-        if username == "" {
-            username = c.PostForm("email")
-        }
-        if username == "" {
-            fail(c, 400, "用户名或邮箱不能为空")
-            c.Abort()
-            return
-        }
-        
-        limiter := getRegisterLoginUserLimiter(username)
-        if !limiter.Allow() {
-            fail(c, 429, "账号请求过于频繁，请稍后再试")
-            c.Abort()
-            return
-        }
-        c.Next()
-    }
-    
-    // 消息频率限流中间件
-    limiters["message_conn"] = func(c *gin.Context) {
-        ip := c.ClientIP()
-        limiter := getMessageConnLimiter(ip)
-        if !limiter.Allow() {
-            fail(c, 429, "消息发送过于频繁，请稍后再试")
-            c.Abort()
-            return
-        }
-        c.Next()
-    }
-    
-    // 房间/用户维度限流中间件
-    limiters["group_user"] = func(c *gin.Context) {
-        fuid := c.GetHeader("FUID")
-        groupID := c.PostForm("group_id")
-        if fuid == "" || groupID == "" {
-            fail(c, 400, "FUID或房间ID不能为空")
-            c.Abort()
-            return
-        }
-        key := fmt.Sprintf("%s:%s", fuid, groupID)
-        
-        limiter := getGroupUserLimiter(key)
-        if !limiter.Allow() {
-            fail(c, 429, "房间内操作过于频繁，请稍后再试")
-            c.Abort()
-            return
-        }
-        c.Next()
-    }
-    
-    return limiters
+// 解析内容信封（旧版整段RSA密文按版本字节缺失识别，透明解密），返回明文及版本（旧版为0）
+func openEnvelope(encoded, msgID, convID string) ([]byte, byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) == 0 {
+		return nil, 0, errEnvelopeFormat
+	}
+	// 长度与RSA密钥相同的优先按旧版解密（v2信封恰好等长时旧版解密必然失败，继续按信封解析）
+	if isLegacyRSAContent(raw) {
+		if plainText, err := rsaDecrypt([]byte(encoded)); err == nil {
+			return plainText, 0, nil
+		}
+	}
+	version := raw[0]
+	ad := envelopeAD(version, msgID, convID)
+	switch version {
+	case envelopeV1:
+		if len(raw) < 3 {
+			return nil, version, errEnvelopeFormat
+		}
+		wrappedLen := int(binary.BigEndian.Uint16(raw[1:3]))
+		if len(raw) < 3+wrappedLen {
+			return nil, version, errEnvelopeFormat
+		}
+		dataKey, err := rsa.DecryptOAEP(sha256.New(), nil, rsaPrivateKey, raw[3:3+wrappedLen], nil)
+		if err != nil {
+			return nil, version, err
+		}
+		plainText, err := gcmOpen(dataKey, raw[3+wrappedLen:], ad)
+		return plainText, version, err
+	case envelopeV2:
+		if len(raw) < 1+32 {
+			return nil, version, errEnvelopeFormat
+		}
+		ephemeralPub, err := ecdh.X25519().NewPublicKey(raw[1:33])
+		if err != nil {
+			return nil, version, errEnvelopeFormat
+		}
+		shared, err := x25519PrivateKey.ECDH(ephemeralPub)
+		if err != nil {
+			return nil, version, err
+		}
+		dataKey, err := deriveEnvelopeKey(shared, raw[1:33], x25519PrivateKey.PublicKey().Bytes())
+		if err != nil {
+			return nil, version, err
+		}
+		plainText, err := gcmOpen(dataKey, raw[33:], ad)
+		return plainText, version, err
+	}
+	return nil, 0, errEnvelopeFormat
 }
 
-// 标准化响应结构体
-type Response struct {
-	Code    int         `json:"code"`
-	Msg     string      `json:"msg"`
-	Data    interface{} `json:"data,omitempty"`
-	Count   int64       `json:"count,omitempty"`
+// 判断内容是否为带版本字节的信封（不解密）
+func isVersionedEnvelope(encoded string) bool {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) == 0 || isLegacyRSAContent(raw) {
+		return false
+	}
+	return raw[0] == envelopeV1 || raw[0] == envelopeV2
 }
 
-// 成功响应
-func success(c *gin.Context, data interface{}, count ...int64) {
-	res := Response{
-		Code: 200,
-		Msg:  "success",
-		Data: data,
+// 获取服务端公钥接口（客户端用于生成内容信封）
+func getCryptoKeysHandler(c *gin.Context) {
+	pubDER, err := x509.MarshalPKIXPublicKey(rsaPublicKey)
+	if err != nil {
+		fail(c, 500, "导出RSA公钥失败: "+err.Error())
+		return
 	}
-	if len(count) > 0 {
-		res.Count = count[0]
+	success(c, map[string]interface{}{
+		"rsa_public_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})),
+		"x25519_public_key": base64.StdEncoding.EncodeToString(x25519PrivateKey.PublicKey().Bytes()),
+		"envelope_versions": []int{int(envelopeV1), int(envelopeV2)},
+		"default_version":   defaultEnvelopeVersion(),
+	})
+}
+
+// 重新加密旧版消息内容（命令行：migrate-envelope）
+func migrateEnvelopeCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate-envelope", flag.ExitOnError)
+	batchSize := fs.Int("batch", 500, "每批处理的消息数")
+	dryRun := fs.Bool("dry-run", false, "只统计不写入")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	version := defaultEnvelopeVersion()
+	var lastID uint64
+	var scanned, migrated, failed int
+	for {
+		var messages []Message
+		if err := db.Where("id > ? AND encryption = 0", lastID).Order("id ASC").Limit(*batchSize).Find(&messages).Error; err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			break
+		}
+		for _, msg := range messages {
+			lastID = msg.ID
+			scanned++
+			raw, err := base64.StdEncoding.DecodeString(msg.Content)
+			if err != nil || !isLegacyRSAContent(raw) {
+				continue
+			}
+			plainText, err := rsaDecrypt([]byte(msg.Content))
+			if err != nil {
+				// 长度恰好等于密钥长度的非旧版内容
+				continue
+			}
+			convID := msg.ConvID
+			if convID == "" {
+				convID = getConversationID(msg.ReceiverType, msg.SenderFUID, msg.ReceiverID)
+			}
+			sealed, err := sealEnvelope(version, plainText, msg.MsgID, convID)
+			if err != nil {
+				failed++
+				log.Errorf("重新加密消息失败: msg_id=%s, err=%v", msg.MsgID, err)
+				continue
+			}
+			if !*dryRun {
+				msg.ConvID = convID
+				updates, err := contentUpdates(sealed, msg.atRestAD())
+				if err != nil {
+					failed++
+					log.Errorf("静态加密消息失败: msg_id=%s, err=%v", msg.MsgID, err)
+					continue
+				}
+				updates["conv_id"] = convID
+				result := db.Model(&Message{}).Where("id = ?", msg.ID).Updates(updates)
+				if result.Error != nil {
+					failed++
+					log.Errorf("更新消息失败: msg_id=%s, err=%v", msg.MsgID, result.Error)
+					continue
+				}
+			}
+			migrated++
+		}
+		log.Infof("migrate-envelope: scanned=%d, migrated=%d, failed=%d, last_id=%d", scanned, migrated, failed, lastID)
 	}
-	c.JSON(200, res)
+	log.Infof("migrate-envelope finished: scanned=%d, migrated=%d, failed=%d, version=%d, dry_run=%v",
+		scanned, migrated, failed, version, *dryRun)
+	return nil
 }
 
-// 错误响应
-func fail(c *gin.Context, code int, msg string) {
-	res := Response{
-		Code: code,
-		Msg:  msg,
+// 静态加密（消息内容、群公告落库前由服务端用AES-256-GCM加密）
+//
+// 密文格式为 "$ear1$" + base64(nonce || 密文)，所用密钥ID单独存入content_key_id列。
+// 加解密与存储无关：GORM模型通过钩子调用，其他存储后端直接调用sealAtRest/openAtRest即可。
+type contentCipher interface {
+	Seal(plainText, ad []byte) (stored string, keyID string, err error)
+	Open(stored, keyID string, ad []byte) ([]byte, error)
+	ActiveKeyID() string
+}
+
+const atRestPrefix = "$ear1$"
+
+// 当前静态加密器（未启用时为nil，内容按原样存储）
+var atRestCipher contentCipher
+
+// 加密待落库内容，返回存储值及密钥ID（未启用时原样返回，密钥ID为空）
+func sealAtRest(plainText, ad string) (string, string, error) {
+	if atRestCipher == nil || plainText == "" {
+		return plainText, "", nil
 	}
-	c.JSON(200, res)
-	log.Errorf("API error: code=%d, msg=%s, path=%s, ip=%s", code, msg, c.Request.URL.Path, getRealIP(c))
+	return atRestCipher.Seal([]byte(plainText), []byte(ad))
 }
 
-// 验证CF人机验证
-func verifyCFTurnstile(token string) bool {
-	if cfg.App.Mode == "debug" {
-		return true // 调试模式跳过验证
+// 解密存储内容（密钥ID为空表示明文存储）
+func openAtRest(stored, keyID, ad string) (string, error) {
+	if keyID == "" {
+		return stored, nil
 	}
-	resp, err := http.PostForm("https://challenges.cloudflare.com/turnstile/v0/siteverify",
-		url.Values{
-			"secret":   {cfg.CFTurnstile.SecretKey},
-			"response": {token},
-		})
-	if err != nil {
-		log.Error("verify CF turnstile failed: ", err)
-		return false
+	if atRestCipher == nil {
+		return "", errors.New("静态加密未启用，无法解密")
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	plainText, err := atRestCipher.Open(stored, keyID, []byte(ad))
 	if err != nil {
-		log.Error("read CF turnstile response failed: ", err)
-		return false
-	}
-	var result struct {
-		Success bool `json:"success"`
+		return "", err
 	}
-	err = json.Unmarshal(body, &result)
+	return string(plainText), nil
+}
+
+// 解密存储内容，失败时记录日志并保留原值（避免单条损坏数据导致整个列表查询失败）
+func openAtRestOrKeep(stored, keyID, ad string) string {
+	plainText, err := openAtRest(stored, keyID, ad)
 	if err != nil {
-		log.Error("unmarshal CF turnstile response failed: ", err)
-		return false
+		log.Errorf("静态解密失败: key_id=%s, ad=%s, err=%v", keyID, ad, err)
+		return stored
 	}
-	return result.Success
+	return plainText
 }
 
-// 用户注册接口
-func registerHandler(c *gin.Context) {
-	// 参数绑定
-	var req struct {
-		Username        string `json:"username" binding:"required,min=3,max=20"`
-		Nickname        string `json:"nickname" binding:"required,min=1,max=20"`
-		Email           string `json:"email" binding:"required,email"`
-		Password        string `json:"password" binding:"required,min=6,max=20"`
-		ConfirmPassword string `json:"confirm_password" binding:"required,eqfield=Password"`
-		TurnstileToken  string `json:"turnstile_token" binding:"required"`
+// 生成更新内容的字段（按字段更新时不会触发模型钩子，须通过此函数加密）
+func contentUpdates(plainText, ad string) (map[string]interface{}, error) {
+	sealed, keyID, err := sealAtRest(plainText, ad)
+	if err != nil {
+		return nil, err
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
-	}
-	// 验证人机验证
-	if !verifyCFTurnstile(req.TurnstileToken) {
-		fail(c, 403, "人机验证失败")
-		return
-	}
-	// 检查用户名是否已存在
-	var user User
-	if err := db.Where("username = ?", req.Username).First(&user).Error; err == nil {
-		fail(c, 400, "用户名已存在")
-		return
+	return map[string]interface{}{"content": sealed, "content_key_id": keyID}, nil
+}
+
+// 密钥环文件格式
+type keyringFile struct {
+	Active string       `json:"active"`
+	Keys   []keyringKey `json:"keys"`
+}
+
+type keyringKey struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"` // base64编码的32字节密钥
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 本地密钥环（实现contentCipher，文件变更后自动重新加载）
+type keyring struct {
+	mu      sync.RWMutex
+	path    string
+	active  string
+	keys    map[string][]byte
+	modTime time.Time
+}
+
+// 加载密钥环（文件不存在时生成）
+func loadKeyring(path string) (*keyring, error) {
+	kr := &keyring{path: path}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := kr.rotate(); err != nil {
+			return nil, err
+		}
+		log.Infof("已生成静态加密密钥环: %s", path)
+		return kr, nil
 	}
-	// 检查邮箱是否已存在
-	if err := db.Where("email = ?", req.Email).First(&user).Error; err == nil {
-		fail(c, 400, "邮箱已存在")
-		return
+	if err := kr.reload(); err != nil {
+		return nil, err
 	}
-	// 生成FUID
-	fuid, err := generateFUID()
+	return kr, nil
+}
+
+// 从文件重新加载
+func (kr *keyring) reload() error {
+	info, err := os.Stat(kr.path)
 	if err != nil {
-		fail(c, 500, "生成用户ID失败，请稍后重试")
-		log.Errorf("生成FUID失败: %v", err)
-		return
+		return fmt.Errorf("读取密钥环失败: %v", err)
 	}
-	// 加密密码
-	hashPassword, err := encryptPassword(req.Password)
+	data, err := os.ReadFile(kr.path)
 	if err != nil {
-		fail(c, 500, "密码加密失败: "+err.Error())
-		return
+		return fmt.Errorf("读取密钥环失败: %v", err)
 	}
-	// 创建用户
-	newUser := User{
-		FUID:     fuid,
-		Username: req.Username,
-		Nickname: req.Nickname,
-		Email:    req.Email,
-		Password: hashPassword,
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("解析密钥环失败: %v", err)
 	}
-	if err := db.Create(&newUser).Error; err != nil {
-		fail(c, 500, "创建用户失败: "+err.Error())
-		return
+	keys := make(map[string][]byte, len(file.Keys))
+	for _, k := range file.Keys {
+		raw, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil || len(raw) != 32 {
+			return fmt.Errorf("密钥%s必须为base64编码的32字节", k.ID)
+		}
+		keys[k.ID] = raw
 	}
-	// 返回用户信息（隐藏敏感信息）
-	respData := map[string]interface{}{
-		"fuid":    newUser.FUID,
-		"username": newUser.Username,
-		"nickname": newUser.Nickname,
-		"email":    newUser.Email,
+	if _, ok := keys[file.Active]; !ok {
+		return fmt.Errorf("当前密钥%s不在密钥环中", file.Active)
 	}
-	success(c, respData)
-	log.Infof("User registered: fuid=%s, username=%s, email=%s", newUser.FUID, newUser.Username, newUser.Email)
+	kr.mu.Lock()
+	kr.active, kr.keys, kr.modTime = file.Active, keys, info.ModTime()
+	kr.mu.Unlock()
+	return nil
 }
 
-// 用户登录接口 - 支持多设备
-func loginHandler(c *gin.Context) {
-	// 参数绑定，新增设备信息
-	var req struct {
-		Account         string `json:"account" binding:"required"` // 用户名/邮箱/FUID
-		Password        string `json:"password" binding:"required"`
-		TurnstileToken  string `json:"turnstile_token" binding:"required"`
-		DeviceName      string `json:"device_name" binding:"required"` // 设备名称
-		DeviceType      string `json:"device_type" binding:"required,oneof=phone pc web app"` // 设备类型
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
-	}
-
-	// 验证人机验证
-	if !verifyCFTurnstile(req.TurnstileToken) {
-		fail(c, 403, "人机验证失败")
+// 文件有变更时重新加载
+func (kr *keyring) reloadIfChanged() {
+	info, err := os.Stat(kr.path)
+	if err != nil {
 		return
 	}
-
-	// 查询用户
-	var user User
-	condition := "username = ? OR email = ? OR fuid = ?"
-	if err := db.Where(condition, req.Account, req.Account, req.Account).First(&user).Error; err != nil {
-		fail(c, 401, "账号或密码错误")
+	kr.mu.RLock()
+	changed := !info.ModTime().Equal(kr.modTime)
+	kr.mu.RUnlock()
+	if !changed {
 		return
 	}
-
-	// 检查用户状态
-	if user.Status == 0 {
-		fail(c, 403, "账号已被禁用")
+	if err := kr.reload(); err != nil {
+		log.Error("重新加载静态加密密钥环失败: ", err)
 		return
 	}
+	log.Infof("静态加密密钥环已重新加载，当前密钥: %s", kr.ActiveKeyID())
+}
 
-	// 验证密码
-	if !verifyPassword(req.Password, user.Password) {
-		fail(c, 401, "账号或密码错误")
-		return
+// 生成新密钥并设为当前密钥（旧密钥保留用于解密），原子写回文件
+func (kr *keyring) rotate() (string, error) {
+	raw := make([]byte, 36)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
 	}
-
-	// 生成设备ID
-	deviceID := generateDeviceID()
-	loginIP := getRealIP(c)
+	// 密钥ID = 时间 + 随机后缀（同一秒内多次轮换也不冲突）
 	now := time.Now()
-
-	// 生成刷新令牌
-	refreshToken, err := generateRefreshToken(user.FUID, deviceID)
+	keyID := fmt.Sprintf("k%s%x", now.Format("20060102150405"), raw[32:])
+	raw = raw[:32]
+	file := keyringFile{Active: keyID}
+	kr.mu.RLock()
+	for id, key := range kr.keys {
+		if id == keyID {
+			kr.mu.RUnlock()
+			return "", errors.New("密钥ID冲突，请稍后重试")
+		}
+		file.Keys = append(file.Keys, keyringKey{ID: id, Key: base64.StdEncoding.EncodeToString(key)})
+	}
+	kr.mu.RUnlock()
+	// 保留原文件中的创建时间
+	if data, err := os.ReadFile(kr.path); err == nil {
+		var old keyringFile
+		if json.Unmarshal(data, &old) == nil {
+			created := make(map[string]time.Time, len(old.Keys))
+			for _, k := range old.Keys {
+				created[k.ID] = k.CreatedAt
+			}
+			for i := range file.Keys {
+				file.Keys[i].CreatedAt = created[file.Keys[i].ID]
+			}
+		}
+	}
+	file.Keys = append(file.Keys, keyringKey{ID: keyID, Key: base64.StdEncoding.EncodeToString(raw), CreatedAt: now})
+	data, err := json.MarshalIndent(file, "", "  ")
 	if err != nil {
-		fail(c, 500, "生成令牌失败")
-		return
+		return "", err
 	}
-
-	// 保存设备信息
-	device := Device{
-		UserFUID:     user.FUID,
-		DeviceID:     deviceID,
-		DeviceName:   req.DeviceName,
-		DeviceType:   req.DeviceType,
-		LoginIP:      loginIP,
-		LoginTime:    now,
-		LastActive:   now,
-		RefreshToken: refreshToken,
-		Status:       1, // 在线状态
+	if err := os.MkdirAll(filepath.Dir(kr.path), 0700); err != nil {
+		return "", fmt.Errorf("创建密钥环目录失败: %v", err)
 	}
-	if err := db.Create(&device).Error; err != nil {
-		fail(c, 500, "保存设备信息失败")
-		return
+	tmpPath := kr.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return "", fmt.Errorf("写入密钥环失败: %v", err)
 	}
-
-	// 生成访问令牌
-	accessExp := now.Add(time.Duration(cfg.Crypto.JWT.Expire) * time.Second)
-	claims := CustomClaims{
-		FUID:     user.FUID,
-		Username: user.Username,
-		Nickname: user.Nickname,
-		DeviceID: deviceID, // 包含设备ID
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(accessExp),
-			IssuedAt:  jwt.NewNumericDate(now),
-		},
+	if err := os.Rename(tmpPath, kr.path); err != nil {
+		return "", fmt.Errorf("写入密钥环失败: %v", err)
 	}
-	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.Crypto.JWT.Secret))
-	if err != nil {
-		fail(c, 500, "生成访问令牌失败")
-		return
+	if err := kr.reload(); err != nil {
+		return "", err
 	}
-
-	// 存储设备在线状态到Redis
-	ctx := context.Background()
-	deviceKey := fmt.Sprintf("user:devices:%s", user.FUID)
-	deviceInfo, _ := json.Marshal(map[string]interface{}{
-		"device_id":   deviceID,
-		"device_name": req.DeviceName,
-		"device_type": req.DeviceType,
-		"login_ip":    loginIP,
-		"login_time":  now.Format(time.RFC3339),
-		"status":      1,
-	})
-	rdb.HSet(ctx, deviceKey, deviceID, deviceInfo)
-	// 设置过期时间(与refresh token一致)
-	rdb.Expire(ctx, deviceKey, time.Duration(cfg.Crypto.JWT.RefreshExpire)*time.Second)
-
-	// 返回登录信息
-	success(c, map[string]interface{}{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
-		"expires_in":    cfg.Crypto.JWT.Expire,
-		"device_id":     deviceID,
-		"user": map[string]interface{}{
-			"fuid":     user.FUID,
-			"username": user.Username,
-			"nickname": user.Nickname,
-		},
-	})
-
-	log.Infof("User logged in: fuid=%s, device_id=%s, ip=%s", user.FUID, deviceID, loginIP)
+	return keyID, nil
 }
 
-// 验证JWT中间件
-func authMiddleware() gin.HandlerFunc {
-    return func(c *gin.Context) {
-        // 获取Token
-        authHeader := c.GetHeader("Authorization")
-        if authHeader == "" {
-            fail(c, 401, "未提供令牌")
-            c.Abort()
-            return
-        }
-
-        // 检查Bearer前缀
-        parts := strings.SplitN(authHeader, " ", 2)
-        if !(len(parts) == 2 && parts[0] == "Bearer") {
-            fail(c, 401, "令牌格式错误（需Bearer前缀）")
-            c.Abort()
-            return
-        }
-        tokenStr := parts[1]
-
-        // 解析Token
-        token, err := jwt.ParseWithClaims(tokenStr, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-            // 验证签名方法
-            if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-                return nil, fmt.Errorf("不支持的签名方法: %v", token.Header["alg"])
-            }
-            // 返回签名密钥
-            return []byte(cfg.Crypto.JWT.Secret), nil
-        })
-
-        // 处理解析错误
-        if err != nil {
-            var msg string
-            switch {
-            case errors.Is(err, jwt.ErrSignatureInvalid):
-                msg = "令牌签名无效"
-            case errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet):
-                msg = "令牌已过期或未生效"
-            default:
-                msg = "令牌解析失败"
-            }
-            fail(c, 401, msg)
-            log.Errorf("JWT验证失败: %v, token: %s", err, tokenStr)
-            c.Abort()
-            return
-        }
+func (kr *keyring) ActiveKeyID() string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active
+}
 
-        // 验证claims有效性
-        if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
-            // 额外校验签发者（确保令牌来源正确）
-            if claims.Issuer != cfg.App.Name {
-                fail(c, 401, "无效的令牌签发者")
-                c.Abort()
-                return
-            }
-
-            // 校验令牌主题（确保是访问令牌）
-            if claims.Subject != "access_token" {
-                fail(c, 401, "令牌类型错误")
-                c.Abort()
-                return
-            }
-
-            // 检查用户是否存在（增强安全性）
-            var user User
-            if err := db.Where("fuid = ? AND status = 1", claims.FUID).First(&user).Error; err != 			nil {
-                fail(c, 401, "用户不存在或已被禁用")
-                c.Abort()
-                return
-            }
-
-		if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
-            // 将用户信息存入上下文
-            c.Set("fuid", claims.FUID)
-            c.Set("username", claims.Username)
-            c.Set("nickname", claims.Nickname)
-            c.Next()
-        } else {
-            fail(c, 401, "令牌无效")
-            c.Abort()
-            return
-			}
-		}
+func (kr *keyring) Seal(plainText, ad []byte) (string, string, error) {
+	kr.mu.RLock()
+	keyID, key := kr.active, kr.keys[kr.active]
+	kr.mu.RUnlock()
+	sealed, err := gcmSeal(key, plainText, ad)
+	if err != nil {
+		return "", "", err
 	}
+	return atRestPrefix + base64.StdEncoding.EncodeToString(sealed), keyID, nil
 }
 
-// 刷新访问令牌接口
-func refreshTokenHandler(c *gin.Context) {
-	var req struct {
-		RefreshToken string `json:"refresh_token" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
+func (kr *keyring) Open(stored, keyID string, ad []byte) ([]byte, error) {
+	if !strings.HasPrefix(stored, atRestPrefix) {
+		return nil, errors.New("静态加密内容格式错误")
 	}
-
-	// 解析刷新令牌
-	token, err := jwt.Parse(req.RefreshToken, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("不支持的签名方法")
-		}
-		return []byte(cfg.Crypto.JWT.Secret), nil
-	})
-	if err != nil || !token.Valid {
-		fail(c, 401, "刷新令牌无效")
-		return
+	sealed, err := base64.StdEncoding.DecodeString(stored[len(atRestPrefix):])
+	if err != nil {
+		return nil, errors.New("静态加密内容格式错误")
 	}
-
-	// 提取令牌信息
-	claims, ok := token.Claims.(jwt.MapClaims)
+	kr.mu.RLock()
+	key, ok := kr.keys[keyID]
+	kr.mu.RUnlock()
 	if !ok {
-		fail(c, 401, "令牌格式错误")
-		return
+		// 其他节点已轮换密钥而本节点尚未加载
+		kr.reloadIfChanged()
+		kr.mu.RLock()
+		key, ok = kr.keys[keyID]
+		kr.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("密钥%s不存在", keyID)
+		}
 	}
+	return gcmOpen(key, sealed, ad)
+}
 
-	fuid, _ := claims["fuid"].(string)
-	deviceID, _ := claims["device_id"].(string)
-
-	// 验证设备状态
-	var device Device
-	if err := db.Where("user_fuid = ? AND device_id = ? AND refresh_token = ? AND status = 1",
-		fuid, deviceID, req.RefreshToken).First(&device).Error; err != nil {
-		fail(c, 401, "设备已下线或令牌无效")
-		return
+// 初始化静态加密
+func initAtRestEncryption() error {
+	if !cfg.Crypto.AtRest.Enable {
+		return nil
 	}
-
-	// 更新最后活跃时间
-	now := time.Now()
-	db.Model(&device).Update("last_active", now)
-
-	// 生成新的访问令牌
-	accessExp := now.Add(time.Duration(cfg.Crypto.JWT.Expire) * time.Second)
-	newClaims := CustomClaims{
-		FUID:     fuid,
-		Username: device.UserFUID, // 实际应从用户表查询
-		DeviceID: deviceID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(accessExp),
-			IssuedAt:  jwt.NewNumericDate(now),
-		},
+	path := cfg.Crypto.AtRest.KeyringPath
+	if path == "" {
+		path = "./keys/keyring.json"
 	}
-	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims).SignedString([]byte(cfg.Crypto.JWT.Secret))
+	kr, err := loadKeyring(path)
 	if err != nil {
-		fail(c, 500, "生成访问令牌失败")
-		return
+		return err
 	}
-
-	// 更新Redis中的最后活跃时间
-	ctx := context.Background()
-	deviceKey := fmt.Sprintf("user:devices:%s", fuid)
-	existingInfo, _ := rdb.HGet(ctx, deviceKey, deviceID).Result()
-	var deviceInfo map[string]interface{}
-	json.Unmarshal([]byte(existingInfo), &deviceInfo)
-	deviceInfo["last_active"] = now.Format(time.RFC3339)
-	updatedInfo, _ := json.Marshal(deviceInfo)
-	rdb.HSet(ctx, deviceKey, deviceID, updatedInfo)
-
-	success(c, map[string]interface{}{
-		"access_token": accessToken,
-		"expires_in":   cfg.Crypto.JWT.Expire,
-	})
+	atRestCipher = kr
+	log.Infof("静态加密已启用，当前密钥: %s", kr.ActiveKeyID())
+	return nil
 }
 
-// 生成设备唯一标识
-func generateDeviceID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return base64.URLEncoding.EncodeToString(b)
+// 密钥环命令（命令行：keyring rotate | keyring status）
+func keyringCommand(args []string) error {
+	kr, ok := atRestCipher.(*keyring)
+	if !ok {
+		return errors.New("静态加密未启用（crypto.at_rest.enable）")
+	}
+	if len(args) == 0 {
+		return errors.New("用法: keyring rotate | keyring status")
+	}
+	switch args[0] {
+	case "rotate":
+		keyID, err := kr.rotate()
+		if err != nil {
+			return err
+		}
+		log.Infof("已生成新密钥: %s，运行中的服务将自动加载，后台任务会用新密钥重新加密存量数据", keyID)
+	case "status":
+		kr.mu.RLock()
+		log.Infof("密钥环: %s，当前密钥: %s，密钥数: %d", kr.path, kr.active, len(kr.keys))
+		kr.mu.RUnlock()
+		for _, table := range []string{"messages", "group_notices"} {
+			var rows []struct {
+				ContentKeyID string
+				Count        int64
+			}
+			db.Table(table).Select("content_key_id, COUNT(*) AS count").Group("content_key_id").Scan(&rows)
+			for _, row := range rows {
+				log.Infof("%s: key_id=%q, rows=%d", table, row.ContentKeyID, row.Count)
+			}
+		}
+	default:
+		return fmt.Errorf("未知子命令: %s", args[0])
+	}
+	return nil
 }
 
-// 生成刷新令牌
-func generateRefreshToken(fuid, deviceID string) (string, error) {
-	// 刷新令牌包含用户ID和设备ID，有效期更长
-	claims := jwt.MapClaims{
-		"fuid":     fuid,
-		"device_id": deviceID,
-		"exp":      time.Now().Add(time.Duration(cfg.Crypto.JWT.RefreshExpire) * time.Second).Unix(),
+// 静态加密维护任务：跟踪密钥环文件变更，并用当前密钥重新加密存量数据（集群内仅一个节点执行）
+func atRestMaintenanceTask() {
+	kr, ok := atRestCipher.(*keyring)
+	if !ok {
+		return
+	}
+	interval := time.Duration(cfg.Crypto.AtRest.ReencryptInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	reloadTicker := time.NewTicker(10 * time.Second)
+	defer reloadTicker.Stop()
+	reencryptTicker := time.NewTicker(interval)
+	defer reencryptTicker.Stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-hup:
+			if err := kr.reload(); err != nil {
+				log.Error("重新加载静态加密密钥环失败: ", err)
+			} else {
+				log.Infof("静态加密密钥环已重新加载，当前密钥: %s", kr.ActiveKeyID())
+			}
+		case <-reloadTicker.C:
+			kr.reloadIfChanged()
+		case <-reencryptTicker.C:
+			ctx := context.Background()
+			locked, err := rdb.SetNX(ctx, "lock:at_rest_reencrypt", nodeID, interval).Result()
+			if err != nil || !locked {
+				continue
+			}
+			reencryptMessages(kr.ActiveKeyID())
+			reencryptGroupNotices(kr.ActiveKeyID())
+			rdb.Del(ctx, "lock:at_rest_reencrypt")
+		}
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(cfg.Crypto.JWT.Secret))
 }
 
-// 获取当前登录设备列表
-func getDevicesHandler(c *gin.Context) {
-	fuid := c.GetHeader("FUID") // 从JWT中间件获取
-	if fuid == "" {
-		fail(c, 401, "未授权")
-		return
+// 静态加密每批处理条数
+func reencryptBatchSize() int {
+	if cfg.Crypto.AtRest.ReencryptBatch > 0 {
+		return cfg.Crypto.AtRest.ReencryptBatch
 	}
+	return 500
+}
 
-	// 从Redis获取设备列表
-	ctx := context.Background()
+// 重新加密非当前密钥（含未加密）的消息
+func reencryptMessages(activeKeyID string) {
+	var lastID uint64
+	var total int
+	for {
+		var messages []Message
+		if err := db.Where("id > ? AND content_key_id != ?", lastID, activeKeyID).
+			Order("id ASC").Limit(reencryptBatchSize()).Find(&messages).Error; err != nil {
+			log.Error("查询待重新加密消息失败: ", err)
+			return
+		}
+		if len(messages) == 0 {
+			break
+		}
+		for _, msg := range messages {
+			lastID = msg.ID
+			if msg.ContentKeyID != "" && strings.HasPrefix(msg.Content, atRestPrefix) {
+				// 解密失败的数据保持原样
+				continue
+			}
+			updates, err := contentUpdates(msg.Content, msg.atRestAD())
+			if err != nil {
+				log.Errorf("重新加密消息失败: msg_id=%s, err=%v", msg.MsgID, err)
+				continue
+			}
+			db.Model(&Message{}).Where("id = ? AND content_key_id = ?", msg.ID, msg.ContentKeyID).Updates(updates)
+			total++
+		}
+	}
+	if total > 0 {
+		log.Infof("消息重新加密完成: key_id=%s, rows=%d", activeKeyID, total)
+	}
+}
+
+// 重新加密非当前密钥（含未加密）的群公告，并为旧数据补齐公告ID
+func reencryptGroupNotices(activeKeyID string) {
+	var lastID uint64
+	var total int
+	for {
+		var notices []GroupNotice
+		if err := db.Where("id > ? AND (content_key_id != ? OR notice_id = '')", lastID, activeKeyID).
+			Order("id ASC").Limit(reencryptBatchSize()).Find(&notices).Error; err != nil {
+			log.Error("查询待重新加密群公告失败: ", err)
+			return
+		}
+		if len(notices) == 0 {
+			break
+		}
+		for _, notice := range notices {
+			lastID = notice.ID
+			if notice.ContentKeyID != "" && strings.HasPrefix(notice.Content, atRestPrefix) {
+				continue
+			}
+			legacyID := notice.NoticeID
+			if notice.NoticeID == "" {
+				noticeID, err := generateUniqueID(32)
+				if err != nil {
+					log.Errorf("生成公告ID失败: id=%d, err=%v", notice.ID, err)
+					continue
+				}
+				notice.NoticeID = noticeID
+			}
+			updates, err := contentUpdates(notice.Content, notice.atRestAD())
+			if err != nil {
+				log.Errorf("重新加密群公告失败: id=%d, err=%v", notice.ID, err)
+				continue
+			}
+			updates["notice_id"] = notice.NoticeID
+			db.Model(&GroupNotice{}).Where("id = ? AND content_key_id = ? AND notice_id = ?", notice.ID, notice.ContentKeyID, legacyID).Updates(updates)
+			total++
+		}
+	}
+	if total > 0 {
+		log.Infof("群公告重新加密完成: key_id=%s, rows=%d", activeKeyID, total)
+	}
+}
+
+// 获取客户端真实IP
+func getRealIP(c *gin.Context) string {
+	// 常见CDN代理头
+	headers := []string{
+		"X-Forwarded-For",
+		"X-Real-IP",
+		"CF-Connecting-IP",
+		"X-Forwarded",
+		"Forwarded-For",
+		"Forwarded",
+		"Proxy-Client-IP",
+		"WL-Proxy-Client-IP",
+	}
+	for _, header := range headers {
+		ipStr := c.GetHeader(header)
+		if ipStr != "" {
+			// 多个IP时取第一个
+			ips := strings.Split(ipStr, ",")
+			ip := strings.TrimSpace(ips[0])
+			if net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+	// 最后取远程IP
+	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return ip
+}
+
+// 健康检查接口
+func healthHandler(c *gin.Context) {
+    // 计算服务已运行时间
+    uptime := time.Since(startTime)
+    
+    // 格式化运行时间为友好显示格式
+    uptimeStr := fmt.Sprintf(
+        "%d小时%d分钟%d秒",
+        int(uptime.Hours()),
+        int(uptime.Minutes())%60,
+        int(uptime.Seconds())%60,
+    )
+    
+    // 构建响应数据
+    data := map[string]interface{}{
+        "status":  "success",
+        "message": "服务运行正常",
+        "uptime":  uptimeStr,
+        "start_at": startTime.Format("2006-01-02 15:04:05"),
+    }
+    
+    success(c, data)
+}
+
+// 创建基于令牌桶的限流器
+// rate: 每秒生成的令牌数
+// burst: 令牌桶容量
+func newTokenBucketLimiter(r rate.Limit, burst int) *rate.Limiter {
+    return rate.NewLimiter(r, burst)
+}
+
+// 获取注册登录IP限流器
+func getRegisterLoginIPLimiter(ip string) *rate.Limiter {
+    if limiter, ok := registerLoginIPLimiters.Load(ip); ok {
+        return limiter.(*rate.Limiter)
+    }
+    
+    // 从配置转换：周期内限制数 -> 每秒令牌数
+    limit := cfg.RateLimit.RegisterLoginIP.Limit
+    period := cfg.RateLimit.RegisterLoginIP.Period
+    r := rate.Limit(limit) / rate.Limit(period) // 每秒生成的令牌数
+    burst := limit                             // 令牌桶容量
+    
+    newLimiter := newTokenBucketLimiter(r, burst)
+    limiter, _ := registerLoginIPLimiters.LoadOrStore(ip, newLimiter)
+    return limiter.(*rate.Limiter)
+}
+
+// 获取注册登录用户限流器
+func getRegisterLoginUserLimiter(username string) *rate.Limiter {
+    if limiter, ok := registerLoginUserLimiters.Load(username); ok {
+        return limiter.(*rate.Limiter)
+    }
+    
+    limit := cfg.RateLimit.RegisterLoginUser.Limit
+    period := cfg.RateLimit.RegisterLoginUser.Period
+    r := rate.Limit(limit) / rate.Limit(period)
+    burst := limit
+    
+    newLimiter := newTokenBucketLimiter(r, burst)
+    limiter, _ := registerLoginUserLimiters.LoadOrStore(username, newLimiter)
+    return limiter.(*rate.Limiter)
+}
+
+// 获取消息频率限流器
+func getMessageConnLimiter(ip string) *rate.Limiter {
+    if limiter, ok := messageConnLimiters.Load(ip); ok {
+        return limiter.(*rate.Limiter)
+    }
+    
+    limit := cfg.RateLimit.MessageConn.Limit
+    period := cfg.RateLimit.MessageConn.Period
+    r := rate.Limit(limit) / rate.Limit(period)
+    burst := limit
+    
+    newLimiter := newTokenBucketLimiter(r, burst)
+    limiter, _ := messageConnLimiters.LoadOrStore(ip, newLimiter)
+    return limiter.(*rate.Limiter)
+}
+
+// 获取房间用户限流器
+func getGroupUserLimiter(key string) *rate.Limiter {
+    if limiter, ok := GroupUserLimiters.Load(key); ok {
+        return limiter.(*rate.Limiter)
+    }
+    
+    limit := cfg.RateLimit.GroupUser.Limit
+    period := cfg.RateLimit.GroupUser.Period
+    r := rate.Limit(limit) / rate.Limit(period)
+    burst := limit
+    
+    newLimiter := newTokenBucketLimiter(r, burst)
+    limiter, _ := GroupUserLimiters.LoadOrStore(key, newLimiter)
+    return limiter.(*rate.Limiter)
+}
+
+// 初始化限流中间件（基于官方令牌桶算法）
+func initRateLimiters() map[string]gin.HandlerFunc {
+    limiters := make(map[string]gin.HandlerFunc)
+    
+    // 注册/登录IP限流中间件
+    limiters["register_login_ip"] = func(c *gin.Context) {
+        ip := getRealIP(c)
+        limiter := getRegisterLoginIPLimiter(ip)
+        if !limiter.Allow() {
+            fail(c, 429, "IP请求过于频繁，请稍后再试")
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+    
+    // 注册/登录用户限流中间件
+    limiters["register_login_user"] = func(c *gin.Context) {
+        // 注册/登录均为JSON请求体：登录取account，注册取username（其次email）
+        // 限流在鉴权之前执行，请求体须限制大小后再读取
+        body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 8<<10))
+        if err != nil {
+            fail(c, 413, "请求体过大或读取失败")
+            c.Abort()
+            return
+        }
+        c.Request.Body = io.NopCloser(bytes.NewReader(body))
+        var target struct {
+            Account  string `json:"account"`
+            Username string `json:"username"`
+            Email    string `json:"email"`
+        }
+        json.Unmarshal(body, &target)
+        username := target.Account
+        if username == "" {
+            username = target.Username
+        }
+        if username == "" {
+            username = target.Email
+        }
+        if username == "" {
+            fail(c, 400, "用户名或邮箱不能为空")
+            c.Abort()
+            return
+        }
+        
+        limiter := getRegisterLoginUserLimiter(username)
+        if !limiter.Allow() {
+            fail(c, 429, "账号请求过于频繁，请稍后再试")
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+    
+    // 消息频率限流中间件
+    limiters["message_conn"] = func(c *gin.Context) {
+        ip := c.ClientIP()
+        limiter := getMessageConnLimiter(ip)
+        if !limiter.Allow() {
+            fail(c, 429, "消息发送过于频繁，请稍后再试")
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+    
+    // 房间/用户维度限流中间件
+    limiters["group_user"] = func(c *gin.Context) {
+        // 用户取认证身份（须在authMiddleware之后），房间取请求体中的群聊接收方；非群聊请求不限制
+        fuid := currentIdentity(c).FUID
+        if fuid == "" {
+            fail(c, 401, "未登录")
+            c.Abort()
+            return
+        }
+        // 请求体须限制大小后再读取
+        body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 8<<10))
+        if err != nil {
+            fail(c, 413, "请求体过大或读取失败")
+            c.Abort()
+            return
+        }
+        c.Request.Body = io.NopCloser(bytes.NewReader(body))
+        var target struct {
+            ReceiverType uint8  `json:"receiver_type"`
+            ReceiverID   string `json:"receiver_id"`
+        }
+        json.Unmarshal(body, &target)
+        if target.ReceiverType != 2 || target.ReceiverID == "" {
+            c.Next()
+            return
+        }
+        key := fmt.Sprintf("%s:%s", fuid, target.ReceiverID)
+        
+        limiter := getGroupUserLimiter(key)
+        if !limiter.Allow() {
+            fail(c, 429, "房间内操作过于频繁，请稍后再试")
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+    
+    return limiters
+}
+
+// 标准化响应结构体
+type Response struct {
+	Code    int         `json:"code"`
+	Msg     string      `json:"msg"`
+	Data    interface{} `json:"data,omitempty"`
+	Count   int64       `json:"count,omitempty"`
+}
+
+// 成功响应
+func success(c *gin.Context, data interface{}, count ...int64) {
+	res := Response{
+		Code: 200,
+		Msg:  "success",
+		Data: data,
+	}
+	if len(count) > 0 {
+		res.Count = count[0]
+	}
+	c.JSON(200, res)
+}
+
+// 错误响应
+func fail(c *gin.Context, code int, msg string) {
+	res := Response{
+		Code: code,
+		Msg:  msg,
+	}
+	c.JSON(200, res)
+	log.Errorf("API error: code=%d, msg=%s, path=%s, ip=%s", code, msg, c.Request.URL.Path, getRealIP(c))
+}
+
+// 验证CF人机验证
+func verifyCFTurnstile(token string) bool {
+	if cfg.App.Mode == "debug" {
+		return true // 调试模式跳过验证
+	}
+	resp, err := http.PostForm("https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		url.Values{
+			"secret":   {cfg.CFTurnstile.SecretKey},
+			"response": {token},
+		})
+	if err != nil {
+		log.Error("verify CF turnstile failed: ", err)
+		return false
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error("read CF turnstile response failed: ", err)
+		return false
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		log.Error("unmarshal CF turnstile response failed: ", err)
+		return false
+	}
+	return result.Success
+}
+
+// 用户注册接口
+func registerHandler(c *gin.Context) {
+	// 参数绑定
+	var req struct {
+		Username        string `json:"username" binding:"required,min=3,max=20"`
+		Nickname        string `json:"nickname" binding:"required,min=1,max=20"`
+		Email           string `json:"email" binding:"required,email"`
+		Password        string `json:"password" binding:"required,min=6,max=20"`
+		ConfirmPassword string `json:"confirm_password" binding:"required,eqfield=Password"`
+		TurnstileToken  string `json:"turnstile_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 验证人机验证
+	if !verifyCFTurnstile(req.TurnstileToken) {
+		fail(c, 403, "人机验证失败")
+		return
+	}
+	// 检查用户名是否已存在
+	var user User
+	if err := db.Where("username = ?", req.Username).First(&user).Error; err == nil {
+		fail(c, 400, "用户名已存在")
+		return
+	}
+	// 检查邮箱是否已存在
+	if err := db.Where("email = ?", req.Email).First(&user).Error; err == nil {
+		fail(c, 400, "邮箱已存在")
+		return
+	}
+	// 生成FUID
+	fuid, err := generateFUID()
+	if err != nil {
+		fail(c, 500, "生成用户ID失败，请稍后重试")
+		log.Errorf("生成FUID失败: %v", err)
+		return
+	}
+	// 加密密码
+	hashPassword, err := encryptPassword(req.Password)
+	if err != nil {
+		fail(c, 500, "密码加密失败: "+err.Error())
+		return
+	}
+	// 创建用户
+	newUser := User{
+		FUID:     fuid,
+		Username: req.Username,
+		Nickname: req.Nickname,
+		Email:    req.Email,
+		Password: hashPassword,
+	}
+	if err := db.Create(&newUser).Error; err != nil {
+		fail(c, 500, "创建用户失败: "+err.Error())
+		return
+	}
+	// 发送邮箱验证邮件
+	if err := sendVerificationMail(&newUser, mailPurposeVerify, newUser.Email); err != nil {
+		log.Errorf("发送邮箱验证邮件失败: fuid=%s, err=%v", newUser.FUID, err)
+	}
+	// 返回用户信息（隐藏敏感信息）
+	respData := map[string]interface{}{
+		"fuid":    newUser.FUID,
+		"username": newUser.Username,
+		"nickname": newUser.Nickname,
+		"email":    newUser.Email,
+		"email_verified": false,
+	}
+	success(c, respData)
+	log.Infof("User registered: fuid=%s, username=%s, email=%s", newUser.FUID, newUser.Username, newUser.Email)
+}
+
+// 用户登录接口 - 支持多设备
+func loginHandler(c *gin.Context) {
+	// 参数绑定，新增设备信息
+	var req struct {
+		Account         string `json:"account" binding:"required"` // 用户名/邮箱/FUID
+		Password        string `json:"password" binding:"required"`
+		TurnstileToken  string `json:"turnstile_token" binding:"required"`
+		DeviceName      string `json:"device_name" binding:"required"` // 设备名称
+		DeviceType      string `json:"device_type" binding:"required,oneof=phone pc web app"` // 设备类型
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+
+	// 验证人机验证
+	if !verifyCFTurnstile(req.TurnstileToken) {
+		fail(c, 403, "人机验证失败")
+		return
+	}
+
+	// 查询用户
+	var user User
+	condition := "username = ? OR email = ? OR fuid = ?"
+	if err := db.Where(condition, req.Account, req.Account, req.Account).First(&user).Error; err != nil {
+		fail(c, 401, "账号或密码错误")
+		return
+	}
+
+	// 检查用户状态
+	if user.Status == 0 {
+		fail(c, 403, "账号已被禁用")
+		return
+	}
+
+	// 登录失败次数过多被临时锁定
+	if locked := loginLockedFor(user.FUID); locked > 0 {
+		fail(c, 423, fmt.Sprintf("登录失败次数过多，账号已临时锁定，请%d分钟后再试", int(locked.Minutes())+1))
+		return
+	}
+
+	// 验证密码
+	if !verifyPassword(req.Password, user.Password) {
+		recordLoginFailure(c, &user, req.DeviceName, req.DeviceType, "password", "wrong_password")
+		fail(c, 401, "账号或密码错误")
+		return
+	}
+
+	// 已开启两步验证：签发临时登录令牌，验证动态码后再完成登录
+	if totpEnabled(user.FUID) {
+		mfaToken, expiresIn, err := issueMFALoginToken(user.FUID, req.DeviceName, req.DeviceType)
+		if err != nil {
+			fail(c, 500, "生成临时令牌失败")
+			return
+		}
+		success(c, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   expiresIn,
+			"methods":      []string{"totp", "recovery_code"},
+		})
+		return
+	}
+
+	completeLogin(c, &user, req.DeviceName, req.DeviceType, "password")
+}
+
+// 完成登录：创建设备、签发访问令牌与刷新令牌并返回（密码、两步验证等登录方式共用）
+func completeLogin(c *gin.Context, user *User, deviceName, deviceType, method string) {
+	// 生成设备ID
+	deviceID := generateDeviceID()
+	loginIP := getRealIP(c)
+	now := time.Now()
+
+	// 保存设备信息
+	device := Device{
+		UserFUID:   user.FUID,
+		DeviceID:   deviceID,
+		DeviceName: deviceName,
+		DeviceType: deviceType,
+		LoginIP:    loginIP,
+		LoginTime:  now,
+		LastActive: now,
+		Status:     1, // 在线状态
+	}
+	if err := db.Create(&device).Error; err != nil {
+		fail(c, 500, "保存设备信息失败")
+		return
+	}
+
+	// 生成刷新令牌（新的令牌族；设备已保存，避免留下无设备的令牌）
+	refreshToken, err := issueRefreshToken(dbRefreshTokens, user.FUID, deviceID, generateDeviceID(), now)
+	if err != nil {
+		db.Delete(&device)
+		fail(c, 500, "生成令牌失败")
+		return
+	}
+
+	// 生成访问令牌
+	accessToken, _, err := generateAccessToken(user.FUID, user.Username, user.Nickname, deviceID, now)
+	if err != nil {
+		fail(c, 500, "生成访问令牌失败")
+		return
+	}
+
+	// 存储设备在线状态到Redis
+	ctx := context.Background()
+	deviceKey := fmt.Sprintf("user:devices:%s", user.FUID)
+	deviceInfo, _ := json.Marshal(map[string]interface{}{
+		"device_id":   deviceID,
+		"device_name": deviceName,
+		"device_type": deviceType,
+		"login_ip":    loginIP,
+		"login_time":  now.Format(time.RFC3339),
+		"status":      1,
+	})
+	rdb.HSet(ctx, deviceKey, deviceID, deviceInfo)
+	// 设置过期时间(与refresh token一致)
+	rdb.Expire(ctx, deviceKey, time.Duration(cfg.Crypto.JWT.RefreshExpire)*time.Second)
+
+	// 返回登录信息
+	success(c, map[string]interface{}{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    cfg.Crypto.JWT.Expire,
+		"device_id":     deviceID,
+		"user": map[string]interface{}{
+			"fuid":     user.FUID,
+			"username": user.Username,
+			"nickname": user.Nickname,
+		},
+	})
+
+	recordLoginSuccess(c, user, deviceID, deviceName, deviceType, method)
+	log.Infof("User logged in: fuid=%s, device_id=%s, ip=%s, method=%s", user.FUID, deviceID, loginIP, method)
+}
+
+// auditLogger 审计日志接口：安全事件、群管理、设备管理及管理接口的操作都通过auditLog写入
+type auditLogger interface {
+	Record(event AuditEvent)
+}
+
+// dbAuditLogger 写入audit_events表（只追加），同时输出结构化日志
+type dbAuditLogger struct{}
+
+func (dbAuditLogger) Record(event AuditEvent) {
+	log.WithFields(logrus.Fields{
+		"audit":       true,
+		"actor":       event.ActorFUID,
+		"action":      event.Action,
+		"target_type": event.TargetType,
+		"target_id":   event.TargetID,
+		"group_quid":  event.GroupQUID,
+		"ip":          event.IP,
+	}).Info("audit event")
+	if err := db.Create(&event).Error; err != nil {
+		log.Errorf("写入审计事件失败: action=%s, target=%s, err=%v", event.Action, event.TargetID, err)
+	}
+}
+
+var auditLog auditLogger = dbAuditLogger{}
+
+// 构造审计事件：操作者取当前身份，IP取getRealIP（后台任务传nil，操作者与IP为空）
+func newAuditEvent(c *gin.Context, action, targetType, targetID string, payload map[string]interface{}) AuditEvent {
+	event := AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+	}
+	if c != nil {
+		identity := currentIdentity(c)
+		event.ActorFUID = identity.FUID
+		event.ActorRole = identity.Role
+		event.IP = getRealIP(c)
+	}
+	if len(payload) > 0 {
+		encoded, _ := json.Marshal(payload)
+		event.Payload = string(encoded)
+	}
+	return event
+}
+
+// 记录审计事件
+func recordAudit(c *gin.Context, action, targetType, targetID string, payload map[string]interface{}) {
+	auditLog.Record(newAuditEvent(c, action, targetType, targetID, payload))
+}
+
+// 记录群聊审计事件（群主可查询本群事件）
+func recordGroupAudit(c *gin.Context, groupQUID, action, targetType, targetID string, payload map[string]interface{}) {
+	event := newAuditEvent(c, action, targetType, targetID, payload)
+	event.GroupQUID = groupQUID
+	auditLog.Record(event)
+}
+
+// 记录账号安全事件（登录、两步验证、会话等），对象为账号本人；登录等未认证请求的操作者即账号本人
+func auditSecurityEvent(c *gin.Context, fuid, action string, fields map[string]interface{}) {
+	event := newAuditEvent(c, action, "user", fuid, fields)
+	if event.ActorFUID == "" {
+		event.ActorFUID = fuid
+	}
+	auditLog.Record(event)
+}
+
+// 群主视图中隐藏的载荷字段（命中的敏感词、消息内容等）
+func ownerHiddenAuditField(key string) bool {
+	return key == "detail" || strings.HasPrefix(key, "content")
+}
+
+// 审计事件信息；reduced为true时为群主视图：不含IP，载荷中不含命中详情及内容字段
+func auditEventData(event *AuditEvent, reduced bool) map[string]interface{} {
+	data := map[string]interface{}{
+		"id":          event.ID,
+		"actor_fuid":  event.ActorFUID,
+		"actor_role":  event.ActorRole,
+		"action":      event.Action,
+		"target_type": event.TargetType,
+		"target_id":   event.TargetID,
+		"group_quid":  event.GroupQUID,
+		"ip":          event.IP,
+		"created_at":  event.CreatedAt.Format("2006-01-02 15:04:05"),
+	}
+	var payload interface{}
+	if event.Payload != "" && json.Unmarshal([]byte(event.Payload), &payload) == nil {
+		data["payload"] = payload
+	}
+	if reduced {
+		delete(data, "ip")
+		if fields, ok := payload.(map[string]interface{}); ok {
+			for key := range fields {
+				if ownerHiddenAuditField(key) {
+					delete(fields, key)
+				}
+			}
+		}
+	}
+	return data
+}
+
+// 按请求参数筛选审计事件（action、target_type、target_id、from、to，时间格式2006-01-02或2006-01-02 15:04:05）
+func auditQuery(c *gin.Context, query *gorm.DB) (*gorm.DB, error) {
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("target_id"); targetID != "" {
+		query = query.Where("target_id = ?", targetID)
+	}
+	for _, bound := range []struct{ param, cond string }{{"from", "created_at >= ?"}, {"to", "created_at <= ?"}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+		if err != nil {
+			if t, err = time.ParseInLocation("2006-01-02", value, time.Local); err != nil {
+				return nil, fmt.Errorf("%s时间格式错误", bound.param)
+			}
+			if bound.param == "to" {
+				t = t.Add(24*time.Hour - time.Second)
+			}
+		}
+		query = query.Where(bound.cond, t)
+	}
+	return query, nil
+}
+
+// 分页返回审计事件（reduced见auditEventData）
+func listAuditEvents(c *gin.Context, query *gorm.DB, reduced bool) {
+	query, err := auditQuery(c, query)
+	if err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+	page, size := pageParams(c)
+	var total int64
+	query.Count(&total)
+	var events []AuditEvent
+	if err := query.Order("id DESC").Offset((page - 1) * size).Limit(size).Find(&events).Error; err != nil {
+		fail(c, 500, "查询审计事件失败")
+		return
+	}
+	list := make([]map[string]interface{}, 0, len(events))
+	for i := range events {
+		list = append(list, auditEventData(&events[i], reduced))
+	}
+	success(c, list, total)
+}
+
+// 查询审计事件（管理员，可按操作者、群聊及通用条件筛选）
+func adminListAuditHandler(c *gin.Context) {
+	query := db.Model(&AuditEvent{})
+	if actor := c.Query("actor_fuid"); actor != "" {
+		query = query.Where("actor_fuid = ?", actor)
+	}
+	if groupQUID := c.Query("group_quid"); groupQUID != "" {
+		query = query.Where("group_quid = ?", groupQUID)
+	}
+	listAuditEvents(c, query, false)
+}
+
+// 查询本群审计事件（仅群主；不返回IP及载荷中的命中详情、内容字段）
+func groupAuditHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	groupQUID := c.Param("quid")
+	var group Group
+	if err := db.Where("quid = ? AND owner_fuid = ? AND status = 1", groupQUID, currentFUID).First(&group).Error; err != nil {
+		fail(c, 403, "仅群主可查看群聊操作记录")
+		return
+	}
+	listAuditEvents(c, db.Model(&AuditEvent{}).Where("group_quid = ?", groupQUID), true)
+}
+
+// 定时清理超过保留期的审计事件（retention_days为0时永久保留）
+func auditRetentionTask() {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		days := cfg.Audit.RetentionDays
+		if days <= 0 {
+			continue
+		}
+		result := db.Where("created_at < ?", time.Now().AddDate(0, 0, -days)).Delete(&AuditEvent{})
+		if result.Error != nil {
+			log.Error("清理审计事件失败: ", result.Error)
+		} else {
+			log.Infof("清理审计事件成功，共删除%d条", result.RowsAffected)
+		}
+	}
+}
+
+// 截断到指定字符数（按Unicode字符计）
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+// 登录结果
+const (
+	loginFailed  = 0
+	loginSucceed = 1
+)
+
+// 登录风险标记
+const (
+	riskNewDevice     = "new_device"     // 从未登录过的设备（设备名称+类型）
+	riskNewIP         = "new_ip"         // 从未登录过的IP
+	riskRapidFailures = "rapid_failures" // 短时间内多次登录失败
+)
+
+func loginFailKey(fuid string) string {
+	return "login_fail:" + fuid
+}
+
+func loginLockKey(fuid string) string {
+	return "login_lock:" + fuid
+}
+
+// 账号是否因登录失败次数过多被临时锁定，返回剩余锁定时间
+func loginLockedFor(fuid string) time.Duration {
+	if !cfg.LoginRisk.Lockout.Enable {
+		return 0
+	}
+	ttl, err := rdb.TTL(context.Background(), loginLockKey(fuid)).Result()
+	if err != nil || ttl <= 0 {
+		return 0
+	}
+	return ttl
+}
+
+// 记录登录失败：写入登录历史，窗口期内失败次数达到阈值时发送安全提醒，达到锁定次数时临时锁定账号
+// 失败计数与锁定只受lockout.enable控制，与风控提醒（login_risk.enable）相互独立
+func recordLoginFailure(c *gin.Context, user *User, deviceName, deviceType, method, reason string) {
+	db.Create(&LoginHistory{
+		UserFUID:   user.FUID,
+		DeviceName: deviceName,
+		DeviceType: deviceType,
+		IP:         getRealIP(c),
+		UserAgent:  truncateRunes(c.Request.UserAgent(), 256),
+		Method:     method,
+		Result:     loginFailed,
+		Reason:     reason,
+	})
+	lockout := cfg.LoginRisk.Lockout
+	if !cfg.LoginRisk.Enable && !lockout.Enable {
+		auditSecurityEvent(c, user.FUID, "login_failed", map[string]interface{}{"method": method, "reason": reason})
+		return
+	}
+	ctx := context.Background()
+	window := cfg.LoginRisk.FailureWindow
+	if window <= 0 {
+		window = 900
+	}
+	failures, err := rdb.Incr(ctx, loginFailKey(user.FUID)).Result()
+	if err != nil {
+		log.Error("记录登录失败次数失败: ", err)
+		return
+	}
+	if failures == 1 {
+		rdb.Expire(ctx, loginFailKey(user.FUID), time.Duration(window)*time.Second)
+	}
+	auditSecurityEvent(c, user.FUID, "login_failed", map[string]interface{}{"method": method, "reason": reason, "failures": failures})
+
+	if cfg.LoginRisk.Enable && cfg.LoginRisk.FailureAlert > 0 && failures == int64(cfg.LoginRisk.FailureAlert) {
+		sendSecurityNotice(user, "登录失败提醒",
+			fmt.Sprintf("您的账号在%d分钟内登录失败%d次（最近一次IP：%s）。如非本人操作，请尽快修改密码并开启两步验证。",
+				window/60, failures, getRealIP(c)))
+	}
+	if lockout.Enable && lockout.MaxFailures > 0 && failures >= int64(lockout.MaxFailures) {
+		duration := lockout.Duration
+		if duration <= 0 {
+			duration = 1800
+		}
+		rdb.Set(ctx, loginLockKey(user.FUID), getRealIP(c), time.Duration(duration)*time.Second)
+		rdb.Del(ctx, loginFailKey(user.FUID))
+		auditSecurityEvent(c, user.FUID, "login_locked", map[string]interface{}{"failures": failures, "duration": duration})
+		sendSecurityNotice(user, "账号已临时锁定",
+			fmt.Sprintf("您的账号登录失败次数过多，已锁定%d分钟。如非本人操作，请尽快修改密码并开启两步验证。", duration/60))
+	}
+}
+
+// 评估本次成功登录的风险：与历史成功登录比较设备与IP，并检查此前的连续失败次数（首次登录不评估）
+func evaluateLoginRisk(fuid, deviceName, deviceType, ip string) []string {
+	var previous int64
+	db.Model(&LoginHistory{}).Where("user_fuid = ? AND result = ?", fuid, loginSucceed).Count(&previous)
+	if previous == 0 {
+		return nil
+	}
+	var risks []string
+	var count int64
+	db.Model(&LoginHistory{}).Where("user_fuid = ? AND result = ? AND device_name = ? AND device_type = ?",
+		fuid, loginSucceed, deviceName, deviceType).Count(&count)
+	if count == 0 {
+		risks = append(risks, riskNewDevice)
+	}
+	db.Model(&LoginHistory{}).Where("user_fuid = ? AND result = ? AND ip = ?", fuid, loginSucceed, ip).Count(&count)
+	if count == 0 {
+		risks = append(risks, riskNewIP)
+	}
+	if cfg.LoginRisk.FailureAlert > 0 {
+		failures, _ := rdb.Get(context.Background(), loginFailKey(fuid)).Int64()
+		if failures >= int64(cfg.LoginRisk.FailureAlert) {
+			risks = append(risks, riskRapidFailures)
+		}
+	}
+	return risks
+}
+
+// 记录登录成功：评估风险并写入登录历史，存在风险时发送安全提醒
+func recordLoginSuccess(c *gin.Context, user *User, deviceID, deviceName, deviceType, method string) {
+	ip := getRealIP(c)
+	var risks []string
+	if cfg.LoginRisk.Enable {
+		risks = evaluateLoginRisk(user.FUID, deviceName, deviceType, ip)
+	}
+	if cfg.LoginRisk.Enable || cfg.LoginRisk.Lockout.Enable {
+		rdb.Del(context.Background(), loginFailKey(user.FUID))
+	}
+	db.Create(&LoginHistory{
+		UserFUID:   user.FUID,
+		DeviceID:   deviceID,
+		DeviceName: deviceName,
+		DeviceType: deviceType,
+		IP:         ip,
+		UserAgent:  truncateRunes(c.Request.UserAgent(), 256),
+		Method:     method,
+		Result:     loginSucceed,
+		Risk:       strings.Join(risks, ","),
+	})
+	auditSecurityEvent(c, user.FUID, "login", map[string]interface{}{"method": method, "device_id": deviceID, "risk": risks})
+	if len(risks) == 0 || !cfg.LoginRisk.NotifyNewDevice {
+		return
+	}
+	sendSecurityNotice(user, "新设备登录提醒",
+		fmt.Sprintf("您的账号于%s在新的设备或网络登录（设备：%s %s，IP：%s）。如非本人操作，请立即在设备管理中将其下线并修改密码。",
+			time.Now().Format("2006-01-02 15:04:05"), deviceType, deviceName, ip))
+}
+
+// 发送安全提醒：系统消息、ntfy推送、邮件
+func sendSecurityNotice(user *User, title, content string) {
+	go func() {
+		if _, err := pushSystemMessage(title, content, systemTargetUsers, []string{user.FUID}); err != nil {
+			log.Error("发送安全提醒系统消息失败: ", err)
+		}
+	}()
+	if cfg.Business.Notify.Ntfy.Enable {
+		go sendNtfyNotification(title, content, user.FUID)
+	}
+	sendMailAsync(user.Email, fmt.Sprintf("【%s】%s", cfg.App.Name, title),
+		fmt.Sprintf("%s，您好：\n\n%s\n", user.Nickname, content))
+}
+
+// 系统消息目标类型
+const (
+	systemTargetAll    = 1 // 全体用户
+	systemTargetUsers  = 2 // 指定用户
+	systemTargetGroups = 3 // 指定群聊
+)
+
+// 全体用户房间（实时连接上线时加入）
+const systemRoomAll = "system:all"
+
+// 发送系统消息：保存到系统消息表并向目标房间推送system_message事件，返回消息ID
+func pushSystemMessage(title, content string, targetType uint8, targetIDs []string) (string, error) {
+	msgID, err := generateUniqueID(32)
+	if err != nil {
+		return "", err
+	}
+	message := SystemMessage{
+		MsgID:        msgID,
+		Title:        title,
+		Content:      content,
+		TargetType:   targetType,
+		TargetIDs:    strings.Join(targetIDs, ","),
+		SendCount:    1,
+		MaxSendCount: 1,
+		Status:       2,
+	}
+	if err := db.Create(&message).Error; err != nil {
+		return "", err
+	}
+	data := map[string]interface{}{
+		"msg_id":    msgID,
+		"title":     title,
+		"content":   content,
+		"send_time": message.CreatedAt.Format("2006-01-02 15:04:05"),
+	}
+	switch targetType {
+	case systemTargetAll:
+		broadcastToRoom(systemRoomAll, "system_message", data)
+	case systemTargetUsers:
+		for _, fuid := range targetIDs {
+			broadcastToRoom("user:"+fuid, "system_message", data)
+		}
+	case systemTargetGroups:
+		for _, quid := range targetIDs {
+			broadcastToRoom("group:"+quid, "system_message", data)
+		}
+	}
+	return msgID, nil
+}
+
+// 查询登录历史（成功与失败的登录记录，按时间倒序）
+func getLoginHistoryHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	page, size := pageParams(c)
+	query := db.Model(&LoginHistory{}).Where("user_fuid = ?", currentFUID)
+	var total int64
+	query.Count(&total)
+	var records []LoginHistory
+	if err := query.Order("id DESC").Offset((page - 1) * size).Limit(size).Find(&records).Error; err != nil {
+		fail(c, 500, "查询登录历史失败")
+		return
+	}
+	list := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		item := map[string]interface{}{
+			"device_id":   record.DeviceID,
+			"device_name": record.DeviceName,
+			"device_type": record.DeviceType,
+			"ip":          record.IP,
+			"user_agent":  record.UserAgent,
+			"method":      record.Method,
+			"success":     record.Result == loginSucceed,
+			"reason":      record.Reason,
+			"risk":        []string{},
+			"created_at":  record.CreatedAt.Format("2006-01-02 15:04:05"),
+		}
+		if record.Risk != "" {
+			item["risk"] = strings.Split(record.Risk, ",")
+		}
+		list = append(list, item)
+	}
+	success(c, list, total)
+}
+
+// 定时清理过期登录历史
+func loginHistoryCleanTask() {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		days := cfg.LoginRisk.HistoryDays
+		if days <= 0 {
+			days = 90
+		}
+		result := db.Where("created_at < ?", time.Now().AddDate(0, 0, -days)).Delete(&LoginHistory{})
+		if result.Error != nil {
+			log.Error("清理登录历史失败: ", result.Error)
+		} else {
+			log.Infof("清理登录历史成功，共删除%d条", result.RowsAffected)
+		}
+	}
+}
+
+// 两步验证（TOTP，RFC 6238：HMAC-SHA1、6位、30秒时间步，允许前后各一个时间步的偏差）
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1
+)
+
+var errSecondFactor = errors.New("验证码错误")
+
+// 计算指定时间步的动态码
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// 校验动态码，返回匹配的时间步（只接受大于lastStep的时间步，防止重放）
+func matchTOTP(secretBase32, code string, lastStep int64, now time.Time) (int64, bool) {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secretBase32)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// 生成TOTP密钥（160位，base32无填充）
+func generateTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw), nil
+}
+
+// 生成otpauth配置URI（客户端据此生成二维码）
+func totpProvisioningURI(account, secret string) string {
+	issuer := cfg.Crypto.TOTP.Issuer
+	if issuer == "" {
+		issuer = cfg.App.Name
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func totpSecretAD(fuid string) string {
+	return "user_totp|" + fuid
+}
+
+// 查询用户两步验证记录并解密密钥
+func loadTOTP(fuid string) (*UserTOTP, string, error) {
+	var record UserTOTP
+	if err := db.Where("user_fuid = ?", fuid).First(&record).Error; err != nil {
+		return nil, "", err
+	}
+	secret, err := openAtRest(record.Secret, record.SecretKeyID, totpSecretAD(fuid))
+	if err != nil {
+		return nil, "", err
+	}
+	return &record, secret, nil
+}
+
+// 用户是否已开启两步验证
+func totpEnabled(fuid string) bool {
+	var count int64
+	db.Model(&UserTOTP{}).Where("user_fuid = ? AND status = 1", fuid).Count(&count)
+	return count > 0
+}
+
+// 校验动态码并记录时间步（条件更新保证同一动态码只能使用一次）
+func consumeTOTPCode(fuid, code string) error {
+	record, secret, err := loadTOTP(fuid)
+	if err != nil {
+		return errSecondFactor
+	}
+	step, ok := matchTOTP(secret, code, record.LastUsedStep, time.Now())
+	if !ok {
+		return errSecondFactor
+	}
+	result := db.Model(&UserTOTP{}).Where("id = ? AND last_used_step < ?", record.ID, step).Update("last_used_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return errSecondFactor
+	}
+	return nil
+}
+
+// 恢复码规范化（忽略大小写、空格及连字符）
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// 使用恢复码（单次有效）
+func consumeRecoveryCode(fuid, code string) error {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	result := db.Model(&RecoveryCode{}).
+		Where("user_fuid = ? AND code_hash = ? AND used_at IS NULL", fuid, hex.EncodeToString(sum[:])).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return errSecondFactor
+	}
+	return nil
+}
+
+// 校验第二因素（动态码或恢复码其一），返回所用方式
+func verifySecondFactor(fuid, code, recoveryCode string) (string, error) {
+	switch {
+	case code != "":
+		return "totp", consumeTOTPCode(fuid, code)
+	case recoveryCode != "":
+		return "recovery_code", consumeRecoveryCode(fuid, recoveryCode)
+	default:
+		return "", errors.New("请提供验证码或恢复码")
+	}
+}
+
+// 敏感操作前重新验证身份：校验密码，开启两步验证且secondFactor为true时还须校验动态码或恢复码；
+// 验证失败时已写入响应，返回false
+func reauthenticate(c *gin.Context, fuid, password, code, recoveryCode string, secondFactor bool) bool {
+	var user User
+	if err := db.Where("fuid = ?", fuid).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return false
+	}
+	if !verifyPassword(password, user.Password) {
+		fail(c, 401, "密码错误")
+		return false
+	}
+	if secondFactor && totpEnabled(fuid) {
+		if _, err := verifySecondFactor(fuid, code, recoveryCode); err != nil {
+			fail(c, 401, err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// 重新生成恢复码（旧恢复码全部作废），返回明文（只展示一次）
+func regenerateRecoveryCodes(tx *gorm.DB, fuid string) ([]string, error) {
+	if err := tx.Where("user_fuid = ?", fuid).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	count := cfg.Crypto.TOTP.RecoveryCodes
+	if count <= 0 {
+		count = 10
+	}
+	codes := make([]string, 0, count)
+	records := make([]RecoveryCode, 0, count)
+	for i := 0; i < count; i++ {
+		raw := make([]byte, 5)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(raw)
+		sum := sha256.Sum256([]byte(code))
+		codes = append(codes, code[:5]+"-"+code[5:])
+		records = append(records, RecoveryCode{UserFUID: fuid, CodeHash: hex.EncodeToString(sum[:])})
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// 剩余可用恢复码数量
+func countRecoveryCodes(fuid string) int64 {
+	var count int64
+	db.Model(&RecoveryCode{}).Where("user_fuid = ? AND used_at IS NULL", fuid).Count(&count)
+	return count
+}
+
+// 两步验证临时登录令牌有效期（秒）
+func mfaLoginTokenExpire() int {
+	if cfg.Crypto.TOTP.LoginTokenExpire > 0 {
+		return cfg.Crypto.TOTP.LoginTokenExpire
+	}
+	return 300
+}
+
+// 签发两步验证临时登录令牌（密码验证通过后使用，单次有效）
+func issueMFALoginToken(fuid, deviceName, deviceType string) (string, int, error) {
+	token, err := generateUniqueID(48)
+	if err != nil {
+		return "", 0, err
+	}
+	expire := mfaLoginTokenExpire()
+	payload, _ := json.Marshal(map[string]string{
+		"fuid":        fuid,
+		"device_name": deviceName,
+		"device_type": deviceType,
+	})
+	if err := rdb.Set(context.Background(), "mfa_login:"+token, payload, time.Duration(expire)*time.Second).Err(); err != nil {
+		return "", 0, err
+	}
+	return token, expire, nil
+}
+
+// 两步验证登录接口（第二步）：校验临时令牌与动态码/恢复码后完成登录
+func mfaLoginHandler(c *gin.Context) {
+	var req struct {
+		MFAToken     string `json:"mfa_token" binding:"required"`
+		Code         string `json:"code" binding:"omitempty,numeric,len=6"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	ctx := context.Background()
+	tokenKey := "mfa_login:" + req.MFAToken
+	data, err := rdb.Get(ctx, tokenKey).Result()
+	if err != nil {
+		fail(c, 401, "临时令牌无效或已过期，请重新登录")
+		return
+	}
+	var pending struct {
+		FUID       string `json:"fuid"`
+		DeviceName string `json:"device_name"`
+		DeviceType string `json:"device_type"`
+	}
+	if err := json.Unmarshal([]byte(data), &pending); err != nil {
+		fail(c, 401, "临时令牌无效或已过期，请重新登录")
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ? AND status = 1", pending.FUID).First(&user).Error; err != nil {
+		fail(c, 403, "账号已被禁用")
+		return
+	}
+	// 与密码登录共用锁定状态（动态码错误同样计入失败次数），锁定后临时令牌作废
+	if locked := loginLockedFor(user.FUID); locked > 0 {
+		rdb.Del(ctx, tokenKey, "mfa_login_attempts:"+req.MFAToken)
+		fail(c, 423, fmt.Sprintf("登录失败次数过多，账号已临时锁定，请%d分钟后再试", int(locked.Minutes())+1))
+		return
+	}
+
+	method, err := verifySecondFactor(user.FUID, req.Code, req.RecoveryCode)
+	if err != nil {
+		// 超过最大尝试次数后临时令牌作废，须重新输入密码
+		maxAttempts := cfg.Crypto.TOTP.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = 5
+		}
+		attemptsKey := "mfa_login_attempts:" + req.MFAToken
+		attempts, _ := rdb.Incr(ctx, attemptsKey).Result()
+		rdb.Expire(ctx, attemptsKey, time.Duration(mfaLoginTokenExpire()+60)*time.Second)
+		if attempts >= int64(maxAttempts) {
+			rdb.Del(ctx, tokenKey, attemptsKey)
+		}
+		auditSecurityEvent(c, user.FUID, "login_2fa_failed", map[string]interface{}{"attempts": attempts})
+		recordLoginFailure(c, &user, pending.DeviceName, pending.DeviceType, "totp", "wrong_2fa")
+		fail(c, 401, err.Error())
+		return
+	}
+	// 临时令牌单次有效（并发提交时只有一个请求能完成登录）
+	if deleted, _ := rdb.Del(ctx, tokenKey).Result(); deleted == 0 {
+		fail(c, 401, "临时令牌无效或已过期，请重新登录")
+		return
+	}
+	rdb.Del(ctx, "mfa_login_attempts:"+req.MFAToken)
+	fields := map[string]interface{}{"method": method}
+	if method == "recovery_code" {
+		fields["recovery_codes_remaining"] = countRecoveryCodes(user.FUID)
+	}
+	auditSecurityEvent(c, user.FUID, "login_2fa_passed", fields)
+	completeLogin(c, &user, pending.DeviceName, pending.DeviceType, method)
+}
+
+// 查询两步验证状态
+func totpStatusHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var record UserTOTP
+	enabled := false
+	if err := db.Where("user_fuid = ?", currentFUID).First(&record).Error; err == nil {
+		enabled = record.Status == 1
+	}
+	result := map[string]interface{}{"enabled": enabled}
+	if enabled {
+		result["confirmed_at"] = record.ConfirmedAt
+		result["recovery_codes_remaining"] = countRecoveryCodes(currentFUID)
+	}
+	success(c, result)
+}
+
+// 开始绑定两步验证：校验密码，生成密钥及配置URI（确认前不生效）
+func totpEnrollHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if !verifyPassword(req.Password, user.Password) {
+		fail(c, 401, "密码错误")
+		return
+	}
+	if totpEnabled(currentFUID) {
+		fail(c, 409, "已开启两步验证，如需更换请先关闭")
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		fail(c, 500, "生成密钥失败")
+		return
+	}
+	sealed, keyID, err := sealAtRest(secret, totpSecretAD(currentFUID))
+	if err != nil {
+		fail(c, 500, "保存密钥失败")
+		return
+	}
+	// 覆盖未确认的旧记录
+	record := UserTOTP{UserFUID: currentFUID, Secret: sealed, SecretKeyID: keyID, Status: 0}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_fuid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "secret_key_id", "status", "last_used_step", "updated_at"}),
+	}).Create(&record).Error
+	if err != nil {
+		fail(c, 500, "保存密钥失败")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "2fa_enroll_started", nil)
+	success(c, map[string]interface{}{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(user.Username, secret),
+		"digits":           totpDigits,
+		"period":           totpPeriod,
+	})
+}
+
+// 确认绑定两步验证：校验动态码后启用，并返回恢复码
+func totpConfirmHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required,numeric,len=6"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	record, secret, err := loadTOTP(currentFUID)
+	if err != nil {
+		fail(c, 404, "请先开始绑定两步验证")
+		return
+	}
+	if record.Status == 1 {
+		fail(c, 409, "两步验证已开启")
+		return
+	}
+	step, ok := matchTOTP(secret, req.Code, record.LastUsedStep, time.Now())
+	if !ok {
+		auditSecurityEvent(c, currentFUID, "2fa_confirm_failed", nil)
+		fail(c, 401, errSecondFactor.Error())
+		return
+	}
+
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&UserTOTP{}).Where("id = ? AND status = 0", record.ID).
+			Updates(map[string]interface{}{"status": 1, "last_used_step": step, "confirmed_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("两步验证状态已变化")
+		}
+		var err error
+		codes, err = regenerateRecoveryCodes(tx, currentFUID)
+		return err
+	})
+	if err != nil {
+		fail(c, 500, "开启两步验证失败")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "2fa_enabled", nil)
+	success(c, map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// 关闭两步验证：须同时校验密码与动态码/恢复码
+func totpDisableHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Password     string `json:"password" binding:"required"`
+		Code         string `json:"code" binding:"omitempty,numeric,len=6"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if !totpEnabled(currentFUID) {
+		fail(c, 400, "未开启两步验证")
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if !verifyPassword(req.Password, user.Password) {
+		fail(c, 401, "密码错误")
+		return
+	}
+	method, err := verifySecondFactor(currentFUID, req.Code, req.RecoveryCode)
+	if err != nil {
+		auditSecurityEvent(c, currentFUID, "2fa_disable_failed", nil)
+		fail(c, 401, err.Error())
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_fuid = ?", currentFUID).Delete(&UserTOTP{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_fuid = ?", currentFUID).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		fail(c, 500, "关闭两步验证失败")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "2fa_disabled", map[string]interface{}{"method": method})
+	success(c, nil)
+}
+
+// 重新生成恢复码：须校验动态码，旧恢复码全部作废
+func regenerateRecoveryCodesHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required,numeric,len=6"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if !totpEnabled(currentFUID) {
+		fail(c, 400, "未开启两步验证")
+		return
+	}
+	if err := consumeTOTPCode(currentFUID, req.Code); err != nil {
+		auditSecurityEvent(c, currentFUID, "2fa_recovery_codes_failed", nil)
+		fail(c, 401, err.Error())
+		return
+	}
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = regenerateRecoveryCodes(tx, currentFUID)
+		return err
+	})
+	if err != nil {
+		fail(c, 500, "生成恢复码失败")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "2fa_recovery_codes_regenerated", nil)
+	success(c, map[string]interface{}{"recovery_codes": codes})
+}
+
+// WebAuthn/通行密钥（passkey）
+//
+// 仅支持attestation为none的注册（不校验认证器型号），签名算法支持ES256(-7)、EdDSA(-8)、RS256(-257)。
+// 注册及登录挑战保存在Redis中，单次有效。
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// authenticatorData标志位
+const (
+	authDataFlagUP = 0x01 // 用户在场
+	authDataFlagUV = 0x04 // 用户已验证
+	authDataFlagAT = 0x40 // 包含凭证数据
+)
+
+var errCBOR = errors.New("CBOR数据格式错误")
+
+// 最小CBOR解码（RFC 8949，仅支持WebAuthn用到的类型：整数、字节串、文本、数组、映射、简单值），返回值及剩余数据
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(data, 0)
+}
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > 16 {
+		return nil, nil, errCBOR
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, errCBOR // 不支持不定长编码
+	}
+	switch major {
+	case 0:
+		if arg > 1<<62 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > 1<<62 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		value := data[:arg]
+		if major == 3 {
+			return string(value), data[arg:], nil
+		}
+		return append([]byte(nil), value...), data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = cborDecodeDepth(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			var err error
+			if key, data, err = cborDecodeDepth(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			if value, data, err = cborDecodeDepth(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+	}
+	return nil, nil, errCBOR
+}
+
+// COSE公钥（已解析，可验证签名）
+type coseKey struct {
+	alg    int64
+	verify func(data, sig []byte) bool
+}
+
+// 解析COSE_Key（RFC 9053）
+func parseCOSEKey(raw []byte) (*coseKey, error) {
+	value, _, err := cborDecode(raw)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("公钥格式错误")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	switch {
+	case alg == coseAlgES256 && kty == 2 && crv == 1:
+		y, _ := m[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("公钥格式错误")
+		}
+		point := append(append([]byte{0x04}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, errors.New("公钥不在曲线上")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return &coseKey{alg: alg, verify: func(data, sig []byte) bool {
+			digest := sha256.Sum256(data)
+			return ecdsa.VerifyASN1(pub, digest[:], sig)
+		}}, nil
+	case alg == coseAlgEdDSA && kty == 1 && crv == 6:
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("公钥格式错误")
+		}
+		pub := ed25519.PublicKey(x)
+		return &coseKey{alg: alg, verify: func(data, sig []byte) bool {
+			return ed25519.Verify(pub, data, sig)
+		}}, nil
+	case alg == coseAlgRS256 && kty == 3:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("公钥格式错误")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return &coseKey{alg: alg, verify: func(data, sig []byte) bool {
+			digest := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+		}}, nil
+	}
+	return nil, fmt.Errorf("不支持的公钥算法: kty=%d, alg=%d", kty, alg)
+}
+
+// 解析后的authenticatorData
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte // 仅注册时存在
+	publicKey    []byte // COSE_Key原始数据，仅注册时存在
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("认证器数据格式错误")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if ad.flags&authDataFlagAT == 0 {
+		return ad, nil
+	}
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("认证器数据格式错误")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+		return nil, errors.New("凭证ID格式错误")
+	}
+	ad.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+	_, after, err := cborDecode(rest)
+	if err != nil {
+		return nil, errors.New("凭证公钥格式错误")
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// 信赖方ID
+func webAuthnRPID() string {
+	if cfg.Crypto.WebAuthn.RPID != "" {
+		return cfg.Crypto.WebAuthn.RPID
+	}
+	return "localhost"
+}
+
+// 校验authenticatorData中的信赖方及用户在场/验证标志
+func checkAuthenticatorData(ad *authenticatorData) error {
+	rpHash := sha256.Sum256([]byte(webAuthnRPID()))
+	if !hmac.Equal(ad.rpIDHash, rpHash[:]) {
+		return errors.New("信赖方ID不匹配")
+	}
+	if ad.flags&authDataFlagUP == 0 {
+		return errors.New("未检测到用户在场")
+	}
+	if cfg.Crypto.WebAuthn.UserVerification == "required" && ad.flags&authDataFlagUV == 0 {
+		return errors.New("未完成用户验证")
+	}
+	return nil
+}
+
+// 校验clientDataJSON（类型、挑战、来源），返回其中的挑战值
+func checkClientData(raw []byte, expectedType string) (string, error) {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return "", errors.New("客户端数据格式错误")
+	}
+	if clientData.Type != expectedType {
+		return "", errors.New("客户端数据类型错误")
+	}
+	origins := cfg.Crypto.WebAuthn.Origins
+	if len(origins) == 0 {
+		origins = cfg.App.CORS.AllowOrigins
+	}
+	allowed := false
+	for _, origin := range origins {
+		if clientData.Origin == origin {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", errors.New("来源不在允许列表中")
+	}
+	return clientData.Challenge, nil
+}
+
+// base64url解码（兼容带填充）
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// 生成挑战并保存到Redis（单次有效），value为挑战所属用户（登录挑战可为空）
+func newWebAuthnChallenge(kind, fuid string) (string, int, error) {
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", 0, err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+	expire := cfg.Crypto.WebAuthn.ChallengeExpire
+	if expire <= 0 {
+		expire = 120
+	}
+	key := fmt.Sprintf("webauthn:%s:%s", kind, challenge)
+	if err := rdb.Set(context.Background(), key, fuid, time.Duration(expire)*time.Second).Err(); err != nil {
+		return "", 0, err
+	}
+	return challenge, expire, nil
+}
+
+// 取出并删除挑战，返回挑战所属用户
+func takeWebAuthnChallenge(kind, challenge string) (string, bool) {
+	fuid, err := rdb.GetDel(context.Background(), fmt.Sprintf("webauthn:%s:%s", kind, challenge)).Result()
+	if err != nil {
+		return "", false
+	}
+	return fuid, true
+}
+
+func webAuthnUserVerification() string {
+	if cfg.Crypto.WebAuthn.UserVerification != "" {
+		return cfg.Crypto.WebAuthn.UserVerification
+	}
+	return "preferred"
+}
+
+// 开始注册通行密钥：重新验证密码（开启两步验证时还须校验动态码或恢复码），返回PublicKeyCredentialCreationOptions
+func passkeyRegisterBeginHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Password     string `json:"password" binding:"required"`
+		Code         string `json:"code" binding:"omitempty,numeric,len=6"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if !reauthenticate(c, currentFUID, req.Password, req.Code, req.RecoveryCode, true) {
+		auditSecurityEvent(c, currentFUID, "passkey_reauth_failed", nil)
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	challenge, expire, err := newWebAuthnChallenge("reg", currentFUID)
+	if err != nil {
+		fail(c, 500, "生成挑战失败")
+		return
+	}
+	// 排除已注册的凭证，避免同一认证器重复注册
+	var existing []WebAuthnCredential
+	db.Where("user_fuid = ?", currentFUID).Find(&existing)
+	exclude := make([]map[string]interface{}, 0, len(existing))
+	for _, cred := range existing {
+		exclude = append(exclude, map[string]interface{}{"type": "public-key", "id": cred.CredentialID})
+	}
+	rpName := cfg.Crypto.WebAuthn.RPName
+	if rpName == "" {
+		rpName = cfg.App.Name
+	}
+	success(c, map[string]interface{}{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": webAuthnRPID(), "name": rpName},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(user.FUID)),
+			"name":        user.Username,
+			"displayName": user.Nickname,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgEdDSA},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"timeout":            expire * 1000,
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": webAuthnUserVerification(),
+		},
+	})
+}
+
+// 完成注册通行密钥：再次校验密码；第二因素已在开始注册时校验，注册挑战只在校验通过后签发且单次有效、绑定用户
+func passkeyRegisterFinishHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Password          string   `json:"password" binding:"required"`
+		ClientDataJSON    string   `json:"client_data_json" binding:"required"`   // base64url
+		AttestationObject string   `json:"attestation_object" binding:"required"` // base64url
+		Name              string   `json:"name" binding:"max=64"`
+		Transports        []string `json:"transports"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if !reauthenticate(c, currentFUID, req.Password, "", "", false) {
+		auditSecurityEvent(c, currentFUID, "passkey_reauth_failed", nil)
+		return
+	}
+	clientDataRaw, err1 := decodeBase64URL(req.ClientDataJSON)
+	attestationRaw, err2 := decodeBase64URL(req.AttestationObject)
+	if err1 != nil || err2 != nil {
+		fail(c, 400, "参数编码错误")
+		return
+	}
+	challenge, err := checkClientData(clientDataRaw, "webauthn.create")
+	if err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+	if owner, ok := takeWebAuthnChallenge("reg", challenge); !ok || owner != currentFUID {
+		fail(c, 400, "挑战无效或已过期")
+		return
+	}
+
+	value, _, err := cborDecode(attestationRaw)
+	attestation, ok := value.(map[interface{}]interface{})
+	if err != nil || !ok {
+		fail(c, 400, "注册数据格式错误")
+		return
+	}
+	if format, _ := attestation["fmt"].(string); format != "none" {
+		fail(c, 400, "仅支持attestation为none的注册")
+		return
+	}
+	authDataRaw, _ := attestation["authData"].([]byte)
+	authData, err := parseAuthenticatorData(authDataRaw)
+	if err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+	if err := checkAuthenticatorData(authData); err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+	if authData.credentialID == nil {
+		fail(c, 400, "注册数据缺少凭证")
+		return
+	}
+	key, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "通行密钥"
+	}
+	credential := WebAuthnCredential{
+		UserFUID:     currentFUID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(authData.credentialID),
+		PublicKey:    base64.StdEncoding.EncodeToString(authData.publicKey),
+		Algorithm:    int(key.alg),
+		SignCount:    authData.signCount,
+		Name:         name,
+		Transports:   strings.Join(req.Transports, ","),
+	}
+	if err := db.Create(&credential).Error; err != nil {
+		fail(c, 409, "该通行密钥已注册")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "passkey_registered", map[string]interface{}{"credential_id": credential.CredentialID})
+	success(c, map[string]interface{}{
+		"id":         credential.ID,
+		"name":       credential.Name,
+		"created_at": credential.CreatedAt.Format("2006-01-02 15:04:05"),
+	})
+}
+
+// 获取当前用户的通行密钥列表
+func listPasskeysHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var credentials []WebAuthnCredential
+	db.Where("user_fuid = ?", currentFUID).Order("created_at DESC").Find(&credentials)
+	list := make([]map[string]interface{}, 0, len(credentials))
+	for _, cred := range credentials {
+		item := map[string]interface{}{
+			"id":            cred.ID,
+			"credential_id": cred.CredentialID,
+			"name":          cred.Name,
+			"algorithm":     cred.Algorithm,
+			"created_at":    cred.CreatedAt.Format("2006-01-02 15:04:05"),
+			"last_used_at":  nil,
+		}
+		if cred.LastUsedAt != nil {
+			item["last_used_at"] = cred.LastUsedAt.Format("2006-01-02 15:04:05")
+		}
+		list = append(list, item)
+	}
+	success(c, list, int64(len(list)))
+}
+
+// 删除通行密钥：重新验证密码（开启两步验证时还须校验动态码或恢复码）
+func deletePasskeyHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Password     string `json:"password" binding:"required"`
+		Code         string `json:"code" binding:"omitempty,numeric,len=6"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if !reauthenticate(c, currentFUID, req.Password, req.Code, req.RecoveryCode, true) {
+		auditSecurityEvent(c, currentFUID, "passkey_reauth_failed", nil)
+		return
+	}
+	result := db.Where("id = ? AND user_fuid = ?", c.Param("id"), currentFUID).Delete(&WebAuthnCredential{})
+	if result.Error != nil {
+		fail(c, 500, "删除失败")
+		return
+	}
+	if result.RowsAffected == 0 {
+		fail(c, 404, "通行密钥不存在")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "passkey_deleted", map[string]interface{}{"id": c.Param("id")})
+	success(c, nil)
+}
+
+// 开始通行密钥登录：返回PublicKeyCredentialRequestOptions（不传账号时由认证器选择可发现凭证）
+func passkeyLoginBeginHandler(c *gin.Context) {
+	var req struct {
+		Account string `json:"account"` // 用户名/邮箱/FUID（可选）
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	allow := make([]map[string]interface{}, 0)
+	fuid := ""
+	if req.Account != "" {
+		var user User
+		if err := db.Where("username = ? OR email = ? OR fuid = ?", req.Account, req.Account, req.Account).First(&user).Error; err == nil {
+			fuid = user.FUID
+			var credentials []WebAuthnCredential
+			db.Where("user_fuid = ?", user.FUID).Find(&credentials)
+			for _, cred := range credentials {
+				item := map[string]interface{}{"type": "public-key", "id": cred.CredentialID}
+				if cred.Transports != "" {
+					item["transports"] = strings.Split(cred.Transports, ",")
+				}
+				allow = append(allow, item)
+			}
+		}
+		// 账号不存在或未注册通行密钥时同样返回挑战，不泄露账号信息
+	}
+	challenge, expire, err := newWebAuthnChallenge("login", fuid)
+	if err != nil {
+		fail(c, 500, "生成挑战失败")
+		return
+	}
+	success(c, map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             webAuthnRPID(),
+		"timeout":          expire * 1000,
+		"userVerification": webAuthnUserVerification(),
+		"allowCredentials": allow,
+	})
+}
+
+// 完成通行密钥登录：校验断言签名后创建设备并签发令牌（与密码登录相同）
+func passkeyLoginFinishHandler(c *gin.Context) {
+	var req struct {
+		CredentialID      string `json:"credential_id" binding:"required"`      // base64url
+		ClientDataJSON    string `json:"client_data_json" binding:"required"`   // base64url
+		AuthenticatorData string `json:"authenticator_data" binding:"required"` // base64url
+		Signature         string `json:"signature" binding:"required"`          // base64url
+		UserHandle        string `json:"user_handle"`                           // base64url
+		DeviceName        string `json:"device_name" binding:"required"`
+		DeviceType        string `json:"device_type" binding:"required,oneof=phone pc web app"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	clientDataRaw, err1 := decodeBase64URL(req.ClientDataJSON)
+	authDataRaw, err2 := decodeBase64URL(req.AuthenticatorData)
+	signature, err3 := decodeBase64URL(req.Signature)
+	credentialID, err4 := decodeBase64URL(req.CredentialID)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		fail(c, 400, "参数编码错误")
+		return
+	}
+	challenge, err := checkClientData(clientDataRaw, "webauthn.get")
+	if err != nil {
+		fail(c, 401, err.Error())
+		return
+	}
+	expectedFUID, ok := takeWebAuthnChallenge("login", challenge)
+	if !ok {
+		fail(c, 401, "挑战无效或已过期")
+		return
+	}
+
+	var credential WebAuthnCredential
+	if err := db.Where("credential_id = ?", base64.RawURLEncoding.EncodeToString(credentialID)).First(&credential).Error; err != nil {
+		fail(c, 401, "通行密钥未注册")
+		return
+	}
+	if expectedFUID != "" && expectedFUID != credential.UserFUID {
+		fail(c, 401, "通行密钥与账号不匹配")
+		return
+	}
+	if req.UserHandle != "" {
+		if handle, err := decodeBase64URL(req.UserHandle); err != nil || string(handle) != credential.UserFUID {
+			fail(c, 401, "通行密钥与账号不匹配")
+			return
+		}
+	}
+
+	authData, err := parseAuthenticatorData(authDataRaw)
+	if err != nil {
+		fail(c, 401, err.Error())
+		return
+	}
+	if err := checkAuthenticatorData(authData); err != nil {
+		fail(c, 401, err.Error())
+		return
+	}
+	publicKey, _ := base64.StdEncoding.DecodeString(credential.PublicKey)
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		fail(c, 500, "通行密钥公钥损坏")
+		return
+	}
+	clientDataHash := sha256.Sum256(clientDataRaw)
+	signed := append(append([]byte(nil), authDataRaw...), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		auditSecurityEvent(c, credential.UserFUID, "passkey_login_failed", map[string]interface{}{"credential_id": credential.CredentialID})
+		fail(c, 401, "通行密钥签名无效")
+		return
+	}
+	// 签名计数器未递增说明凭证可能被克隆（计数器均为0表示认证器不支持计数）
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		auditSecurityEvent(c, credential.UserFUID, "passkey_counter_regressed", map[string]interface{}{
+			"credential_id": credential.CredentialID,
+			"stored":        credential.SignCount,
+			"received":      authData.signCount,
+		})
+		fail(c, 401, "通行密钥异常，请使用其他方式登录")
+		return
+	}
+
+	var user User
+	if err := db.Where("fuid = ?", credential.UserFUID).First(&user).Error; err != nil {
+		fail(c, 401, "用户不存在")
+		return
+	}
+	if user.Status == 0 {
+		fail(c, 403, "账号已被禁用")
+		return
+	}
+	now := time.Now()
+	if authData.signCount == 0 {
+		// 认证器不支持计数
+		db.Model(&credential).Update("last_used_at", now)
+	} else {
+		// 条件更新：并发提交同一断言或克隆凭证时只有计数器更大的一次能成功
+		result := db.Model(&WebAuthnCredential{}).Where("id = ? AND sign_count < ?", credential.ID, authData.signCount).
+			Updates(map[string]interface{}{"sign_count": authData.signCount, "last_used_at": now})
+		if result.Error != nil {
+			fail(c, 500, "登录失败")
+			return
+		}
+		if result.RowsAffected == 0 {
+			auditSecurityEvent(c, credential.UserFUID, "passkey_counter_regressed", map[string]interface{}{
+				"credential_id": credential.CredentialID,
+				"received":      authData.signCount,
+			})
+			fail(c, 401, "通行密钥异常，请使用其他方式登录")
+			return
+		}
+	}
+	completeLogin(c, &user, req.DeviceName, req.DeviceType, "passkey")
+}
+
+// 邮件令牌用途
+const (
+	mailPurposeVerify = "verify_email"
+	mailPurposeChange = "change_email"
+	mailPurposeReset  = "reset_password"
+)
+
+// 邮件令牌签名密钥（initMailer中设置）
+var mailTokenKey []byte
+
+var errMailToken = errors.New("链接无效或已过期")
+
+// 邮件令牌声明：令牌为 base64url(声明JSON) + "." + base64url(HMAC-SHA256)，
+// 同时在Redis中登记nonce，保证单次有效；同一用户同一用途只有最新签发的令牌有效
+type mailTokenClaims struct {
+	Purpose string `json:"p"`
+	FUID    string `json:"f"`
+	Email   string `json:"e"`
+	Nonce   string `json:"n"`
+	Exp     int64  `json:"x"`
+}
+
+func signMailToken(payload []byte) string {
+	mac := hmac.New(sha256.New, mailTokenKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 签发邮件令牌
+func issueMailToken(purpose, fuid, email string, ttl time.Duration) (string, error) {
+	nonce, err := generateUniqueID(24)
+	if err != nil {
+		return "", err
+	}
+	claims := mailTokenClaims{Purpose: purpose, FUID: fuid, Email: email, Nonce: nonce, Exp: time.Now().Add(ttl).Unix()}
+	payload, _ := json.Marshal(claims)
+	ctx := context.Background()
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, "mail_token:"+nonce, purpose, ttl)
+	pipe.Set(ctx, fmt.Sprintf("mail_token_latest:%s:%s", purpose, fuid), nonce, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + signMailToken(payload), nil
+}
+
+// 校验签名与有效期（不消耗令牌）
+func parseMailToken(token string) (*mailTokenClaims, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errMailToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || !hmac.Equal([]byte(signMailToken(payload)), []byte(parts[1])) {
+		return nil, errMailToken
+	}
+	var claims mailTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || time.Now().Unix() > claims.Exp {
+		return nil, errMailToken
+	}
+	return &claims, nil
+}
+
+// 校验并消耗邮件令牌
+func consumeMailToken(token string, purposes ...string) (*mailTokenClaims, error) {
+	claims, err := parseMailToken(token)
+	if err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, p := range purposes {
+		if claims.Purpose == p {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, errMailToken
+	}
+	ctx := context.Background()
+	latest, _ := rdb.Get(ctx, fmt.Sprintf("mail_token_latest:%s:%s", claims.Purpose, claims.FUID)).Result()
+	if latest != claims.Nonce {
+		return nil, errMailToken
+	}
+	if purpose, err := rdb.GetDel(ctx, "mail_token:"+claims.Nonce).Result(); err != nil || purpose != claims.Purpose {
+		return nil, errMailToken
+	}
+	rdb.Del(ctx, fmt.Sprintf("mail_token_latest:%s:%s", claims.Purpose, claims.FUID))
+	return claims, nil
+}
+
+// 邮件发送冷却（同一用户同一用途间隔不少于60秒），返回是否允许发送
+func mailCooldown(purpose, fuid string) bool {
+	ok, err := rdb.SetNX(context.Background(), fmt.Sprintf("mail_cooldown:%s:%s", purpose, fuid), 1, 60*time.Second).Result()
+	return err == nil && ok
+}
+
+func mailTokenTTL(seconds, fallback int) time.Duration {
+	if seconds <= 0 {
+		seconds = fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// 发送邮箱验证邮件（注册、更换邮箱共用）
+func sendVerificationMail(user *User, purpose, email string) error {
+	ttl := mailTokenTTL(cfg.Mail.VerifyExpire, 86400)
+	token, err := issueMailToken(purpose, user.FUID, email, ttl)
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("【%s】请验证您的邮箱", cfg.App.Name)
+	if purpose == mailPurposeChange {
+		subject = fmt.Sprintf("【%s】请确认更换登录邮箱", cfg.App.Name)
+	}
+	body := fmt.Sprintf("%s，您好：\n\n请在%d小时内打开以下链接完成邮箱验证：\n%s\n\n如非本人操作，请忽略本邮件。\n",
+		user.Nickname, int(ttl.Hours()), mailLink("/verify-email", token))
+	sendMailAsync(email, subject, body)
+	return nil
+}
+
+// 注销用户全部设备会话（重置密码等场景）
+func revokeUserSessions(fuid, reason string) {
+	var devices []Device
+	db.Where("user_fuid = ? AND status = 1", fuid).Find(&devices)
+	for _, device := range devices {
+		if err := revokeDeviceSession(fuid, device.DeviceID, reason); err != nil {
+			log.Errorf("注销设备会话失败: fuid=%s, device_id=%s, err=%v", fuid, device.DeviceID, err)
+		}
+	}
+	// 未在线设备的刷新令牌同样吊销
+	db.Model(&RefreshToken{}).Where("user_fuid = ? AND status IN ?", fuid, []uint8{1, 2}).Update("status", 3)
+}
+
+// 验证邮箱接口（注册验证与更换邮箱确认共用）
+func verifyEmailHandler(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	claims, err := consumeMailToken(req.Token, mailPurposeVerify, mailPurposeChange)
+	if err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ? AND status = 1", claims.FUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在或已被禁用")
+		return
+	}
+
+	if claims.Purpose == mailPurposeVerify {
+		if user.Email != claims.Email {
+			fail(c, 400, "邮箱已变更，请重新发送验证邮件")
+			return
+		}
+		db.Model(&user).Update("email_verified", 1)
+		auditSecurityEvent(c, user.FUID, "email_verified", map[string]interface{}{"email": claims.Email})
+		success(c, map[string]interface{}{"email": claims.Email, "email_verified": true})
+		return
+	}
+
+	// 更换邮箱
+	var count int64
+	db.Model(&User{}).Where("email = ? AND fuid <> ?", claims.Email, user.FUID).Count(&count)
+	if count > 0 {
+		fail(c, 409, "该邮箱已被其他账号使用")
+		return
+	}
+	oldEmail := user.Email
+	if err := db.Model(&user).Updates(map[string]interface{}{"email": claims.Email, "email_verified": 1}).Error; err != nil {
+		fail(c, 500, "更换邮箱失败")
+		return
+	}
+	sendMailAsync(oldEmail, fmt.Sprintf("【%s】登录邮箱已更换", cfg.App.Name),
+		fmt.Sprintf("%s，您好：\n\n您的账号登录邮箱已更换为 %s。如非本人操作，请立即重置密码并联系客服。\n", user.Nickname, claims.Email))
+	auditSecurityEvent(c, user.FUID, "email_changed", map[string]interface{}{"old_email": oldEmail, "new_email": claims.Email})
+	success(c, map[string]interface{}{"email": claims.Email, "email_verified": true})
+}
+
+// 重新发送邮箱验证邮件
+func resendVerificationHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if user.EmailVerified == 1 {
+		fail(c, 400, "邮箱已验证")
+		return
+	}
+	if !mailCooldown(mailPurposeVerify, currentFUID) {
+		fail(c, 429, "发送过于频繁，请稍后再试")
+		return
+	}
+	if err := sendVerificationMail(&user, mailPurposeVerify, user.Email); err != nil {
+		fail(c, 500, "发送验证邮件失败")
+		return
+	}
+	success(c, nil)
+}
+
+// 申请重置密码（无论邮箱是否存在都返回成功，避免暴露账号信息）
+func requestPasswordResetHandler(c *gin.Context) {
+	var req struct {
+		Email          string `json:"email" binding:"required,email"`
+		TurnstileToken string `json:"turnstile_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if !verifyCFTurnstile(req.TurnstileToken) {
+		fail(c, 403, "人机验证失败")
+		return
+	}
+	var user User
+	if err := db.Where("email = ? AND status = 1", req.Email).First(&user).Error; err == nil && mailCooldown(mailPurposeReset, user.FUID) {
+		ttl := mailTokenTTL(cfg.Mail.ResetExpire, 1800)
+		token, err := issueMailToken(mailPurposeReset, user.FUID, user.Email, ttl)
+		if err != nil {
+			log.Errorf("签发重置密码令牌失败: fuid=%s, err=%v", user.FUID, err)
+		} else {
+			body := fmt.Sprintf("%s，您好：\n\n请在%d分钟内打开以下链接重置密码：\n%s\n\n重置后所有设备将退出登录。如非本人操作，请忽略本邮件。\n",
+				user.Nickname, int(ttl.Minutes()), mailLink("/reset-password", token))
+			sendMailAsync(user.Email, fmt.Sprintf("【%s】重置密码", cfg.App.Name), body)
+			auditSecurityEvent(c, user.FUID, "password_reset_requested", nil)
+		}
+	}
+	success(c, nil)
+}
+
+// 重置密码：校验令牌后修改密码，并注销全部设备会话
+func resetPasswordHandler(c *gin.Context) {
+	var req struct {
+		Token           string `json:"token" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required,min=6,max=20"`
+		ConfirmPassword string `json:"confirm_password" binding:"required,eqfield=NewPassword"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	claims, err := consumeMailToken(req.Token, mailPurposeReset)
+	if err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ? AND status = 1", claims.FUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在或已被禁用")
+		return
+	}
+	if user.Email != claims.Email {
+		fail(c, 400, errMailToken.Error())
+		return
+	}
+	hash, err := encryptPassword(req.NewPassword)
+	if err != nil {
+		fail(c, 500, "密码加密失败")
+		return
+	}
+	// 能收到重置邮件即证明邮箱有效
+	if err := db.Model(&user).Updates(map[string]interface{}{"password": hash, "email_verified": 1}).Error; err != nil {
+		fail(c, 500, "重置密码失败")
+		return
+	}
+	revokeUserSessions(user.FUID, "password_reset")
+	sendMailAsync(user.Email, fmt.Sprintf("【%s】密码已重置", cfg.App.Name),
+		fmt.Sprintf("%s，您好：\n\n您的账号密码已重置，所有设备已退出登录。如非本人操作，请立即联系客服。\n", user.Nickname))
+	auditSecurityEvent(c, user.FUID, "password_reset", nil)
+	success(c, nil)
+}
+
+// 申请更换邮箱：校验密码后向新邮箱发送确认链接，确认后生效
+func changeEmailHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		NewEmail string `json:"new_email" binding:"required,email,max=128"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if !verifyPassword(req.Password, user.Password) {
+		fail(c, 401, "密码错误")
+		return
+	}
+	if strings.EqualFold(req.NewEmail, user.Email) {
+		fail(c, 400, "新邮箱与当前邮箱相同")
+		return
+	}
+	var count int64
+	db.Model(&User{}).Where("email = ?", req.NewEmail).Count(&count)
+	if count > 0 {
+		fail(c, 409, "该邮箱已被其他账号使用")
+		return
+	}
+	if !mailCooldown(mailPurposeChange, currentFUID) {
+		fail(c, 429, "发送过于频繁，请稍后再试")
+		return
+	}
+	if err := sendVerificationMail(&user, mailPurposeChange, req.NewEmail); err != nil {
+		fail(c, 500, "发送确认邮件失败")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "email_change_requested", map[string]interface{}{"new_email": req.NewEmail})
+	success(c, nil)
+}
+
+// 令牌校验错误
+var (
+	errTokenSignature   = errors.New("令牌签名无效")
+	errTokenExpired     = errors.New("令牌已过期或未生效")
+	errTokenMalformed   = errors.New("令牌解析失败")
+	errTokenIssuer      = errors.New("无效的令牌签发者")
+	errTokenSubject     = errors.New("令牌类型错误")
+	errTokenRevoked     = errors.New("令牌已失效，请重新登录")
+	errTokenCheckFailed = errors.New("令牌校验失败，请稍后重试")
+)
+
+// JWT签名密钥集（RS256/EdDSA）
+//
+// 密钥目录下每个 <kid>.pem 为PKCS8私钥（可签名、可验证），<kid>.pub.pem 为已退役密钥的公钥（只验证）。
+// 签名使用 active_kid 指定的密钥，未指定时使用最新生成的私钥；所有公钥通过 /.well-known/jwks.json 公开，
+// 其他服务按令牌头中的kid选择公钥验证，无需持有任何密钥。
+type jwtKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	signer  crypto.Signer // 退役密钥为nil
+	public  crypto.PublicKey
+	modTime time.Time
+}
+
+type jwtKeySet struct {
+	mu         sync.RWMutex
+	dir        string
+	active     *jwtKey
+	keys       map[string]*jwtKey
+	dirModTime time.Time
+}
+
+var jwtKeys *jwtKeySet
+
+// 签名算法（默认EdDSA）
+func jwtAlgorithm() string {
+	if strings.EqualFold(cfg.Crypto.JWT.Algorithm, "RS256") {
+		return "RS256"
+	}
+	return "EdDSA"
+}
+
+// 从PEM解析JWT密钥
+func parseJWTKey(kid string, data []byte, publicOnly bool) (*jwtKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("PEM格式错误")
+	}
+	key := &jwtKey{kid: kid}
+	if publicOnly {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.public = pub
+	} else {
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("不支持的私钥类型")
+		}
+		key.signer = signer
+		key.public = signer.Public()
+	}
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, errors.New("仅支持RSA及Ed25519密钥")
+	}
+	return key, nil
+}
+
+// 从目录加载全部密钥
+func (ks *jwtKeySet) reload() error {
+	dirInfo, err := os.Stat(ks.dir)
+	if err != nil {
+		return fmt.Errorf("读取JWT密钥目录失败: %v", err)
+	}
+	entries, err := os.ReadDir(ks.dir)
+	if err != nil {
+		return fmt.Errorf("读取JWT密钥目录失败: %v", err)
+	}
+	keys := make(map[string]*jwtKey)
+	var newest *jwtKey
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+		publicOnly := strings.HasSuffix(name, ".pub.pem")
+		kid := strings.TrimSuffix(strings.TrimSuffix(name, ".pem"), ".pub")
+		data, err := os.ReadFile(filepath.Join(ks.dir, name))
+		if err != nil {
+			return fmt.Errorf("读取JWT密钥%s失败: %v", name, err)
+		}
+		key, err := parseJWTKey(kid, data, publicOnly)
+		if err != nil {
+			return fmt.Errorf("解析JWT密钥%s失败: %v", name, err)
+		}
+		if info, err := entry.Info(); err == nil {
+			key.modTime = info.ModTime()
+		}
+		if existing, ok := keys[kid]; ok && existing.signer != nil {
+			continue
+		}
+		keys[kid] = key
+		if key.signer != nil && key.method.Alg() == jwtAlgorithm() && (newest == nil || key.modTime.After(newest.modTime)) {
+			newest = key
+		}
+	}
+	active := newest
+	if cfg.Crypto.JWT.ActiveKID != "" {
+		key, ok := keys[cfg.Crypto.JWT.ActiveKID]
+		if !ok || key.signer == nil {
+			return fmt.Errorf("JWT签名密钥%s不存在或已退役", cfg.Crypto.JWT.ActiveKID)
+		}
+		active = key
+	}
+	if active == nil {
+		return errors.New("没有可用的JWT签名密钥")
+	}
+	ks.mu.Lock()
+	ks.keys, ks.active, ks.dirModTime = keys, active, dirInfo.ModTime()
+	ks.mu.Unlock()
+	return nil
+}
+
+// 目录有变更时重新加载（新增、退役密钥）
+func (ks *jwtKeySet) reloadIfChanged() {
+	info, err := os.Stat(ks.dir)
+	if err != nil {
+		return
+	}
+	ks.mu.RLock()
+	changed := !info.ModTime().Equal(ks.dirModTime)
+	ks.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := ks.reload(); err != nil {
+		log.Error("重新加载JWT密钥失败: ", err)
+		return
+	}
+	log.Infof("JWT密钥已重新加载，当前签名密钥: %s", ks.activeKey().kid)
+}
+
+// 生成新的签名密钥文件，返回kid
+func (ks *jwtKeySet) generate(alg string) (string, error) {
+	var priv interface{}
+	switch alg {
+	case "RS256":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return "", err
+		}
+		priv = key
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		priv = key
+	default:
+		return "", fmt.Errorf("不支持的签名算法: %s", alg)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	kid := fmt.Sprintf("%s-%x", time.Now().Format("20060102150405"), suffix)
+	if err := os.MkdirAll(ks.dir, 0700); err != nil {
+		return "", fmt.Errorf("创建JWT密钥目录失败: %v", err)
+	}
+	path := filepath.Join(ks.dir, kid+".pem")
+	if err := os.WriteFile(path+".tmp", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+// 退役密钥：删除私钥只保留公钥，已签发的令牌到期前仍可验证
+func (ks *jwtKeySet) retire(kid string) error {
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	active := ks.active
+	ks.mu.RUnlock()
+	if !ok || key.signer == nil {
+		return fmt.Errorf("密钥%s不存在或已退役", kid)
+	}
+	if active.kid == kid {
+		return errors.New("不能退役当前签名密钥，请先轮换")
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		return err
+	}
+	pubPath := filepath.Join(ks.dir, kid+".pub.pem")
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(ks.dir, kid+".pem"))
+}
+
+// 当前签名密钥
+func (ks *jwtKeySet) activeKey() *jwtKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.active
+}
+
+// 按kid查找验证密钥（未知kid时重新加载一次，兼容其他节点刚轮换的密钥）
+func (ks *jwtKeySet) lookup(kid string) (*jwtKey, bool) {
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	ks.mu.RUnlock()
+	if !ok {
+		ks.reloadIfChanged()
+		ks.mu.RLock()
+		key, ok = ks.keys[kid]
+		ks.mu.RUnlock()
+	}
+	return key, ok
+}
+
+// 初始化JWT签名密钥（目录为空时生成第一把密钥）
+func initJWTKeys() error {
+	dir := cfg.Crypto.JWT.KeyDir
+	if dir == "" {
+		dir = "./keys/jwt"
+	}
+	ks := &jwtKeySet{dir: dir}
+	if err := ks.reload(); err != nil {
+		kid, genErr := ks.generate(jwtAlgorithm())
+		if genErr != nil {
+			return fmt.Errorf("%v；生成JWT签名密钥失败: %v", err, genErr)
+		}
+		log.Infof("已生成JWT签名密钥: kid=%s, alg=%s", kid, jwtAlgorithm())
+		if err := ks.reload(); err != nil {
+			return err
+		}
+	}
+	jwtKeys = ks
+	log.Infof("JWT签名密钥加载成功: kid=%s, alg=%s, 验证密钥数=%d", ks.activeKey().kid, ks.activeKey().method.Alg(), len(ks.keys))
+	return nil
+}
+
+// 使用当前密钥签名（令牌头携带kid）
+func signJWT(claims jwt.Claims) (string, error) {
+	key := jwtKeys.activeKey()
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.signer)
+}
+
+// 令牌验证密钥查找（按kid选择公钥，算法须与密钥一致；过渡期可接受旧HS256令牌）
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if cfg.Crypto.JWT.AcceptLegacyHS256 && token.Method.Alg() == "HS256" {
+			return []byte(cfg.Crypto.JWT.Secret), nil
+		}
+		return nil, fmt.Errorf("不支持的签名方法: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("令牌缺少kid")
+	}
+	key, ok := jwtKeys.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("未知的签名密钥: %s", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("签名方法与密钥不匹配: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// 公开JWT验证公钥（JWKS）
+func jwksHandler(c *gin.Context) {
+	jwtKeys.mu.RLock()
+	kids := make([]string, 0, len(jwtKeys.keys))
+	for kid := range jwtKeys.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	keys := make([]map[string]interface{}, 0, len(kids))
+	for _, kid := range kids {
+		key := jwtKeys.keys[kid]
+		jwk := map[string]interface{}{
+			"kid": kid,
+			"use": "sig",
+			"alg": key.method.Alg(),
+		}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		keys = append(keys, jwk)
+	}
+	jwtKeys.mu.RUnlock()
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, map[string]interface{}{"keys": keys})
+}
+
+// JWT密钥命令（命令行：jwt-keys list | jwt-keys rotate [-alg RS256|EdDSA] | jwt-keys retire <kid>）
+func jwtKeysCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("用法: jwt-keys list | jwt-keys rotate [-alg RS256|EdDSA] | jwt-keys retire <kid>")
+	}
+	switch args[0] {
+	case "list":
+		jwtKeys.mu.RLock()
+		defer jwtKeys.mu.RUnlock()
+		for kid, key := range jwtKeys.keys {
+			log.Infof("kid=%s, alg=%s, active=%v, retired=%v, created=%s", kid, key.method.Alg(),
+				key == jwtKeys.active, key.signer == nil, key.modTime.Format("2006-01-02 15:04:05"))
+		}
+	case "rotate":
+		fs := flag.NewFlagSet("jwt-keys rotate", flag.ExitOnError)
+		alg := fs.String("alg", jwtAlgorithm(), "签名算法 RS256 或 EdDSA")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		kid, err := jwtKeys.generate(*alg)
+		if err != nil {
+			return err
+		}
+		log.Infof("已生成JWT签名密钥: kid=%s, alg=%s（未配置active_kid时运行中的服务将自动切换为该密钥签名）", kid, *alg)
+	case "retire":
+		if len(args) < 2 {
+			return errors.New("用法: jwt-keys retire <kid>")
+		}
+		if err := jwtKeys.retire(args[1]); err != nil {
+			return err
+		}
+		log.Infof("JWT签名密钥已退役: kid=%s（公钥保留用于验证，确认其签发的令牌全部过期后可删除公钥文件）", args[1])
+	default:
+		return fmt.Errorf("未知子命令: %s", args[0])
+	}
+	return nil
+}
+
+// JWT密钥维护任务：跟踪密钥目录变更
+func jwtKeyReloadTask() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		jwtKeys.reloadIfChanged()
+	}
+}
+
+// 生成访问令牌
+func generateAccessToken(fuid, username, nickname, deviceID string, now time.Time) (string, time.Time, error) {
+	accessExp := now.Add(time.Duration(cfg.Crypto.JWT.Expire) * time.Second)
+	// 令牌唯一ID，用于单个令牌吊销
+	jti, err := generateUniqueID(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims := CustomClaims{
+		FUID:     fuid,
+		Username: username,
+		Nickname: nickname,
+		DeviceID: deviceID, // 包含设备ID
+		Scope:    scopeIM,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.App.Name,
+			Subject:   "access_token",
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(accessExp),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	accessToken, err := signJWT(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return accessToken, accessExp, nil
+}
+
+// 解析并校验访问令牌（HTTP中间件与Socket.IO共用）
+func parseAccessToken(tokenStr string) (*CustomClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenStr, &CustomClaims{}, jwtKeyFunc)
+	if err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrSignatureInvalid):
+			return nil, errTokenSignature
+		case errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet):
+			return nil, errTokenExpired
+		default:
+			return nil, errTokenMalformed
+		}
+	}
+	claims, ok := token.Claims.(*CustomClaims)
+	if !ok || !token.Valid {
+		return nil, errTokenMalformed
+	}
+	// 校验签发者（确保令牌来源正确）
+	if claims.Issuer != cfg.App.Name {
+		return nil, errTokenIssuer
+	}
+	// 校验令牌主题（确保是访问令牌）
+	if claims.Subject != "access_token" {
+		return nil, errTokenSubject
+	}
+	// 校验吊销名单（令牌或其设备已注销）
+	revoked, err := isAccessTokenRevoked(claims)
+	if err != nil {
+		log.Errorf("查询令牌吊销名单失败: %v", err)
+		return nil, errTokenCheckFailed
+	}
+	if revoked {
+		return nil, errTokenRevoked
+	}
+	return claims, nil
+}
+
+// 访问令牌吊销名单（Redis）：单个令牌按jti，整台设备按设备ID；过期时间不超过访问令牌有效期
+func denylistJTIKey(jti string) string {
+	return "jwt_deny:jti:" + jti
+}
+
+func denylistDeviceKey(fuid, deviceID string) string {
+	return fmt.Sprintf("jwt_deny:device:%s:%s", fuid, deviceID)
+}
+
+// 吊销单个访问令牌（保留到令牌过期）
+func revokeAccessToken(jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if jti == "" || ttl <= 0 {
+		return nil
+	}
+	return rdb.Set(context.Background(), denylistJTIKey(jti), 1, ttl).Err()
+}
+
+// 吊销设备已签发的全部访问令牌（设备ID每次登录重新生成，保留一个访问令牌有效期即可）
+func revokeDeviceAccessTokens(fuid, deviceID, reason string) error {
+	ttl := time.Duration(cfg.Crypto.JWT.Expire) * time.Second
+	return rdb.Set(context.Background(), denylistDeviceKey(fuid, deviceID), reason, ttl).Err()
+}
+
+// 检查访问令牌是否已被吊销
+func isAccessTokenRevoked(claims *CustomClaims) (bool, error) {
+	keys := []string{denylistDeviceKey(claims.FUID, claims.DeviceID)}
+	if claims.ID != "" {
+		keys = append(keys, denylistJTIKey(claims.ID))
+	}
+	n, err := rdb.Exists(context.Background(), keys...).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// 退出登录接口：吊销当前访问令牌并注销当前设备会话
+func logoutHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	if err := revokeAccessToken(currentIdentity(c).JTI, currentIdentity(c).ExpiresAt); err != nil {
+		fail(c, 500, "退出登录失败")
+		return
+	}
+	if err := revokeDeviceSession(currentFUID, deviceID, "logout"); err != nil {
+		fail(c, 500, "退出登录失败")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "logout", map[string]interface{}{"device_id": deviceID})
+	success(c, nil)
+}
+
+// 访问令牌权限范围
+const (
+	scopeIM = "im" // 即时通讯全部接口（登录签发的访问令牌）
+)
+
+// 系统角色（users.role，普通用户为空）
+const (
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+	roleSupport   = "support"
+)
+
+// authIdentity 已认证身份（由authMiddleware写入上下文，handler通过currentIdentity读取）
+type authIdentity struct {
+	FUID      string
+	Username  string
+	Nickname  string
+	Role      string // 系统角色
+	DeviceID  string
+	JTI       string
+	Scopes    []string
+	ExpiresAt time.Time // 访问令牌过期时间
+}
+
+// 是否拥有指定权限范围
+func (id authIdentity) hasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authPolicy 路由访问策略：Scopes须全部具备，Roles具备其一即可（为空表示不限制）
+type authPolicy struct {
+	Scopes []string
+	Roles  []string
+}
+
+// 私有接口默认策略
+var defaultAuthPolicy = authPolicy{Scopes: []string{scopeIM}}
+
+// 校验身份是否满足策略
+func (p authPolicy) allows(id authIdentity) bool {
+	for _, scope := range p.Scopes {
+		if !id.hasScope(scope) {
+			return false
+		}
+	}
+	if len(p.Roles) == 0 {
+		return true
+	}
+	for _, role := range p.Roles {
+		if id.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+const identityContextKey = "auth_identity"
+
+// 读取当前请求的已认证身份（未认证时返回零值，FUID为空）
+func currentIdentity(c *gin.Context) authIdentity {
+	if v, ok := c.Get(identityContextKey); ok {
+		if id, ok := v.(authIdentity); ok {
+			return id
+		}
+	}
+	return authIdentity{}
+}
+
+// 按令牌声明加载身份：校验用户状态与设备状态（HTTP中间件与实时连接共用）
+func loadIdentity(fuid, deviceID string) (authIdentity, error) {
+	var user User
+	if err := db.Where("fuid = ? AND status = 1", fuid).First(&user).Error; err != nil {
+		return authIdentity{}, errors.New("用户不存在或已被禁用")
+	}
+	var device Device
+	if err := db.Where("user_fuid = ? AND device_id = ? AND status = 1", fuid, deviceID).First(&device).Error; err != nil {
+		return authIdentity{}, errors.New("设备已下线，请重新登录")
+	}
+	return authIdentity{
+		FUID:     user.FUID,
+		Username: user.Username,
+		Nickname: user.Nickname,
+		Role:     user.Role,
+		DeviceID: deviceID,
+	}, nil
+}
+
+// 令牌声明中的权限范围（未携带scope的令牌视为即时通讯全部权限）
+func claimScopes(claims *CustomClaims) []string {
+	if claims.Scope == "" {
+		return []string{scopeIM}
+	}
+	return strings.Fields(claims.Scope)
+}
+
+// 认证中间件：校验签名、签发者、令牌类型、吊销名单、用户状态及设备状态，
+// 并按策略检查权限范围与角色；不传策略时使用defaultAuthPolicy
+func authMiddleware(policies ...authPolicy) gin.HandlerFunc {
+	if len(policies) == 0 {
+		policies = []authPolicy{defaultAuthPolicy}
+	}
+	return func(c *gin.Context) {
+		// 获取Token
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			fail(c, 401, "未提供令牌")
+			c.Abort()
+			return
+		}
+
+		// 检查Bearer前缀
+		parts := strings.SplitN(authHeader, " ", 2)
+		if !(len(parts) == 2 && parts[0] == "Bearer") {
+			fail(c, 401, "令牌格式错误（需Bearer前缀）")
+			c.Abort()
+			return
+		}
+
+		// 解析Token
+		claims, err := parseAccessToken(parts[1])
+		if err != nil {
+			fail(c, 401, err.Error())
+			log.Errorf("JWT验证失败: %v", err)
+			c.Abort()
+			return
+		}
+
+		// 检查用户及设备状态
+		identity, err := loadIdentity(claims.FUID, claims.DeviceID)
+		if err != nil {
+			fail(c, 401, err.Error())
+			c.Abort()
+			return
+		}
+		identity.JTI = claims.ID
+		identity.Scopes = claimScopes(claims)
+		identity.ExpiresAt = claims.ExpiresAt.Time
+
+		for _, policy := range policies {
+			if !policy.allows(identity) {
+				fail(c, 403, "无权访问")
+				c.Abort()
+				return
+			}
+		}
+
+		// 将身份存入上下文
+		c.Set(identityContextKey, identity)
+		c.Next()
+	}
+}
+
+// 路由级策略（在authMiddleware之后使用，如管理接口限定角色）
+func requirePolicy(policy authPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := currentIdentity(c)
+		if identity.FUID == "" {
+			fail(c, 401, "未登录")
+			c.Abort()
+			return
+		}
+		if !policy.allows(identity) {
+			fail(c, 403, "无权访问")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 刷新访问令牌接口
+func refreshTokenHandler(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+
+	// 按哈希查找并校验刷新令牌
+	now := time.Now()
+	stored, err := checkRefreshToken(dbRefreshTokens, req.RefreshToken, now)
+	switch {
+	case errors.Is(err, errRefreshTokenRotated):
+		// 宽限期内再次使用刚轮换的令牌（如多个标签页同时刷新），返回同一组令牌
+		if pair, ok := awaitRotatedTokens(req.RefreshToken); ok {
+			success(c, pair)
+			return
+		}
+		rejectReusedRefreshToken(c, stored)
+		return
+	case errors.Is(err, errRefreshTokenReused):
+		rejectReusedRefreshToken(c, stored)
+		return
+	case errors.Is(err, errRefreshTokenExpired):
+		fail(c, 401, "刷新令牌已失效，请重新登录")
+		return
+	case err != nil:
+		fail(c, 401, "刷新令牌无效")
+		return
+	}
+
+	// 验证设备状态
+	var device Device
+	if err := db.Where("user_fuid = ? AND device_id = ? AND status = 1", stored.UserFUID, stored.DeviceID).First(&device).Error; err != nil {
+		fail(c, 401, "设备已下线或令牌无效")
+		return
+	}
+	// 用户名、昵称从用户表查询
+	var user User
+	if err := db.Where("fuid = ? AND status = 1", stored.UserFUID).First(&user).Error; err != nil {
+		fail(c, 401, "用户不存在或已被禁用")
+		return
+	}
+
+	// 轮换刷新令牌：旧令牌标记为已轮换，同一令牌族签发新令牌
+	refreshToken, err := rotateRefreshToken(dbRefreshTokens, stored, now)
+	if errors.Is(err, errRefreshTokenRotated) {
+		// 并发使用同一令牌：等待另一请求的轮换结果，取不到时按重用处理
+		if pair, ok := awaitRotatedTokens(req.RefreshToken); ok {
+			success(c, pair)
+			return
+		}
+		rejectReusedRefreshToken(c, stored)
+		return
+	}
+	if err != nil {
+		fail(c, 500, "轮换刷新令牌失败")
+		return
+	}
+
+	// 生成新的访问令牌
+	accessToken, _, err := generateAccessToken(user.FUID, user.Username, user.Nickname, device.DeviceID, now)
+	if err != nil {
+		fail(c, 500, "生成访问令牌失败")
+		return
+	}
+
+	// 更新最后活跃时间
+	db.Model(&device).Update("last_active", now)
+	ctx := context.Background()
+	deviceKey := fmt.Sprintf("user:devices:%s", user.FUID)
+	existingInfo, _ := rdb.HGet(ctx, deviceKey, device.DeviceID).Result()
+	deviceInfo := map[string]interface{}{}
+	json.Unmarshal([]byte(existingInfo), &deviceInfo)
+	deviceInfo["last_active"] = now.Format(time.RFC3339)
+	updatedInfo, _ := json.Marshal(deviceInfo)
+	rdb.HSet(ctx, deviceKey, device.DeviceID, updatedInfo)
+	rdb.Expire(ctx, deviceKey, time.Duration(cfg.Crypto.JWT.RefreshExpire)*time.Second)
+
+	pair := map[string]interface{}{
+		"access_token":       accessToken,
+		"refresh_token":      refreshToken,
+		"expires_in":         cfg.Crypto.JWT.Expire,
+		"refresh_expires_in": cfg.Crypto.JWT.RefreshExpire,
+	}
+	saveRotatedTokens(req.RefreshToken, pair)
+	success(c, pair)
+}
+
+// 已轮换的令牌在宽限期外再次出现，视为被盗用：吊销令牌族，同时注销整个设备会话
+func rejectReusedRefreshToken(c *gin.Context, stored *RefreshToken) {
+	if err := dbRefreshTokens.RevokeFamily(stored.FamilyID); err != nil {
+		log.Errorf("吊销刷新令牌族失败: family=%s, err=%v", stored.FamilyID, err)
+	}
+	revokeDeviceSession(stored.UserFUID, stored.DeviceID, "refresh_token_reused")
+	log.Warnf("Refresh token reuse detected: fuid=%s, device_id=%s, family=%s, ip=%s",
+		stored.UserFUID, stored.DeviceID, stored.FamilyID, getRealIP(c))
+	fail(c, 401, "刷新令牌已失效，设备会话已注销，请重新登录")
+}
+
+// 刷新令牌轮换宽限期：期间再次提交旧令牌返回同一组新令牌，不视为重用
+func refreshGracePeriod() time.Duration {
+	if cfg.Crypto.JWT.RefreshGrace > 0 {
+		return time.Duration(cfg.Crypto.JWT.RefreshGrace) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// 轮换结果在Redis中的键及加密密钥（由旧令牌派生，只有持有旧令牌的请求能取回新令牌）
+func refreshGraceKey(oldToken string) (string, []byte) {
+	sum := sha256.Sum256([]byte("refresh_grace|" + oldToken))
+	return "refresh_grace:" + hashRefreshToken(oldToken), sum[:]
+}
+
+// 保存轮换结果（宽限期内有效）
+func saveRotatedTokens(oldToken string, pair map[string]interface{}) {
+	redisKey, key := refreshGraceKey(oldToken)
+	encoded, _ := json.Marshal(pair)
+	sealed, err := gcmSeal(key, encoded, []byte(redisKey))
+	if err != nil {
+		log.Error("保存刷新令牌轮换结果失败: ", err)
+		return
+	}
+	if err := rdb.Set(context.Background(), redisKey, sealed, refreshGracePeriod()).Err(); err != nil {
+		log.Error("保存刷新令牌轮换结果失败: ", err)
+	}
+}
+
+// 取回旧令牌的轮换结果；并发请求可能尚未保存，最多等待2秒
+func awaitRotatedTokens(oldToken string) (map[string]interface{}, bool) {
+	redisKey, key := refreshGraceKey(oldToken)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sealed, err := rdb.Get(context.Background(), redisKey).Bytes()
+		if err == nil {
+			var pair map[string]interface{}
+			plain, err := gcmOpen(key, sealed, []byte(redisKey))
+			if err != nil || json.Unmarshal(plain, &pair) != nil {
+				return nil, false
+			}
+			return pair, true
+		}
+		if time.Now().After(deadline) {
+			return nil, false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 生成设备唯一标识
+func generateDeviceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+var (
+	errRefreshTokenInvalid = errors.New("刷新令牌无效")
+	errRefreshTokenExpired = errors.New("刷新令牌已失效")
+	errRefreshTokenReused  = errors.New("刷新令牌被重复使用")
+	errRefreshTokenRotated = errors.New("刷新令牌刚被轮换")
+	errRefreshTokenRaced   = errors.New("刷新令牌已被并发使用")
+)
+
+// 刷新令牌存储（轮换与重用检测逻辑与存储无关，默认实现为数据库）
+type refreshTokenStore interface {
+	FindByHash(hash string) (*RefreshToken, error)
+	Create(token *RefreshToken) error
+	// 将有效的旧令牌标记为已轮换并保存新令牌（原子执行），旧令牌已不是有效状态时返回errRefreshTokenRaced
+	Rotate(oldID uint64, next *RefreshToken, now time.Time) error
+	// 吊销令牌族内全部未吊销的令牌
+	RevokeFamily(familyID string) error
+}
+
+// 数据库刷新令牌存储
+type dbRefreshTokenStore struct{}
+
+var dbRefreshTokens refreshTokenStore = dbRefreshTokenStore{}
+
+func (dbRefreshTokenStore) FindByHash(hash string) (*RefreshToken, error) {
+	var token RefreshToken
+	if err := db.Where("token_hash = ?", hash).First(&token).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (dbRefreshTokenStore) Create(token *RefreshToken) error {
+	return db.Create(token).Error
+}
+
+func (dbRefreshTokenStore) Rotate(oldID uint64, next *RefreshToken, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RefreshToken{}).Where("id = ? AND status = 1", oldID).
+			Updates(map[string]interface{}{"status": 2, "rotated_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenRaced
+		}
+		return tx.Create(next).Error
+	})
+}
+
+func (dbRefreshTokenStore) RevokeFamily(familyID string) error {
+	return db.Model(&RefreshToken{}).Where("family_id = ? AND status IN ?", familyID, []uint8{1, 2}).
+		Update("status", 3).Error
+}
+
+// 刷新令牌哈希（数据库只保存哈希）
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 生成刷新令牌（随机不透明字符串）及其记录
+func newRefreshToken(fuid, deviceID, familyID string, now time.Time) (string, *RefreshToken, error) {
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, &RefreshToken{
+		TokenHash: hashRefreshToken(token),
+		FamilyID:  familyID,
+		UserFUID:  fuid,
+		DeviceID:  deviceID,
+		Status:    1,
+		ExpiresAt: now.Add(time.Duration(cfg.Crypto.JWT.RefreshExpire) * time.Second),
+	}, nil
+}
+
+// 签发刷新令牌，familyID为所属令牌族
+func issueRefreshToken(store refreshTokenStore, fuid, deviceID, familyID string, now time.Time) (string, error) {
+	token, record, err := newRefreshToken(fuid, deviceID, familyID, now)
+	if err != nil {
+		return "", err
+	}
+	if err := store.Create(record); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// 校验刷新令牌；已轮换的令牌在宽限期内再次出现时返回errRefreshTokenRotated，
+// 超过宽限期时吊销整个令牌族并返回errRefreshTokenReused（均同时返回令牌记录）
+func checkRefreshToken(store refreshTokenStore, token string, now time.Time) (*RefreshToken, error) {
+	stored, err := store.FindByHash(hashRefreshToken(token))
+	if err != nil {
+		return nil, errRefreshTokenInvalid
+	}
+	switch {
+	case stored.Status == 2 && stored.RotatedAt != nil && now.Sub(*stored.RotatedAt) < refreshGracePeriod():
+		return stored, errRefreshTokenRotated
+	case stored.Status == 2:
+		if err := store.RevokeFamily(stored.FamilyID); err != nil {
+			log.Errorf("吊销刷新令牌族失败: family=%s, err=%v", stored.FamilyID, err)
+		}
+		return stored, errRefreshTokenReused
+	case stored.Status != 1 || now.After(stored.ExpiresAt):
+		return stored, errRefreshTokenExpired
+	}
+	return stored, nil
+}
+
+// 轮换刷新令牌：旧令牌标记为已轮换，同一令牌族签发新令牌；
+// 同一令牌已被并发请求轮换时返回errRefreshTokenRotated，由调用方在宽限期内返回同一组令牌
+func rotateRefreshToken(store refreshTokenStore, stored *RefreshToken, now time.Time) (string, error) {
+	token, next, err := newRefreshToken(stored.UserFUID, stored.DeviceID, stored.FamilyID, now)
+	if err != nil {
+		return "", err
+	}
+	if err := store.Rotate(stored.ID, next, now); err != nil {
+		if errors.Is(err, errRefreshTokenRaced) {
+			return "", errRefreshTokenRotated
+		}
+		return "", err
+	}
+	return token, nil
+}
+
+// 注销设备会话：吊销访问令牌与全部刷新令牌、设备下线、断开实时连接、删除端到端加密密钥
+func revokeDeviceSession(fuid, deviceID, reason string) error {
+	// 先写入吊销名单，设备的访问令牌立即失效
+	if err := revokeDeviceAccessTokens(fuid, deviceID, reason); err != nil {
+		return err
+	}
+	err := db.Model(&Device{}).Where("user_fuid = ? AND device_id = ?", fuid, deviceID).
+		Updates(map[string]interface{}{"status": 0, "refresh_token": ""}).Error
+	if err != nil {
+		return err
+	}
+	db.Model(&RefreshToken{}).Where("user_fuid = ? AND device_id = ? AND status IN ?", fuid, deviceID, []uint8{1, 2}).
+		Update("status", 3)
+	rdb.HDel(context.Background(), fmt.Sprintf("user:devices:%s", fuid), deviceID)
+	disconnectDeviceSockets(fuid, deviceID, reason)
+	purgeDeviceKeys(fuid, deviceID)
+	log.Infof("Device session revoked: fuid=%s, device_id=%s, reason=%s", fuid, deviceID, reason)
+	return nil
+}
+
+// 清除旧版明文保存在devices表的刷新令牌（刷新令牌已改为哈希存储于refresh_tokens表，旧值不再有效）
+func clearLegacyRefreshTokens() {
+	result := db.Model(&Device{}).Where("refresh_token <> ''").Update("refresh_token", "")
+	if result.Error != nil {
+		log.Error("清除旧版明文刷新令牌失败: ", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Infof("已清除旧版明文刷新令牌%d条", result.RowsAffected)
+	}
+}
+
+// 清理过期刷新令牌（启动时先清除旧版明文刷新令牌）
+func refreshTokenCleanTask() {
+	clearLegacyRefreshTokens()
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		result := db.Where("expires_at < ?", time.Now()).Delete(&RefreshToken{})
+		if result.Error != nil {
+			log.Error("清理过期刷新令牌失败: ", result.Error)
+		} else {
+			log.Infof("清理过期刷新令牌成功，共删除%d条", result.RowsAffected)
+		}
+	}
+}
+
+// 获取当前登录设备列表
+func getDevicesHandler(c *gin.Context) {
+	fuid := currentIdentity(c).FUID
+	if fuid == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+
+	// 从Redis获取设备列表
+	ctx := context.Background()
 	deviceKey := fmt.Sprintf("user:devices:%s", fuid)
 	devicesMap, err := rdb.HGetAll(ctx, deviceKey).Result()
 	if err != nil {
-		fail(c, 500, "获取设备列表失败")
+		fail(c, 500, "获取设备列表失败")
+		return
+	}
+
+	var devices []interface{}
+	for _, infoStr := range devicesMap {
+		var deviceInfo map[string]interface{}
+		json.Unmarshal([]byte(infoStr), &deviceInfo)
+		devices = append(devices, deviceInfo)
+	}
+
+	success(c, devices)
+}
+
+// 踢下线指定设备
+func kickDeviceHandler(c *gin.Context) {
+	fuid := currentIdentity(c).FUID
+	if fuid == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+
+	var req struct {
+		DeviceID string `json:"device_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+
+	var count int64
+	db.Model(&Device{}).Where("user_fuid = ? AND device_id = ?", fuid, req.DeviceID).Count(&count)
+	if count == 0 {
+		fail(c, 404, "设备不存在")
+		return
+	}
+	// 设备下线、吊销刷新令牌、断开实时连接（全部节点）、删除端到端加密密钥
+	if err := revokeDeviceSession(fuid, req.DeviceID, "device_kicked"); err != nil {
+		fail(c, 500, "操作失败")
+		return
+	}
+	recordAudit(c, "device_kicked", "device", req.DeviceID, nil)
+
+	success(c, nil)
+	log.Infof("Device kicked: fuid=%s, device_id=%s", fuid, req.DeviceID)
+}
+
+// 搜索好友接口
+func searchFriendHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取搜索参数
+	keyword := c.Query("keyword")
+	if keyword == "" {
+		fail(c, 400, "搜索关键词不能为空")
+		return
+	}
+	// 搜索用户（FUID/用户名/昵称/邮箱）
+	var users []User
+	condition := "(fuid LIKE ? OR username LIKE ? OR nickname LIKE ? OR email LIKE ?) AND status = 1"
+	likeKeyword := "%" + keyword + "%"
+	if err := db.Where(condition, likeKeyword, likeKeyword, likeKeyword, likeKeyword).
+		Select("fuid, username, nickname, avatar, signature, vip_level, vip_exp").
+		Find(&users).Error; err != nil {
+		fail(c, 500, "搜索好友失败: "+err.Error())
+		return
+	}
+	// 排除自己
+	var result []map[string]interface{}
+	for _, user := range users {
+		if user.FUID == currentFUID {
+			continue
+		}
+		// 检查是否已添加好友
+		var friend Friend
+		err := db.Where("user_fuid = ? AND friend_fuid = ? AND status != 0", currentFUID, user.FUID).First(&friend).Error
+		isFriend := err == nil
+		isBlack := false
+		if isFriend {
+			isBlack = friend.Status == 2
+		}
+		result = append(result, map[string]interface{}{
+			"fuid":        user.FUID,
+			"username":    user.Username,
+			"nickname":    user.Nickname,
+			"avatar":      user.Avatar,
+			"signature":   user.Signature,
+			"vip_level":   user.VIPLevel,
+			"vip_exp":     user.VIPExp,
+			"is_friend":   isFriend,
+			"is_black":    isBlack,
+		})
+	}
+	success(c, result, int64(len(result)))
+}
+
+// 添加好友接口
+func addFriendHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		FriendFUID string `json:"friend_fuid" binding:"required"`
+		Remark     string `json:"remark" binding:"max=20"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 检查好友是否存在
+	var friendUser User
+	if err := db.Where("fuid = ? AND status = 1", req.FriendFUID).First(&friendUser).Error; err != nil {
+		fail(c, 400, "好友不存在或已被禁用")
+		return
+	}
+	// 检查是否是自己
+	if req.FriendFUID == currentFUID {
+		fail(c, 400, "不能添加自己为好友")
+		return
+	}
+	// 检查是否已添加
+	var friend Friend
+	err := db.Where("user_fuid = ? AND friend_fuid = ?", currentFUID, req.FriendFUID).First(&friend).Error
+	if err == nil {
+		if friend.Status == 1 {
+			fail(c, 400, "已添加该用户为好友")
+		} else if friend.Status == 2 {
+			fail(c, 400, "该用户在你的黑名单中，请先移除")
+		} else if friend.Status == 0 {
+			// 恢复好友关系
+			friend.Status = 1
+			friend.Remark = req.Remark
+			if err := db.Save(&friend).Error; err != nil {
+				fail(c, 500, "恢复好友关系失败: "+err.Error())
+				return
+			}
+			success(c, map[string]string{"msg": "恢复好友关系成功"})
+			return
+		}
+	}
+	// 检查好友数量是否超限
+	var friendCount int64
+	db.Model(&Friend{}).Where("user_fuid = ? AND status = 1", currentFUID).Count(&friendCount)
+	if friendCount >= int64(cfg.Business.User.FriendMax) {
+		fail(c, 400, fmt.Sprintf("好友数量已达上限(%d)", cfg.Business.User.FriendMax))
+		return
+	}
+	// 添加好友
+	newFriend := Friend{
+		UserFUID:    currentFUID,
+		FriendFUID:  req.FriendFUID,
+		Remark:      req.Remark,
+		Status:      1,
+	}
+	if err := db.Create(&newFriend).Error; err != nil {
+		fail(c, 500, "添加好友失败: "+err.Error())
+		return
+	}
+	
+	// 同时需要为对方添加反向好友关系
+	reverseFriend := Friend{
+    UserFUID:    req.FriendFUID,
+    FriendFUID:  currentFUID,
+    Remark:      "",
+    Status:      1,
+	}
+	
+	if err := db.Create(&reverseFriend).Error; err != nil {
+    // 回滚当前好友记录
+    db.Delete(&newFriend)
+    fail(c, 500, "添加好友失败: "+err.Error())
+    return
+	}
+
+	// 发送ntfy推送（如果启用）
+	if cfg.Business.Notify.Ntfy.Enable {
+		go sendNtfyNotification("添加好友通知", fmt.Sprintf("用户%s(%s)添加你为好友", 
+			currentIdentity(c).Nickname, currentFUID), req.FriendFUID)
+	}
+	success(c, map[string]string{"msg": "添加好友成功"})
+	log.Infof("Add friend: user=%s, friend=%s", currentFUID, req.FriendFUID)
+}
+
+// 删除好友接口
+func deleteFriendHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取好友FUID
+	friendFUID := c.Param("fuid")
+	if friendFUID == "" {
+		fail(c, 400, "好友FUID不能为空")
+		return
+	}
+	// 更新好友状态为已删除
+	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ?", currentFUID, friendFUID).
+		Update("status", 0).Error
+	if err != nil {
+		fail(c, 500, "删除好友失败: "+err.Error())
+		return
+	}
+	success(c, map[string]string{"msg": "删除好友成功"})
+	log.Infof("Delete friend: user=%s, friend=%s", currentFUID, friendFUID)
+}
+
+// 修改好友备注接口
+func updateFriendRemarkHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		FriendFUID string `json:"friend_fuid" binding:"required"`
+		Remark     string `json:"remark" binding:"max=20"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 更新备注
+	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 1", 
+		currentFUID, req.FriendFUID).Update("remark", req.Remark).Error
+	if err != nil {
+		fail(c, 500, "修改备注失败: "+err.Error())
+		return
+	}
+	success(c, map[string]string{"msg": "修改备注成功"})
+	log.Infof("Update friend remark: user=%s, friend=%s, remark=%s", currentFUID, req.FriendFUID, req.Remark)
+}
+
+// 加入黑名单接口
+func addBlacklistHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取好友FUID
+	friendFUID := c.Param("fuid")
+	if friendFUID == "" {
+		fail(c, 400, "好友FUID不能为空")
+		return
+	}
+	// 更新好友状态为黑名单
+	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 1", 
+		currentFUID, friendFUID).Update("status", 2).Error
+	if err != nil {
+		fail(c, 500, "加入黑名单失败: "+err.Error())
+		return
+	}
+	success(c, map[string]string{"msg": "加入黑名单成功"})
+	log.Infof("Add blacklist: user=%s, friend=%s", currentFUID, friendFUID)
+}
+
+// 移出黑名单接口
+func removeBlacklistHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取好友FUID
+	friendFUID := c.Param("fuid")
+	if friendFUID == "" {
+		fail(c, 400, "好友FUID不能为空")
+		return
+	}
+	// 更新好友状态为正常
+	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 2",
+		currentFUID, friendFUID).Update("status", 1).Error
+	if err != nil {
+		fail(c, 500, "移出黑名单失败: "+err.Error())
+		return
+	}
+	success(c, map[string]string{"msg": "移出黑名单成功"})
+	log.Infof("Remove blacklist: user=%s, friend=%s", currentFUID, friendFUID)
+}
+
+// 创建群聊接口
+func createGroupHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		Name        string `json:"name" binding:"required,min=1,max=20"`
+		Desc        string `json:"desc" binding:"max=256"`
+		Avatar      string `json:"avatar"` // 头像URL
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 检查创建群聊数量是否超限
+	var groupCount int64
+	db.Model(&Group{}).Where("owner_fuid = ? AND status = 1", currentFUID).Count(&groupCount)
+	if groupCount >= int64(cfg.Business.Group.CreateMax) {
+		fail(c, 400, fmt.Sprintf("创建群聊数量已达上限(%d)", cfg.Business.Group.CreateMax))
+		return
+	}
+	// 生成QUID
+	quid, err := generateQUID()
+	if err != nil {
+		fail(c, 500, "生成QUID失败: "+err.Error())
+		return
+	}
+	// 创建群聊
+	newGroup := Group{
+		QUID:       quid,
+		Name:       req.Name,
+		OwnerFUID:  currentFUID,
+		Avatar:     req.Avatar,
+		Desc:       req.Desc,
+		VIPLevel:   0,
+		VIPExp:     0,
+		Status:     1,
+	}
+	if err := db.Create(&newGroup).Error; err != nil {
+		fail(c, 500, "创建群聊失败: "+err.Error())
+		return
+	}
+	// 添加群主到群成员
+	groupMember := GroupMember{
+		GroupQUID:  quid,
+		UserFUID:   currentFUID,
+		Role:       1, // 群主
+		Status:     1,
+	}
+	if err := db.Create(&groupMember).Error; err != nil {
+		// 回滚群聊创建
+		db.Delete(&newGroup)
+		fail(c, 500, "添加群主到群成员失败: "+err.Error())
+		return
+	}
+	// 群主的在线连接加入群房间
+	joinUserToRoom(currentFUID, "group:"+quid)
+	// 返回群聊信息
+	respData := map[string]interface{}{
+		"quid":        newGroup.QUID,
+		"name":        newGroup.Name,
+		"owner_fuid":  newGroup.OwnerFUID,
+		"avatar":      newGroup.Avatar,
+		"desc":        newGroup.Desc,
+		"vip_level":   newGroup.VIPLevel,
+		"vip_exp":     newGroup.VIPExp,
+	}
+	success(c, respData)
+	log.Infof("Create group: quid=%s, owner=%s, name=%s", quid, currentFUID, req.Name)
+}
+
+// 搜索群聊接口
+func searchGroupHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取搜索参数
+	keyword := c.Query("keyword")
+	if keyword == "" {
+		fail(c, 400, "搜索关键词不能为空")
+		return
+	}
+	// 搜索群聊（QUID/群名）
+	var groups []Group
+	condition := "quid LIKE ? OR name LIKE ? AND status = 1"
+	likeKeyword := "%" + keyword + "%"
+	if err := db.Where(condition, likeKeyword, likeKeyword).
+		Select("quid, name, owner_fuid, avatar, desc, vip_level, vip_exp").
+		Find(&groups).Error; err != nil {
+		fail(c, 500, "搜索群聊失败: "+err.Error())
+		return
+	}
+	// 检查是否已加入群聊
+	var result []map[string]interface{}
+	for _, group := range groups {
+		var member GroupMember
+		err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", group.QUID, currentFUID).First(&member).Error
+		isJoined := err == nil
+		role := 0
+		if isJoined {
+			role = int(member.Role)
+		}
+		// 获取群主昵称
+		var owner User
+		db.Where("fuid = ?", group.OwnerFUID).Select("nickname").First(&owner)
+		result = append(result, map[string]interface{}{
+			"quid":        group.QUID,
+			"name":        group.Name,
+			"owner_fuid":  group.OwnerFUID,
+			"owner_nickname": owner.Nickname,
+			"avatar":      group.Avatar,
+			"desc":        group.Desc,
+			"vip_level":   group.VIPLevel,
+			"vip_exp":     group.VIPExp,
+			"is_joined":   isJoined,
+			"role":        role,
+		})
+	}
+	success(c, result, int64(len(result)))
+}
+
+// 加入群聊接口
+func joinGroupHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		GroupQUID string `json:"group_quid" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 检查群聊是否存在
+	var group Group
+	if err := db.Where("quid = ? AND status = 1", req.GroupQUID).First(&group).Error; err != nil {
+		fail(c, 400, "群聊不存在或已解散")
+		return
+	}
+	// 检查是否已加入
+	var member GroupMember
+	err := db.Where("group_quid = ? AND user_fuid = ?", req.GroupQUID, currentFUID).First(&member).Error
+	if err == nil {
+		if member.Status == 1 {
+			fail(c, 400, "已加入该群聊")
+		} else if member.Status == 0 {
+			// 恢复群成员身份（重新加入前的消息不可见）
+			member.Status = 1
+			member.JoinSeq = latestConversationSeq(getConversationID(2, currentFUID, req.GroupQUID))
+			if err := db.Save(&member).Error; err != nil {
+				fail(c, 500, "恢复群成员身份失败: "+err.Error())
+				return
+			}
+			joinUserToRoom(currentFUID, "group:"+req.GroupQUID)
+			go rotateGroupSenderKey(req.GroupQUID, "member_join")
+			success(c, map[string]string{"msg": "重新加入群聊成功"})
+			return
+		}
+	}
+	// 检查群成员数量是否超限
+	var memberCount int64
+	db.Model(&GroupMember{}).Where("group_quid = ? AND status = 1", req.GroupQUID).Count(&memberCount)
+	if memberCount >= int64(cfg.Business.Group.MemberMax) {
+		fail(c, 400, fmt.Sprintf("群成员数量已达上限(%d)", cfg.Business.Group.MemberMax))
+		return
+	}
+	// 加入群聊
+	newMember := GroupMember{
+		GroupQUID:  req.GroupQUID,
+		UserFUID:   currentFUID,
+		Role:       0, // 普通成员
+		Status:     1,
+		JoinSeq:    latestConversationSeq(getConversationID(2, currentFUID, req.GroupQUID)),
+	}
+	if err := db.Create(&newMember).Error; err != nil {
+		fail(c, 500, "加入群聊失败: "+err.Error())
+		return
+	}
+	// 用户的在线连接加入群房间
+	joinUserToRoom(currentFUID, "group:"+req.GroupQUID)
+	// 新成员加入，轮换发送者密钥
+	go rotateGroupSenderKey(req.GroupQUID, "member_join")
+	// 发送ntfy推送（如果启用）
+	if cfg.Business.Notify.Ntfy.Enable {
+		go sendNtfyNotification("入群通知", fmt.Sprintf("用户%s(%s)加入群聊%s",
+			currentIdentity(c).Nickname, currentFUID, group.Name), group.OwnerFUID)
+	}
+	success(c, map[string]string{"msg": "加入群聊成功"})
+	log.Infof("Join group: user=%s, group=%s", currentFUID, req.GroupQUID)
+}
+
+// 退出群聊接口
+func quitGroupHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取群聊QUID
+	groupQUID := c.Param("quid")
+	if groupQUID == "" {
+		fail(c, 400, "群聊QUID不能为空")
+		return
+	}
+	// 检查是否是群主
+	var member GroupMember
+	err := db.Where("group_quid = ? AND user_fuid = ? AND role = 1", groupQUID, currentFUID).First(&member).Error
+	if err == nil {
+		fail(c, 400, "群主不能退出群聊，请转让群主或解散群聊")
+		return
+	}
+	// 更新群成员状态为已退出
+	err = db.Model(&GroupMember{}).Where("group_quid = ? AND user_fuid = ? AND status = 1",
+		groupQUID, currentFUID).Update("status", 0).Error
+	if err != nil {
+		fail(c, 500, "退出群聊失败: "+err.Error())
+		return
+	}
+	// 用户的在线连接离开群房间
+	removeUserFromRoom(currentFUID, "group:"+groupQUID)
+	// 成员退出，丢弃其未接收的密钥并轮换发送者密钥
+	dropSenderKeyDistributions(groupQUID, currentFUID)
+	go rotateGroupSenderKey(groupQUID, "member_quit")
+	success(c, map[string]string{"msg": "退出群聊成功"})
+	log.Infof("Quit group: user=%s, group=%s", currentFUID, groupQUID)
+}
+
+// 群聊禁言接口
+func groupMuteHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		GroupQUID   string `json:"group_quid" binding:"required"`
+		UserFUID    string `json:"user_fuid" binding:"required"` // 被禁言用户
+		MuteTime    int    `json:"mute_time"` // 禁言时间（秒），默认使用配置值
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 检查当前用户权限（群主/管理）
+	var currentMember GroupMember
+	err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&currentMember).Error
+	if err != nil {
+		fail(c, 403, "你不是该群成员，无操作权限")
+		return
+	}
+	if currentMember.Role != 1 && currentMember.Role != 2 {
+		fail(c, 403, "仅群主和管理员可执行禁言操作")
+		return
+	}
+	// 检查被禁言用户是否是群成员
+	var targetMember GroupMember
+	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, req.UserFUID).First(&targetMember).Error
+	if err != nil {
+		fail(c, 400, "被禁言用户不是该群成员")
+		return
+	}
+	// 检查被禁言用户是否是群主
+	if targetMember.Role == 1 {
+		fail(c, 400, "不能禁言群主")
+		return
+	}
+	// 计算禁言结束时间
+	muteTime := req.MuteTime
+	if muteTime <= 0 {
+		muteTime = cfg.Business.Group.MuteTimeDefault
+	}
+	muteEndTime := time.Now().Add(time.Duration(muteTime) * time.Second)
+	// 更新禁言时间
+	err = db.Model(&targetMember).Update("mute_end_time", muteEndTime).Error
+	if err != nil {
+		fail(c, 500, "禁言操作失败: "+err.Error())
+		return
+	}
+	recordGroupAudit(c, req.GroupQUID, "group_member_muted", "user", req.UserFUID, map[string]interface{}{
+		"mute_time": muteTime,
+		"until":     muteEndTime.Format("2006-01-02 15:04:05"),
+	})
+	// 发送ntfy推送
+	if cfg.Business.Notify.Ntfy.Enable {
+		go sendNtfyNotification("群禁言通知", fmt.Sprintf("你在群聊%s中被禁言%d秒",
+			req.GroupQUID, muteTime), req.UserFUID)
+	}
+	success(c, map[string]string{"msg": fmt.Sprintf("禁言成功，禁言时长%d秒", muteTime)})
+	log.Infof("Group mute: group=%s, operator=%s, target=%s, time=%d", req.GroupQUID, currentFUID, req.UserFUID, muteTime)
+}
+
+// 踢出群聊接口
+func kickGroupMemberHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		GroupQUID   string `json:"group_quid" binding:"required"`
+		UserFUID    string `json:"user_fuid" binding:"required"` // 被踢出用户
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 检查当前用户权限（群主/管理）
+	var currentMember GroupMember
+	err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&currentMember).Error
+	if err != nil {
+		fail(c, 403, "你不是该群成员，无操作权限")
+		return
+	}
+	if currentMember.Role != 1 && currentMember.Role != 2 {
+		fail(c, 403, "仅群主和管理员可执行踢出操作")
+		return
+	}
+	// 检查被踢出用户是否是群成员
+	var targetMember GroupMember
+	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, req.UserFUID).First(&targetMember).Error
+	if err != nil {
+		fail(c, 400, "被踢出用户不是该群成员")
+		return
+	}
+	// 检查被踢出用户是否是群主
+	if targetMember.Role == 1 {
+		fail(c, 400, "不能踢出群主")
+		return
+	}
+	// 更新群成员状态为已踢出
+	err = db.Model(&targetMember).Update("status", 0).Error
+	if err != nil {
+		fail(c, 500, "踢出操作失败: "+err.Error())
+		return
+	}
+	recordGroupAudit(c, req.GroupQUID, "group_member_kicked", "user", req.UserFUID, nil)
+	// 被踢用户的在线连接离开群房间，并通知被踢用户
+	removeUserFromRoom(req.UserFUID, "group:"+req.GroupQUID)
+	go broadcastToRoom("user:"+req.UserFUID, "group_kicked", map[string]interface{}{
+		"group_quid":    req.GroupQUID,
+		"operator_fuid": currentFUID,
+	})
+	// 成员被踢出，丢弃其未接收的密钥并轮换发送者密钥
+	dropSenderKeyDistributions(req.GroupQUID, req.UserFUID)
+	go rotateGroupSenderKey(req.GroupQUID, "member_kicked")
+	// 发送ntfy推送
+	if cfg.Business.Notify.Ntfy.Enable {
+		go sendNtfyNotification("踢出群聊通知", fmt.Sprintf("你被移出群聊%s", req.GroupQUID), req.UserFUID)
+	}
+	success(c, map[string]string{"msg": "踢出群聊成功"})
+	log.Infof("Kick group member: group=%s, operator=%s, target=%s", req.GroupQUID, currentFUID, req.UserFUID)
+}
+
+// 发布群公告接口
+func publishGroupNoticeHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		GroupQUID   string `json:"group_quid" binding:"required"`
+		Content     string `json:"content" binding:"required,max=256"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 检查当前用户权限（群主/管理）
+	var currentMember GroupMember
+	err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&currentMember).Error
+	if err != nil {
+		fail(c, 403, "你不是该群成员，无操作权限")
+		return
+	}
+	if currentMember.Role != 1 && currentMember.Role != 2 {
+		fail(c, 403, "仅群主和管理员可发布群公告")
+		return
+	}
+	// 创建群公告
+	noticeID, err := generateUniqueID(32)
+	if err != nil {
+		fail(c, 500, "生成公告ID失败: "+err.Error())
+		return
+	}
+	notice := GroupNotice{
+		NoticeID:      noticeID,
+		GroupQUID:     req.GroupQUID,
+		Content:       req.Content,
+		PublisherFUID: currentFUID,
+		PublishTime:   time.Now(),
+	}
+	if err := db.Create(&notice).Error; err != nil {
+		fail(c, 500, "发布群公告失败: "+err.Error())
+		return
+	}
+	// 推送群公告给所有在线成员
+	go broadcastToRoom("group:"+req.GroupQUID, "group_notice", map[string]interface{}{
+		"notice_id":      notice.NoticeID,
+		"group_quid":     req.GroupQUID,
+		"content":        notice.Content,
+		"publisher_fuid": notice.PublisherFUID,
+		"publish_time":   notice.PublishTime.Format("2006-01-02 15:04:05"),
+	})
+	// 离线通知（ntfy）
+	go func() {
+		var members []GroupMember
+		db.Where("group_quid = ? AND status = 1", req.GroupQUID).Find(&members)
+		for _, member := range members {
+			if cfg.Business.Notify.Ntfy.Enable {
+				sendNtfyNotification("群公告", fmt.Sprintf("群聊%s发布新公告: %s", req.GroupQUID, req.Content), member.UserFUID)
+			}
+		}
+	}()
+	success(c, map[string]string{"msg": "发布群公告成功"})
+	log.Infof("Publish group notice: group=%s, publisher=%s, content=%s", req.GroupQUID, currentFUID, req.Content)
+}
+
+// 解散群聊接口
+func dissolveGroupHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取群聊QUID
+	groupQUID := c.Param("quid")
+	if groupQUID == "" {
+		fail(c, 400, "群聊QUID不能为空")
+		return
+	}
+	// 检查是否是群主
+	var group Group
+	err := db.Where("quid = ? AND owner_fuid = ? AND status = 1", groupQUID, currentFUID).First(&group).Error
+	if err != nil {
+		fail(c, 403, "仅群主可解散群聊")
+		return
+	}
+	if err := dissolveGroup(&group, "群聊%s已被群主解散"); err != nil {
+		fail(c, 500, "解散群聊失败: "+err.Error())
+		return
+	}
+	recordGroupAudit(c, groupQUID, "group_dissolved", "group", groupQUID, nil)
+	success(c, map[string]string{"msg": "解散群聊成功"})
+	log.Infof("Dissolve group: group=%s, owner=%s", groupQUID, currentFUID)
+}
+
+// 解散群聊：更新状态、成员退出、删除密钥分发记录，推送解散通知并清空房间（notice为通知文案，%s为群QUID）
+func dissolveGroup(group *Group, notice string) error {
+	members, err := dissolveGroupRecords(db, group)
+	if err != nil {
+		return err
+	}
+	notifyGroupDissolved(group, members, notice)
+	return nil
+}
+
+// 解散群聊的数据库变更（可在事务内执行），返回解散前的群成员用于推送通知
+func dissolveGroupRecords(tx *gorm.DB, group *Group) ([]GroupMember, error) {
+	groupQUID := group.QUID
+	// 解散前记录群成员，用于推送通知
+	var members []GroupMember
+	tx.Where("group_quid = ? AND status = 1", groupQUID).Find(&members)
+	// 更新群聊状态为已解散
+	if err := tx.Model(group).Update("status", 0).Error; err != nil {
+		return nil, err
+	}
+	// 更新所有群成员状态为已退出
+	if err := tx.Model(&GroupMember{}).Where("group_quid = ?", groupQUID).Update("status", 0).Error; err != nil {
+		return nil, err
+	}
+	// 删除该群的全部发送者密钥分发记录
+	if err := tx.Where("group_quid = ?", groupQUID).Delete(&SenderKeyDistribution{}).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// 推送解散通知后清空群房间（保证通知先于清空到达各节点）
+func notifyGroupDissolved(group *Group, members []GroupMember, notice string) {
+	groupQUID := group.QUID
+	go func() {
+		broadcastToRoom("group:"+groupQUID, "group_dissolved", map[string]interface{}{
+			"group_quid": groupQUID,
+			"owner_fuid": group.OwnerFUID,
+		})
+		clearRoom("group:" + groupQUID)
+	}()
+	go func() {
+		for _, member := range members {
+			if cfg.Business.Notify.Ntfy.Enable {
+				sendNtfyNotification("群聊解散通知", fmt.Sprintf(notice, groupQUID), member.UserFUID)
+			}
+		}
+	}()
+}
+
+// 转让群聊接口
+func transferGroupHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		GroupQUID   string `json:"group_quid" binding:"required"`
+		TargetFUID  string `json:"target_fuid" binding:"required"` // 转让目标用户
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	// 检查是否是群主
+	var group Group
+	err := db.Where("quid = ? AND owner_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&group).Error
+	if err != nil {
+		fail(c, 403, "仅群主可转让群聊")
+		return
+	}
+	// 检查目标用户是否是群成员
+	var targetMember GroupMember
+	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, req.TargetFUID).First(&targetMember).Error
+	if err != nil {
+		fail(c, 400, "转让目标用户不是该群成员")
+		return
+	}
+	// 更新群主
+	err = transferGroupOwner(db, &group, &targetMember)
+	if err != nil {
+		fail(c, 500, "转让群聊失败: "+err.Error())
+		return
+	}
+	recordGroupAudit(c, req.GroupQUID, "group_transferred", "user", req.TargetFUID, map[string]interface{}{"from": currentFUID})
+	// 发送转让通知
+	if cfg.Business.Notify.Ntfy.Enable {
+		// 通知新群主
+		go sendNtfyNotification("群聊转让通知", fmt.Sprintf("你已成为群聊%s的新群主", req.GroupQUID), req.TargetFUID)
+		// 通知原群主
+		go sendNtfyNotification("群聊转让通知", fmt.Sprintf("你已将群聊%s转让给用户%s", req.GroupQUID, req.TargetFUID), currentFUID)
+	}
+	success(c, map[string]string{"msg": "转让群聊成功"})
+	log.Infof("Transfer group: group=%s, from=%s, to=%s", req.GroupQUID, currentFUID, req.TargetFUID)
+}
+
+// 转让群主（原群主降为普通成员），tx可以是外层事务
+func transferGroupOwner(tx *gorm.DB, group *Group, target *GroupMember) error {
+	previousOwner := group.OwnerFUID
+	return tx.Transaction(func(tx *gorm.DB) error {
+		// 更新群聊群主
+		if err := tx.Model(group).Update("owner_fuid", target.UserFUID).Error; err != nil {
+			return err
+		}
+		// 更新原群主角色为普通成员
+		if err := tx.Model(&GroupMember{}).Where("group_quid = ? AND user_fuid = ?", group.QUID, previousOwner).Update("role", 0).Error; err != nil {
+			return err
+		}
+		// 更新新群主角色为群主
+		return tx.Model(target).Update("role", 1).Error
+	})
+}
+
+// 业务错误（消息管道等HTTP/WebSocket共用逻辑返回）
+type apiError struct {
+	Code int
+	Msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.Msg
+}
+
+// 发送消息请求（HTTP/WebSocket共用）
+type sendMessageRequest struct {
+	ReceiverType uint8  `json:"receiver_type" binding:"required,oneof=1 2"`        // 1:单聊 2:群聊
+	ReceiverID   string `json:"receiver_id" binding:"required"`                    // 单聊:好友FUID 群聊:群QUID
+	ContentType  uint8  `json:"content_type" binding:"required,oneof=1 2 3 4 5"`   // 1:文字 2:图片 3:文件 4:表情 5:系统消息
+	Content      string `json:"content" binding:"required"`                        // 加密后的内容
+	Encryption   uint8  `json:"encryption" binding:"oneof=0 1"`                    // 0:传输加密 1:端到端加密（content为客户端密文信封，服务端原样转发）
+	MsgID        string `json:"msg_id" binding:"omitempty,alphanum,min=16,max=64"` // 客户端生成的消息ID（可选，使用内容信封时必填）
+	FontStyle    string `json:"font_style"`                                        // 字体样式
+	FontSize     int    `json:"font_size"`                                         // 字体大小
+	FontColor    string `json:"font_color"`                                        // 字体颜色
+}
+
+// 校验发送权限（好友关系/黑名单、群成员/禁言）
+func checkSendPermission(senderFUID string, receiverType uint8, receiverID string) *apiError {
+	if receiverType == 1 {
+		// 单聊：检查是否是好友且不在黑名单
+		var friend Friend
+		err := db.Where("user_fuid = ? AND friend_fuid = ? AND status = 1", senderFUID, receiverID).First(&friend).Error
+		if err != nil {
+			return &apiError{400, "该用户不是你的好友，无法发送消息"}
+		}
+		// 检查对方是否将自己加入黑名单
+		var reverseFriend Friend
+		err = db.Where("user_fuid = ? AND friend_fuid = ? AND status = 2", receiverID, senderFUID).First(&reverseFriend).Error
+		if err == nil {
+			return &apiError{403, "对方已将你加入黑名单，无法发送消息"}
+		}
+	} else if receiverType == 2 {
+		// 群聊：检查是否是群成员，且未被禁言
+		var member GroupMember
+		err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", receiverID, senderFUID).First(&member).Error
+		if err != nil {
+			return &apiError{403, "你不是该群成员，无法发送消息"}
+		}
+		// 检查是否被禁言
+		if member.MuteEndTime.After(time.Now()) {
+			return &apiError{403, fmt.Sprintf("你已被禁言，禁言结束时间：%s", member.MuteEndTime.Format("2006-01-02 15:04:05"))}
+		}
+	}
+	return nil
+}
+
+// 待过滤的消息（发送消息管道在持久化前构造）
+type filterMessage struct {
+	SenderFUID   string
+	ReceiverType uint8
+	ReceiverID   string
+	ContentType  uint8
+	Text         string            // 明文，过滤器可修改（如替换敏感词）
+	Inspectable  bool              // 服务端能否读取内容（端到端加密、非文字消息为false，内容类过滤器跳过）
+	Group        groupFilterConfig // 群聊过滤设置（单聊为零值）
+}
+
+// 拦截结果
+type filterBlock struct {
+	Filter string
+	Reason string                 // 返回给发送者的提示
+	Detail map[string]interface{} // 写入审计日志的附加信息
+}
+
+// messageFilter 消息过滤器：返回非nil表示拦截；可修改msg.Text实现替换
+type messageFilter interface {
+	Name() string
+	Apply(msg *filterMessage) *filterBlock
+}
+
+// 过滤器链（按注册顺序执行）
+var messageFilters []messageFilter
+
+// 注册消息过滤器（自定义过滤器在initMessageFilters之后注册即可生效）
+func registerMessageFilter(f messageFilter) {
+	messageFilters = append(messageFilters, f)
+}
+
+// groupOptionalFilter 可由群主在本群停用的过滤器（自定义过滤器实现该接口并返回true才允许停用；内置过滤器均为全局强制）
+type groupOptionalFilter interface {
+	GroupOptional() bool
+}
+
+// 过滤器能否在群内停用
+func filterGroupOptional(f messageFilter) bool {
+	optional, ok := f.(groupOptionalFilter)
+	return ok && optional.GroupOptional()
+}
+
+// 群聊过滤设置（群主配置，只能在全局配置基础上收紧，未设置的项沿用全局配置）
+type groupFilterConfig struct {
+	Disabled     []string `json:"disabled"`      // 在本群停用的过滤器（仅限可选过滤器）
+	WordAction   string   `json:"word_action"`   // 敏感词处理方式 block（为空沿用全局；全局为block时不能改为replace）
+	ExtraWords   []string `json:"extra_words"`   // 本群追加的敏感词
+	AllowDomains []string `json:"allow_domains"` // 本群允许的链接域名（在全局白名单范围内进一步收窄，为空沿用全局）
+	FloodMax     int      `json:"flood_max"`     // 本群窗口内最多消息数（取与全局的较小值，为0沿用全局）
+}
+
+func (g groupFilterConfig) disabled(f messageFilter) bool {
+	if !filterGroupOptional(f) {
+		return false
+	}
+	for _, d := range g.Disabled {
+		if d == f.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验群聊过滤设置：群主只能收紧过滤，不能停用全局过滤器或放宽全局配置
+func validateGroupFilterConfig(config groupFilterConfig) error {
+	for _, name := range config.Disabled {
+		var found messageFilter
+		for _, f := range messageFilters {
+			if f.Name() == name {
+				found = f
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("未知的过滤器: %s", name)
+		}
+		if !filterGroupOptional(found) {
+			return fmt.Errorf("全局过滤器不能在群内停用: %s", name)
+		}
+	}
+	if config.WordAction == "replace" && cfg.MessageFilter.SensitiveWords.Action == "block" {
+		return errors.New("全局敏感词处理方式为拦截，群内不能改为替换")
+	}
+	return nil
+}
+
+// 群聊过滤设置缓存（30秒，设置更新时本节点立即失效）
+type cachedGroupFilter struct {
+	config   groupFilterConfig
+	loadedAt time.Time
+}
+
+var groupFilterCache sync.Map
+
+// 读取群聊过滤设置
+func loadGroupFilterConfig(groupQUID string) groupFilterConfig {
+	if v, ok := groupFilterCache.Load(groupQUID); ok {
+		cached := v.(cachedGroupFilter)
+		if time.Since(cached.loadedAt) < 30*time.Second {
+			return cached.config
+		}
+	}
+	var config groupFilterConfig
+	var setting GroupFilterSetting
+	if err := db.Where("group_quid = ?", groupQUID).First(&setting).Error; err == nil {
+		json.Unmarshal([]byte(setting.Config), &config)
+	}
+	groupFilterCache.Store(groupQUID, cachedGroupFilter{config: config, loadedAt: time.Now()})
+	return config
+}
+
+// 执行过滤器链，返回拦截结果（nil表示放行，msg.Text可能已被修改）
+func runMessageFilters(msg *filterMessage) *filterBlock {
+	if !cfg.MessageFilter.Enable {
+		return nil
+	}
+	for _, f := range messageFilters {
+		if msg.Group.disabled(f) {
+			continue
+		}
+		if block := f.Apply(msg); block != nil {
+			block.Filter = f.Name()
+			return block
+		}
+	}
+	return nil
+}
+
+// 发送管道中的过滤：解出可检查的明文、执行过滤器链；内容被修改时重新生成信封
+func filterOutgoingMessage(senderFUID string, req *sendMessageRequest, msgID string) *apiError {
+	if !cfg.MessageFilter.Enable || len(messageFilters) == 0 {
+		return nil
+	}
+	convID := getConversationID(req.ReceiverType, senderFUID, req.ReceiverID)
+	msg := filterMessage{
+		SenderFUID:   senderFUID,
+		ReceiverType: req.ReceiverType,
+		ReceiverID:   req.ReceiverID,
+		ContentType:  req.ContentType,
+	}
+	if req.ReceiverType == 2 {
+		msg.Group = loadGroupFilterConfig(req.ReceiverID)
+	}
+	if req.Encryption == 0 && req.ContentType == 1 {
+		// 声明为传输加密的文字消息必须能被服务端解出，否则会绕过内容过滤
+		plain, _, err := openEnvelope(req.Content, msgID, convID)
+		if err != nil {
+			return &apiError{400, "消息内容无法解密，请使用服务端公钥生成内容信封"}
+		}
+		msg.Text = string(plain)
+		msg.Inspectable = true
+	}
+	original := msg.Text
+	if block := runMessageFilters(&msg); block != nil {
+		event := newAuditEvent(nil, "message_blocked", "user", req.ReceiverID, map[string]interface{}{
+			"filter":       block.Filter,
+			"reason":       block.Reason,
+			"detail":       block.Detail,
+			"content_type": req.ContentType,
+		})
+		event.ActorFUID = senderFUID
+		if req.ReceiverType == 2 {
+			event.TargetType = "group"
+			event.GroupQUID = req.ReceiverID
+		}
+		auditLog.Record(event)
+		return &apiError{403, block.Reason}
+	}
+	if msg.Inspectable && msg.Text != original {
+		sealed, err := sealEnvelope(defaultEnvelopeVersion(), []byte(msg.Text), msgID, convID)
+		if err != nil {
+			return &apiError{500, "处理消息内容失败"}
+		}
+		req.Content = sealed
+	}
+	return nil
+}
+
+// Aho-Corasick多模式匹配（按字符、忽略大小写）
+type acNode struct {
+	next map[rune]int
+	fail int
+	out  []int // 以该节点结尾的词长度
+}
+
+type acMatcher struct {
+	nodes []acNode
+}
+
+// 构建匹配自动机
+func newACMatcher(words []string) *acMatcher {
+	m := &acMatcher{nodes: []acNode{{next: map[rune]int{}}}}
+	for _, word := range words {
+		runes := []rune(strings.ToLower(strings.TrimSpace(word)))
+		if len(runes) == 0 {
+			continue
+		}
+		cur := 0
+		for _, r := range runes {
+			nxt, ok := m.nodes[cur].next[r]
+			if !ok {
+				m.nodes = append(m.nodes, acNode{next: map[rune]int{}})
+				nxt = len(m.nodes) - 1
+				m.nodes[cur].next[r] = nxt
+			}
+			cur = nxt
+		}
+		m.nodes[cur].out = append(m.nodes[cur].out, len(runes))
+	}
+	// 广度优先构建失败指针
+	queue := make([]int, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for r, child := range m.nodes[cur].next {
+			f := m.nodes[cur].fail
+			for f > 0 {
+				if _, ok := m.nodes[f].next[r]; ok {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if target, ok := m.nodes[f].next[r]; ok && target != child {
+				m.nodes[child].fail = target
+			}
+			m.nodes[child].out = append(m.nodes[child].out, m.nodes[m.nodes[child].fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+// 查找全部匹配，返回各匹配的[起始, 结束)字符下标
+func (m *acMatcher) find(text []rune) [][2]int {
+	var matches [][2]int
+	cur := 0
+	for i, r := range text {
+		r = unicode.ToLower(r)
+		for cur > 0 {
+			if _, ok := m.nodes[cur].next[r]; ok {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		if nxt, ok := m.nodes[cur].next[r]; ok {
+			cur = nxt
+		}
+		for _, length := range m.nodes[cur].out {
+			matches = append(matches, [2]int{i + 1 - length, i + 1})
+		}
+	}
+	return matches
+}
+
+// 敏感词过滤器
+type sensitiveWordFilter struct {
+	matcher *acMatcher
+	groups  sync.Map // 群聊追加词的自动机缓存（key为quid，值为groupWordMatcher）
+}
+
+type groupWordMatcher struct {
+	words   string
+	matcher *acMatcher
+}
+
+func (f *sensitiveWordFilter) Name() string { return "sensitive_words" }
+
+func (f *sensitiveWordFilter) Apply(msg *filterMessage) *filterBlock {
+	if !msg.Inspectable || msg.Text == "" {
+		return nil
+	}
+	text := []rune(msg.Text)
+	matches := f.matcher.find(text)
+	if len(msg.Group.ExtraWords) > 0 {
+		matches = append(matches, f.groupMatcher(msg.ReceiverID, msg.Group.ExtraWords).find(text)...)
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	hits := make([]string, 0, len(matches))
+	for _, match := range matches {
+		hits = append(hits, string(text[match[0]:match[1]]))
+	}
+	// 群内只能收紧为拦截
+	action := cfg.MessageFilter.SensitiveWords.Action
+	if msg.Group.WordAction == "block" {
+		action = "block"
+	}
+	if action == "block" {
+		return &filterBlock{Reason: "消息包含敏感词，发送失败", Detail: map[string]interface{}{"words": hits}}
+	}
+	replacement := cfg.MessageFilter.SensitiveWords.Replacement
+	if replacement == "" {
+		replacement = "*"
+	}
+	masked := make([]bool, len(text))
+	for _, match := range matches {
+		for i := match[0]; i < match[1]; i++ {
+			masked[i] = true
+		}
+	}
+	var b strings.Builder
+	for i, r := range text {
+		if masked[i] {
+			b.WriteString(replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	msg.Text = b.String()
+	return nil
+}
+
+// 群聊追加词自动机（词表变化时重建）
+func (f *sensitiveWordFilter) groupMatcher(groupQUID string, words []string) *acMatcher {
+	key := strings.Join(words, "\n")
+	if v, ok := f.groups.Load(groupQUID); ok && v.(groupWordMatcher).words == key {
+		return v.(groupWordMatcher).matcher
+	}
+	matcher := newACMatcher(words)
+	f.groups.Store(groupQUID, groupWordMatcher{words: key, matcher: matcher})
+	return matcher
+}
+
+// 加载敏感词（配置中的词及词库文件，每行一个，#开头为注释）
+func loadSensitiveWords() ([]string, error) {
+	words := append([]string{}, cfg.MessageFilter.SensitiveWords.Words...)
+	path := cfg.MessageFilter.SensitiveWords.DictPath
+	if path == "" {
+		return words, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Warnf("敏感词库文件不存在: %s", path)
+			return words, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, nil
+}
+
+// 链接过滤器（只允许白名单域名及其子域名的链接）
+type linkFilter struct{}
+
+// 匹配带协议或www.前缀的链接，以及不带前缀的“域名.顶级域名[:端口][/路径]”（如evil.com/x）
+var linkPattern = regexp.MustCompile(`(?i)(?:https?://|www\.)[^\s<>"'，。）]+|\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}\b(?::\d{1,5})?(?:/[^\s<>"'，。）]*)?`)
+
+func (linkFilter) Name() string { return "link" }
+
+// 链接域名是否在白名单中
+func linkAllowed(link string, domains []string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (linkFilter) Apply(msg *filterMessage) *filterBlock {
+	if !msg.Inspectable {
+		return nil
+	}
+	var denied []string
+	msg.Text = linkPattern.ReplaceAllStringFunc(msg.Text, func(link string) string {
+		// 须在全局白名单内；群聊设置了白名单时还须同时在群白名单内
+		if linkAllowed(link, cfg.MessageFilter.Link.AllowDomains) &&
+			(len(msg.Group.AllowDomains) == 0 || linkAllowed(link, msg.Group.AllowDomains)) {
+			return link
+		}
+		denied = append(denied, link)
+		return "[链接已屏蔽]"
+	})
+	if len(denied) > 0 && cfg.MessageFilter.Link.Action != "replace" {
+		return &filterBlock{Reason: "消息包含不允许的链接，发送失败", Detail: map[string]interface{}{"links": denied}}
+	}
+	return nil
+}
+
+// 刷屏过滤器（窗口内消息数及重复内容次数，计数保存在Redis，集群共享）
+type floodFilter struct{}
+
+func (floodFilter) Name() string { return "flood" }
+
+// 窗口计数（首次计数时设置过期时间）
+func incrWindowCounter(key string, window int) int64 {
+	ctx := context.Background()
+	count, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return 0
+	}
+	if count == 1 {
+		rdb.Expire(ctx, key, time.Duration(window)*time.Second)
+	}
+	return count
+}
+
+func (floodFilter) Apply(msg *filterMessage) *filterBlock {
+	conf := cfg.MessageFilter.Flood
+	if conf.Window > 0 && conf.MaxMessages > 0 {
+		if count := incrWindowCounter("msg_flood:"+msg.SenderFUID, conf.Window); count > int64(conf.MaxMessages) {
+			return &filterBlock{Reason: "发送消息过于频繁，请稍后再试", Detail: map[string]interface{}{"count": count, "window": conf.Window}}
+		}
+	}
+	// 群聊单独计数（只对本群生效，上限取群设置与全局的较小值）
+	if limit := groupFloodLimit(conf.MaxMessages, msg.Group.FloodMax); conf.Window > 0 && msg.ReceiverType == 2 && limit > 0 {
+		key := fmt.Sprintf("msg_flood:%s:%s", msg.SenderFUID, msg.ReceiverID)
+		if count := incrWindowCounter(key, conf.Window); count > int64(limit) {
+			return &filterBlock{Reason: "发送消息过于频繁，请稍后再试", Detail: map[string]interface{}{"count": count, "window": conf.Window, "group_limit": limit}}
+		}
+	}
+	if msg.Inspectable && msg.Text != "" && conf.RepeatWindow > 0 && conf.MaxRepeats > 0 {
+		sum := sha256.Sum256([]byte(msg.Text))
+		key := fmt.Sprintf("msg_repeat:%s:%s:%s", msg.SenderFUID, msg.ReceiverID, hex.EncodeToString(sum[:8]))
+		if count := incrWindowCounter(key, conf.RepeatWindow); count > int64(conf.MaxRepeats) {
+			return &filterBlock{Reason: "请勿重复发送相同内容", Detail: map[string]interface{}{"count": count, "window": conf.RepeatWindow}}
+		}
+	}
+	return nil
+}
+
+// 群聊刷屏上限（未设置时为0，不单独计数）
+func groupFloodLimit(global, group int) int {
+	if group <= 0 {
+		return 0
+	}
+	if global > 0 && global < group {
+		return global
+	}
+	return group
+}
+
+// 初始化内置过滤器（刷屏、敏感词、链接）
+func initMessageFilters() error {
+	if !cfg.MessageFilter.Enable {
+		return nil
+	}
+	if cfg.MessageFilter.Flood.Enable {
+		registerMessageFilter(floodFilter{})
+	}
+	if cfg.MessageFilter.SensitiveWords.Enable {
+		words, err := loadSensitiveWords()
+		if err != nil {
+			return err
+		}
+		registerMessageFilter(&sensitiveWordFilter{matcher: newACMatcher(words)})
+		log.Infof("敏感词过滤器加载成功，共%d个词", len(words))
+	}
+	if cfg.MessageFilter.Link.Enable {
+		registerMessageFilter(linkFilter{})
+	}
+	return nil
+}
+
+// 查询群聊过滤设置（群主、群管理员）
+func getGroupFilterHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	groupQUID := c.Param("quid")
+	var member GroupMember
+	err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1 AND role IN ?", groupQUID, currentFUID, []uint8{1, 2}).First(&member).Error
+	if err != nil {
+		fail(c, 403, "仅群主和管理员可查看过滤设置")
+		return
+	}
+	filters := make([]string, 0, len(messageFilters))
+	optional := make([]string, 0)
+	for _, f := range messageFilters {
+		filters = append(filters, f.Name())
+		if filterGroupOptional(f) {
+			optional = append(optional, f.Name())
+		}
+	}
+	success(c, map[string]interface{}{
+		"config":   loadGroupFilterConfig(groupQUID),
+		"filters":  filters,  // 当前启用的过滤器
+		"optional": optional, // 可在本群停用的过滤器
+	})
+}
+
+// 修改群聊过滤设置（仅群主）
+func updateGroupFilterHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	groupQUID := c.Param("quid")
+	var group Group
+	if err := db.Where("quid = ? AND owner_fuid = ? AND status = 1", groupQUID, currentFUID).First(&group).Error; err != nil {
+		fail(c, 403, "仅群主可修改过滤设置")
+		return
+	}
+	var req struct {
+		Disabled     []string `json:"disabled" binding:"max=20"`
+		WordAction   string   `json:"word_action" binding:"omitempty,oneof=replace block"`
+		ExtraWords   []string `json:"extra_words" binding:"max=200,dive,max=32"`
+		AllowDomains []string `json:"allow_domains" binding:"max=50,dive,max=128"`
+		FloodMax     int      `json:"flood_max" binding:"min=0,max=1000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	config := groupFilterConfig{
+		Disabled:     req.Disabled,
+		WordAction:   req.WordAction,
+		ExtraWords:   req.ExtraWords,
+		AllowDomains: req.AllowDomains,
+		FloodMax:     req.FloodMax,
+	}
+	if err := validateGroupFilterConfig(config); err != nil {
+		fail(c, 400, err.Error())
+		return
+	}
+	encoded, _ := json.Marshal(config)
+	setting := GroupFilterSetting{GroupQUID: groupQUID, Config: string(encoded), UpdatedBy: currentFUID}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "group_quid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"config", "updated_by", "updated_at"}),
+	}).Create(&setting).Error
+	if err != nil {
+		fail(c, 500, "保存过滤设置失败")
+		return
+	}
+	groupFilterCache.Delete(groupQUID)
+	recordGroupAudit(c, groupQUID, "group_filter_updated", "group", groupQUID, map[string]interface{}{
+		"disabled":      req.Disabled,
+		"word_action":   req.WordAction,
+		"extra_words":   len(req.ExtraWords),
+		"allow_domains": req.AllowDomains,
+		"flood_max":     req.FloodMax,
+	})
+	success(c, config)
+}
+
+// 发送消息（消息管道：校验、过滤、分配序号、持久化、离线存储、推送）
+func sendMessage(senderFUID string, req sendMessageRequest) (*Message, *apiError) {
+	// 账号发送限制（全局禁言、仅限好友）
+	restrictions := loadSendRestrictions(senderFUID)
+	if apiErr := checkSendRestrictions(senderFUID, restrictions, req.ReceiverType, req.ReceiverID); apiErr != nil {
+		return nil, apiErr
+	}
+	// 验证接收方合法性
+	if apiErr := checkSendPermission(senderFUID, req.ReceiverType, req.ReceiverID); apiErr != nil {
+		return nil, apiErr
+	}
+	// 生成消息ID（客户端可预先生成，用于内容信封的关联数据）
+	msgID := req.MsgID
+	if msgID == "" {
+		var err error
+		msgID, err = generateUniqueID(32)
+		if err != nil {
+			return nil, &apiError{500, "生成消息ID失败: " + err.Error()}
+		}
+	} else {
+		var exists int64
+		db.Model(&Message{}).Where("msg_id = ?", msgID).Count(&exists)
+		if exists > 0 {
+			return nil, &apiError{409, "消息ID已存在"}
+		}
+	}
+	// 校验内容信封与消息ID、会话绑定（旧版整段RSA密文不校验）
+	if req.Encryption == 0 && isVersionedEnvelope(req.Content) {
+		if req.MsgID == "" {
+			return nil, &apiError{400, "使用内容信封时须由客户端生成msg_id"}
+		}
+		convID := getConversationID(req.ReceiverType, senderFUID, req.ReceiverID)
+		if _, _, err := openEnvelope(req.Content, msgID, convID); err != nil {
+			return nil, &apiError{400, "消息内容校验失败（信封与消息ID或会话不匹配）"}
+		}
+	}
+	// 内容过滤（敏感词、链接、刷屏等，可能替换内容或拦截）
+	if apiErr := filterOutgoingMessage(senderFUID, &req, msgID); apiErr != nil {
+		return nil, apiErr
+	}
+	// 处理字体参数默认值
+	fontStyle := req.FontStyle
+	if fontStyle == "" {
+		fontStyle = "思源黑体"
+	}
+	fontSize := req.FontSize
+	if fontSize <= 0 {
+		fontSize = 14
+	}
+	fontColor := req.FontColor
+	if fontColor == "" {
+		fontColor = "#000000"
+	}
+	// 创建消息记录
+	message := Message{
+		MsgID:        msgID,
+		SenderFUID:   senderFUID,
+		ReceiverType: req.ReceiverType,
+		ReceiverID:   req.ReceiverID,
+		ContentType:  req.ContentType,
+		Content:      req.Content, // 已加密内容
+		Encryption:   req.Encryption,
+		FontStyle:    fontStyle,
+		FontSize:     fontSize,
+		FontColor:    fontColor,
+		IsRecalled:   false,
+		IsRead:       false,
+		SendTime:     time.Now(),
+	}
+	// 影子封禁：照常保存，但只有发送者可见
+	message.Shadow = restrictionActive(restrictions.ShadowBanUntil)
+	if message.Shadow {
+		return saveShadowMessage(&message)
+	}
+	// 分配会话序号
+	if err := assignMessageSeq(&message); err != nil {
+		return nil, &apiError{500, "分配消息序号失败: " + err.Error()}
+	}
+	if err := db.Create(&message).Error; err != nil {
+		// 序号已分配但消息未保存，记为作废，避免客户端反复补拉
+		voidConversationSeq(message.ConvID, message.Seq)
+		return nil, &apiError{500, "保存消息失败: " + err.Error()}
+	}
+	// 处理离线消息
+	go saveOfflineMessage(req.ReceiverType, req.ReceiverID, msgID)
+	// 推送消息（socket.io/WebSocket）
+	go pushMessageToClient(message)
+	// 发送ntfy推送（离线时）
+	go func() {
+		var targetFUIDs []string
+		if req.ReceiverType == 1 {
+			targetFUIDs = append(targetFUIDs, req.ReceiverID)
+		} else {
+			// 群聊：获取所有在线成员（排除自己）
+			var members []GroupMember
+			db.Where("group_quid = ? AND user_fuid != ? AND status = 1", req.ReceiverID, senderFUID).Find(&members)
+			for _, m := range members {
+				targetFUIDs = append(targetFUIDs, m.UserFUID)
+			}
+		}
+		// 服务端不解密消息内容，推送仅提示有新消息
+		var preview string
+		if req.ReceiverType == 1 {
+			var sender User
+			db.Select("nickname").Where("fuid = ?", senderFUID).First(&sender)
+			preview = fmt.Sprintf("%s 给你发来一条新消息", sender.Nickname)
+		} else {
+			var group Group
+			db.Select("name").Where("quid = ?", req.ReceiverID).First(&group)
+			preview = fmt.Sprintf("群聊「%s」有一条新消息", group.Name)
+		}
+		// 检查用户是否在线（Redis中存在则在线）
+		ctx := context.Background()
+		for _, fuid := range targetFUIDs {
+			online, err := rdb.Exists(ctx, "online_user:"+fuid).Result()
+			if err != nil || online == 0 {
+				// 离线推送
+				if cfg.Business.Notify.Ntfy.Enable {
+					var title string
+					if req.ReceiverType == 1 {
+						title = "好友消息"
+					} else {
+						title = "群聊消息"
+					}
+					sendNtfyNotification(title, preview, fuid)
+				}
+			}
+		}
+	}()
+	log.Infof("Send message: msg_id=%s, sender=%s, receiver_type=%d, receiver_id=%s",
+		msgID, senderFUID, req.ReceiverType, req.ReceiverID)
+	return &message, nil
+}
+
+// 发送消息接口
+func sendMessageHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req sendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	message, apiErr := sendMessage(currentFUID, req)
+	if apiErr != nil {
+		fail(c, apiErr.Code, apiErr.Msg)
+		return
+	}
+	success(c, map[string]interface{}{
+		"msg_id":    message.MsgID,
+		"conv_id":   message.ConvID,
+		"seq":       message.Seq,
+		"send_time": message.SendTime.Format("2006-01-02 15:04:05"),
+	})
+}
+
+// 撤回消息（HTTP/WebSocket共用）
+func recallMessage(senderFUID, msgID string) *apiError {
+	// 查询消息
+	var message Message
+	err := db.Where("msg_id = ? AND sender_fuid = ?", msgID, senderFUID).First(&message).Error
+	if err != nil {
+		return &apiError{400, "消息不存在或不是你发送的"}
+	}
+	// 检查是否超过撤回时间
+	recallTimeout := time.Duration(cfg.Business.Message.RecallTimeout) * time.Second
+	if time.Since(message.SendTime) > recallTimeout {
+		return &apiError{400, fmt.Sprintf("消息超过%d分钟，无法撤回", cfg.Business.Message.RecallTimeout/60)}
+	}
+	// 更新消息为已撤回
+	err = db.Model(&message).Update("is_recalled", true).Error
+	if err != nil {
+		return &apiError{500, "撤回消息失败: " + err.Error()}
+	}
+	// 推送撤回通知
+	go pushRecallMessageToClient(message)
+	log.Infof("Recall message: msg_id=%s, sender=%s", msgID, senderFUID)
+	return nil
+}
+
+// 撤回消息接口
+func recallMessageHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取消息ID
+	msgID := c.Param("msg_id")
+	if msgID == "" {
+		fail(c, 400, "消息ID不能为空")
+		return
+	}
+	if apiErr := recallMessage(currentFUID, msgID); apiErr != nil {
+		fail(c, apiErr.Code, apiErr.Msg)
+		return
+	}
+	success(c, map[string]string{"msg": "撤回消息成功"})
+}
+
+// 发送正在输入状态（HTTP/WebSocket/Socket.IO共用，不持久化）
+func sendTyping(senderFUID string, receiverType uint8, receiverID string) *apiError {
+	if receiverType != 1 && receiverType != 2 {
+		return &apiError{400, "接收类型错误"}
+	}
+	if apiErr := checkSendPermission(senderFUID, receiverType, receiverID); apiErr != nil {
+		return apiErr
+	}
+	room := "user:" + receiverID
+	if receiverType == 2 {
+		room = "group:" + receiverID
+	}
+	broadcastToRoom(room, "typing", map[string]interface{}{
+		"sender_fuid":   senderFUID,
+		"receiver_type": receiverType,
+		"receiver_id":   receiverID,
+		"conv_id":       getConversationID(receiverType, senderFUID, receiverID),
+		"timestamp":     time.Now().Unix(),
+	})
+	return nil
+}
+
+// 保存离线消息
+func saveOfflineMessage(receiverType uint8, receiverID string, msgID string) {
+	ctx := context.Background()
+	if receiverType == 1 {
+		// 单聊：保存到接收方离线消息
+		offlineMsg := OfflineMessage{
+			UserFUID: receiverID,
+			MsgID:    msgID,
+			Status:   0,
+		}
+		db.Create(&offlineMsg)
+		// Redis记录离线消息数
+		rdb.Incr(ctx, "offline_msg_count:"+receiverID)
+	} else {
+		// 群聊：保存到所有离线成员
+		var members []GroupMember
+		db.Where("group_quid = ? AND status = 1", receiverID).Find(&members)
+		for _, member := range members {
+			// 检查是否在线
+			online, err := rdb.Exists(ctx, "online_user:"+member.UserFUID).Result()
+			if err != nil || online == 0 {
+				offlineMsg := OfflineMessage{
+					UserFUID: member.UserFUID,
+					MsgID:    msgID,
+					Status:   0,
+				}
+				db.Create(&offlineMsg)
+				// Redis记录离线消息数
+				rdb.Incr(ctx, "offline_msg_count:"+member.UserFUID)
+			}
+		}
+	}
+}
+
+// 推送消息到客户端（socket.io）
+func pushMessageToClient(message Message) {
+	// 构建推送数据
+	pushData := buildMessageData(message)
+	// 获取发送者信息
+	var sender User
+	db.Where("fuid = ?", message.SenderFUID).Select("nickname, vip_level").First(&sender)
+	pushData["sender_nickname"] = sender.Nickname
+	pushData["sender_vip_level"] = sender.VIPLevel
+
+	ctx := context.Background()
+	if message.ReceiverType == 1 {
+		// 单聊：推送给接收方
+		groupID := "user:" + message.ReceiverID
+		// 检查接收方是否在线
+		online, err := rdb.Exists(ctx, "online_user:"+message.ReceiverID).Result()
+		if err == nil && online > 0 {
+			// 通过socket.io推送（跨节点广播）
+			broadcastToRoom(groupID, "new_message", pushData)
+			// 更新已读状态
+			db.Model(&message).Update("is_read", true)
+		}
+	} else {
+		// 群聊：推送给所有在线成员
+		groupID := "group:" + message.ReceiverID
+		broadcastToRoom(groupID, "new_message", pushData)
+		// 更新已读状态（在线成员）
+		var members []GroupMember
+		db.Where("group_quid = ? AND status = 1", message.ReceiverID).Find(&members)
+		for _, m := range members {
+			online, err := rdb.Exists(ctx, "online_user:"+m.UserFUID).Result()
+			if err == nil && online > 0 {
+				// 简化处理：群消息已读状态按用户维度，此处省略
+			}
+		}
+	}
+}
+
+// 推送撤回消息通知
+func pushRecallMessageToClient(message Message) {
+	pushData := map[string]interface{}{
+		"msg_id":      message.MsgID,
+		"conv_id":     message.ConvID,
+		"seq":         message.Seq,
+		"is_recalled": true,
+		"recall_time": time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if message.Shadow {
+		// 影子消息不通知其他人；群聊消息改为通知发送者自己的其他设备（与正常撤回时经群房间送达一致）
+		if message.ReceiverType == 2 {
+			broadcastToRoom("user:"+message.SenderFUID, "recall_message", pushData)
+		}
+		return
+	}
+	if message.ReceiverType == 1 {
+		groupID := "user:" + message.ReceiverID
+		broadcastToRoom(groupID, "recall_message", pushData)
+	} else {
+		groupID := "group:" + message.ReceiverID
+		broadcastToRoom(groupID, "recall_message", pushData)
+	}
+}
+
+// 构建消息数据（推送/离线/历史查询共用）
+func buildMessageData(msg Message) map[string]interface{} {
+	return map[string]interface{}{
+		"msg_id":        msg.MsgID,
+		"conv_id":       msg.ConvID,
+		"seq":           msg.Seq,
+		"sender_fuid":   msg.SenderFUID,
+		"receiver_type": msg.ReceiverType,
+		"receiver_id":   msg.ReceiverID,
+		"content_type":  msg.ContentType,
+		"content":       msg.Content,
+		"encryption":    msg.Encryption,
+		"font_style":    msg.FontStyle,
+		"font_size":     msg.FontSize,
+		"font_color":    msg.FontColor,
+		"is_recalled":   msg.IsRecalled,
+		"send_time":     msg.SendTime.Format("2006-01-02 15:04:05"),
+	}
+}
+
+// 获取会话ID（单聊按双方fuid排序，保证双方一致）
+func getConversationID(receiverType uint8, senderFUID, receiverID string) string {
+	if receiverType == 2 {
+		return "group:" + receiverID
+	}
+	if senderFUID > receiverID {
+		senderFUID, receiverID = receiverID, senderFUID
+	}
+	return fmt.Sprintf("single:%s:%s", senderFUID, receiverID)
+}
+
+// 分配会话内严格递增的消息序号（Redis INCR）
+func nextConversationSeq(convID string) (uint64, error) {
+	ctx := context.Background()
+	key := "conv_seq:" + convID
+	// Redis中无序号时（首次使用或缓存丢失），以数据库中已有的最大序号为起点
+	exists, err := rdb.Exists(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		var maxSeq uint64
+		if err := db.Model(&Message{}).Where("conv_id = ?", convID).
+			Select("COALESCE(MAX(seq), 0)").Scan(&maxSeq).Error; err != nil {
+			return 0, err
+		}
+		if err := rdb.SetNX(ctx, key, maxSeq, 0).Err(); err != nil {
+			return 0, err
+		}
+	}
+	seq, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(seq), nil
+}
+
+// 会话当前最新序号（Redis中无序号时取数据库中的最大序号）
+func latestConversationSeq(convID string) uint64 {
+	latest, err := rdb.Get(context.Background(), "conv_seq:"+convID).Uint64()
+	if err != nil {
+		db.Model(&Message{}).Where("conv_id = ?", convID).Select("COALESCE(MAX(seq), 0)").Scan(&latest)
+	}
+	return latest
+}
+
+// 记录作废的序号（已分配但消息未能保存），区间查询时告知客户端该序号永久为空
+func voidConversationSeq(convID string, seq uint64) {
+	if err := rdb.SAdd(context.Background(), "conv_seq_void:"+convID, seq).Err(); err != nil {
+		log.Errorf("记录作废序号失败: conv_id=%s, seq=%d, err=%v", convID, seq, err)
+	}
+}
+
+// 区间[start, end]内作废的序号（升序）
+func voidConversationSeqs(convID string, start, end uint64) []uint64 {
+	members, _ := rdb.SMembers(context.Background(), "conv_seq_void:"+convID).Result()
+	seqs := make([]uint64, 0)
+	for _, member := range members {
+		seq, err := strconv.ParseUint(member, 10, 64)
+		if err == nil && seq >= start && seq <= end {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// 为消息设置会话ID和序号
+func assignMessageSeq(message *Message) error {
+	message.ConvID = getConversationID(message.ReceiverType, message.SenderFUID, message.ReceiverID)
+	seq, err := nextConversationSeq(message.ConvID)
+	if err != nil {
+		return err
+	}
+	message.Seq = seq
+	return nil
+}
+
+// 按序号区间拉取会话消息接口（用于客户端补齐缺失消息）
+func getMessageRangeHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 参数绑定
+	var req struct {
+		ReceiverType uint8  `form:"receiver_type" binding:"required,oneof=1 2"` // 1:单聊 2:群聊
+		ReceiverID   string `form:"receiver_id" binding:"required"`             // 单聊:好友FUID 群聊:群QUID
+		StartSeq     uint64 `form:"start_seq"`                                  // 起始序号（包含）
+		EndSeq       uint64 `form:"end_seq"`                                    // 结束序号（包含），0表示不限
+		Limit        int    `form:"limit" binding:"max=500"`                    // 最大条数，默认100
+	}
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if req.EndSeq > 0 && req.EndSeq < req.StartSeq {
+		fail(c, 400, "结束序号不能小于起始序号")
+		return
+	}
+	// 群聊需验证群成员身份，且只能拉取加入之后的消息（单聊会话ID由自己的fuid计算，天然只能访问自己的会话）
+	var minSeq uint64
+	if req.ReceiverType == 2 {
+		var member GroupMember
+		if err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.ReceiverID, currentFUID).First(&member).Error; err != nil {
+			fail(c, 403, "你不是该群成员，无法查看消息")
+			return
+		}
+		minSeq = member.JoinSeq + 1
+	}
+	startSeq := req.StartSeq
+	if startSeq < minSeq {
+		startSeq = minSeq
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	convID := getConversationID(req.ReceiverType, currentFUID, req.ReceiverID)
+	query := db.Where("conv_id = ? AND seq >= ? AND (shadow = 0 OR sender_fuid = ?)", convID, startSeq, currentFUID)
+	if req.EndSeq > 0 {
+		query = query.Where("seq <= ?", req.EndSeq)
+	}
+	var messages []Message
+	// 影子消息与锚点序号的消息同序号，按ID排在其后
+	if err := query.Order("seq ASC, id ASC").Limit(limit).Find(&messages).Error; err != nil {
+		fail(c, 500, "查询消息失败: "+err.Error())
+		return
+	}
+	// 当前会话最新序号
+	latestSeq := latestConversationSeq(convID)
+	result := make([]map[string]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, buildMessageData(msg))
+	}
+	// 本次查询覆盖的区间内永久为空的序号（消息保存失败），客户端无需再补拉
+	endSeq := latestSeq
+	if req.EndSeq > 0 && req.EndSeq < endSeq {
+		endSeq = req.EndSeq
+	}
+	if len(messages) == limit {
+		endSeq = messages[len(messages)-1].Seq
+	}
+	success(c, map[string]interface{}{
+		"conv_id":    convID,
+		"latest_seq": latestSeq,
+		"min_seq":    minSeq, // 可拉取的最小序号（群聊为加入之后）
+		"empty_seqs": voidConversationSeqs(convID, startSeq, endSeq),
+		"messages":   result,
+	}, int64(len(result)))
+}
+
+// 端到端加密密钥目录（X3DH）
+//
+// 每台设备上传身份公钥(X25519)、签名公钥(Ed25519)、签名预密钥及一批一次性预密钥；
+// 发起方获取对方各设备的预密钥包后在本地完成X3DH协商，服务端只保存和分发公钥，不参与也无法解密会话。
+
+// 签名预密钥上传参数
+type signedPreKeyUpload struct {
+	KeyID     uint32 `json:"key_id" binding:"required"`
+	PublicKey string `json:"public_key" binding:"required"` // X25519公钥(base64)
+	Signature string `json:"signature" binding:"required"`  // 签名公钥对public_key原始字节的签名(base64)
+}
+
+// 一次性预密钥上传参数
+type oneTimePreKeyUpload struct {
+	KeyID     uint32 `json:"key_id" binding:"required"`     // 非0，同一批次内不能重复
+	PublicKey string `json:"public_key" binding:"required"` // X25519公钥(base64)
+}
+
+// 一次性预密钥数量上限
+func maxOneTimePreKeys() int {
+	if cfg.Crypto.E2EE.MaxOneTimePreKeys > 0 {
+		return cfg.Crypto.E2EE.MaxOneTimePreKeys
+	}
+	return 200
+}
+
+// 一次性预密钥不足提醒阈值
+func preKeyLowThreshold() int64 {
+	if cfg.Crypto.E2EE.PreKeyLowThreshold > 0 {
+		return int64(cfg.Crypto.E2EE.PreKeyLowThreshold)
+	}
+	return 10
+}
+
+// 解码32字节公钥（base64）
+func decodePublicKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("公钥不是合法的base64")
+	}
+	if len(key) != 32 {
+		return nil, errors.New("公钥长度必须为32字节")
+	}
+	return key, nil
+}
+
+// 校验Ed25519签名（signingKey对data的签名）
+func verifyKeySignature(signingKey, data []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("签名格式错误")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(signingKey), data, sig) {
+		return errors.New("签名校验失败")
+	}
+	return nil
+}
+
+// 保存签名预密钥（旧的标记为已轮换，仍可用于已建立的会话）
+func storeSignedPreKey(fuid, deviceID string, signingKey []byte, spk signedPreKeyUpload) *apiError {
+	publicKey, err := decodePublicKey(spk.PublicKey)
+	if err != nil {
+		return &apiError{400, "签名预密钥错误: " + err.Error()}
+	}
+	if err := verifyKeySignature(signingKey, publicKey, spk.Signature); err != nil {
+		return &apiError{400, "签名预密钥错误: " + err.Error()}
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&SignedPreKey{}).Where("user_fuid = ? AND device_id = ? AND status = 1", fuid, deviceID).
+			Update("status", 0).Error; err != nil {
+			return err
+		}
+		return tx.Create(&SignedPreKey{
+			UserFUID:  fuid,
+			DeviceID:  deviceID,
+			KeyID:     spk.KeyID,
+			PublicKey: spk.PublicKey,
+			Signature: spk.Signature,
+			Status:    1,
+		}).Error
+	})
+	if err != nil {
+		return &apiError{500, "保存签名预密钥失败: " + err.Error()}
+	}
+	return nil
+}
+
+// 保存一次性预密钥（批次内key_id须非0且不重复；与已保存的key_id重复时忽略），返回当前剩余数量
+func storeOneTimePreKeys(fuid, deviceID string, keys []oneTimePreKeyUpload) (int64, *apiError) {
+	var remaining int64
+	db.Model(&OneTimePreKey{}).Where("user_fuid = ? AND device_id = ?", fuid, deviceID).Count(&remaining)
+	if len(keys) == 0 {
+		return remaining, nil
+	}
+	if remaining+int64(len(keys)) > int64(maxOneTimePreKeys()) {
+		return remaining, &apiError{400, fmt.Sprintf("一次性预密钥数量超过上限%d（当前剩余%d）", maxOneTimePreKeys(), remaining)}
+	}
+	records := make([]OneTimePreKey, 0, len(keys))
+	seen := make(map[uint32]bool, len(keys))
+	for _, k := range keys {
+		if k.KeyID == 0 || seen[k.KeyID] {
+			return remaining, &apiError{400, fmt.Sprintf("一次性预密钥key_id无效或重复: %d", k.KeyID)}
+		}
+		seen[k.KeyID] = true
+		if _, err := decodePublicKey(k.PublicKey); err != nil {
+			return remaining, &apiError{400, fmt.Sprintf("一次性预密钥%d错误: %s", k.KeyID, err.Error())}
+		}
+		records = append(records, OneTimePreKey{UserFUID: fuid, DeviceID: deviceID, KeyID: k.KeyID, PublicKey: k.PublicKey})
+	}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&records).Error; err != nil {
+		return remaining, &apiError{500, "保存一次性预密钥失败: " + err.Error()}
+	}
+	db.Model(&OneTimePreKey{}).Where("user_fuid = ? AND device_id = ?", fuid, deviceID).Count(&remaining)
+	return remaining, nil
+}
+
+// 领取一个一次性预密钥（领取即删除，并发请求跳过已锁定的行），返回剩余数量
+func claimOneTimePreKey(fuid, deviceID string) (*OneTimePreKey, int64) {
+	var claimed *OneTimePreKey
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var key OneTimePreKey
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("user_fuid = ? AND device_id = ?", fuid, deviceID).
+			Order("id ASC").First(&key).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&key).Error; err != nil {
+			return err
+		}
+		claimed = &key
+		return nil
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Error("领取一次性预密钥失败: ", err)
+	}
+	var remaining int64
+	db.Model(&OneTimePreKey{}).Where("user_fuid = ? AND device_id = ?", fuid, deviceID).Count(&remaining)
+	return claimed, remaining
+}
+
+// 提醒设备补充一次性预密钥
+func notifyPreKeyLow(fuid, deviceID string, remaining int64) {
+	broadcastToRoom("user:"+fuid, "prekey_low", map[string]interface{}{
+		"device_id": deviceID,
+		"remaining": remaining,
+	})
+}
+
+// 删除设备的全部密钥（设备下线/被踢出时调用）
+func purgeDeviceKeys(fuid, deviceID string) {
+	db.Where("user_fuid = ? AND device_id = ?", fuid, deviceID).Delete(&OneTimePreKey{})
+	db.Where("user_fuid = ? AND device_id = ?", fuid, deviceID).Delete(&SignedPreKey{})
+	db.Where("user_fuid = ? AND device_id = ?", fuid, deviceID).Delete(&DeviceIdentityKey{})
+	db.Where("recipient_fuid = ? AND recipient_device_id = ?", fuid, deviceID).Delete(&SenderKeyDistribution{})
+}
+
+// 是否允许获取目标用户的预密钥包（本人其他设备、好友、同群成员）
+func canFetchPreKeys(requesterFUID, targetFUID string) bool {
+	if requesterFUID == targetFUID {
+		return true
+	}
+	var count int64
+	db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 1", requesterFUID, targetFUID).Count(&count)
+	if count > 0 {
+		return true
+	}
+	db.Table("group_members AS a").
+		Joins("JOIN group_members AS b ON a.group_quid = b.group_quid").
+		Where("a.user_fuid = ? AND b.user_fuid = ? AND a.status = 1 AND b.status = 1", requesterFUID, targetFUID).
+		Count(&count)
+	return count > 0
+}
+
+// 上传设备密钥接口（首次上传身份密钥，之后可轮换签名预密钥、追加一次性预密钥）
+func uploadDeviceKeysHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		IdentityKey       string                `json:"identity_key" binding:"required"`
+		SigningKey        string                `json:"signing_key" binding:"required"`
+		IdentitySignature string                `json:"identity_signature" binding:"required"`
+		SignedPreKey      signedPreKeyUpload    `json:"signed_prekey" binding:"required"`
+		OneTimePreKeys    []oneTimePreKeyUpload `json:"one_time_prekeys" binding:"max=100,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	identityKey, err := decodePublicKey(req.IdentityKey)
+	if err != nil {
+		fail(c, 400, "身份公钥错误: "+err.Error())
+		return
+	}
+	signingKey, err := decodePublicKey(req.SigningKey)
+	if err != nil {
+		fail(c, 400, "签名公钥错误: "+err.Error())
+		return
+	}
+	if err := verifyKeySignature(signingKey, identityKey, req.IdentitySignature); err != nil {
+		fail(c, 400, "身份公钥"+err.Error())
+		return
+	}
+
+	// 身份密钥与设备绑定，不允许替换（更换密钥需重新登录设备）
+	var existing DeviceIdentityKey
+	err = db.Where("user_fuid = ? AND device_id = ?", currentFUID, deviceID).First(&existing).Error
+	if err == nil {
+		if existing.IdentityKey != req.IdentityKey || existing.SigningKey != req.SigningKey {
+			fail(c, 409, "该设备已上传身份密钥，不允许替换，请重新登录设备")
+			return
+		}
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		if err := db.Create(&DeviceIdentityKey{
+			UserFUID:          currentFUID,
+			DeviceID:          deviceID,
+			IdentityKey:       req.IdentityKey,
+			SigningKey:        req.SigningKey,
+			IdentitySignature: req.IdentitySignature,
+		}).Error; err != nil {
+			fail(c, 500, "保存身份密钥失败: "+err.Error())
+			return
+		}
+	} else {
+		fail(c, 500, "查询身份密钥失败: "+err.Error())
+		return
+	}
+
+	if apiErr := storeSignedPreKey(currentFUID, deviceID, signingKey, req.SignedPreKey); apiErr != nil {
+		fail(c, apiErr.Code, apiErr.Msg)
+		return
+	}
+	remaining, apiErr := storeOneTimePreKeys(currentFUID, deviceID, req.OneTimePreKeys)
+	if apiErr != nil {
+		fail(c, apiErr.Code, apiErr.Msg)
+		return
+	}
+	success(c, map[string]interface{}{
+		"device_id":                 deviceID,
+		"one_time_prekey_count":     remaining,
+		"max_one_time_prekey_count": maxOneTimePreKeys(),
+	})
+	log.Infof("Device keys uploaded: fuid=%s, device_id=%s, one_time_prekeys=%d", currentFUID, deviceID, remaining)
+}
+
+// 补充预密钥接口（追加一次性预密钥，可同时轮换签名预密钥）
+func replenishPreKeysHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		SignedPreKey   *signedPreKeyUpload   `json:"signed_prekey"`
+		OneTimePreKeys []oneTimePreKeyUpload `json:"one_time_prekeys" binding:"max=100,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	var identity DeviceIdentityKey
+	if err := db.Where("user_fuid = ? AND device_id = ?", currentFUID, deviceID).First(&identity).Error; err != nil {
+		fail(c, 400, "请先上传设备身份密钥")
+		return
+	}
+	if req.SignedPreKey != nil {
+		signingKey, err := decodePublicKey(identity.SigningKey)
+		if err != nil {
+			fail(c, 500, "设备签名公钥损坏")
+			return
+		}
+		if apiErr := storeSignedPreKey(currentFUID, deviceID, signingKey, *req.SignedPreKey); apiErr != nil {
+			fail(c, apiErr.Code, apiErr.Msg)
+			return
+		}
+	}
+	remaining, apiErr := storeOneTimePreKeys(currentFUID, deviceID, req.OneTimePreKeys)
+	if apiErr != nil {
+		fail(c, apiErr.Code, apiErr.Msg)
+		return
+	}
+	success(c, map[string]interface{}{
+		"device_id":             deviceID,
+		"one_time_prekey_count": remaining,
+	})
+}
+
+// 查询本设备预密钥余量接口
+func getPreKeyCountHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var remaining int64
+	db.Model(&OneTimePreKey{}).Where("user_fuid = ? AND device_id = ?", currentFUID, deviceID).Count(&remaining)
+	var spk SignedPreKey
+	data := map[string]interface{}{
+		"device_id":                 deviceID,
+		"one_time_prekey_count":     remaining,
+		"max_one_time_prekey_count": maxOneTimePreKeys(),
+		"low_threshold":             preKeyLowThreshold(),
+	}
+	if err := db.Where("user_fuid = ? AND device_id = ? AND status = 1", currentFUID, deviceID).First(&spk).Error; err == nil {
+		data["signed_prekey_id"] = spk.KeyID
+		data["signed_prekey_created_at"] = spk.CreatedAt.Format("2006-01-02 15:04:05")
+	}
+	success(c, data)
+}
+
+// 获取预密钥包接口（每个设备领取一个一次性预密钥，用于发起X3DH）
+func getPreKeyBundleHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	targetFUID := c.Param("fuid")
+	if !canFetchPreKeys(currentFUID, targetFUID) {
+		fail(c, 403, "无权获取该用户的密钥")
+		return
+	}
+	// 限制获取频率，防止恶意耗尽对方的一次性预密钥
+	ctx := context.Background()
+	fetchKey := fmt.Sprintf("prekey_fetch:%s:%s", currentFUID, targetFUID)
+	fetchCount, _ := rdb.Incr(ctx, fetchKey).Result()
+	if fetchCount == 1 {
+		rdb.Expire(ctx, fetchKey, time.Minute)
+	}
+	if fetchCount > 20 {
+		fail(c, 429, "获取密钥过于频繁，请稍后再试")
+		return
+	}
+
+	// 只返回在线（未被踢出）设备的密钥
+	query := db.Where("user_fuid = ? AND device_id IN (?)", targetFUID,
+		db.Model(&Device{}).Select("device_id").Where("user_fuid = ? AND status = 1", targetFUID))
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if targetFUID == currentFUID {
+		query = query.Where("device_id != ?", currentIdentity(c).DeviceID)
+	}
+	var identities []DeviceIdentityKey
+	if err := query.Find(&identities).Error; err != nil {
+		fail(c, 500, "查询设备密钥失败: "+err.Error())
+		return
+	}
+	bundles := make([]map[string]interface{}, 0, len(identities))
+	for _, identity := range identities {
+		var spk SignedPreKey
+		if err := db.Where("user_fuid = ? AND device_id = ? AND status = 1", targetFUID, identity.DeviceID).First(&spk).Error; err != nil {
+			continue
+		}
+		bundle := map[string]interface{}{
+			"device_id":          identity.DeviceID,
+			"identity_key":       identity.IdentityKey,
+			"signing_key":        identity.SigningKey,
+			"identity_signature": identity.IdentitySignature,
+			"signed_prekey": map[string]interface{}{
+				"key_id":     spk.KeyID,
+				"public_key": spk.PublicKey,
+				"signature":  spk.Signature,
+			},
+		}
+		otpk, remaining := claimOneTimePreKey(targetFUID, identity.DeviceID)
+		if otpk != nil {
+			bundle["one_time_prekey"] = map[string]interface{}{
+				"key_id":     otpk.KeyID,
+				"public_key": otpk.PublicKey,
+			}
+		}
+		if remaining < preKeyLowThreshold() {
+			notifyPreKeyLow(targetFUID, identity.DeviceID, remaining)
+		}
+		bundles = append(bundles, bundle)
+	}
+	success(c, map[string]interface{}{
+		"fuid":    targetFUID,
+		"devices": bundles,
+	}, int64(len(bundles)))
+}
+
+// 群聊发送者密钥（Sender Key）分发
+//
+// 每个成员设备为群生成自己的发送者密钥，通过与其他成员设备的X3DH会话加密后，经服务端逐设备转发。
+// 服务端只保存不透明密文并记录哪些设备尚未收到；成员变动（加入、退出、踢出）时递增群密钥版本，
+// 所有成员须为新版本重新生成并分发发送者密钥，退出者无法解密之后的消息，新成员无法解密之前的消息。
+
+// 轮换群发送者密钥版本并通知在线成员
+func rotateGroupSenderKey(groupQUID, reason string) {
+	if err := db.Model(&Group{}).Where("quid = ?", groupQUID).
+		Update("key_epoch", gorm.Expr("key_epoch + 1")).Error; err != nil {
+		log.Error("轮换群发送者密钥版本失败: ", err)
+		return
+	}
+	var group Group
+	if err := db.Select("key_epoch").Where("quid = ?", groupQUID).First(&group).Error; err != nil {
+		log.Error("查询群发送者密钥版本失败: ", err)
+		return
+	}
+	broadcastToRoom("group:"+groupQUID, "group_key_rotate", map[string]interface{}{
+		"group_quid": groupQUID,
+		"epoch":      group.KeyEpoch,
+		"reason":     reason,
+	})
+	log.Infof("Group sender key rotated: group=%s, epoch=%d, reason=%s", groupQUID, group.KeyEpoch, reason)
+}
+
+// 删除成员离开后不应再收到的分发记录
+func dropSenderKeyDistributions(groupQUID, recipientFUID string) {
+	db.Where("group_quid = ? AND recipient_fuid = ? AND status = 0", groupQUID, recipientFUID).Delete(&SenderKeyDistribution{})
+}
+
+// 统计设备待接收的分发数量（仍在群内的）
+func countPendingSenderKeys(fuid, deviceID string) int64 {
+	var count int64
+	db.Model(&SenderKeyDistribution{}).
+		Where("recipient_fuid = ? AND recipient_device_id = ? AND status = 0", fuid, deviceID).
+		Where("group_quid IN (?)", db.Model(&GroupMember{}).Select("group_quid").Where("user_fuid = ? AND status = 1", fuid)).
+		Count(&count)
+	return count
+}
+
+// 查询群内需要接收发送者密钥的成员设备（在线设备，且已上传身份密钥）
+func groupKeyRecipients(groupQUID string) ([]DeviceIdentityKey, error) {
+	var devices []DeviceIdentityKey
+	err := db.Table("device_identity_keys AS k").
+		Select("k.user_fuid, k.device_id").
+		Joins("JOIN group_members AS m ON m.user_fuid = k.user_fuid AND m.group_quid = ? AND m.status = 1", groupQUID).
+		Joins("JOIN devices AS d ON d.user_fuid = k.user_fuid AND d.device_id = k.device_id AND d.status = 1").
+		Find(&devices).Error
+	return devices, err
+}
+
+// 分发发送者密钥接口
+func distributeSenderKeyHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		GroupQUID     string `json:"group_quid" binding:"required"`
+		Epoch         uint64 `json:"epoch"`
+		Distributions []struct {
+			RecipientFUID     string `json:"recipient_fuid" binding:"required"`
+			RecipientDeviceID string `json:"recipient_device_id" binding:"required"`
+			Payload           string `json:"payload" binding:"required,max=8192"`
+		} `json:"distributions" binding:"required,min=1,max=500,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if !isGroupMember(req.GroupQUID, currentFUID) {
+		fail(c, 403, "你不是该群成员")
+		return
+	}
+	var group Group
+	if err := db.Where("quid = ? AND status = 1", req.GroupQUID).First(&group).Error; err != nil {
+		fail(c, 404, "群聊不存在或已解散")
+		return
+	}
+	// 只接受当前版本的密钥，避免成员变动后仍分发旧密钥
+	if req.Epoch != group.KeyEpoch {
+		c.JSON(200, Response{Code: 409, Msg: "群密钥版本已变更，请重新生成发送者密钥", Data: map[string]interface{}{
+			"epoch": group.KeyEpoch,
+		}})
+		return
+	}
+	recipients, err := groupKeyRecipients(req.GroupQUID)
+	if err != nil {
+		fail(c, 500, "查询群成员设备失败: "+err.Error())
+		return
+	}
+	allowed := make(map[string]bool, len(recipients))
+	for _, r := range recipients {
+		allowed[r.UserFUID+"/"+r.DeviceID] = true
+	}
+	records := make([]SenderKeyDistribution, 0, len(req.Distributions))
+	notifyFUIDs := make(map[string]bool)
+	for _, d := range req.Distributions {
+		if d.RecipientFUID == currentFUID && d.RecipientDeviceID == deviceID {
+			continue
+		}
+		if !allowed[d.RecipientFUID+"/"+d.RecipientDeviceID] {
+			fail(c, 400, fmt.Sprintf("设备%s不是该群的有效成员设备", d.RecipientDeviceID))
+			return
+		}
+		records = append(records, SenderKeyDistribution{
+			GroupQUID:         req.GroupQUID,
+			Epoch:             req.Epoch,
+			SenderFUID:        currentFUID,
+			SenderDeviceID:    deviceID,
+			RecipientFUID:     d.RecipientFUID,
+			RecipientDeviceID: d.RecipientDeviceID,
+			Payload:           d.Payload,
+			Status:            0,
+		})
+		notifyFUIDs[d.RecipientFUID] = true
+	}
+	if len(records) > 0 {
+		// 同一版本重复分发时覆盖旧密文
+		err = db.Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]interface{}{"payload": gorm.Expr("VALUES(payload)"), "status": 0}),
+		}).Create(&records).Error
+		if err != nil {
+			fail(c, 500, "保存分发记录失败: "+err.Error())
+			return
+		}
+	}
+	for fuid := range notifyFUIDs {
+		go broadcastToRoom("user:"+fuid, "sender_key_distribution", map[string]interface{}{
+			"group_quid":       req.GroupQUID,
+			"epoch":            req.Epoch,
+			"sender_fuid":      currentFUID,
+			"sender_device_id": deviceID,
+		})
+	}
+	success(c, map[string]interface{}{"epoch": req.Epoch}, int64(len(records)))
+}
+
+// 获取本设备待接收的发送者密钥接口
+func getPendingSenderKeysHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	query := db.Where("recipient_fuid = ? AND recipient_device_id = ? AND status = 0", currentFUID, deviceID).
+		Where("group_quid IN (?)", db.Model(&GroupMember{}).Select("group_quid").Where("user_fuid = ? AND status = 1", currentFUID))
+	if groupQUID := c.Query("group_quid"); groupQUID != "" {
+		query = query.Where("group_quid = ?", groupQUID)
+	}
+	var distributions []SenderKeyDistribution
+	if err := query.Order("id ASC").Limit(500).Find(&distributions).Error; err != nil {
+		fail(c, 500, "查询分发记录失败: "+err.Error())
+		return
+	}
+	list := make([]map[string]interface{}, 0, len(distributions))
+	for _, d := range distributions {
+		list = append(list, map[string]interface{}{
+			"id":               d.ID,
+			"group_quid":       d.GroupQUID,
+			"epoch":            d.Epoch,
+			"sender_fuid":      d.SenderFUID,
+			"sender_device_id": d.SenderDeviceID,
+			"payload":          d.Payload,
+			"created_at":       d.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	success(c, list, int64(len(list)))
+}
+
+// 确认已接收发送者密钥接口（确认后服务端清除密文）
+func ackSenderKeysHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		IDs []uint64 `json:"ids" binding:"required,min=1,max=500"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	result := db.Model(&SenderKeyDistribution{}).
+		Where("id IN ? AND recipient_fuid = ? AND recipient_device_id = ? AND status = 0", req.IDs, currentFUID, deviceID).
+		Updates(map[string]interface{}{"status": 1, "payload": ""})
+	if result.Error != nil {
+		fail(c, 500, "确认失败: "+result.Error.Error())
+		return
+	}
+	success(c, nil, result.RowsAffected)
+}
+
+// 查询尚未收到本设备当前版本发送者密钥的成员设备接口
+func getMissingSenderKeysHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	deviceID := currentIdentity(c).DeviceID
+	if currentFUID == "" || deviceID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	groupQUID := c.Query("group_quid")
+	if groupQUID == "" {
+		fail(c, 400, "群QUID不能为空")
+		return
+	}
+	if !isGroupMember(groupQUID, currentFUID) {
+		fail(c, 403, "你不是该群成员")
+		return
+	}
+	var group Group
+	if err := db.Where("quid = ? AND status = 1", groupQUID).First(&group).Error; err != nil {
+		fail(c, 404, "群聊不存在或已解散")
+		return
+	}
+	recipients, err := groupKeyRecipients(groupQUID)
+	if err != nil {
+		fail(c, 500, "查询群成员设备失败: "+err.Error())
+		return
+	}
+	var sent []SenderKeyDistribution
+	db.Select("recipient_fuid, recipient_device_id").
+		Where("group_quid = ? AND epoch = ? AND sender_fuid = ? AND sender_device_id = ?", groupQUID, group.KeyEpoch, currentFUID, deviceID).
+		Find(&sent)
+	delivered := make(map[string]bool, len(sent))
+	for _, d := range sent {
+		delivered[d.RecipientFUID+"/"+d.RecipientDeviceID] = true
+	}
+	missing := make([]map[string]interface{}, 0)
+	for _, r := range recipients {
+		if r.UserFUID == currentFUID && r.DeviceID == deviceID {
+			continue
+		}
+		if !delivered[r.UserFUID+"/"+r.DeviceID] {
+			missing = append(missing, map[string]interface{}{
+				"fuid":      r.UserFUID,
+				"device_id": r.DeviceID,
+			})
+		}
+	}
+	success(c, map[string]interface{}{
+		"group_quid": groupQUID,
+		"epoch":      group.KeyEpoch,
+		"devices":    missing,
+	}, int64(len(missing)))
+}
+
+// 文件/图片上传接口
+func uploadFileHandler(c *gin.Context) {
+	// 获取当前用户FUID
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 获取文件类型（image/file）
+	fileType := c.Query("type")
+	if fileType != "image" && fileType != "file" {
+		fail(c, 400, "文件类型必须是image或file")
+		return
+	}
+	// 获取上传文件
+	file, fileHeader, err := c.Request.FormFile("file")
+	if err != nil {
+		fail(c, 400, "获取文件失败: "+err.Error())
+		return
+	}
+	defer file.Close()
+	// 检查文件大小
+	maxSize := cfg.Storage.File.MaxSize
+	if fileType == "image" {
+		maxSize = cfg.Storage.Image.MaxSize
+	}
+	if fileHeader.Size > int64(maxSize) {
+		fail(c, 400, fmt.Sprintf("文件大小超过限制（最大%dMB）", maxSize/1024/1024))
+		return
+	}
+	// 检查文件扩展名
+	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
+	ext = strings.TrimPrefix(ext, ".")
+	allowTypes := cfg.Storage.File.AllowTypes
+	if fileType == "image" {
+		allowTypes = cfg.Storage.Image.AllowTypes
+	}
+	allow := false
+	for _, t := range allowTypes {
+		if ext == t {
+			allow = true
+			break
+		}
+	}
+	if !allow {
+		fail(c, 400, fmt.Sprintf("不支持的文件类型，允许的类型：%s", strings.Join(allowTypes, ",")))
+		return
+	}
+	// 生成文件名并存储（本地存储按类型分目录；MinIO沿用原有布局，对象key即文件名）
+	fileName := fmt.Sprintf("%s_%d.%s", currentFUID, time.Now().UnixNano(), ext)
+	fileKey := fileType + "/" + fileName
+	if cfg.Storage.Type == "minio" {
+		fileKey = fileName
+	}
+	fileURL, err := fileStorage.Put(context.Background(), fileKey, file, fileHeader.Size, contentTypeByExt(ext))
+	if err != nil {
+		fail(c, 500, err.Error())
+		return
+	}
+	// 文件URL经TLS返回，由客户端放入消息内容后随消息一起加密
+	success(c, map[string]interface{}{
+		"file_url":  fileURL,
+		"file_name": fileHeader.Filename,
+		"file_size": fileHeader.Size,
+	})
+	log.Infof("Upload file: user=%s, type=%s, name=%s, size=%d, url=%s",
+		currentFUID, fileType, fileHeader.Filename, fileHeader.Size, fileURL)
+}
+
+// 清理用户输入文本：去除控制字符、格式字符（零宽、双向控制等）及首尾空白，singleLine时换行也去除并合并空白
+func sanitizeText(s string, singleLine bool) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n' && !singleLine:
+			b.WriteRune(r)
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteRune(' ')
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r), r == utf8.RuneError:
+			// 丢弃
+		default:
+			b.WriteRune(r)
+		}
+	}
+	out := strings.TrimSpace(b.String())
+	if singleLine {
+		out = strings.Join(strings.Fields(out), " ")
+	}
+	return out
+}
+
+// 当前用户资料
+func userProfileData(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"fuid":             user.FUID,
+		"username":         user.Username,
+		"nickname":         user.Nickname,
+		"email":            user.Email,
+		"email_verified":   user.EmailVerified == 1,
+		"avatar":           user.Avatar,
+		"signature":        user.Signature,
+		"vip_level":        user.VIPLevel,
+		"vip_exp":          user.VIPExp,
+		"role":             user.Role,
+		"two_factor":       totpEnabled(user.FUID),
+		"deletion_pending": pendingDeletionAt(user.FUID),
+		"created_at":       user.CreatedAt.Format("2006-01-02 15:04:05"),
+	}
+}
+
+// 待执行的注销时间（没有注销申请时为nil）
+func pendingDeletionAt(fuid string) interface{} {
+	var deletion AccountDeletion
+	if err := db.Where("user_fuid = ? AND status = ?", fuid, deletionPending).First(&deletion).Error; err != nil {
+		return nil
+	}
+	return deletion.ExecuteAt.Format("2006-01-02 15:04:05")
+}
+
+// 向好友及自己的其他设备推送资料变更
+func broadcastProfileUpdated(user *User) {
+	data := map[string]interface{}{
+		"fuid":      user.FUID,
+		"nickname":  user.Nickname,
+		"avatar":    user.Avatar,
+		"signature": user.Signature,
+	}
+	var friendFUIDs []string
+	db.Model(&Friend{}).Where("friend_fuid = ? AND status = 1", user.FUID).Pluck("user_fuid", &friendFUIDs)
+	for _, fuid := range friendFUIDs {
+		broadcastToRoom("user:"+fuid, "profile_updated", data)
+	}
+	broadcastToRoom("user:"+user.FUID, "profile_updated", data)
+}
+
+// 获取当前用户资料
+func getMyProfileHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	success(c, userProfileData(&user))
+}
+
+// 修改当前用户资料（昵称、个性签名；未传的字段不修改）
+func updateMyProfileHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Nickname  *string `json:"nickname"`
+		Signature *string `json:"signature"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	updates := map[string]interface{}{}
+	if req.Nickname != nil {
+		nickname := sanitizeText(*req.Nickname, true)
+		if n := utf8.RuneCountInString(nickname); n < 1 || n > 20 {
+			fail(c, 400, "昵称长度须为1~20个字符")
+			return
+		}
+		updates["nickname"] = nickname
+	}
+	if req.Signature != nil {
+		signature := sanitizeText(*req.Signature, false)
+		if utf8.RuneCountInString(signature) > 80 {
+			fail(c, 400, "个性签名不能超过80个字符")
+			return
+		}
+		updates["signature"] = signature
+	}
+	if len(updates) == 0 {
+		fail(c, 400, "没有需要修改的资料")
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if err := db.Model(&user).Updates(updates).Error; err != nil {
+		fail(c, 500, "修改资料失败")
+		return
+	}
+	if v, ok := updates["nickname"]; ok {
+		user.Nickname = v.(string)
+	}
+	if v, ok := updates["signature"]; ok {
+		user.Signature = v.(string)
+	}
+	broadcastProfileUpdated(&user)
+	log.Infof("Profile updated: fuid=%s, fields=%v", currentFUID, updates)
+	success(c, userProfileData(&user))
+}
+
+// 上传头像（仅限图片，校验扩展名、大小及文件内容）
+func uploadAvatarHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	file, fileHeader, err := c.Request.FormFile("file")
+	if err != nil {
+		fail(c, 400, "获取文件失败: "+err.Error())
+		return
+	}
+	defer file.Close()
+	if fileHeader.Size > int64(cfg.Storage.Image.MaxSize) {
+		fail(c, 400, fmt.Sprintf("头像大小超过限制（最大%dKB）", cfg.Storage.Image.MaxSize/1024))
+		return
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(fileHeader.Filename)), ".")
+	allow := false
+	for _, t := range cfg.Storage.Image.AllowTypes {
+		if ext == t {
+			allow = true
+			break
+		}
+	}
+	if !allow {
+		fail(c, 400, fmt.Sprintf("不支持的图片类型，允许的类型：%s", strings.Join(cfg.Storage.Image.AllowTypes, ",")))
+		return
+	}
+	// 按文件内容识别类型，拒绝伪装成图片的文件
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if !strings.HasPrefix(http.DetectContentType(head[:n]), "image/") {
+		fail(c, 400, "文件内容不是有效的图片")
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		fail(c, 500, "读取文件失败")
+		return
+	}
+
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	ctx := context.Background()
+	fileName := fmt.Sprintf("%s_%d.%s", currentFUID, time.Now().UnixNano(), ext)
+	avatarKey := "avatar/" + fileName
+	avatarURL, err := fileStorage.Put(ctx, avatarKey, file, fileHeader.Size, contentTypeByExt(ext))
+	if err != nil {
+		fail(c, 500, err.Error())
+		return
+	}
+	if err := db.Model(&user).Update("avatar", avatarURL).Error; err != nil {
+		fileStorage.Delete(ctx, avatarKey)
+		fail(c, 500, "修改头像失败")
+		return
+	}
+	// 删除之前上传的头像（只删除本存储后端avatar目录下的文件，外部URL不处理）
+	if oldKey, ok := fileStorage.Key(user.Avatar); ok && strings.HasPrefix(oldKey, "avatar/") && oldKey != avatarKey {
+		if err := fileStorage.Delete(ctx, oldKey); err != nil {
+			log.Warnf("删除旧头像失败: fuid=%s, key=%s, err=%v", currentFUID, oldKey, err)
+		}
+	}
+	user.Avatar = avatarURL
+	broadcastProfileUpdated(&user)
+	log.Infof("Avatar updated: fuid=%s, url=%s", currentFUID, avatarURL)
+	success(c, map[string]interface{}{"avatar": avatarURL})
+}
+
+// 修改密码：校验当前密码，按配置的bcrypt成本重新哈希，并注销其他设备
+func changePasswordHandler(c *gin.Context) {
+	identity := currentIdentity(c)
+	if identity.FUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required,min=6,max=20"`
+		ConfirmPassword string `json:"confirm_password" binding:"required,eqfield=NewPassword"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", identity.FUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if !verifyPassword(req.CurrentPassword, user.Password) {
+		auditSecurityEvent(c, user.FUID, "password_change_failed", nil)
+		fail(c, 401, "当前密码错误")
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		fail(c, 400, "新密码不能与当前密码相同")
+		return
+	}
+	hash, err := encryptPassword(req.NewPassword)
+	if err != nil {
+		fail(c, 500, "密码加密失败")
+		return
+	}
+	if err := db.Model(&user).Update("password", hash).Error; err != nil {
+		fail(c, 500, "修改密码失败")
+		return
+	}
+	// 注销除当前设备外的全部会话
+	var devices []Device
+	db.Where("user_fuid = ? AND status = 1 AND device_id <> ?", user.FUID, identity.DeviceID).Find(&devices)
+	for _, device := range devices {
+		revokeDeviceSession(user.FUID, device.DeviceID, "password_changed")
+	}
+	sendMailAsync(user.Email, fmt.Sprintf("【%s】密码已修改", cfg.App.Name),
+		fmt.Sprintf("%s，您好：\n\n您的账号密码已修改，其他设备已退出登录。如非本人操作，请立即重置密码。\n", user.Nickname))
+	auditSecurityEvent(c, user.FUID, "password_changed", map[string]interface{}{"revoked_devices": len(devices)})
+	success(c, nil)
+}
+
+// 账号注销状态
+const (
+	deletionPending   = 1 // 冷静期中
+	deletionCancelled = 2 // 已撤销
+	deletionCompleted = 3 // 已执行
+)
+
+// 数据导出状态
+const (
+	exportPending = 0
+	exportReady   = 1
+	exportFailed  = 2
+	exportExpired = 3
+)
+
+// 注销冷静期
+func deletionGracePeriod() time.Duration {
+	days := cfg.Business.User.DeletionGraceDays
+	if days <= 0 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// 申请注销账号：校验密码（开启两步验证时还须校验动态码），冷静期结束后由后台任务执行
+func requestAccountDeletionHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var req struct {
+		Password     string `json:"password" binding:"required"`
+		Code         string `json:"code" binding:"omitempty,numeric,len=6"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	var user User
+	if err := db.Where("fuid = ?", currentFUID).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if !verifyPassword(req.Password, user.Password) {
+		fail(c, 401, "密码错误")
+		return
+	}
+	if totpEnabled(currentFUID) {
+		if _, err := verifySecondFactor(currentFUID, req.Code, req.RecoveryCode); err != nil {
+			fail(c, 401, err.Error())
+			return
+		}
+	}
+	now := time.Now()
+	deletion := AccountDeletion{
+		UserFUID:    currentFUID,
+		Status:      deletionPending,
+		RequestedAt: now,
+		ExecuteAt:   now.Add(deletionGracePeriod()),
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_fuid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "requested_at", "execute_at", "updated_at"}),
+	}).Create(&deletion).Error
+	if err != nil {
+		fail(c, 500, "申请注销失败")
+		return
+	}
+	sendMailAsync(user.Email, fmt.Sprintf("【%s】账号注销申请", cfg.App.Name),
+		fmt.Sprintf("%s，您好：\n\n您的账号将于 %s 注销，注销后资料、好友关系及聊天记录将无法恢复。在此之前登录并撤销申请即可保留账号。\n",
+			user.Nickname, deletion.ExecuteAt.Format("2006-01-02 15:04")))
+	auditSecurityEvent(c, currentFUID, "account_deletion_requested", map[string]interface{}{"execute_at": deletion.ExecuteAt})
+	success(c, map[string]interface{}{
+		"status":     deletionPending,
+		"execute_at": deletion.ExecuteAt.Format("2006-01-02 15:04:05"),
+	})
+}
+
+// 查询注销申请
+func getAccountDeletionHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var deletion AccountDeletion
+	if err := db.Where("user_fuid = ? AND status = ?", currentFUID, deletionPending).First(&deletion).Error; err != nil {
+		success(c, map[string]interface{}{"pending": false})
+		return
+	}
+	success(c, map[string]interface{}{
+		"pending":      true,
+		"requested_at": deletion.RequestedAt.Format("2006-01-02 15:04:05"),
+		"execute_at":   deletion.ExecuteAt.Format("2006-01-02 15:04:05"),
+	})
+}
+
+// 撤销注销申请（冷静期内）
+func cancelAccountDeletionHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	result := db.Model(&AccountDeletion{}).Where("user_fuid = ? AND status = ?", currentFUID, deletionPending).
+		Update("status", deletionCancelled)
+	if result.Error != nil {
+		fail(c, 500, "撤销失败")
+		return
+	}
+	if result.RowsAffected == 0 {
+		fail(c, 404, "没有待执行的注销申请")
+		return
+	}
+	auditSecurityEvent(c, currentFUID, "account_deletion_cancelled", nil)
+	success(c, nil)
+}
+
+// 执行账号注销：转让或解散自己的群、退出所有群、解除好友关系、注销全部设备、
+// 按策略删除或抹除消息、删除导出文件，最后匿名化用户记录。
+// 数据库变更在同一事务内完成，任一步失败整体回滚（由账号生命周期任务下次重试）；
+// 推送、吊销令牌、删除文件等外部副作用在提交后执行
+func executeAccountDeletion(fuid string) error {
+	var user User
+	if err := db.Where("fuid = ?", fuid).First(&user).Error; err != nil {
+		return err
+	}
+
+	type dissolvedGroup struct {
+		group   Group
+		members []GroupMember
+	}
+	var (
+		dissolved   []dissolvedGroup
+		transferred []GroupMember
+		ownedGroups []Group
+		memberships []GroupMember
+		friendFUIDs []string
+		deviceIDs   []string
+		exports     []DataExport
+	)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// 自己是群主的群：转让给管理员（其次最早入群的成员），没有其他成员时解散
+		if err := tx.Where("owner_fuid = ? AND status = 1", fuid).Find(&ownedGroups).Error; err != nil {
+			return err
+		}
+		for i := range ownedGroups {
+			group := &ownedGroups[i]
+			var successor GroupMember
+			err := tx.Where("group_quid = ? AND user_fuid <> ? AND status = 1", group.QUID, fuid).
+				Order("role DESC, created_at ASC").First(&successor).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				members, err := dissolveGroupRecords(tx, group)
+				if err != nil {
+					return err
+				}
+				dissolved = append(dissolved, dissolvedGroup{group: *group, members: members})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := transferGroupOwner(tx, group, &successor); err != nil {
+				return err
+			}
+			transferred = append(transferred, successor)
+		}
+
+		// 退出所有群，删除发给本人的全部发送者密钥分发记录
+		if err := tx.Where("user_fuid = ? AND status = 1", fuid).Find(&memberships).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&GroupMember{}).Where("user_fuid = ? AND status = 1", fuid).Update("status", 0).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("recipient_fuid = ?", fuid).Delete(&SenderKeyDistribution{}).Error; err != nil {
+			return err
+		}
+
+		// 解除好友关系（双向）
+		if err := tx.Model(&Friend{}).Where("friend_fuid = ? AND status <> 0", fuid).Pluck("user_fuid", &friendFUIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Friend{}).Where("user_fuid = ? OR friend_fuid = ?", fuid, fuid).Update("status", 0).Error; err != nil {
+			return err
+		}
+
+		// 删除全部设备及认证数据、设备密钥
+		if err := tx.Model(&Device{}).Where("user_fuid = ?", fuid).Pluck("device_id", &deviceIDs).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			&OneTimePreKey{}, &SignedPreKey{}, &DeviceIdentityKey{},
+			&Device{}, &RefreshToken{}, &UserTOTP{}, &RecoveryCode{}, &WebAuthnCredential{},
+		} {
+			if err := tx.Where("user_fuid = ?", fuid).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		// 本人发送的消息：delete直接删除；tombstone（默认）抹除内容并标记为撤回，保留会话序号连续
+		if cfg.Business.User.DeletionMessagePolicy == "delete" {
+			if err := tx.Where("sender_fuid = ?", fuid).Delete(&Message{}).Error; err != nil {
+				return err
+			}
+		} else {
+			err := tx.Model(&Message{}).Where("sender_fuid = ?", fuid).
+				Updates(map[string]interface{}{"content": "", "content_key_id": "", "is_recalled": true}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// 删除数据导出记录（文件在提交后删除）
+		if err := tx.Where("user_fuid = ?", fuid).Find(&exports).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_fuid = ?", fuid).Delete(&DataExport{}).Error; err != nil {
+			return err
+		}
+
+		// 匿名化用户记录（保留FUID，历史消息的发送者仍可关联）
+		unusable, _ := generateUniqueID(32)
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"username":       "deleted_" + fuid,
+			"nickname":       "已注销用户",
+			"email":          "deleted_" + fuid + "@invalid",
+			"password":       "!" + unusable, // 不是有效的bcrypt哈希，无法登录
+			"avatar":         "",
+			"signature":      "",
+			"email_verified": 0,
+			"role":           "",
+			"status":         0,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// 以下为提交后的副作用
+	for i := range dissolved {
+		notifyGroupDissolved(&dissolved[i].group, dissolved[i].members, "群聊%s的群主已注销账号，群聊已解散")
+		recordGroupAudit(nil, dissolved[i].group.QUID, "group_dissolved", "group", dissolved[i].group.QUID, map[string]interface{}{"reason": "owner_deleted"})
+	}
+	for _, successor := range transferred {
+		recordGroupAudit(nil, successor.GroupQUID, "group_transferred", "user", successor.UserFUID, map[string]interface{}{
+			"from":   fuid,
+			"reason": "owner_deleted",
+		})
+		if cfg.Business.Notify.Ntfy.Enable {
+			go sendNtfyNotification("群聊转让通知", fmt.Sprintf("原群主已注销账号，你已成为群聊%s的新群主", successor.GroupQUID), successor.UserFUID)
+		}
+	}
+	for _, member := range memberships {
+		removeUserFromRoom(fuid, "group:"+member.GroupQUID)
+		go rotateGroupSenderKey(member.GroupQUID, "member_deleted")
+	}
+	for _, friendFUID := range friendFUIDs {
+		broadcastToRoom("user:"+friendFUID, "friend_removed", map[string]interface{}{"fuid": fuid})
+	}
+	for _, deviceID := range deviceIDs {
+		if err := revokeDeviceAccessTokens(fuid, deviceID, "account_deleted"); err != nil {
+			log.Errorf("吊销设备访问令牌失败: fuid=%s, device_id=%s, err=%v", fuid, deviceID, err)
+		}
+		disconnectDeviceSockets(fuid, deviceID, "account_deleted")
+	}
+	rdb.Del(context.Background(), fmt.Sprintf("user:devices:%s", fuid))
+	for _, export := range exports {
+		if export.FileKey != "" {
+			if err := exportStorage(&export).Delete(context.Background(), export.FileKey); err != nil {
+				log.Errorf("删除数据导出文件失败: fuid=%s, key=%s, err=%v", fuid, export.FileKey, err)
+			}
+		}
+	}
+
+	recordAudit(nil, "account_deleted", "user", fuid, map[string]interface{}{
+		"groups_owned":   len(ownedGroups),
+		"groups_joined":  len(memberships),
+		"friends":        len(friendFUIDs),
+		"message_policy": cfg.Business.User.DeletionMessagePolicy,
+	})
+	log.Infof("Account deleted: fuid=%s, groups_owned=%d, groups_joined=%d, friends=%d",
+		fuid, len(ownedGroups), len(memberships), len(friendFUIDs))
+	return nil
+}
+
+// 申请导出个人数据（异步生成ZIP，完成后推送data_export_ready事件）
+func requestDataExportHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	// 每24小时最多申请一次
+	var recent int64
+	db.Model(&DataExport{}).Where("user_fuid = ? AND created_at > ?", currentFUID, time.Now().Add(-24*time.Hour)).Count(&recent)
+	if recent > 0 {
+		fail(c, 429, "24小时内只能申请一次数据导出")
+		return
+	}
+	exportID, err := generateUniqueID(32)
+	if err != nil {
+		fail(c, 500, "申请导出失败")
+		return
+	}
+	export := DataExport{ExportID: exportID, UserFUID: currentFUID, Status: exportPending}
+	if err := db.Create(&export).Error; err != nil {
+		fail(c, 500, "申请导出失败")
 		return
 	}
+	go runDataExport(export)
+	auditSecurityEvent(c, currentFUID, "data_export_requested", map[string]interface{}{"export_id": exportID})
+	success(c, map[string]interface{}{"export_id": exportID, "status": exportPending})
+}
 
-	var devices []interface{}
-	for _, infoStr := range devicesMap {
-		var deviceInfo map[string]interface{}
-		json.Unmarshal([]byte(infoStr), &deviceInfo)
-		devices = append(devices, deviceInfo)
+// 查询最近的数据导出
+func getDataExportHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var export DataExport
+	if err := db.Where("user_fuid = ?", currentFUID).Order("id DESC").First(&export).Error; err != nil {
+		fail(c, 404, "没有数据导出记录")
+		return
+	}
+	data := map[string]interface{}{
+		"export_id":  export.ExportID,
+		"status":     export.Status,
+		"created_at": export.CreatedAt.Format("2006-01-02 15:04:05"),
 	}
+	if export.Status == exportReady {
+		data["download_url"] = dataExportDownloadPath(export.ExportID)
+		data["file_size"] = export.FileSize
+		if export.ExpiresAt != nil {
+			data["expires_at"] = export.ExpiresAt.Format("2006-01-02 15:04:05")
+		}
+	}
+	success(c, data)
+}
 
-	success(c, devices)
+// 下载数据导出接口（只能下载本人未过期的导出）
+func downloadDataExportHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
+	}
+	var export DataExport
+	if err := db.Where("export_id = ? AND user_fuid = ?", c.Param("export_id"), currentFUID).First(&export).Error; err != nil {
+		fail(c, 404, "数据导出不存在")
+		return
+	}
+	if export.Status != exportReady || export.FileURL != "" || (export.ExpiresAt != nil && export.ExpiresAt.Before(time.Now())) {
+		fail(c, 410, "数据导出已过期或尚未生成")
+		return
+	}
+	reader, err := privateStorage.Open(c.Request.Context(), export.FileKey)
+	if err != nil {
+		log.Errorf("读取数据导出失败: export_id=%s, err=%v", export.ExportID, err)
+		fail(c, 500, "读取数据导出失败")
+		return
+	}
+	defer reader.Close()
+	auditSecurityEvent(c, currentFUID, "data_export_downloaded", map[string]interface{}{"export_id": export.ExportID})
+	c.Header("Cache-Control", "no-store")
+	c.DataFromReader(http.StatusOK, export.FileSize, "application/zip", reader, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="export_%s.zip"`, export.ExportID),
+	})
 }
 
-// 踢下线指定设备
-func kickDeviceHandler(c *gin.Context) {
-	fuid := c.GetHeader("FUID")
-	if fuid == "" {
-		fail(c, 401, "未授权")
+// 数据导出下载路径
+func dataExportDownloadPath(exportID string) string {
+	return "/api/v1/private/user/me/export/" + exportID + "/download"
+}
+
+// 数据导出所在的存储后端（早期版本生成的导出保存在公开存储中，file_url非空）
+func exportStorage(export *DataExport) storageBackend {
+	if export.FileURL != "" {
+		return fileStorage
+	}
+	return privateStorage
+}
+
+// 生成数据导出ZIP并保存到非公开存储
+func runDataExport(export DataExport) {
+	fileKey := fmt.Sprintf("export/%s_%s.zip", export.UserFUID, export.ExportID)
+	size, err := buildDataExport(export.UserFUID, fileKey)
+	if err != nil {
+		log.Errorf("数据导出失败: fuid=%s, export_id=%s, err=%v", export.UserFUID, export.ExportID, err)
+		db.Model(&export).Updates(map[string]interface{}{"status": exportFailed, "error": err.Error()})
+		return
+	}
+	days := cfg.Business.User.ExportExpireDays
+	if days <= 0 {
+		days = 7
+	}
+	expiresAt := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	db.Model(&export).Updates(map[string]interface{}{
+		"status":     exportReady,
+		"file_key":   fileKey,
+		"file_size":  size,
+		"expires_at": expiresAt,
+	})
+	broadcastToRoom("user:"+export.UserFUID, "data_export_ready", map[string]interface{}{
+		"export_id":    export.ExportID,
+		"download_url": dataExportDownloadPath(export.ExportID),
+		"expires_at":   expiresAt.Format("2006-01-02 15:04:05"),
+	})
+	log.Infof("Data export ready: fuid=%s, export_id=%s, size=%d", export.UserFUID, export.ExportID, size)
+}
+
+// 写入ZIP中的一个JSON文件
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// 生成数据导出ZIP（个人资料、好友、群聊、消息记录），先写入临时文件再保存到非公开存储，返回文件大小
+func buildDataExport(fuid, fileKey string) (int64, error) {
+	var user User
+	if err := db.Where("fuid = ?", fuid).First(&user).Error; err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp("", "im-export-*.zip")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+	profile := userProfileData(&user)
+	profile["exported_at"] = time.Now().Format("2006-01-02 15:04:05")
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		return 0, err
+	}
+
+	var friends []Friend
+	db.Where("user_fuid = ? AND status <> 0", fuid).Find(&friends)
+	friendList := make([]map[string]interface{}, 0, len(friends))
+	for _, f := range friends {
+		friendList = append(friendList, map[string]interface{}{
+			"fuid":       f.FriendFUID,
+			"remark":     f.Remark,
+			"status":     f.Status,
+			"created_at": f.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	if err := writeZipJSON(zw, "friends.json", friendList); err != nil {
+		return 0, err
+	}
+
+	var memberships []GroupMember
+	db.Where("user_fuid = ? AND status = 1", fuid).Find(&memberships)
+	groupList := make([]map[string]interface{}, 0, len(memberships))
+	for _, m := range memberships {
+		var group Group
+		db.Where("quid = ?", m.GroupQUID).First(&group)
+		groupList = append(groupList, map[string]interface{}{
+			"quid":      m.GroupQUID,
+			"name":      group.Name,
+			"role":      m.Role,
+			"joined_at": m.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	if err := writeZipJSON(zw, "groups.json", groupList); err != nil {
+		return 0, err
+	}
+
+	// 消息记录：本人发送的消息、单聊收到的消息及所在群聊中加入之后收到的消息，每行一条JSON，分批读取
+	w, err := zw.Create("messages.jsonl")
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	receivedInGroup := db.Model(&GroupMember{}).Select("1").
+		Where("group_members.group_quid = messages.receiver_id AND group_members.user_fuid = ? AND group_members.status = 1 AND messages.seq > group_members.join_seq", fuid)
+	var lastID uint64
+	for {
+		var batch []Message
+		err := db.Where("id > ?", lastID).
+			Where(db.Where("sender_fuid = ?", fuid).
+				Or("receiver_type = 1 AND receiver_id = ? AND shadow = 0", fuid).
+				Or("receiver_type = 2 AND shadow = 0 AND EXISTS (?)", receivedInGroup)).
+			Order("id ASC").Limit(500).Find(&batch).Error
+		if err != nil {
+			return 0, err
+		}
+		for _, msg := range batch {
+			if err := enc.Encode(buildMessageData(msg)); err != nil {
+				return 0, err
+			}
+		}
+		if len(batch) < 500 {
+			break
+		}
+		lastID = batch[len(batch)-1].ID
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := privateStorage.Put(context.Background(), fileKey, tmp, info.Size(), "application/zip"); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// 账号生命周期任务：执行到期的注销申请、删除过期的数据导出文件（集群内通过Redis锁只由一个节点执行）
+func accountLifecycleTask() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx := context.Background()
+		locked, err := rdb.SetNX(ctx, "lock:account_lifecycle", nodeID, 50*time.Minute).Result()
+		if err != nil || !locked {
+			continue
+		}
+		now := time.Now()
+		var due []AccountDeletion
+		db.Where("status = ? AND execute_at <= ?", deletionPending, now).Find(&due)
+		for _, deletion := range due {
+			if err := executeAccountDeletion(deletion.UserFUID); err != nil {
+				log.Errorf("执行账号注销失败: fuid=%s, err=%v", deletion.UserFUID, err)
+				continue
+			}
+			db.Model(&deletion).Updates(map[string]interface{}{"status": deletionCompleted, "completed_at": now})
+		}
+
+		// 过期的导出，以及早期版本保存在公开存储中的导出（立即删除）
+		var expired []DataExport
+		db.Where("status = ? AND (expires_at <= ? OR file_url <> '')", exportReady, now).Find(&expired)
+		for _, export := range expired {
+			if err := exportStorage(&export).Delete(ctx, export.FileKey); err != nil {
+				log.Errorf("删除过期数据导出失败: export_id=%s, err=%v", export.ExportID, err)
+				continue
+			}
+			db.Model(&export).Updates(map[string]interface{}{"status": exportExpired, "file_url": ""})
+		}
+		rdb.Del(ctx, "lock:account_lifecycle")
+	}
+}
+
+// 分页参数（page从1开始，size默认20、最大100）
+func pageParams(c *gin.Context) (int, int) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	size, _ := strconv.Atoi(c.DefaultQuery("size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > 100 {
+		size = 20
+	}
+	return page, size
+}
+
+// 管理接口访问策略：admin全部权限；moderator处理用户、群聊与举报；support只读及强制下线
+var (
+	adminPolicyStaff     = authPolicy{Roles: []string{roleAdmin, roleModerator, roleSupport}}
+	adminPolicyModerator = authPolicy{Roles: []string{roleAdmin, roleModerator}}
+	adminPolicyAdmin     = authPolicy{Roles: []string{roleAdmin}}
+)
+
+// 校验操作者能否管理目标用户：不能操作自己；系统角色用户只有admin可以操作
+func adminCanManage(actor authIdentity, target *User) error {
+	if actor.FUID == target.FUID {
+		return errors.New("不能对自己执行该操作")
+	}
+	if target.Role != "" && actor.Role != roleAdmin {
+		return errors.New("无权操作管理人员账号")
+	}
+	return nil
+}
+
+// 管理端用户信息
+func adminUserData(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"fuid":               user.FUID,
+		"username":           user.Username,
+		"nickname":           user.Nickname,
+		"email":              user.Email,
+		"email_verified":     user.EmailVerified == 1,
+		"avatar":             user.Avatar,
+		"status":             user.Status,
+		"role":               user.Role,
+		"vip_level":          user.VIPLevel,
+		"mute_until":         formatTimePtr(user.MuteUntil),
+		"friends_only_until": formatTimePtr(user.FriendsOnlyUntil),
+		"shadow_ban_until":   formatTimePtr(user.ShadowBanUntil),
+		"created_at":         user.CreatedAt.Format("2006-01-02 15:04:05"),
+	}
+}
+
+// 格式化可空时间（为空时返回nil）
+func formatTimePtr(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// 搜索用户（按FUID、用户名、昵称、邮箱模糊匹配，可按状态、角色筛选）
+func adminSearchUsersHandler(c *gin.Context) {
+	page, size := pageParams(c)
+	query := db.Model(&User{})
+	if keyword := strings.TrimSpace(c.Query("keyword")); keyword != "" {
+		like := "%" + keyword + "%"
+		query = query.Where("fuid = ? OR username LIKE ? OR nickname LIKE ? OR email LIKE ?", keyword, like, like, like)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if role, ok := c.GetQuery("role"); ok {
+		query = query.Where("role = ?", role)
+	}
+	var total int64
+	query.Count(&total)
+	var users []User
+	if err := query.Order("id DESC").Offset((page - 1) * size).Limit(size).Find(&users).Error; err != nil {
+		fail(c, 500, "查询用户失败")
+		return
+	}
+	list := make([]map[string]interface{}, 0, len(users))
+	for i := range users {
+		list = append(list, adminUserData(&users[i]))
+	}
+	success(c, list, total)
+}
+
+// 用户详情（含在线设备、两步验证、注销申请及最近登录）
+func adminGetUserHandler(c *gin.Context) {
+	var user User
+	if err := db.Where("fuid = ?", c.Param("fuid")).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	data := adminUserData(&user)
+	var devices []Device
+	db.Where("user_fuid = ? AND status = 1", user.FUID).Find(&devices)
+	deviceList := make([]map[string]interface{}, 0, len(devices))
+	for _, device := range devices {
+		deviceList = append(deviceList, map[string]interface{}{
+			"device_id":   device.DeviceID,
+			"device_name": device.DeviceName,
+			"device_type": device.DeviceType,
+			"login_ip":    device.LoginIP,
+			"login_time":  device.LoginTime.Format("2006-01-02 15:04:05"),
+		})
+	}
+	data["devices"] = deviceList
+	data["two_factor"] = totpEnabled(user.FUID)
+	data["deletion_pending"] = pendingDeletionAt(user.FUID)
+	var lastLogin LoginHistory
+	if err := db.Where("user_fuid = ? AND result = ?", user.FUID, loginSucceed).Order("id DESC").First(&lastLogin).Error; err == nil {
+		data["last_login"] = map[string]interface{}{
+			"ip":         lastLogin.IP,
+			"method":     lastLogin.Method,
+			"created_at": lastLogin.CreatedAt.Format("2006-01-02 15:04:05"),
+		}
+	}
+	success(c, data)
+}
+
+// 启用/禁用账号（禁用时注销全部设备会话）
+func adminSetUserStatusHandler(enable bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Reason string `json:"reason" binding:"max=200"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			fail(c, 400, "参数错误: "+err.Error())
+			return
+		}
+		var user User
+		if err := db.Where("fuid = ?", c.Param("fuid")).First(&user).Error; err != nil {
+			fail(c, 404, "用户不存在")
+			return
+		}
+		if err := adminCanManage(currentIdentity(c), &user); err != nil {
+			fail(c, 403, err.Error())
+			return
+		}
+		action, status := "user_disabled", uint8(0)
+		if enable {
+			action, status = "user_enabled", 1
+			var deleted int64
+			db.Model(&AccountDeletion{}).Where("user_fuid = ? AND status = ?", user.FUID, deletionCompleted).Count(&deleted)
+			if deleted > 0 {
+				fail(c, 400, "账号已注销，无法启用")
+				return
+			}
+		}
+		var err error
+		if enable {
+			err = db.Model(&user).Update("status", status).Error
+		} else {
+			err = disableUser(user.FUID, "account_disabled")
+		}
+		if err != nil {
+			fail(c, 500, "更新账号状态失败")
+			return
+		}
+		recordAudit(c, action, "user", user.FUID, map[string]interface{}{"reason": req.Reason})
+		success(c, map[string]interface{}{"fuid": user.FUID, "status": status})
+	}
+}
+
+// 强制下线（注销全部设备会话）
+func adminLogoutUserHandler(c *gin.Context) {
+	var user User
+	if err := db.Where("fuid = ?", c.Param("fuid")).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
+		return
+	}
+	if err := adminCanManage(currentIdentity(c), &user); err != nil {
+		fail(c, 403, err.Error())
 		return
 	}
+	var online int64
+	db.Model(&Device{}).Where("user_fuid = ? AND status = 1", user.FUID).Count(&online)
+	revokeUserSessions(user.FUID, "admin_logout")
+	recordAudit(c, "user_logout_forced", "user", user.FUID, map[string]interface{}{"devices": online})
+	success(c, map[string]interface{}{"fuid": user.FUID, "revoked_devices": online})
+}
 
+// 设置系统角色（为空表示普通用户）
+func adminSetUserRoleHandler(c *gin.Context) {
 	var req struct {
-		DeviceID string `json:"device_id" binding:"required"`
+		Role string `json:"role" binding:"omitempty,oneof=admin moderator support"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
+	var user User
+	if err := db.Where("fuid = ? AND status = 1", c.Param("fuid")).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在或已被禁用")
+		return
+	}
+	if err := adminCanManage(currentIdentity(c), &user); err != nil {
+		fail(c, 403, err.Error())
+		return
+	}
+	previous := user.Role
+	if err := db.Model(&user).Update("role", req.Role).Error; err != nil {
+		fail(c, 500, "设置角色失败")
+		return
+	}
+	recordAudit(c, "user_role_changed", "user", user.FUID, map[string]interface{}{"from": previous, "to": req.Role})
+	success(c, map[string]interface{}{"fuid": user.FUID, "role": req.Role})
+}
 
-	// 更新设备状态为离线
-	ctx := context.Background()
-	result := db.Model(&Device{}).
-		Where("user_fuid = ? AND device_id = ?", fuid, req.DeviceID).
-		Updates(map[string]interface{}{
-			"status":       0,
-			"refresh_token": "", // 失效刷新令牌
-		})
-	if result.Error != nil {
-		fail(c, 500, "操作失败")
+// 解散群聊
+func adminDissolveGroupHandler(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"max=200"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
-	if result.RowsAffected == 0 {
-		fail(c, 404, "设备不存在")
+	var group Group
+	if err := db.Where("quid = ? AND status = 1", c.Param("quid")).First(&group).Error; err != nil {
+		fail(c, 404, "群聊不存在或已解散")
+		return
+	}
+	if err := dissolveGroup(&group, "群聊%s因违反社区规范已被解散"); err != nil {
+		fail(c, 500, "解散群聊失败: "+err.Error())
+		return
+	}
+	recordGroupAudit(c, group.QUID, "group_dissolved", "group", group.QUID, map[string]interface{}{
+		"owner_fuid": group.OwnerFUID,
+		"reason":     req.Reason,
+	})
+	success(c, nil)
+}
+
+// 发送系统消息（全体、指定用户或指定群聊）
+func adminSendSystemMessageHandler(c *gin.Context) {
+	var req struct {
+		Title      string   `json:"title" binding:"required,max=64"`
+		Content    string   `json:"content" binding:"required,max=2000"`
+		TargetType uint8    `json:"target_type" binding:"required,oneof=1 2 3"` // 1:全体 2:指定用户 3:指定群
+		TargetIDs  []string `json:"target_ids" binding:"max=1000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
+	}
+	if req.TargetType != systemTargetAll && len(req.TargetIDs) == 0 {
+		fail(c, 400, "目标ID不能为空")
+		return
+	}
+	msgID, err := pushSystemMessage(req.Title, req.Content, req.TargetType, req.TargetIDs)
+	if err != nil {
+		fail(c, 500, "发送系统消息失败")
+		return
+	}
+	recordAudit(c, "system_message_sent", "system", msgID, map[string]interface{}{
+		"title":       req.Title,
+		"target_type": req.TargetType,
+		"target_ids":  req.TargetIDs,
+	})
+	success(c, map[string]interface{}{"msg_id": msgID})
+}
+
+// 举报单信息
+func reportData(report *Report) map[string]interface{} {
+	data := map[string]interface{}{
+		"report_id":     report.ReportID,
+		"reporter_fuid": report.ReporterFUID,
+		"target_type":   report.TargetType,
+		"target_id":     report.TargetID,
+		"reason":        report.Reason,
+		"detail":        report.Detail,
+		"status":        report.Status,
+		"handler_fuid":  report.HandlerFUID,
+		"action":        report.Action,
+		"result":        report.Result,
+		"created_at":    report.CreatedAt.Format("2006-01-02 15:04:05"),
+	}
+	if report.HandledAt != nil {
+		data["handled_at"] = report.HandledAt.Format("2006-01-02 15:04:05")
+	}
+	return data
+}
+
+// 举报列表（可按状态、对象类型筛选）
+func adminListReportsHandler(c *gin.Context) {
+	page, size := pageParams(c)
+	query := db.Model(&Report{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	var total int64
+	query.Count(&total)
+	var reports []Report
+	if err := query.Order("id DESC").Offset((page - 1) * size).Limit(size).Find(&reports).Error; err != nil {
+		fail(c, 500, "查询举报失败")
 		return
 	}
-
-	// 从Redis移除设备
-	deviceKey := fmt.Sprintf("user:devices:%s", fuid)
-	rdb.HDel(ctx, deviceKey, req.DeviceID)
-
-	success(c, nil)
-	log.Infof("Device kicked: fuid=%s, device_id=%s", fuid, req.DeviceID)
+	list := make([]map[string]interface{}, 0, len(reports))
+	for i := range reports {
+		list = append(list, reportData(&reports[i]))
+	}
+	success(c, list, total)
 }
 
-// JWT验证中间件
-func JWTAuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			fail(c, 401, "请提供授权令牌")
-			c.Abort()
+// 举报详情（含证据快照）
+func adminGetReportHandler(c *gin.Context) {
+	var report Report
+	if err := db.Where("report_id = ?", c.Param("id")).First(&report).Error; err != nil {
+		fail(c, 404, "举报不存在")
+		return
+	}
+	data := reportData(&report)
+	if report.Evidence != "" {
+		plain, err := openAtRest(report.Evidence, report.EvidenceKeyID, reportEvidenceAD(report.ReportID))
+		if err != nil {
+			log.Errorf("解密举报证据失败: report_id=%s, key_id=%s, err=%v", report.ReportID, report.EvidenceKeyID, err)
+			fail(c, 500, "解密举报证据失败")
 			return
 		}
-
-		parts := strings.SplitN(authHeader, " ", 2)
-		if !(len(parts) == 2 && parts[0] == "Bearer") {
-			fail(c, 401, "授权令牌格式错误")
-			c.Abort()
-			return
+		var evidence interface{}
+		if json.Unmarshal([]byte(plain), &evidence) == nil {
+			data["evidence"] = evidence
 		}
+	}
+	recordAudit(c, "report_viewed", "report", report.ReportID, nil)
+	success(c, data)
+}
 
-		// 解析token
-		token, err := jwt.ParseWithClaims(parts[1], &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.Crypto.JWT.Secret), nil
-		})
+func reportEvidenceAD(reportID string) string {
+	return "reports|" + reportID
+}
 
-		if err != nil || !token.Valid {
-			fail(c, 401, "无效的授权令牌")
-			c.Abort()
-			return
-		}
+// 未结案举报的唯一键（同一举报人对同一对象只能有一条未结案举报）
+func reportOpenKey(reporterFUID string, targetType uint8, targetID string) *string {
+	key := fmt.Sprintf("%s|%d|%s", reporterFUID, targetType, targetID)
+	return &key
+}
 
-		// 验证设备状态
-		claims, ok := token.Claims.(*CustomClaims)
-		if !ok {
-			fail(c, 401, "令牌信息错误")
-			c.Abort()
-			return
-		}
+// 举报对象类型
+const (
+	reportTargetUser    = 1
+	reportTargetMessage = 2
+	reportTargetGroup   = 3
+)
 
-		// 检查设备是否在线
-		var device Device
-		if err := db.Where("user_fuid = ? AND device_id = ? AND status = 1",
-			claims.FUID, claims.DeviceID).First(&device).Error; err != nil {
-			fail(c, 401, "设备已下线，请重新登录")
-			c.Abort()
-			return
-		}
+// 举报处理状态
+const (
+	reportPending   = 0 // 待处理
+	reportReviewing = 1 // 处理中（已被审核员认领）
+	reportResolved  = 2 // 已处理
+	reportRejected  = 3 // 已驳回
+)
 
-		// 将用户信息存入上下文
-		c.Set("FUID", claims.FUID)
-		c.Set("Username", claims.Username)
-		c.Set("DeviceID", claims.DeviceID)
-		c.Next()
-	}
-}
+// 举报处理措施
+const (
+	moderationNone     = "none"     // 不处罚（举报成立但无需处罚，或仅记录）
+	moderationWarn     = "warn"     // 警告
+	moderationMute     = "mute"     // 全局禁言
+	moderationDisable  = "disable"  // 禁用账号
+	moderationDissolve = "dissolve" // 解散群聊
+)
 
-// 搜索好友接口
-func searchFriendHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
+// 解出服务端可读的消息明文（传输加密的内容信封；端到端加密消息无法解出）
+func messagePlaintext(msg *Message) (string, bool) {
+	if msg.Encryption != 0 {
+		return "", false
 	}
-	// 获取搜索参数
-	keyword := c.Query("keyword")
-	if keyword == "" {
-		fail(c, 400, "搜索关键词不能为空")
-		return
+	plain, _, err := openEnvelope(msg.Content, msg.MsgID, msg.ConvID)
+	if err != nil {
+		return "", false
 	}
-	// 搜索用户（FUID/用户名/昵称/邮箱）
-	var users []User
-	condition := "(fuid LIKE ? OR username LIKE ? OR nickname LIKE ? OR email LIKE ?) AND status = 1"
-	likeKeyword := "%" + keyword + "%"
-	if err := db.Where(condition, likeKeyword, likeKeyword, likeKeyword, likeKeyword).
-		Select("fuid, username, nickname, avatar, signature, vip_level, vip_exp").
-		Find(&users).Error; err != nil {
-		fail(c, 500, "搜索好友失败: "+err.Error())
-		return
+	return string(plain), true
+}
+
+// 举报人能否查看该消息（单聊双方、群聊成员）
+func canViewMessage(fuid string, msg *Message) bool {
+	if msg.Shadow && msg.SenderFUID != fuid {
+		return false
 	}
-	// 排除自己
-	var result []map[string]interface{}
-	for _, user := range users {
-		if user.FUID == currentFUID {
-			continue
-		}
-		// 检查是否已添加好友
-		var friend Friend
-		err := db.Where("user_fuid = ? AND friend_fuid = ? AND status != 0", currentFUID, user.FUID).First(&friend).Error
-		isFriend := err == nil
-		isBlack := false
-		if isFriend {
-			isBlack = friend.Status == 2
-		}
-		result = append(result, map[string]interface{}{
-			"fuid":        user.FUID,
-			"username":    user.Username,
-			"nickname":    user.Nickname,
-			"avatar":      user.Avatar,
-			"signature":   user.Signature,
-			"vip_level":   user.VIPLevel,
-			"vip_exp":     user.VIPExp,
-			"is_friend":   isFriend,
-			"is_black":    isBlack,
-		})
+	if msg.ReceiverType == 1 {
+		return msg.SenderFUID == fuid || msg.ReceiverID == fuid
 	}
-	success(c, result, int64(len(result)))
+	var count int64
+	db.Model(&GroupMember{}).Where("group_quid = ? AND user_fuid = ? AND status = 1", msg.ReceiverID, fuid).Count(&count)
+	return count > 0
 }
 
-// 添加好友接口
-func addFriendHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+// 提交举报（用户、消息、群聊）
+func createReportHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
-	// 参数绑定
 	var req struct {
-		FriendFUID string `json:"friend_fuid" binding:"required"`
-		Remark     string `json:"remark" binding:"max=20"`
+		TargetType      uint8  `json:"target_type" binding:"required,oneof=1 2 3"` // 1:用户 2:消息 3:群聊
+		TargetID        string `json:"target_id" binding:"required,max=64"`
+		Reason          string `json:"reason" binding:"required,oneof=spam abuse fraud porn illegal other"`
+		Detail          string `json:"detail" binding:"max=500"`
+		IncludeEvidence bool   `json:"include_evidence"`                    // 举报消息时附带消息快照
+		EvidenceContent string `json:"evidence_content" binding:"max=4000"` // 端到端加密消息由举报人提供解密后的内容
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
-	// 检查好友是否存在
-	var friendUser User
-	if err := db.Where("fuid = ? AND status = 1", req.FriendFUID).First(&friendUser).Error; err != nil {
-		fail(c, 400, "好友不存在或已被禁用")
-		return
-	}
-	// 检查是否是自己
-	if req.FriendFUID == currentFUID {
-		fail(c, 400, "不能添加自己为好友")
-		return
-	}
-	// 检查是否已添加
-	var friend Friend
-	err := db.Where("user_fuid = ? AND friend_fuid = ?", currentFUID, req.FriendFUID).First(&friend).Error
-	if err == nil {
-		if friend.Status == 1 {
-			fail(c, 400, "已添加该用户为好友")
-		} else if friend.Status == 2 {
-			fail(c, 400, "该用户在你的黑名单中，请先移除")
-		} else if friend.Status == 0 {
-			// 恢复好友关系
-			friend.Status = 1
-			friend.Remark = req.Remark
-			if err := db.Save(&friend).Error; err != nil {
-				fail(c, 500, "恢复好友关系失败: "+err.Error())
-				return
+
+	var evidence map[string]interface{}
+	switch req.TargetType {
+	case reportTargetUser:
+		if req.TargetID == currentFUID {
+			fail(c, 400, "不能举报自己")
+			return
+		}
+		var count int64
+		db.Model(&User{}).Where("fuid = ?", req.TargetID).Count(&count)
+		if count == 0 {
+			fail(c, 404, "用户不存在")
+			return
+		}
+	case reportTargetMessage:
+		var msg Message
+		if err := db.Where("msg_id = ?", req.TargetID).First(&msg).Error; err != nil || !canViewMessage(currentFUID, &msg) {
+			fail(c, 404, "消息不存在")
+			return
+		}
+		if msg.SenderFUID == currentFUID {
+			fail(c, 400, "不能举报自己发送的消息")
+			return
+		}
+		if req.IncludeEvidence {
+			evidence = buildMessageData(msg)
+			if plain, ok := messagePlaintext(&msg); ok {
+				evidence["plaintext"] = plain
+			} else if req.EvidenceContent != "" {
+				evidence["plaintext"] = sanitizeText(req.EvidenceContent, false)
+				evidence["plaintext_source"] = "reporter" // 端到端加密消息，内容由举报人提供，服务端无法核实
 			}
-			success(c, map[string]string{"msg": "恢复好友关系成功"})
+			evidence["captured_at"] = time.Now().Format("2006-01-02 15:04:05")
+		}
+	case reportTargetGroup:
+		var count int64
+		db.Model(&Group{}).Where("quid = ? AND status = 1", req.TargetID).Count(&count)
+		if count == 0 {
+			fail(c, 404, "群聊不存在或已解散")
 			return
 		}
 	}
-	// 检查好友数量是否超限
-	var friendCount int64
-	db.Model(&Friend{}).Where("user_fuid = ? AND status = 1", currentFUID).Count(&friendCount)
-	if friendCount >= int64(cfg.Business.User.FriendMax) {
-		fail(c, 400, fmt.Sprintf("好友数量已达上限(%d)", cfg.Business.User.FriendMax))
+
+	// 同一对象未处理完前不能重复举报（并发提交由open_key唯一索引兜底）
+	var open int64
+	db.Model(&Report{}).Where("reporter_fuid = ? AND target_type = ? AND target_id = ? AND status IN ?",
+		currentFUID, req.TargetType, req.TargetID, []uint8{reportPending, reportReviewing}).Count(&open)
+	if open > 0 {
+		fail(c, 409, "你已举报过该对象，请等待处理结果")
 		return
 	}
-	// 添加好友
-	newFriend := Friend{
-		UserFUID:    currentFUID,
-		FriendFUID:  req.FriendFUID,
-		Remark:      req.Remark,
-		Status:      1,
+	// 每日举报次数限制（只统计提交成功的举报）
+	dailyLimit := cfg.Business.Report.DailyLimit
+	if dailyLimit <= 0 {
+		dailyLimit = 20
 	}
-	if err := db.Create(&newFriend).Error; err != nil {
-		fail(c, 500, "添加好友失败: "+err.Error())
+	ctx := context.Background()
+	limitKey := fmt.Sprintf("report_daily:%s:%s", currentFUID, time.Now().Format("20060102"))
+	if count, _ := rdb.Get(ctx, limitKey).Int64(); count >= int64(dailyLimit) {
+		fail(c, 429, "今日举报次数已达上限")
 		return
 	}
-	
-	// 同时需要为对方添加反向好友关系
-	reverseFriend := Friend{
-    UserFUID:    req.FriendFUID,
-    FriendFUID:  currentFUID,
-    Remark:      "",
-    Status:      1,
+
+	reportID, err := generateUniqueID(32)
+	if err != nil {
+		fail(c, 500, "提交举报失败")
+		return
+	}
+	report := Report{
+		ReportID:     reportID,
+		ReporterFUID: currentFUID,
+		TargetType:   req.TargetType,
+		TargetID:     req.TargetID,
+		Reason:       req.Reason,
+		Detail:       sanitizeText(req.Detail, false),
+		Status:       reportPending,
+		OpenKey:      reportOpenKey(currentFUID, req.TargetType, req.TargetID),
+	}
+	if evidence != nil {
+		encoded, _ := json.Marshal(evidence)
+		sealed, keyID, err := sealAtRest(string(encoded), reportEvidenceAD(reportID))
+		if err != nil {
+			log.Error("加密举报证据失败: ", err)
+			fail(c, 500, "提交举报失败")
+			return
+		}
+		report.Evidence, report.EvidenceKeyID = sealed, keyID
 	}
-	
-	if err := db.Create(&reverseFriend).Error; err != nil {
-    // 回滚当前好友记录
-    db.Delete(&newFriend)
-    fail(c, 500, "添加好友失败: "+err.Error())
-    return
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&report)
+	if result.Error != nil {
+		fail(c, 500, "提交举报失败")
+		return
 	}
-
-	// 发送ntfy推送（如果启用）
-	if cfg.Business.Notify.Ntfy.Enable {
-		go sendNtfyNotification("添加好友通知", fmt.Sprintf("用户%s(%s)添加你为好友", 
-			c.GetString("nickname"), currentFUID), req.FriendFUID)
+	if result.RowsAffected == 0 {
+		fail(c, 409, "你已举报过该对象，请等待处理结果")
+		return
 	}
-	success(c, map[string]string{"msg": "添加好友成功"})
-	log.Infof("Add friend: user=%s, friend=%s", currentFUID, req.FriendFUID)
+	if count, _ := rdb.Incr(ctx, limitKey).Result(); count == 1 {
+		rdb.Expire(ctx, limitKey, 24*time.Hour)
+	}
+	log.Infof("Report created: report_id=%s, reporter=%s, target_type=%d, target_id=%s, reason=%s",
+		reportID, currentFUID, req.TargetType, req.TargetID, req.Reason)
+	success(c, map[string]interface{}{"report_id": reportID, "status": reportPending})
 }
 
-// 删除好友接口
-func deleteFriendHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+// 我的举报（含处理状态与结果）
+func listMyReportsHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
-	// 获取好友FUID
-	friendFUID := c.Param("fuid")
-	if friendFUID == "" {
-		fail(c, 400, "好友FUID不能为空")
+	page, size := pageParams(c)
+	query := db.Model(&Report{}).Where("reporter_fuid = ?", currentFUID)
+	var total int64
+	query.Count(&total)
+	var reports []Report
+	if err := query.Order("id DESC").Offset((page - 1) * size).Limit(size).Find(&reports).Error; err != nil {
+		fail(c, 500, "查询举报失败")
+		return
+	}
+	list := make([]map[string]interface{}, 0, len(reports))
+	for _, report := range reports {
+		item := map[string]interface{}{
+			"report_id":   report.ReportID,
+			"target_type": report.TargetType,
+			"target_id":   report.TargetID,
+			"reason":      report.Reason,
+			"status":      report.Status,
+			"result":      report.Result,
+			"created_at":  report.CreatedAt.Format("2006-01-02 15:04:05"),
+		}
+		if report.HandledAt != nil {
+			item["handled_at"] = report.HandledAt.Format("2006-01-02 15:04:05")
+		}
+		list = append(list, item)
+	}
+	success(c, list, total)
+}
+
+// 认领举报（待处理→处理中）
+func adminClaimReportHandler(c *gin.Context) {
+	identity := currentIdentity(c)
+	result := db.Model(&Report{}).Where("report_id = ? AND status = ?", c.Param("id"), reportPending).
+		Updates(map[string]interface{}{"status": reportReviewing, "handler_fuid": identity.FUID})
+	if result.Error != nil {
+		fail(c, 500, "认领举报失败")
 		return
 	}
-	// 更新好友状态为已删除
-	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ?", currentFUID, friendFUID).
-		Update("status", 0).Error
-	if err != nil {
-		fail(c, 500, "删除好友失败: "+err.Error())
+	if result.RowsAffected == 0 {
+		fail(c, 409, "举报不存在或已被认领")
 		return
 	}
-	success(c, map[string]string{"msg": "删除好友成功"})
-	log.Infof("Delete friend: user=%s, friend=%s", currentFUID, friendFUID)
+	recordAudit(c, "report_claimed", "report", c.Param("id"), nil)
+	success(c, map[string]interface{}{"report_id": c.Param("id"), "status": reportReviewing})
 }
 
-// 修改好友备注接口
-func updateFriendRemarkHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
+// 举报指向的责任用户与群聊（用户举报为该用户；消息举报为发送者及所在群；群聊举报为群主及该群）
+func reportSubjects(report *Report) (string, string, error) {
+	switch report.TargetType {
+	case reportTargetUser:
+		return report.TargetID, "", nil
+	case reportTargetMessage:
+		var msg Message
+		if err := db.Where("msg_id = ?", report.TargetID).First(&msg).Error; err != nil {
+			return "", "", errors.New("被举报消息已不存在")
+		}
+		if msg.ReceiverType == 2 {
+			return msg.SenderFUID, msg.ReceiverID, nil
+		}
+		return msg.SenderFUID, "", nil
+	case reportTargetGroup:
+		var group Group
+		if err := db.Where("quid = ?", report.TargetID).First(&group).Error; err != nil {
+			return "", "", errors.New("被举报群聊不存在")
+		}
+		return group.OwnerFUID, group.QUID, nil
 	}
-	// 参数绑定
+	return "", "", errors.New("未知的举报对象")
+}
+
+// 禁用账号并注销全部设备会话
+func disableUser(fuid, reason string) error {
+	if err := db.Model(&User{}).Where("fuid = ?", fuid).Update("status", 0).Error; err != nil {
+		return err
+	}
+	revokeUserSessions(fuid, reason)
+	return nil
+}
+
+// 处理举报：执行处理措施（警告、全局禁言、禁用账号、解散群聊）或驳回，并通知举报人
+//
+// 先以条件更新认领并结案（仍为待处理/处理中的举报才会更新），更新成功后才执行处理措施，
+// 避免并发处理同一举报时重复处罚；处理措施执行失败时恢复举报原状态。
+func adminResolveReportHandler(c *gin.Context) {
 	var req struct {
-		FriendFUID string `json:"friend_fuid" binding:"required"`
-		Remark     string `json:"remark" binding:"max=20"`
+		Action   string `json:"action" binding:"required,oneof=none warn mute disable dissolve reject"`
+		Duration int    `json:"duration" binding:"min=0,max=31536000"` // 禁言秒数（action为mute时必填）
+		Result   string `json:"result" binding:"max=500"`              // 处理说明（会发送给举报人）
+		Message  string `json:"message" binding:"max=500"`             // 警告内容（action为warn时发送给被处理用户）
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
-	// 更新备注
-	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 1", 
-		currentFUID, req.FriendFUID).Update("remark", req.Remark).Error
-	if err != nil {
-		fail(c, 500, "修改备注失败: "+err.Error())
+	identity := currentIdentity(c)
+	var report Report
+	if err := db.Where("report_id = ?", c.Param("id")).First(&report).Error; err != nil {
+		fail(c, 404, "举报不存在")
+		return
+	}
+	if report.Status == reportResolved || report.Status == reportRejected {
+		fail(c, 409, "举报已处理")
+		return
+	}
+	if report.Status == reportReviewing && report.HandlerFUID != identity.FUID && identity.Role != roleAdmin {
+		fail(c, 403, "该举报已由其他审核员认领")
+		return
+	}
+
+	// 校验处理措施（不产生任何副作用）
+	status := uint8(reportResolved)
+	payload := map[string]interface{}{"report_id": report.ReportID}
+	var subjectFUID string
+	var group Group
+	if req.Action == "reject" {
+		status = reportRejected
+	} else if req.Action != moderationNone {
+		var groupQUID string
+		var err error
+		subjectFUID, groupQUID, err = reportSubjects(&report)
+		if err != nil {
+			fail(c, 400, err.Error())
+			return
+		}
+		if req.Action != moderationDissolve {
+			var subject User
+			if err := db.Where("fuid = ?", subjectFUID).First(&subject).Error; err != nil {
+				fail(c, 404, "被处理用户不存在")
+				return
+			}
+			if err := adminCanManage(identity, &subject); err != nil {
+				fail(c, 403, err.Error())
+				return
+			}
+		}
+		switch req.Action {
+		case moderationMute:
+			if req.Duration <= 0 {
+				fail(c, 400, "请指定禁言时长")
+				return
+			}
+		case moderationDissolve:
+			if groupQUID == "" || db.Where("quid = ? AND status = 1", groupQUID).First(&group).Error != nil {
+				fail(c, 400, "该举报没有可解散的群聊")
+				return
+			}
+		}
+		payload["subject_fuid"] = subjectFUID
+	}
+
+	// 条件更新结案：只有仍为待处理/处理中（且未被其他审核员认领）的举报才会更新
+	now := time.Now()
+	query := db.Model(&Report{}).Where("report_id = ? AND status IN ?", report.ReportID, []uint8{reportPending, reportReviewing})
+	if identity.Role != roleAdmin {
+		query = query.Where("(status = ? OR handler_fuid = ?)", reportPending, identity.FUID)
+	}
+	result := query.Updates(map[string]interface{}{
+		"status":       status,
+		"handler_fuid": identity.FUID,
+		"action":       req.Action,
+		"result":       req.Result,
+		"handled_at":   now,
+		"open_key":     gorm.Expr("NULL"),
+	})
+	if result.Error != nil {
+		fail(c, 500, "更新举报状态失败")
 		return
 	}
-	success(c, map[string]string{"msg": "修改备注成功"})
-	log.Infof("Update friend remark: user=%s, friend=%s, remark=%s", currentFUID, req.FriendFUID, req.Remark)
+	if result.RowsAffected == 0 {
+		fail(c, 409, "举报已处理或已被其他审核员认领")
+		return
+	}
+	// 处理措施执行失败时恢复举报原状态，以便重新处理
+	restore := func() {
+		db.Model(&Report{}).Where("report_id = ? AND status = ? AND handler_fuid = ?", report.ReportID, status, identity.FUID).
+			Updates(map[string]interface{}{
+				"status":       report.Status,
+				"handler_fuid": report.HandlerFUID,
+				"action":       report.Action,
+				"result":       report.Result,
+				"handled_at":   gorm.Expr("NULL"),
+				"open_key":     report.OpenKey,
+			})
+	}
+
+	switch req.Action {
+	case moderationWarn:
+		message := req.Message
+		if message == "" {
+			message = "你的行为被举报并经审核确认违反社区规范，请遵守相关规定，多次违规将被禁言或封禁账号。"
+		}
+		if _, err := pushSystemMessage("违规警告", message, systemTargetUsers, []string{subjectFUID}); err != nil {
+			restore()
+			fail(c, 500, "发送警告失败")
+			return
+		}
+		if cfg.Business.Notify.Ntfy.Enable {
+			go sendNtfyNotification("违规警告", message, subjectFUID)
+		}
+		recordAudit(c, "user_warned", "user", subjectFUID, map[string]interface{}{"report_id": report.ReportID, "message": message})
+	case moderationMute:
+		until := now.Add(time.Duration(req.Duration) * time.Second)
+		if err := setUserRestriction(subjectFUID, restrictionMute, &until); err != nil {
+			restore()
+			fail(c, 500, "禁言失败")
+			return
+		}
+		go func() {
+			if _, err := pushSystemMessage("禁言通知", fmt.Sprintf("你因违反社区规范被禁言，禁言结束时间：%s", until.Format("2006-01-02 15:04:05")),
+				systemTargetUsers, []string{subjectFUID}); err != nil {
+				log.Error("发送禁言通知失败: ", err)
+			}
+		}()
+		payload["until"] = until.Format("2006-01-02 15:04:05")
+		recordAudit(c, "user_muted", "user", subjectFUID, map[string]interface{}{"report_id": report.ReportID, "until": payload["until"]})
+	case moderationDisable:
+		if err := disableUser(subjectFUID, "account_disabled"); err != nil {
+			restore()
+			fail(c, 500, "禁用账号失败")
+			return
+		}
+		recordAudit(c, "user_disabled", "user", subjectFUID, map[string]interface{}{"report_id": report.ReportID})
+	case moderationDissolve:
+		if err := dissolveGroup(&group, "群聊%s因违反社区规范已被解散"); err != nil {
+			restore()
+			fail(c, 500, "解散群聊失败: "+err.Error())
+			return
+		}
+		recordGroupAudit(c, group.QUID, "group_dissolved", "group", group.QUID, map[string]interface{}{"report_id": report.ReportID})
+	}
+
+	payload["action"] = req.Action
+	recordAudit(c, "report_resolved", "report", report.ReportID, payload)
+	notifyReporter(&report, status, req.Result)
+	success(c, map[string]interface{}{"report_id": report.ReportID, "status": status, "action": req.Action})
 }
 
-// 加入黑名单接口
-func addBlacklistHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
-	}
-	// 获取好友FUID
-	friendFUID := c.Param("fuid")
-	if friendFUID == "" {
-		fail(c, 400, "好友FUID不能为空")
-		return
+// 向举报人发送处理结果（不透露具体处罚措施）
+func notifyReporter(report *Report, status uint8, result string) {
+	content := "你提交的举报经审核未发现违规，感谢你的反馈。"
+	if status == reportResolved {
+		content = "你提交的举报已核实处理，感谢你为维护社区环境做出的贡献。"
 	}
-	// 更新好友状态为黑名单
-	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 1", 
-		currentFUID, friendFUID).Update("status", 2).Error
-	if err != nil {
-		fail(c, 500, "加入黑名单失败: "+err.Error())
-		return
+	if result != "" {
+		content += "\n处理说明：" + result
 	}
-	success(c, map[string]string{"msg": "加入黑名单成功"})
-	log.Infof("Add blacklist: user=%s, friend=%s", currentFUID, friendFUID)
+	go func() {
+		if _, err := pushSystemMessage("举报处理结果", content, systemTargetUsers, []string{report.ReporterFUID}); err != nil {
+			log.Error("发送举报处理结果失败: ", err)
+		}
+	}()
 }
 
-// 移出黑名单接口
-func removeBlacklistHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
+// 账号发送限制类型（对应users表中的结束时间字段）
+const (
+	restrictionMute        = "mute"         // 全局禁言：不能发送任何消息
+	restrictionFriendsOnly = "friends_only" // 仅限好友：只能向互为好友的用户发送单聊消息
+	restrictionShadowBan   = "shadow_ban"   // 影子封禁：消息照常保存，但只有发送者自己可见，不投递给其他人
+)
+
+var restrictionColumns = map[string]string{
+	restrictionMute:        "mute_until",
+	restrictionFriendsOnly: "friends_only_until",
+	restrictionShadowBan:   "shadow_ban_until",
+}
+
+// 永久限制的结束时间
+var restrictionForever = time.Date(9999, 12, 31, 23, 59, 59, 0, time.Local)
+
+// 账号发送限制
+type sendRestrictions struct {
+	MuteUntil        *time.Time
+	FriendsOnlyUntil *time.Time
+	ShadowBanUntil   *time.Time
+}
+
+// 限制是否生效中
+func restrictionActive(until *time.Time) bool {
+	return until != nil && until.After(time.Now())
+}
+
+// 读取账号发送限制
+func loadSendRestrictions(fuid string) sendRestrictions {
+	var user User
+	db.Select("mute_until, friends_only_until, shadow_ban_until").Where("fuid = ?", fuid).First(&user)
+	return sendRestrictions{
+		MuteUntil:        user.MuteUntil,
+		FriendsOnlyUntil: user.FriendsOnlyUntil,
+		ShadowBanUntil:   user.ShadowBanUntil,
 	}
-	// 获取好友FUID
-	friendFUID := c.Param("fuid")
-	if friendFUID == "" {
-		fail(c, 400, "好友FUID不能为空")
-		return
+}
+
+// 校验账号发送限制（全局禁言、仅限好友；影子封禁不拦截，由发送管道静默丢弃）
+func checkSendRestrictions(senderFUID string, r sendRestrictions, receiverType uint8, receiverID string) *apiError {
+	if restrictionActive(r.MuteUntil) {
+		if r.MuteUntil.Equal(restrictionForever) {
+			return &apiError{403, "你已被永久禁言"}
+		}
+		return &apiError{403, fmt.Sprintf("你已被全局禁言，禁言结束时间：%s", r.MuteUntil.Format("2006-01-02 15:04:05"))}
 	}
-	// 更新好友状态为正常
-	err := db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 2",
-		currentFUID, friendFUID).Update("status", 1).Error
-	if err != nil {
-		fail(c, 500, "移出黑名单失败: "+err.Error())
-		return
+	if restrictionActive(r.FriendsOnlyUntil) {
+		if receiverType != 1 {
+			return &apiError{403, "你的账号目前只能向好友发送消息"}
+		}
+		var count int64
+		db.Model(&Friend{}).Where("user_fuid = ? AND friend_fuid = ? AND status = 1", receiverID, senderFUID).Count(&count)
+		if count == 0 {
+			return &apiError{403, "你的账号目前只能向互为好友的用户发送消息"}
+		}
 	}
-	success(c, map[string]string{"msg": "移出黑名单成功"})
-	log.Infof("Remove blacklist: user=%s, friend=%s", currentFUID, friendFUID)
+	return nil
 }
 
-// 创建群聊接口
-func createGroupHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
+// 设置或解除账号限制（until为nil表示解除）
+func setUserRestriction(fuid, kind string, until *time.Time) error {
+	column, ok := restrictionColumns[kind]
+	if !ok {
+		return fmt.Errorf("未知的限制类型: %s", kind)
 	}
-	// 参数绑定
+	return db.Model(&User{}).Where("fuid = ?", fuid).Update(column, until).Error
+}
+
+// 保存影子封禁的消息：不占用会话序号（序号取发送时会话的最新序号，只作排序锚点，不递增计数器），
+// 接收方看到的latest_seq和序号区间因此保持连续；不写离线消息、不推送给其他人；
+// 群聊消息正常情况下会经群房间送达发送者的其他设备，此处改为只推送到发送者自己的房间；
+// 单聊消息正常情况下只推送给接收方，发送者的其他设备通过历史/区间查询获取，与正常发送一致
+func saveShadowMessage(message *Message) (*Message, *apiError) {
+	message.ConvID = getConversationID(message.ReceiverType, message.SenderFUID, message.ReceiverID)
+	message.Seq = latestConversationSeq(message.ConvID)
+	if err := db.Create(message).Error; err != nil {
+		return nil, &apiError{500, "保存消息失败: " + err.Error()}
+	}
+	if message.ReceiverType == 2 {
+		pushData := buildMessageData(*message)
+		var sender User
+		db.Where("fuid = ?", message.SenderFUID).Select("nickname, vip_level").First(&sender)
+		pushData["sender_nickname"] = sender.Nickname
+		pushData["sender_vip_level"] = sender.VIPLevel
+		go broadcastToRoom("user:"+message.SenderFUID, "new_message", pushData)
+	}
+	log.Debugf("Shadow banned message hidden: msg_id=%s, sender=%s, receiver_id=%s, seq=%d",
+		message.MsgID, message.SenderFUID, message.ReceiverID, message.Seq)
+	return message, nil
+}
+
+// 设置账号限制（全局禁言、仅限好友、影子封禁），duration为秒数；永久限制须显式指定permanent
+func adminSetRestrictionHandler(c *gin.Context) {
 	var req struct {
-		Name        string `json:"name" binding:"required,min=1,max=20"`
-		Desc        string `json:"desc" binding:"max=256"`
-		Avatar      string `json:"avatar"` // 头像URL
+		Type      string `json:"type" binding:"required,oneof=mute friends_only shadow_ban"`
+		Duration  int    `json:"duration" binding:"min=0,max=315360000"`
+		Permanent bool   `json:"permanent"`
+		Reason    string `json:"reason" binding:"max=200"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
-	// 检查创建群聊数量是否超限
-	var groupCount int64
-	db.Model(&Group{}).Where("owner_fuid = ? AND status = 1", currentFUID).Count(&groupCount)
-	if groupCount >= int64(cfg.Business.Group.CreateMax) {
-		fail(c, 400, fmt.Sprintf("创建群聊数量已达上限(%d)", cfg.Business.Group.CreateMax))
+	if req.Permanent == (req.Duration > 0) {
+		fail(c, 400, "请指定限制时长（duration）或永久限制（permanent），二者只能选其一")
 		return
 	}
-	// 生成QUID
-	quid, err := generateQUID()
-	if err != nil {
-		fail(c, 500, "生成QUID失败: "+err.Error())
+	var user User
+	if err := db.Where("fuid = ?", c.Param("fuid")).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
 		return
 	}
-	// 创建群聊
-	newGroup := Group{
-		QUID:       quid,
-		Name:       req.Name,
-		OwnerFUID:  currentFUID,
-		Avatar:     req.Avatar,
-		Desc:       req.Desc,
-		VIPLevel:   0,
-		VIPExp:     0,
-		Status:     1,
-	}
-	if err := db.Create(&newGroup).Error; err != nil {
-		fail(c, 500, "创建群聊失败: "+err.Error())
+	if err := adminCanManage(currentIdentity(c), &user); err != nil {
+		fail(c, 403, err.Error())
 		return
 	}
-	// 添加群主到群成员
-	groupMember := GroupMember{
-		GroupQUID:  quid,
-		UserFUID:   currentFUID,
-		Role:       1, // 群主
-		Status:     1,
+	until := restrictionForever
+	if !req.Permanent {
+		until = time.Now().Add(time.Duration(req.Duration) * time.Second)
 	}
-	if err := db.Create(&groupMember).Error; err != nil {
-		// 回滚群聊创建
-		db.Delete(&newGroup)
-		fail(c, 500, "添加群主到群成员失败: "+err.Error())
+	if err := setUserRestriction(user.FUID, req.Type, &until); err != nil {
+		fail(c, 500, "设置限制失败")
 		return
 	}
-	// 返回群聊信息
-	respData := map[string]interface{}{
-		"quid":        newGroup.QUID,
-		"name":        newGroup.Name,
-		"owner_fuid":  newGroup.OwnerFUID,
-		"avatar":      newGroup.Avatar,
-		"desc":        newGroup.Desc,
-		"vip_level":   newGroup.VIPLevel,
-		"vip_exp":     newGroup.VIPExp,
+	untilText := until.Format("2006-01-02 15:04:05")
+	// 影子封禁不通知本人
+	var notice string
+	switch req.Type {
+	case restrictionMute:
+		notice = fmt.Sprintf("你因违反社区规范被全局禁言，禁言结束时间：%s", untilText)
+	case restrictionFriendsOnly:
+		notice = fmt.Sprintf("你的账号因违反社区规范被限制为只能向互为好友的用户发送消息，限制结束时间：%s", untilText)
 	}
-	success(c, respData)
-	log.Infof("Create group: quid=%s, owner=%s, name=%s", quid, currentFUID, req.Name)
+	if notice != "" {
+		go func() {
+			if _, err := pushSystemMessage("账号限制通知", notice, systemTargetUsers, []string{user.FUID}); err != nil {
+				log.Error("发送账号限制通知失败: ", err)
+			}
+		}()
+	}
+	recordAudit(c, "user_restricted", "user", user.FUID, map[string]interface{}{
+		"type":   req.Type,
+		"until":  untilText,
+		"reason": req.Reason,
+	})
+	success(c, map[string]interface{}{"fuid": user.FUID, "type": req.Type, "until": untilText})
 }
 
-// 搜索群聊接口
-func searchGroupHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
+// 解除账号限制
+func adminLiftRestrictionHandler(c *gin.Context) {
+	kind := c.Param("type")
+	if _, ok := restrictionColumns[kind]; !ok {
+		fail(c, 400, "未知的限制类型")
 		return
 	}
-	// 获取搜索参数
-	keyword := c.Query("keyword")
-	if keyword == "" {
-		fail(c, 400, "搜索关键词不能为空")
+	var user User
+	if err := db.Where("fuid = ?", c.Param("fuid")).First(&user).Error; err != nil {
+		fail(c, 404, "用户不存在")
 		return
 	}
-	// 搜索群聊（QUID/群名）
-	var groups []Group
-	condition := "quid LIKE ? OR name LIKE ? AND status = 1"
-	likeKeyword := "%" + keyword + "%"
-	if err := db.Where(condition, likeKeyword, likeKeyword).
-		Select("quid, name, owner_fuid, avatar, desc, vip_level, vip_exp").
-		Find(&groups).Error; err != nil {
-		fail(c, 500, "搜索群聊失败: "+err.Error())
+	if err := adminCanManage(currentIdentity(c), &user); err != nil {
+		fail(c, 403, err.Error())
 		return
 	}
-	// 检查是否已加入群聊
-	var result []map[string]interface{}
-	for _, group := range groups {
-		var member GroupMember
-		err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", group.QUID, currentFUID).First(&member).Error
-		isJoined := err == nil
-		role := 0
-		if isJoined {
-			role = int(member.Role)
-		}
-		// 获取群主昵称
-		var owner User
-		db.Where("fuid = ?", group.OwnerFUID).Select("nickname").First(&owner)
-		result = append(result, map[string]interface{}{
-			"quid":        group.QUID,
-			"name":        group.Name,
-			"owner_fuid":  group.OwnerFUID,
-			"owner_nickname": owner.Nickname,
-			"avatar":      group.Avatar,
-			"desc":        group.Desc,
-			"vip_level":   group.VIPLevel,
-			"vip_exp":     group.VIPExp,
-			"is_joined":   isJoined,
-			"role":        role,
-		})
+	if err := setUserRestriction(user.FUID, kind, nil); err != nil {
+		fail(c, 500, "解除限制失败")
+		return
 	}
-	success(c, result, int64(len(result)))
+	recordAudit(c, "user_restriction_lifted", "user", user.FUID, map[string]interface{}{"type": kind})
+	success(c, nil)
 }
 
-// 加入群聊接口
-func joinGroupHandler(c *gin.Context) {
+// 获取好友资料卡接口
+func getFriendProfileHandler(c *gin.Context) {
 	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
-	// 参数绑定
-	var req struct {
-		GroupQUID string `json:"group_quid" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
-	}
-	// 检查群聊是否存在
-	var group Group
-	if err := db.Where("quid = ? AND status = 1", req.GroupQUID).First(&group).Error; err != nil {
-		fail(c, 400, "群聊不存在或已解散")
+	// 获取好友FUID
+	friendFUID := c.Param("fuid")
+	if friendFUID == "" {
+		fail(c, 400, "好友FUID不能为空")
 		return
 	}
-	// 检查是否已加入
-	var member GroupMember
-	err := db.Where("group_quid = ? AND user_fuid = ?", req.GroupQUID, currentFUID).First(&member).Error
-	if err == nil {
-		if member.Status == 1 {
-			fail(c, 400, "已加入该群聊")
-		} else if member.Status == 0 {
-			// 恢复群成员身份
-			member.Status = 1
-			if err := db.Save(&member).Error; err != nil {
-				fail(c, 500, "恢复群成员身份失败: "+err.Error())
-				return
-			}
-			success(c, map[string]string{"msg": "重新加入群聊成功"})
-			return
-		}
-	}
-	// 检查群成员数量是否超限
-	var memberCount int64
-	db.Model(&GroupMember{}).Where("group_quid = ? AND status = 1", req.GroupQUID).Count(&memberCount)
-	if memberCount >= int64(cfg.Business.Group.MemberMax) {
-		fail(c, 400, fmt.Sprintf("群成员数量已达上限(%d)", cfg.Business.Group.MemberMax))
+	// 查询好友信息
+	var user User
+	err := db.Where("fuid = ? AND status = 1", friendFUID).
+		Select("fuid, nickname, vip_level, vip_exp, signature").
+		First(&user).Error
+	if err != nil {
+		fail(c, 400, "好友不存在或已被禁用")
 		return
 	}
-	// 加入群聊
-	newMember := GroupMember{
-		GroupQUID:  req.GroupQUID,
-		UserFUID:   currentFUID,
-		Role:       0, // 普通成员
-		Status:     1,
-	}
-	if err := db.Create(&newMember).Error; err != nil {
-		fail(c, 500, "加入群聊失败: "+err.Error())
+	// 检查是否是好友
+	var friend Friend
+	err = db.Where("user_fuid = ? AND friend_fuid = ? AND status = 1", currentFUID, friendFUID).First(&friend).Error
+	if err != nil {
+		fail(c, 403, "该用户不是你的好友，无法查看资料卡")
 		return
 	}
-	// 发送ntfy推送（如果启用）
-	if cfg.Business.Notify.Ntfy.Enable {
-		go sendNtfyNotification("入群通知", fmt.Sprintf("用户%s(%s)加入群聊%s",
-			c.GetString("nickname"), currentFUID, group.Name), group.OwnerFUID)
+	// 构建资料卡数据
+	profile := map[string]interface{}{
+		"fuid":        user.FUID,
+		"nickname":    user.Nickname,
+		"vip_level":   user.VIPLevel,
+		"vip_exp":     user.VIPExp,
+		"signature":   user.Signature,
 	}
-	success(c, map[string]string{"msg": "加入群聊成功"})
-	log.Infof("Join group: user=%s, group=%s", currentFUID, req.GroupQUID)
+	success(c, profile)
 }
-
-// 退出群聊接口
-func quitGroupHandler(c *gin.Context) {
+
+// 获取群聊资料卡接口
+func getGroupProfileHandler(c *gin.Context) {
 	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
@@ -1996,1512 +10118,1877 @@ func quitGroupHandler(c *gin.Context) {
 		fail(c, 400, "群聊QUID不能为空")
 		return
 	}
-	// 检查是否是群主
-	var member GroupMember
-	err := db.Where("group_quid = ? AND user_fuid = ? AND role = 1", groupQUID, currentFUID).First(&member).Error
-	if err == nil {
-		fail(c, 400, "群主不能退出群聊，请转让群主或解散群聊")
+	// 查询群聊信息
+	var group Group
+	err := db.Where("quid = ? AND status = 1", groupQUID).
+		Select("quid, owner_fuid, name, vip_level, vip_exp, desc").
+		First(&group).Error
+	if err != nil {
+		fail(c, 400, "群聊不存在或已解散")
 		return
 	}
-	// 更新群成员状态为已退出
-	err = db.Model(&GroupMember{}).Where("group_quid = ? AND user_fuid = ? AND status = 1",
-		groupQUID, currentFUID).Update("status", 0).Error
+	// 检查是否是群成员
+	var member GroupMember
+	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", groupQUID, currentFUID).First(&member).Error
 	if err != nil {
-		fail(c, 500, "退出群聊失败: "+err.Error())
+		fail(c, 403, "你不是该群成员，无法查看资料卡")
 		return
 	}
-	success(c, map[string]string{"msg": "退出群聊成功"})
-	log.Infof("Quit group: user=%s, group=%s", currentFUID, groupQUID)
+	// 获取群主信息
+	var owner User
+	db.Where("fuid = ?", group.OwnerFUID).Select("nickname").First(&owner)
+	// 构建资料卡数据
+	profile := map[string]interface{}{
+		"quid":          group.QUID,
+		"owner_fuid":    group.OwnerFUID,
+		"owner_nickname": owner.Nickname,
+		"group_name":    group.Name,
+		"vip_level":     group.VIPLevel,
+		"vip_exp":       group.VIPExp,
+		"desc":          group.Desc,
+	}
+	success(c, profile)
 }
 
-// 群聊禁言接口
-func groupMuteHandler(c *gin.Context) {
+// 获取离线消息接口
+func getOfflineMessageHandler(c *gin.Context) {
 	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
-	// 参数绑定
-	var req struct {
-		GroupQUID   string `json:"group_quid" binding:"required"`
-		UserFUID    string `json:"user_fuid" binding:"required"` // 被禁言用户
-		MuteTime    int    `json:"mute_time"` // 禁言时间（秒），默认使用配置值
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
-	}
-	// 检查当前用户权限（群主/管理）
-	var currentMember GroupMember
-	err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&currentMember).Error
-	if err != nil {
-		fail(c, 403, "你不是该群成员，无操作权限")
-		return
-	}
-	if currentMember.Role != 1 && currentMember.Role != 2 {
-		fail(c, 403, "仅群主和管理员可执行禁言操作")
-		return
-	}
-	// 检查被禁言用户是否是群成员
-	var targetMember GroupMember
-	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, req.UserFUID).First(&targetMember).Error
+	// 查询离线消息
+	var offlineMsgs []OfflineMessage
+	err := db.Where("user_fuid = ? AND status = 0", currentFUID).Find(&offlineMsgs).Error
 	if err != nil {
-		fail(c, 400, "被禁言用户不是该群成员")
-		return
-	}
-	// 检查被禁言用户是否是群主
-	if targetMember.Role == 1 {
-		fail(c, 400, "不能禁言群主")
+		fail(c, 500, "查询离线消息失败: "+err.Error())
 		return
 	}
-	// 计算禁言结束时间
-	muteTime := req.MuteTime
-	if muteTime <= 0 {
-		muteTime = cfg.Business.Group.MuteTimeDefault
+	// 获取消息详情
+	var msgIDs []string
+	for _, om := range offlineMsgs {
+		msgIDs = append(msgIDs, om.MsgID)
 	}
-	muteEndTime := time.Now().Add(time.Duration(muteTime) * time.Second)
-	// 更新禁言时间
-	err = db.Model(&targetMember).Update("mute_end_time", muteEndTime).Error
-	if err != nil {
-		fail(c, 500, "禁言操作失败: "+err.Error())
-		return
+	var messages []Message
+	if len(msgIDs) > 0 {
+		db.Where("msg_id IN ? AND shadow = 0", msgIDs).Find(&messages)
 	}
-	// 发送ntfy推送
-	if cfg.Business.Notify.Ntfy.Enable {
-		go sendNtfyNotification("群禁言通知", fmt.Sprintf("你在群聊%s中被禁言%d秒",
-			req.GroupQUID, muteTime), req.UserFUID)
+	// 构建返回数据
+	var result []map[string]interface{}
+	for _, msg := range messages {
+		result = append(result, buildMessageData(msg))
 	}
-	success(c, map[string]string{"msg": fmt.Sprintf("禁言成功，禁言时长%d秒", muteTime)})
-	log.Infof("Group mute: group=%s, operator=%s, target=%s, time=%d", req.GroupQUID, currentFUID, req.UserFUID, muteTime)
+	// 更新离线消息状态为已推送
+	db.Model(&OfflineMessage{}).Where("user_fuid = ?", currentFUID).Update("status", 1)
+	// 清空离线消息数
+	ctx := context.Background()
+	rdb.Del(ctx, "offline_msg_count:"+currentFUID)
+	success(c, result, int64(len(result)))
 }
 
-// 踢出群聊接口
-func kickGroupMemberHandler(c *gin.Context) {
+// 获取未读消息数接口
+func getUnreadMessageCountHandler(c *gin.Context) {
 	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
-	// 参数绑定
-	var req struct {
-		GroupQUID   string `json:"group_quid" binding:"required"`
-		UserFUID    string `json:"user_fuid" binding:"required"` // 被踢出用户
+	ctx := context.Background()
+	// 获取离线消息数（好友+群聊）
+	offlineCount, err := rdb.Get(ctx, "offline_msg_count:"+currentFUID).Int64()
+	if err != nil {
+		offlineCount = 0
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
+	// 区分好友和群聊消息数
+	// 1. 好友未读消息数
+	var friendUnread int64
+	db.Table("messages m").
+		Joins("LEFT JOIN friends f ON m.receiver_id = f.friend_fuid AND f.user_fuid = ?", currentFUID).
+		Where("m.receiver_type = 1 AND m.receiver_id = ? AND m.is_read = 0 AND m.is_recalled = 0 AND m.shadow = 0", currentFUID).
+		Count(&friendUnread)
+	// 2. 群聊未读消息数
+	var groupUnread int64
+	db.Table("messages m").
+		Joins("LEFT JOIN group_members gm ON m.receiver_id = gm.group_quid AND gm.user_fuid = ?", currentFUID).
+		Where("m.receiver_type = 2 AND gm.status = 1 AND m.is_recalled = 0 AND m.shadow = 0").
+		Count(&groupUnread)
+	// 构建返回数据
+	countData := map[string]interface{}{
+		"total":   offlineCount + friendUnread + groupUnread,
+		"friend":  friendUnread,
+		"group":   groupUnread,
+		"offline": offlineCount,
 	}
-	// 检查当前用户权限（群主/管理）
-	var currentMember GroupMember
-	err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&currentMember).Error
+	success(c, countData)
+}
+
+// ntfy消息推送
+func sendNtfyNotification(title, content, targetFUID string) {
+	// 获取目标用户信息
+	var user User
+	err := db.Where("fuid = ?", targetFUID).Select("nickname, email").First(&user).Error
 	if err != nil {
-		fail(c, 403, "你不是该群成员，无操作权限")
+		log.Error("获取推送用户信息失败: ", err)
 		return
 	}
-	if currentMember.Role != 1 && currentMember.Role != 2 {
-		fail(c, 403, "仅群主和管理员可执行踢出操作")
-		return
+	// 构建推送数据
+	pushData := map[string]string{
+		"topic":   cfg.Business.Notify.Ntfy.Topic + "_" + targetFUID,
+		"title":   title,
+		"message": content,
+		"priority": "high",
+		"tags":    "chat_im",
 	}
-	// 检查被踢出用户是否是群成员
-	var targetMember GroupMember
-	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, req.UserFUID).First(&targetMember).Error
+	// 转换为JSON
+	jsonData, err := json.Marshal(pushData)
 	if err != nil {
-		fail(c, 400, "被踢出用户不是该群成员")
+		log.Error("序列化推送数据失败: ", err)
 		return
 	}
-	// 检查被踢出用户是否是群主
-	if targetMember.Role == 1 {
-		fail(c, 400, "不能踢出群主")
+	// 发送POST请求
+	req, err := http.NewRequest("POST", cfg.Business.Notify.Ntfy.URL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		log.Error("创建推送请求失败: ", err)
 		return
 	}
-	// 更新群成员状态为已踢出
-	err = db.Model(&targetMember).Update("status", 0).Error
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
 	if err != nil {
-		fail(c, 500, "踢出操作失败: "+err.Error())
+		log.Error("发送推送请求失败: ", err)
 		return
 	}
-	// 发送ntfy推送
-	if cfg.Business.Notify.Ntfy.Enable {
-		go sendNtfyNotification("踢出群聊通知", fmt.Sprintf("你被移出群聊%s", req.GroupQUID), req.UserFUID)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Error("推送请求返回错误: ", string(body))
 	}
-	success(c, map[string]string{"msg": "踢出群聊成功"})
-	log.Infof("Kick group member: group=%s, operator=%s, target=%s", req.GroupQUID, currentFUID, req.UserFUID)
 }
 
-// 发布群公告接口
-func publishGroupNoticeHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
+// 邮件发送接口（SMTP或日志/文件，测试环境使用日志实现即可）
+type mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTP邮件发送
+type smtpMailer struct {
+	host        string
+	port        int
+	username    string
+	password    string
+	from        string
+	implicitTLS bool // 465端口等直接TLS连接；否则由服务器支持时自动STARTTLS
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	msg := buildMailMessage(m.from, to, subject, body)
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
 	}
-	// 参数绑定
-	var req struct {
-		GroupQUID   string `json:"group_quid" binding:"required"`
-		Content     string `json:"content" binding:"required,max=256"`
+	if !m.implicitTLS {
+		return smtp.SendMail(addr, auth, m.from, []string{to}, msg)
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: m.host})
+	if err != nil {
+		return err
 	}
-	// 检查当前用户权限（群主/管理）
-	var currentMember GroupMember
-	err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&currentMember).Error
+	client, err := smtp.NewClient(conn, m.host)
 	if err != nil {
-		fail(c, 403, "你不是该群成员，无操作权限")
-		return
+		conn.Close()
+		return err
 	}
-	if currentMember.Role != 1 && currentMember.Role != 2 {
-		fail(c, 403, "仅群主和管理员可发布群公告")
-		return
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
 	}
-	// 创建群公告
-	notice := GroupNotice{
-		GroupQUID:     req.GroupQUID,
-		Content:       req.Content,
-		PublisherFUID: currentFUID,
-		PublishTime:   time.Now(),
+	if err := client.Mail(m.from); err != nil {
+		return err
 	}
-	if err := db.Create(&notice).Error; err != nil {
-		fail(c, 500, "发布群公告失败: "+err.Error())
-		return
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// 日志邮件（不实际发送）：配置了目录时每封邮件写入一个.eml文件，否则写入日志
+type logMailer struct {
+	dir  string
+	from string
+}
+
+func (m *logMailer) Send(to, subject, body string) error {
+	if m.dir == "" {
+		log.Infof("Mail (log driver): to=%s, subject=%s\n%s", to, subject, body)
+		return nil
+	}
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s_%d.eml", time.Now().Format("20060102150405"), time.Now().UnixNano()%1e6)
+	return os.WriteFile(filepath.Join(m.dir, name), buildMailMessage(m.from, to, subject, body), 0600)
+}
+
+// 构建纯文本邮件（主题使用RFC 2047编码）
+func buildMailMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + mime.BEncoding.Encode("UTF-8", subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	return []byte(b.String())
+}
+
+// 当前邮件发送实现
+var mailSender mailer
+
+// 初始化邮件发送及邮件令牌签名密钥
+func initMailer() error {
+	from := cfg.Mail.From
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	switch cfg.Mail.Driver {
+	case "smtp":
+		if cfg.Mail.SMTP.Host == "" {
+			return errors.New("未配置SMTP服务器")
+		}
+		mailSender = &smtpMailer{
+			host:        cfg.Mail.SMTP.Host,
+			port:        cfg.Mail.SMTP.Port,
+			username:    cfg.Mail.SMTP.Username,
+			password:    cfg.Mail.SMTP.Password,
+			from:        from,
+			implicitTLS: cfg.Mail.SMTP.ImplicitTLS,
+		}
+	case "", "log":
+		mailSender = &logMailer{dir: cfg.Mail.LogDir, from: from}
+	default:
+		return fmt.Errorf("不支持的邮件驱动: %s", cfg.Mail.Driver)
+	}
+	if cfg.Mail.TokenSecret != "" {
+		mailTokenKey = []byte(cfg.Mail.TokenSecret)
+	} else {
+		// 未配置时随机生成：重启或多节点部署时已发出的链接将失效
+		mailTokenKey = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, mailTokenKey); err != nil {
+			return err
+		}
+		log.Warn("未配置mail.token_secret，邮件令牌签名密钥已随机生成（重启后已发出的链接失效，多节点部署须配置）")
 	}
-	// 推送群公告给所有成员
+	log.Infof("Mailer initialized: driver=%s", cfg.Mail.Driver)
+	return nil
+}
+
+// 异步发送邮件（失败只记录日志）
+func sendMailAsync(to, subject, body string) {
 	go func() {
-		var members []GroupMember
-		db.Where("group_quid = ? AND status = 1", req.GroupQUID).Find(&members)
-		for _, member := range members {
-			if cfg.Business.Notify.Ntfy.Enable {
-				sendNtfyNotification("群公告", fmt.Sprintf("群聊%s发布新公告: %s", req.GroupQUID, req.Content), member.UserFUID)
-			}
+		if err := mailSender.Send(to, subject, body); err != nil {
+			log.Errorf("发送邮件失败: to=%s, subject=%s, err=%v", to, subject, err)
 		}
 	}()
-	success(c, map[string]string{"msg": "发布群公告成功"})
-	log.Infof("Publish group notice: group=%s, publisher=%s, content=%s", req.GroupQUID, currentFUID, req.Content)
 }
 
-// 解散群聊接口
-func dissolveGroupHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
-	}
-	// 获取群聊QUID
-	groupQUID := c.Param("quid")
-	if groupQUID == "" {
-		fail(c, 400, "群聊QUID不能为空")
-		return
+// 邮件链接（配置了前端地址时生成完整链接，否则只给出令牌）
+func mailLink(path, token string) string {
+	if cfg.Mail.LinkBase == "" {
+		return token
 	}
-	// 检查是否是群主
-	var group Group
-	err := db.Where("quid = ? AND owner_fuid = ? AND status = 1", groupQUID, currentFUID).First(&group).Error
-	if err != nil {
-		fail(c, 403, "仅群主可解散群聊")
-		return
+	return strings.TrimRight(cfg.Mail.LinkBase, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// VIP等级更新定时任务
+func vipLevelUpdateTask() {
+	ticker := time.NewTicker(time.Duration(cfg.Business.VIP.UpdateInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		log.Info("开始更新用户VIP等级")
+		// 1. 更新用户VIP经验
+		var users []User
+		db.Where("vip_start_time IS NOT NULL AND status = 1").Find(&users)
+		for _, user := range users {
+			// 计算在线时长（简化：此处假设用户在线状态通过Redis记录）
+			ctx := context.Background()
+			online, err := rdb.Exists(ctx, "online_user:"+user.FUID).Result()
+			if err != nil || online == 0 {
+				continue
+			}
+			// 添加经验
+			newExp := user.VIPExp + uint64(cfg.Business.VIP.ExpPerHour)
+			newLevel := uint8(newExp / 100) // 每100经验升1级，可配置
+			if newLevel > uint8(cfg.Business.VIP.LevelMax) {
+				newLevel = uint8(cfg.Business.VIP.LevelMax)
+				newExp = uint64(cfg.Business.VIP.LevelMax) * 100
+			}
+			// 更新
+			db.Model(&user).Updates(map[string]interface{}{
+				"vip_exp":   newExp,
+				"vip_level": newLevel,
+			})
+		}
+		// 2. 更新群聊VIP经验
+		var groups []Group
+		db.Where("vip_start_time IS NOT NULL AND status = 1").Find(&groups)
+		for _, group := range groups {
+			// 添加经验
+			newExp := group.VIPExp + uint64(cfg.Business.GroupVIP.ExpPerHour)
+			newLevel := uint8(newExp / 100)
+			if newLevel > uint8(cfg.Business.GroupVIP.LevelMax) {
+				newLevel = uint8(cfg.Business.GroupVIP.LevelMax)
+				newExp = uint64(cfg.Business.GroupVIP.LevelMax) * 100
+			}
+			// 更新
+			db.Model(&group).Updates(map[string]interface{}{
+				"vip_exp":   newExp,
+				"vip_level": newLevel,
+			})
+		}
+		log.Info("完成VIP等级更新")
 	}
-	// 更新群聊状态为已解散
-	err = db.Model(&group).Update("status", 0).Error
-	if err != nil {
-		fail(c, 500, "解散群聊失败: "+err.Error())
+}
+
+// 消息自动清理定时任务
+func messageAutoCleanTask() {
+	if !cfg.Business.Message.AutoClean.Enable {
 		return
 	}
-	// 更新所有群成员状态为已退出
-	db.Model(&GroupMember{}).Where("group_quid = ?", groupQUID).Update("status", 0)
-	// 推送解散通知
-	go func() {
-		var members []GroupMember
-		db.Where("group_quid = ? AND status = 1", groupQUID).Find(&members)
-		for _, member := range members {
-			if cfg.Business.Notify.Ntfy.Enable {
-				sendNtfyNotification("群聊解散通知", fmt.Sprintf("群聊%s已被群主解散", groupQUID), member.UserFUID)
-			}
+	// 每天凌晨执行
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		log.Info("开始自动清理过期消息")
+		// 计算清理时间点
+		cleanTime := time.Now().AddDate(0, 0, -cfg.Business.Message.AutoClean.Days)
+		// 删除过期消息
+		result := db.Where("send_time < ?", cleanTime).Delete(&Message{})
+		if result.Error != nil {
+			log.Error("清理过期消息失败: ", result.Error)
+		} else {
+			log.Infof("清理过期消息成功，共删除%d条", result.RowsAffected)
 		}
-	}()
-	success(c, map[string]string{"msg": "解散群聊成功"})
-	log.Infof("Dissolve group: group=%s, owner=%s", groupQUID, currentFUID)
+		// 删除关联的离线消息
+		db.Where("created_at < ?", cleanTime).Delete(&OfflineMessage{})
+	}
 }
 
-// 转让群聊接口
-func transferGroupHandler(c *gin.Context) {
+// 发送语音消息接口（扩展现有消息类型）
+func sendVoiceMessageHandler(c *gin.Context) {
 	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
+
 	// 参数绑定
 	var req struct {
-		GroupQUID   string `json:"group_quid" binding:"required"`
-		TargetFUID  string `json:"target_fuid" binding:"required"` // 转让目标用户
+		ReceiverType uint8  `json:"receiver_type" binding:"required,oneof=1 2"` // 1:单聊 2:群聊
+		ReceiverID   string `json:"receiver_id" binding:"required"`             // 接收方ID
+		Duration     int    `json:"duration" binding:"required,min=1"`          // 语音时长(秒)
+		VoiceURL     string `json:"voice_url" binding:"required"`               // 加密后的语音文件URL
+		FontStyle    string `json:"font_style"`                                 // 可选文字样式
+		FontSize     int    `json:"font_size"`                                  // 可选文字大小
+		FontColor    string `json:"font_color"`                                 // 可选文字颜色
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
-	// 检查是否是群主
-	var group Group
-	err := db.Where("quid = ? AND owner_fuid = ? AND status = 1", req.GroupQUID, currentFUID).First(&group).Error
-	if err != nil {
-		fail(c, 403, "仅群主可转让群聊")
-		return
-	}
-	// 检查目标用户是否是群成员
-	var targetMember GroupMember
-	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.GroupQUID, req.TargetFUID).First(&targetMember).Error
-	if err != nil {
-		fail(c, 400, "转让目标用户不是该群成员")
-		return
-	}
-	// 更新群主
-	err = db.Transaction(func(tx *gorm.DB) error {
-		// 更新群聊群主
-		if err := tx.Model(&group).Update("owner_fuid", req.TargetFUID).Error; err != nil {
-			return err
-		}
-		// 更新原群主角色为普通成员
-		if err := tx.Model(&GroupMember{}).Where("group_quid = ? AND user_fuid = ?", req.GroupQUID, currentFUID).Update("role", 0).Error; err != nil {
-			return err
-		}
-		// 更新新群主角色为群主
-		if err := tx.Model(&targetMember).Update("role", 1).Error; err != nil {
-			return err
-		}
-		return nil
+
+	// 保存并推送语音消息（content_type=6表示语音消息，复用消息管道）
+	message, apiErr := sendMessage(currentFUID, sendMessageRequest{
+		ReceiverType: req.ReceiverType,
+		ReceiverID:   req.ReceiverID,
+		ContentType:  6, // 新增：6=语音消息
+		Content:      fmt.Sprintf(`{"url":"%s","duration":%d}`, req.VoiceURL, req.Duration), // 加密的JSON内容
+		FontStyle:    req.FontStyle,
+		FontSize:     req.FontSize,
+		FontColor:    req.FontColor,
 	})
-	if err != nil {
-		fail(c, 500, "转让群聊失败: "+err.Error())
+	if apiErr != nil {
+		fail(c, apiErr.Code, apiErr.Msg)
 		return
 	}
-	// 发送转让通知
-	if cfg.Business.Notify.Ntfy.Enable {
-		// 通知新群主
-		go sendNtfyNotification("群聊转让通知", fmt.Sprintf("你已成为群聊%s的新群主", req.GroupQUID), req.TargetFUID)
-		// 通知原群主
-		go sendNtfyNotification("群聊转让通知", fmt.Sprintf("你已将群聊%s转让给用户%s", req.GroupQUID, req.TargetFUID), currentFUID)
-	}
-	success(c, map[string]string{"msg": "转让群聊成功"})
-	log.Infof("Transfer group: group=%s, from=%s, to=%s", req.GroupQUID, currentFUID, req.TargetFUID)
+
+	success(c, map[string]interface{}{
+		"msg_id":    message.MsgID,
+		"conv_id":   message.ConvID,
+		"seq":       message.Seq,
+		"send_time": message.SendTime.Format("2006-01-02 15:04:05"),
+		"duration":  req.Duration,
+	})
+	log.Infof("Send voice message: msg_id=%s, sender=%s, receiver_type=%d, receiver_id=%s, duration=%ds",
+		message.MsgID, currentFUID, req.ReceiverType, req.ReceiverID, req.Duration)
 }
 
-// 发送消息接口
-func sendMessageHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+// 发起语音/视频通话接口
+func initCallHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
+
 	// 参数绑定
 	var req struct {
 		ReceiverType uint8  `json:"receiver_type" binding:"required,oneof=1 2"` // 1:单聊 2:群聊
-		ReceiverID   string `json:"receiver_id" binding:"required"` // 单聊:好友FUID 群聊:群QUID
-		ContentType  uint8  `json:"content_type" binding:"required,oneof=1 2 3 4 5"` // 1:文字 2:图片 3:文件 4:表情 5:系统消息
-		Content      string `json:"content" binding:"required"` // 加密后的内容
-		FontStyle    string `json:"font_style"` // 字体样式
-		FontSize     int    `json:"font_size"`  // 字体大小
-		FontColor    string `json:"font_color"` // 字体颜色
+		ReceiverID   string `json:"receiver_id" binding:"required"`             // 接收方ID
+		CallType     uint8  `json:"call_type" binding:"required,oneof=1 2"`     // 1:语音 2:视频
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
+
 	// 验证接收方合法性
 	if req.ReceiverType == 1 {
-		// 单聊：检查是否是好友且不在黑名单
-		var friend Friend
-		err := db.Where("user_fuid = ? AND friend_fuid = ? AND status = 1", currentFUID, req.ReceiverID).First(&friend).Error
-		if err != nil {
-			fail(c, 400, "该用户不是你的好友，无法发送消息")
-			return
-		}
-		// 检查对方是否将自己加入黑名单
-		var reverseFriend Friend
-		err = db.Where("user_fuid = ? AND friend_fuid = ? AND status = 2", req.ReceiverID, currentFUID).First(&reverseFriend).Error
-		if err == nil {
-			fail(c, 403, "对方已将你加入黑名单，无法发送消息")
-			return
-		}
-	} else if req.ReceiverType == 2 {
-		// 群聊：检查是否是群成员，且未被禁言
-		var member GroupMember
-		err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.ReceiverID, currentFUID).First(&member).Error
-		if err != nil {
-			fail(c, 403, "你不是该群成员，无法发送消息")
-			return
-		}
-		// 检查是否被禁言
-		if member.MuteEndTime.After(time.Now()) {
-			fail(c, 403, fmt.Sprintf("你已被禁言，禁言结束时间：%s", member.MuteEndTime.Format("2006-01-02 15:04:05")))
-			return
-		}
-	}
-	// 生成消息ID
-	msgID, err := generateUniqueID(32)
-	if err != nil {
-		fail(c, 500, "生成消息ID失败: "+err.Error())
-		return
-	}
-	// 处理字体参数默认值
-	fontStyle := req.FontStyle
-	if fontStyle == "" {
-		fontStyle = "思源黑体"
-	}
-	fontSize := req.FontSize
-	if fontSize <= 0 {
-		fontSize = 14
-	}
-	fontColor := req.FontColor
-	if fontColor == "" {
-		fontColor = "#000000"
-	}
-	// 创建消息记录
-	message := Message{
-		MsgID:        msgID,
-		SenderFUID:   currentFUID,
-		ReceiverType: req.ReceiverType,
-		ReceiverID:   req.ReceiverID,
-		ContentType:  req.ContentType,
-		Content:      req.Content, // 已加密内容
-		FontStyle:    fontStyle,
-		FontSize:     fontSize,
-		FontColor:    fontColor,
-		IsRecalled:   false,
-		IsRead:       false,
-		SendTime:     time.Now(),
-	}
-	if err := db.Create(&message).Error; err != nil {
-		fail(c, 500, "保存消息失败: "+err.Error())
-		return
-	}
-	// 处理离线消息
-	go saveOfflineMessage(req.ReceiverType, req.ReceiverID, msgID)
-	// 推送消息（socket.io）
-	go pushMessageToClient(message)
-	// 发送ntfy推送（离线时）
-	go func() {
-		var targetFUIDs []string
-		if req.ReceiverType == 1 {
-			targetFUIDs = append(targetFUIDs, req.ReceiverID)
-		} else {
-			// 群聊：获取所有在线成员（排除自己）
-			var members []GroupMember
-			db.Where("group_quid = ? AND user_fuid != ? AND status = 1", req.ReceiverID, currentFUID).Find(&members)
-			for _, m := range members {
-				targetFUIDs = append(targetFUIDs, m.UserFUID)
-			}
-		}
-		// 解密内容用于推送
-		decryptedContent, err := rsaDecrypt([]byte(req.Content))
-		if err != nil {
-			log.Error("解密消息内容失败: ", err)
+		// 单聊：检查好友关系
+		var friend Friend
+		if err := db.Where("user_fuid = ? AND friend_fuid = ? AND status = 1", currentFUID, req.ReceiverID).First(&friend).Error; err != nil {
+			fail(c, 400, "该用户不是你的好友，无法发起通话")
 			return
 		}
-		// 检查用户是否在线（Redis中存在则在线）
-		ctx := context.Background()
-		for _, fuid := range targetFUIDs {
-			online, err := rdb.Exists(ctx, "online_user:"+fuid).Result()
-			if err != nil || online == 0 {
-				// 离线推送
-				if cfg.Business.Notify.Ntfy.Enable {
-					var title string
-					if req.ReceiverType == 1 {
-						title = "好友消息"
-					} else {
-						title = "群聊消息"
-					}
-					sendNtfyNotification(title, string(decryptedContent), fuid)
-				}
-			}
+	} else if req.ReceiverType == 2 {
+		// 群聊：检查群成员身份
+		var member GroupMember
+		if err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.ReceiverID, currentFUID).First(&member).Error; err != nil {
+			fail(c, 403, "你不是该群成员，无法发起群通话")
+			return
 		}
-	}()
+	}
+
+	// 生成通话ID
+	callID, err := generateUniqueID(32)
+	if err != nil {
+		fail(c, 500, "生成通话ID失败: "+err.Error())
+		return
+	}
+
+	// 创建通话记录（初始状态：等待接听）
+	call := Call{
+		CallID:       callID,
+		SenderFUID:   currentFUID,
+		ReceiverType: req.ReceiverType,
+		ReceiverID:   req.ReceiverID,
+		CallType:     req.CallType,
+		Status:       0, // 0:等待接听
+		CreateTime:   time.Now(),
+	}
+	if err := db.Create(&call).Error; err != nil {
+		fail(c, 500, "创建通话记录失败: "+err.Error())
+		return
+	}
+
+	// 推送通话请求给接收方
+	go pushCallNotification(call, "incoming")
+
 	success(c, map[string]interface{}{
-		"msg_id": message.MsgID,
-		"send_time": message.SendTime.Format("2006-01-02 15:04:05"),
+		"call_id":     call.CallID,
+		"create_time": call.CreateTime.Format("2006-01-02 15:04:05"),
+		"status":      "等待对方接听",
 	})
-	log.Infof("Send message: msg_id=%s, sender=%s, receiver_type=%d, receiver_id=%s",
-		msgID, currentFUID, req.ReceiverType, req.ReceiverID)
+	log.Infof("Init call: call_id=%s, sender=%s, type=%d, receiver_type=%d, receiver_id=%s",
+		callID, currentFUID, req.CallType, req.ReceiverType, req.ReceiverID)
 }
 
-// 撤回消息接口
-func recallMessageHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+// 接听通话接口
+func acceptCallHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
-	// 获取消息ID
-	msgID := c.Param("msg_id")
-	if msgID == "" {
-		fail(c, 400, "消息ID不能为空")
+
+	// 参数绑定
+	var req struct {
+		CallID string `json:"call_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
-	// 查询消息
-	var message Message
-	err := db.Where("msg_id = ? AND sender_fuid = ?", msgID, currentFUID).First(&message).Error
-	if err != nil {
-		fail(c, 400, "消息不存在或不是你发送的")
+
+	// 查询通话记录并验证权限
+	var call Call
+	if err := db.Where("call_id = ?", req.CallID).First(&call).Error; err != nil {
+		fail(c, 400, "通话记录不存在")
 		return
 	}
-	// 检查是否超过撤回时间
-	recallTimeout := time.Duration(cfg.Business.Message.RecallTimeout) * time.Second
-	if time.Since(message.SendTime) > recallTimeout {
-		fail(c, 400, fmt.Sprintf("消息超过%d分钟，无法撤回", cfg.Business.Message.RecallTimeout/60))
+
+	// 验证是否为通话接收方
+	if call.ReceiverType == 1 && call.ReceiverID != currentFUID {
+		fail(c, 403, "无权操作此通话")
 		return
 	}
-	// 更新消息为已撤回
-	err = db.Model(&message).Update("is_recalled", true).Error
-	if err != nil {
-		fail(c, 500, "撤回消息失败: "+err.Error())
+	if call.ReceiverType == 2 {
+		// 群聊需验证是否为群成员
+		var member GroupMember
+		if err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", call.ReceiverID, currentFUID).First(&member).Error; err != nil {
+			fail(c, 403, "你不是该群成员，无权接听")
+			return
+		}
+	}
+
+	// 验证通话状态（必须为等待接听状态）
+	if call.Status != 0 {
+		fail(c, 400, "该通话状态不允许接听")
 		return
 	}
-	// 推送撤回通知
-	go pushRecallMessageToClient(message)
-	success(c, map[string]string{"msg": "撤回消息成功"})
-	log.Infof("Recall message: msg_id=%s, sender=%s", msgID, currentFUID)
-}
 
-// 保存离线消息
-func saveOfflineMessage(receiverType uint8, receiverID string, msgID string) {
-	ctx := context.Background()
-	if receiverType == 1 {
-		// 单聊：保存到接收方离线消息
-		offlineMsg := OfflineMessage{
-			UserFUID: receiverID,
-			MsgID:    msgID,
-			Status:   0,
-		}
-		db.Create(&offlineMsg)
-		// Redis记录离线消息数
-		rdb.Incr(ctx, "offline_msg_count:"+receiverID)
-	} else {
-		// 群聊：保存到所有离线成员
-		var members []GroupMember
-		db.Where("group_quid = ? AND status = 1", receiverID).Find(&members)
-		for _, member := range members {
-			// 检查是否在线
-			online, err := rdb.Exists(ctx, "online_user:"+member.UserFUID).Result()
-			if err != nil || online == 0 {
-				offlineMsg := OfflineMessage{
-					UserFUID: member.UserFUID,
-					MsgID:    msgID,
-					Status:   0,
-				}
-				db.Create(&offlineMsg)
-				// Redis记录离线消息数
-				rdb.Incr(ctx, "offline_msg_count:"+member.UserFUID)
-			}
-		}
+	// 更新通话状态为通话中
+	startTime := time.Now()
+	if err := db.Model(&call).Updates(map[string]interface{}{
+		"status":     1, // 1:通话中
+		"start_time": startTime,
+	}).Error; err != nil {
+		fail(c, 500, "更新通话状态失败: "+err.Error())
+		return
 	}
+
+	// 推送接听通知给发起方
+	go pushCallNotification(call, "accepted")
+
+	success(c, map[string]interface{}{
+		"call_id":    call.CallID,
+		"start_time": startTime.Format("2006-01-02 15:04:05"),
+		"status":     "通话中",
+	})
+	log.Infof("Accept call: call_id=%s, receiver=%s", req.CallID, currentFUID)
 }
 
-// 推送消息到客户端（socket.io）
-func pushMessageToClient(message Message) {
-	// 构建推送数据
-	pushData := map[string]interface{}{
-		"msg_id":         message.MsgID,
-		"sender_fuid":    message.SenderFUID,
-		"receiver_type":  message.ReceiverType,
-		"receiver_id":    message.ReceiverID,
-		"content_type":   message.ContentType,
-		"content":        message.Content,
-		"font_style":     message.FontStyle,
-		"font_size":      message.FontSize,
-		"font_color":     message.FontColor,
-		"is_recalled":    message.IsRecalled,
-		"send_time":      message.SendTime.Format("2006-01-02 15:04:05"),
+// 拒绝通话接口
+func rejectCallHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
+		return
 	}
-	// 获取发送者信息
-	var sender User
-	db.Where("fuid = ?", message.SenderFUID).Select("nickname, vip_level").First(&sender)
-	pushData["sender_nickname"] = sender.Nickname
-	pushData["sender_vip_level"] = sender.VIPLevel
 
-	ctx := context.Background()
-	if message.ReceiverType == 1 {
-		// 单聊：推送给接收方
-		groupID := "user:" + message.ReceiverID
-		// 检查接收方是否在线
-		online, err := rdb.Exists(ctx, "online_user:"+message.ReceiverID).Result()
-		if err == nil && online > 0 {
-			// 通过socket.io推送
-			// socketServer是全局socket.io服务实例
-			socketServer.BroadcastToRoom("", groupID, "new_message", pushData)
-			// 更新已读状态
-			db.Model(&message).Update("is_read", true)
-		}
-	} else {
-		// 群聊：推送给所有在线成员
-		groupID := "group:" + message.ReceiverID
-		socketServer.BroadcastToRoom("", groupID, "new_message", pushData)
-		// 更新已读状态（在线成员）
-		var members []GroupMember
-		db.Where("group_quid = ? AND status = 1", message.ReceiverID).Find(&members)
-		for _, m := range members {
-			online, err := rdb.Exists(ctx, "online_user:"+m.UserFUID).Result()
-			if err == nil && online > 0 {
-				// 简化处理：群消息已读状态按用户维度，此处省略
-			}
-		}
+	// 参数绑定
+	var req struct {
+		CallID  string `json:"call_id" binding:"required"`
+		Reason  string `json:"reason" binding:"max=100"` // 拒绝原因（可选）
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
+		return
 	}
-}
 
-// 推送撤回消息通知
-func pushRecallMessageToClient(message Message) {
-	pushData := map[string]interface{}{
-		"msg_id":        message.MsgID,
-		"is_recalled":   true,
-		"recall_time":   time.Now().Format("2006-01-02 15:04:05"),
+	// 查询通话记录并验证权限
+	var call Call
+	if err := db.Where("call_id = ?", req.CallID).First(&call).Error; err != nil {
+		fail(c, 400, "通话记录不存在")
+		return
 	}
-	if message.ReceiverType == 1 {
-		groupID := "user:" + message.ReceiverID
-		socketServer.BroadcastToRoom("", groupID, "recall_message", pushData)
-	} else {
-		groupID := "group:" + message.ReceiverID
-		socketServer.BroadcastToRoom("", groupID, "recall_message", pushData)
+
+	// 验证是否为通话接收方
+	if call.ReceiverType == 1 && call.ReceiverID != currentFUID {
+		fail(c, 403, "无权操作此通话")
+		return
 	}
-}
 
-// 文件/图片上传接口
-func uploadFileHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
+	// 验证通话状态
+	if call.Status != 0 {
+		fail(c, 400, "该通话状态不允许拒绝")
 		return
 	}
-	// 获取文件类型（image/file）
-	fileType := c.Query("type")
-	if fileType != "image" && fileType != "file" {
-		fail(c, 400, "文件类型必须是image或file")
+
+	// 更新通话状态为已拒绝
+	if err := db.Model(&call).Updates(map[string]interface{}{
+		"status":    2, // 2:已拒绝
+		"end_time":  time.Now(),
+	}).Error; err != nil {
+		fail(c, 500, "更新通话状态失败: "+err.Error())
 		return
 	}
-	// 获取上传文件
-	file, fileHeader, err := c.Request.FormFile("file")
-	if err != nil {
-		fail(c, 400, "获取文件失败: "+err.Error())
+
+	// 推送拒绝通知给发起方
+	go pushCallNotification(call, "rejected", req.Reason)
+
+	success(c, map[string]string{
+		"msg": "已拒绝通话",
+	})
+	log.Infof("Reject call: call_id=%s, receiver=%s, reason=%s", req.CallID, currentFUID, req.Reason)
+}
+
+// 结束通话接口
+func endCallHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
+	if currentFUID == "" {
+		fail(c, 401, "未登录")
 		return
 	}
-	defer file.Close()
-	// 检查文件大小
-	maxSize := cfg.Storage.File.MaxSize
-	if fileType == "image" {
-		maxSize = cfg.Storage.Image.MaxSize
+
+	// 参数绑定
+	var req struct {
+		CallID string `json:"call_id" binding:"required"`
 	}
-	if fileHeader.Size > int64(maxSize) {
-		fail(c, 400, fmt.Sprintf("文件大小超过限制（最大%dMB）", maxSize/1024/1024))
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, 400, "参数错误: "+err.Error())
 		return
 	}
-	// 检查文件扩展名
-	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
-	ext = strings.TrimPrefix(ext, ".")
-	allowTypes := cfg.Storage.File.AllowTypes
-	if fileType == "image" {
-		allowTypes = cfg.Storage.Image.AllowTypes
-	}
-	allow := false
-	for _, t := range allowTypes {
-		if ext == t {
-			allow = true
-			break
-		}
+
+	// 查询通话记录并验证权限（发起者或接收者均可结束）
+	var call Call
+	if err := db.Where("call_id = ?", req.CallID).First(&call).Error; err != nil {
+		fail(c, 400, "通话记录不存在")
+		return
 	}
-	if !allow {
-		fail(c, 400, fmt.Sprintf("不支持的文件类型，允许的类型：%s", strings.Join(allowTypes, ",")))
+
+	// 验证操作权限
+	isSender := call.SenderFUID == currentFUID
+	isReceiver := (call.ReceiverType == 1 && call.ReceiverID == currentFUID) || 
+	              (call.ReceiverType == 2 && isGroupMember(call.ReceiverID, currentFUID))
+	if !isSender && !isReceiver {
+		fail(c, 403, "无权结束此通话")
 		return
 	}
-	// 生成文件名
-	fileName := fmt.Sprintf("%s_%d.%s", currentFUID, time.Now().UnixNano(), ext)
-	var fileURL string
-	// 存储文件
-	if cfg.Storage.Type == "minio" {
-		// MinIO存储
-		ctx := context.Background()
-		_, err := minioClient.PutObject(ctx, cfg.Storage.MinIO.Bucket, fileName, file, fileHeader.Size, minio.PutObjectOptions{
-			ContentType: http.DetectContentType([]byte(ext)),
-		})
-		if err != nil {
-			fail(c, 500, "MinIO上传失败: "+err.Error())
-			return
-		}
-		fileURL = fmt.Sprintf("%s/%s/%s", cfg.Storage.MinIO.Domain, cfg.Storage.MinIO.Bucket, fileName)
-	} else {
-		// 本地存储
-		// 创建存储目录
-		uploadDir := filepath.Join(cfg.Storage.Local.Path, fileType)
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			fail(c, 500, "创建存储目录失败: "+err.Error())
-			return
-		}
-		// 保存文件
-		filePath := filepath.Join(uploadDir, fileName)
-		outFile, err := os.Create(filePath)
-		if err != nil {
-			fail(c, 500, "创建文件失败: "+err.Error())
-			return
-		}
-		defer outFile.Close()
-		_, err = io.Copy(outFile, file)
-		if err != nil {
-			fail(c, 500, "保存文件失败: "+err.Error())
-			return
-		}
-		fileURL = fmt.Sprintf("%s/%s/%s", cfg.Storage.Local.Domain, fileType, fileName)
+
+	// 验证通话状态（必须为通话中）
+	if call.Status != 1 {
+		fail(c, 400, "该通话状态不允许结束")
+		return
 	}
-	// RSA加密文件URL
-	encryptedURL, err := rsaEncrypt([]byte(fileURL))
-	if err != nil {
-		fail(c, 500, "加密文件URL失败: "+err.Error())
+
+	// 计算通话时长
+	endTime := time.Now()
+	duration := int(endTime.Sub(call.StartTime).Seconds())
+
+	// 更新通话状态为已结束
+	if err := db.Model(&call).Updates(map[string]interface{}{
+		"status":   3,        // 3:已结束
+		"end_time": endTime,
+		"duration": duration,
+	}).Error; err != nil {
+		fail(c, 500, "更新通话状态失败: "+err.Error())
 		return
 	}
+
+	// 推送结束通知给相关方
+	go pushCallNotification(call, "ended", fmt.Sprintf("通话时长: %d秒", duration))
+
 	success(c, map[string]interface{}{
-		"file_url": encryptedURL, // 返回加密后的URL
-		"file_name": fileHeader.Filename,
-		"file_size": fileHeader.Size,
+		"msg":      "通话已结束",
+		"duration": duration,
+		"end_time": endTime.Format("2006-01-02 15:04:05"),
 	})
-	log.Infof("Upload file: user=%s, type=%s, name=%s, size=%d, url=%s",
-		currentFUID, fileType, fileHeader.Filename, fileHeader.Size, fileURL)
+	log.Infof("End call: call_id=%s, operator=%s, duration=%ds", req.CallID, currentFUID, duration)
 }
 
-// 获取好友资料卡接口
-func getFriendProfileHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
+// 推送通话通知（内部使用）
+func pushCallNotification(call Call, action string, extra ...string) {
+	// 构建通知内容
+	notification := map[string]interface{}{
+		"call_id":      call.CallID,
+		"sender_fuid":  call.SenderFUID,
+		"receiver_type": call.ReceiverType,
+		"receiver_id":  call.ReceiverID,
+		"call_type":    call.CallType,
+		"action":       action, // incoming/accepted/rejected/ended
+		"timestamp":    time.Now().Unix(),
 	}
-	// 获取好友FUID
-	friendFUID := c.Param("fuid")
-	if friendFUID == "" {
-		fail(c, 400, "好友FUID不能为空")
-		return
+	if len(extra) > 0 {
+		notification["extra"] = extra[0]
 	}
-	// 查询好友信息
-	var user User
-	err := db.Where("fuid = ? AND status = 1", friendFUID).
-		Select("fuid, nickname, vip_level, vip_exp, signature").
-		First(&user).Error
-	if err != nil {
-		fail(c, 400, "好友不存在或已被禁用")
-		return
+
+	// 推送目标：接听/拒绝通知发起方；来电通知接收方（单聊为接收者，群聊为所有群成员）；结束通知双方
+	var targetFUIDs []string
+	if action == "accepted" || action == "rejected" || action == "ended" {
+		targetFUIDs = append(targetFUIDs, call.SenderFUID)
 	}
-	// 检查是否是好友
-	var friend Friend
-	err = db.Where("user_fuid = ? AND friend_fuid = ? AND status = 1", currentFUID, friendFUID).First(&friend).Error
-	if err != nil {
-		fail(c, 403, "该用户不是你的好友，无法查看资料卡")
-		return
+	if action == "incoming" || action == "ended" {
+		if call.ReceiverType == 1 {
+			targetFUIDs = append(targetFUIDs, call.ReceiverID)
+		} else {
+			var members []GroupMember
+			db.Where("group_quid = ? AND user_fuid != ? AND status = 1", call.ReceiverID, call.SenderFUID).Find(&members)
+			for _, m := range members {
+				targetFUIDs = append(targetFUIDs, m.UserFUID)
+			}
+		}
 	}
-	// 构建资料卡数据
-	profile := map[string]interface{}{
-		"fuid":        user.FUID,
-		"nickname":    user.Nickname,
-		"vip_level":   user.VIPLevel,
-		"vip_exp":     user.VIPExp,
-		"signature":   user.Signature,
+	for _, fuid := range targetFUIDs {
+		broadcastToRoom("user:"+fuid, "call_notification", notification)
 	}
-	success(c, profile)
 }
 
-// 获取群聊资料卡接口
-func getGroupProfileHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
-	}
-	// 获取群聊QUID
-	groupQUID := c.Param("quid")
-	if groupQUID == "" {
-		fail(c, 400, "群聊QUID不能为空")
-		return
+
+
+// 检查是否为群成员（内部使用）
+func isGroupMember(groupQUID, userFUID string) bool {
+	var count int64
+	db.Model(&GroupMember{}).Where("group_quid = ? AND user_fuid = ? AND status = 1", groupQUID, userFUID).Count(&count)
+	return count > 0
+}
+
+// 日志分割定时任务
+func logRotateTask() {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		log.Info("开始日志分割")
+		// 关闭当前日志文件
+		// 重新创建日志文件
+		logFileName := filepath.Join(cfg.Log.Path, time.Now().Format(cfg.Log.FileNameFormat)+".log")
+		file, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Error("创建新日志文件失败: ", err)
+			continue
+		}
+		log.SetOutput(io.MultiWriter(os.Stdout, file))
+		// 清理旧日志文件
+		cleanOldLogs()
+		log.Info("完成日志分割")
 	}
-	// 查询群聊信息
-	var group Group
-	err := db.Where("quid = ? AND status = 1", groupQUID).
-		Select("quid, owner_fuid, name, vip_level, vip_exp, desc").
-		First(&group).Error
+}
+
+// 清理旧日志文件
+func cleanOldLogs() {
+	files, err := os.ReadDir(cfg.Log.Path)
 	if err != nil {
-		fail(c, 400, "群聊不存在或已解散")
+		log.Error("读取日志目录失败: ", err)
 		return
 	}
-	// 检查是否是群成员
-	var member GroupMember
-	err = db.Where("group_quid = ? AND user_fuid = ? AND status = 1", groupQUID, currentFUID).First(&member).Error
-	if err != nil {
-		fail(c, 403, "你不是该群成员，无法查看资料卡")
-		return
+	// 计算保留时间
+	keepTime := time.Now().AddDate(0, 0, -cfg.Log.MaxAge)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		// 检查文件名是否符合格式
+		if !strings.HasPrefix(file.Name(), "log_") {
+			continue
+		}
+		// 检查文件修改时间
+		fileInfo, err := file.Info()
+		if err != nil {
+		log.Error("获取文件信息失败: ", err, " 文件名称: ", file.Name())
+		continue
+		}
+
+		// 检查文件修改时间是否早于保留时间
+		if fileInfo.ModTime().Before(keepTime) {
+		filePath := filepath.Join(cfg.Log.Path, file.Name())
+		if err := os.Remove(filePath); err != nil {
+		log.Error("删除旧日志文件失败: ", err, " 文件路径: ", filePath)
+		} else {
+		log.Infof("删除旧日志文件: %s", filePath)
+			}
+		}
 	}
-	// 获取群主信息
-	var owner User
-	db.Where("fuid = ?", group.OwnerFUID).Select("nickname").First(&owner)
-	// 构建资料卡数据
-	profile := map[string]interface{}{
-		"quid":          group.QUID,
-		"owner_fuid":    group.OwnerFUID,
-		"owner_nickname": owner.Nickname,
-		"group_name":    group.Name,
-		"vip_level":     group.VIPLevel,
-		"vip_exp":       group.VIPExp,
-		"desc":          group.Desc,
+}
+
+// Socket.IO连接会话
+type socketSession struct {
+	FUID        string
+	DeviceID    string
+	mu          sync.Mutex
+	expireTimer *time.Timer
+}
+
+// 令牌到期后断开连接（重复调用会重置到期时间）
+func (ss *socketSession) scheduleExpiry(conn liveConn, expiresAt time.Time) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.expireTimer != nil {
+		ss.expireTimer.Stop()
+	}
+	ss.expireTimer = time.AfterFunc(time.Until(expiresAt), func() {
+		conn.Emit("token_expired", map[string]interface{}{"device_id": ss.DeviceID})
+		conn.Close()
+		log.Infof("Socket.IO token expired: fuid=%s, device_id=%s, conn_id=%s", ss.FUID, ss.DeviceID, conn.ID())
+	})
+}
+
+// 停止到期计时
+func (ss *socketSession) stopExpiry() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.expireTimer != nil {
+		ss.expireTimer.Stop()
+	}
+}
+
+// 校验实时连接凭证：访问令牌（与authMiddleware相同）或一次性连接票据
+func authenticateSocket(token, ticket string) (*socketSession, time.Time, error) {
+	var fuid, deviceID string
+	var expiresAt time.Time
+	switch {
+	case ticket != "":
+		ctx := context.Background()
+		data, err := rdb.GetDel(ctx, "socket_ticket:"+ticket).Result()
+		if err != nil {
+			return nil, time.Time{}, errors.New("连接票据无效或已过期")
+		}
+		var payload struct {
+			FUID      string `json:"fuid"`
+			DeviceID  string `json:"device_id"`
+			ExpiresAt int64  `json:"expires_at"`
+		}
+		if err := json.Unmarshal([]byte(data), &payload); err != nil {
+			return nil, time.Time{}, errors.New("连接票据无效或已过期")
+		}
+		fuid, deviceID, expiresAt = payload.FUID, payload.DeviceID, time.Unix(payload.ExpiresAt, 0)
+	case token != "":
+		claims, err := parseAccessToken(token)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if !defaultAuthPolicy.allows(authIdentity{Scopes: claimScopes(claims)}) {
+			return nil, time.Time{}, errors.New("令牌无权建立连接")
+		}
+		fuid, deviceID, expiresAt = claims.FUID, claims.DeviceID, claims.ExpiresAt.Time
+	default:
+		return nil, time.Time{}, errors.New("未提供Token")
 	}
-	success(c, profile)
+	if !expiresAt.After(time.Now()) {
+		return nil, time.Time{}, errTokenExpired
+	}
+	// 检查用户及设备状态（与authMiddleware相同）
+	if _, err := loadIdentity(fuid, deviceID); err != nil {
+		return nil, time.Time{}, err
+	}
+	return &socketSession{FUID: fuid, DeviceID: deviceID}, expiresAt, nil
 }
 
-// 获取离线消息接口
-func getOfflineMessageHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
+// 获取Socket.IO连接票据接口（短期、一次性，用于无法在URL中携带JWT的客户端）
+func socketTicketHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
-	// 查询离线消息
-	var offlineMsgs []OfflineMessage
-	err := db.Where("user_fuid = ? AND status = 0", currentFUID).Find(&offlineMsgs).Error
+	ticket, err := generateUniqueID(48)
 	if err != nil {
-		fail(c, 500, "查询离线消息失败: "+err.Error())
+		fail(c, 500, "生成连接票据失败: "+err.Error())
 		return
 	}
-	// 获取消息详情
-	var msgIDs []string
-	for _, om := range offlineMsgs {
-		msgIDs = append(msgIDs, om.MsgID)
-	}
-	var messages []Message
-	if len(msgIDs) > 0 {
-		db.Where("msg_id IN ?", msgIDs).Find(&messages)
-	}
-	// 构建返回数据
-	var result []map[string]interface{}
-	for _, msg := range messages {
-		result = append(result, map[string]interface{}{
-			"msg_id":         msg.MsgID,
-			"sender_fuid":    msg.SenderFUID,
-			"receiver_type":  msg.ReceiverType,
-			"receiver_id":    msg.ReceiverID,
-			"content_type":   msg.ContentType,
-			"content":        msg.Content,
-			"font_style":     msg.FontStyle,
-			"font_size":      msg.FontSize,
-			"font_color":     msg.FontColor,
-			"is_recalled":    msg.IsRecalled,
-			"send_time":      msg.SendTime.Format("2006-01-02 15:04:05"),
-		})
+	payload, _ := json.Marshal(map[string]interface{}{
+		"fuid":       currentFUID,
+		"device_id":  currentIdentity(c).DeviceID,
+		"expires_at": currentIdentity(c).ExpiresAt.Unix(), // 连接有效期不超过访问令牌
+	})
+	expireSeconds := cfg.Crypto.JWT.SocketTicketExpire
+	if expireSeconds <= 0 {
+		expireSeconds = 30
 	}
-	// 更新离线消息状态为已推送
-	db.Model(&OfflineMessage{}).Where("user_fuid = ?", currentFUID).Update("status", 1)
-	// 清空离线消息数
 	ctx := context.Background()
-	rdb.Del(ctx, "offline_msg_count:"+currentFUID)
-	success(c, result, int64(len(result)))
-}
-
-// 获取未读消息数接口
-func getUnreadMessageCountHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
+	if err := rdb.Set(ctx, "socket_ticket:"+ticket, payload, time.Duration(expireSeconds)*time.Second).Err(); err != nil {
+		fail(c, 500, "保存连接票据失败: "+err.Error())
 		return
 	}
-	ctx := context.Background()
-	// 获取离线消息数（好友+群聊）
-	offlineCount, err := rdb.Get(ctx, "offline_msg_count:"+currentFUID).Int64()
-	if err != nil {
-		offlineCount = 0
-	}
-	// 区分好友和群聊消息数
-	// 1. 好友未读消息数
-	var friendUnread int64
-	db.Table("messages m").
-		Joins("LEFT JOIN friends f ON m.receiver_id = f.friend_fuid AND f.user_fuid = ?", currentFUID).
-		Where("m.receiver_type = 1 AND m.receiver_id = ? AND m.is_read = 0 AND m.is_recalled = 0", currentFUID).
-		Count(&friendUnread)
-	// 2. 群聊未读消息数
-	var groupUnread int64
-	db.Table("messages m").
-		Joins("LEFT JOIN group_members gm ON m.receiver_id = gm.group_quid AND gm.user_fuid = ?", currentFUID).
-		Where("m.receiver_type = 2 AND gm.status = 1 AND m.is_recalled = 0").
-		Count(&groupUnread)
-	// 构建返回数据
-	countData := map[string]interface{}{
-		"total":   offlineCount + friendUnread + groupUnread,
-		"friend":  friendUnread,
-		"group":   groupUnread,
-		"offline": offlineCount,
+	success(c, map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": expireSeconds,
+	})
+}
+
+// 实时连接上线：注册连接、记录在线状态、加入用户及群聊房间
+func registerLiveConn(conn liveConn, session *socketSession) {
+	localConns.add(session.FUID, conn)
+	markUserOnline(session.FUID, conn.ID())
+	// 加入用户房间及全体用户房间
+	conn.Join("user:" + session.FUID)
+	conn.Join(systemRoomAll)
+	// 加入所有群聊房间
+	var groupMembers []GroupMember
+	db.Where("user_fuid = ? AND status = 1", session.FUID).Find(&groupMembers)
+	for _, gm := range groupMembers {
+		conn.Join("group:" + gm.GroupQUID)
+	}
+	// 提醒设备拉取离线期间收到的发送者密钥
+	if pending := countPendingSenderKeys(session.FUID, session.DeviceID); pending > 0 {
+		conn.Emit("sender_key_pending", map[string]interface{}{"count": pending})
 	}
-	success(c, countData)
 }
 
-// ntfy消息推送
-func sendNtfyNotification(title, content, targetFUID string) {
-	// 获取目标用户信息
-	var user User
-	err := db.Where("fuid = ?", targetFUID).Select("nickname, email").First(&user).Error
-	if err != nil {
-		log.Error("获取推送用户信息失败: ", err)
-		return
+// 实时连接下线：停止到期计时、移除注册及在线状态
+func unregisterLiveConn(conn liveConn, session *socketSession) {
+	session.stopExpiry()
+	localConns.remove(session.FUID, conn.ID())
+	localRooms.leaveAll(conn)
+	markUserOffline(session.FUID, conn.ID())
+}
+
+// 校验WebSocket来源（浏览器须在CORS白名单内；机器人等非浏览器客户端不携带Origin头，直接放行）
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
 	}
-	// 构建推送数据
-	pushData := map[string]string{
-		"topic":   cfg.Business.Notify.Ntfy.Topic + "_" + targetFUID,
-		"title":   title,
-		"message": content,
-		"priority": "high",
-		"tags":    "chat_im",
+	for _, allowed := range cfg.App.CORS.AllowOrigins {
+		if origin == allowed || allowed == "*" {
+			return true
+		}
 	}
-	// 转换为JSON
-	jsonData, err := json.Marshal(pushData)
-	if err != nil {
-		log.Error("序列化推送数据失败: ", err)
-		return
+	return false
+}
+
+// 断开指定设备的所有实时连接（全部节点）
+func disconnectDeviceSockets(fuid, deviceID, reason string) {
+	msg := clusterMessage{Type: "device_disconnect", FUID: fuid, DeviceID: deviceID, Event: reason}
+	handleClusterMessage(msg)
+	publishClusterMessage(msg)
+}
+
+// 初始化Socket.IO服务
+func initSocketIO() (*socketio.Server, error) {
+	// 创建socket.io服务器
+	server := socketio.NewServer(&engineio.Options{
+		Transports: []transport.Transport{
+			&transportWs.Transport{
+				CheckOrigin: checkWebSocketOrigin,
+			},
+		},
+	})
+	// 连接事件
+	server.OnConnect("/", func(s socketio.Conn) error {
+		// 验证Token（访问令牌或一次性连接票据）
+		u := s.URL()
+		query := (&u).Query()
+		session, expiresAt, err := authenticateSocket(query.Get("token"), query.Get("ticket"))
+		if err != nil {
+			return err
+		}
+		s.SetContext(session)
+		// 令牌过期后自动断开
+		session.scheduleExpiry(s, expiresAt)
+		// 记录在线状态并加入用户/群聊房间
+		registerLiveConn(s, session)
+		log.Infof("Socket.IO connect: fuid=%s, device_id=%s, conn_id=%s", session.FUID, session.DeviceID, s.ID())
+		return nil
+	})
+	// 续期事件：客户端刷新访问令牌后提交新令牌，延长连接有效期
+	server.OnEvent("/", "reauth", func(s socketio.Conn, token string) map[string]interface{} {
+		session, ok := s.Context().(*socketSession)
+		if !ok {
+			return map[string]interface{}{"code": 401, "msg": "未认证的连接"}
+		}
+		claims, err := parseAccessToken(token)
+		if err != nil {
+			return map[string]interface{}{"code": 401, "msg": err.Error()}
+		}
+		if claims.FUID != session.FUID || claims.DeviceID != session.DeviceID {
+			return map[string]interface{}{"code": 403, "msg": "令牌与当前连接不匹配"}
+		}
+		session.scheduleExpiry(s, claims.ExpiresAt.Time)
+		return map[string]interface{}{"code": 200, "msg": "success", "expires_at": claims.ExpiresAt.Unix()}
+	})
+	// 正在输入事件
+	server.OnEvent("/", "typing", func(s socketio.Conn, req typingRequest) map[string]interface{} {
+		session, ok := s.Context().(*socketSession)
+		if !ok {
+			return map[string]interface{}{"code": 401, "msg": "未认证的连接"}
+		}
+		if apiErr := sendTyping(session.FUID, req.ReceiverType, req.ReceiverID); apiErr != nil {
+			return map[string]interface{}{"code": apiErr.Code, "msg": apiErr.Msg}
+		}
+		return map[string]interface{}{"code": 200, "msg": "success"}
+	})
+	// 断开连接事件
+	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
+		// 获取连接会话（连接时写入上下文）
+		session, ok := s.Context().(*socketSession)
+		if ok {
+			// 删除在线状态
+			unregisterLiveConn(s, session)
+			log.Infof("Socket.IO disconnect: fuid=%s, device_id=%s, conn_id=%s, reason=%s", session.FUID, session.DeviceID, s.ID(), reason)
+		}
+	})
+	// 错误事件
+	server.OnError("/", func(s socketio.Conn, err error) {
+		log.Errorf("Socket.IO error: conn_id=%s, err=%v", s.ID(), err)
+	})
+	return server, nil
+}
+
+// 原生WebSocket协议（/ws）
+//
+// 所有帧均为JSON文本帧：{"type": "...", "id": "...", "event": "...", "data": {...}}
+//
+//	type  帧类型；id 客户端请求ID（可选，服务端在ack/error中原样返回）；event 仅push帧使用
+//
+// 客户端 -> 服务端：
+//
+//	auth    {"token": "<访问令牌>"} 或 {"ticket": "<连接票据>"}，连接后10秒内必须完成（也可通过 /ws?token= 或 ?ticket= 直接认证）；
+//	        已认证后再次发送auth可续期（须为同一用户同一设备）
+//	send    与 POST /api/v1/private/message/send 请求体相同，成功返回ack {msg_id, conv_id, seq, send_time}
+//	recall  {"msg_id": "..."}，成功返回ack {msg_id}
+//	typing  {"receiver_type": 1|2, "receiver_id": "..."}，成功返回ack
+//	ping    {}，返回pong
+//
+// 服务端 -> 客户端：
+//
+//	ack     请求成功，data为结果
+//	error   请求失败，data为 {code, msg}
+//	push    服务端推送，event与Socket.IO事件同名（new_message、recall_message、typing、group_notice、
+//	        group_dissolved、group_kicked、call_notification、token_expired、device_kicked），data与Socket.IO相同
+//	pong    ping的响应
+//
+// 服务端每54秒发送WebSocket ping控制帧，客户端60秒内无任何数据（含pong控制帧）将被断开。
+type wsFrame struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id,omitempty"`
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// 正在输入请求（WebSocket/Socket.IO共用）
+type typingRequest struct {
+	ReceiverType uint8  `json:"receiver_type"` // 1:单聊 2:群聊
+	ReceiverID   string `json:"receiver_id"`
+}
+
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingPeriod   = wsPongWait * 9 / 10
+	wsAuthWait     = 10 * time.Second
+	wsMaxFrameSize = 64 * 1024
+	wsSendBuffer   = 256
+)
+
+// 原生WebSocket连接（实现liveConn）
+type wsClient struct {
+	id        string
+	ip        string
+	conn      *gorillaWs.Conn
+	session   *socketSession
+	sendChan  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (w *wsClient) ID() string {
+	return w.id
+}
+
+func (w *wsClient) Join(room string) {
+	localRooms.join(room, w)
+}
+
+func (w *wsClient) Leave(room string) {
+	localRooms.leave(room, w)
+}
+
+func (w *wsClient) Context() interface{} {
+	return w.session
+}
+
+// 推送事件（与Socket.IO的Emit语义一致）
+func (w *wsClient) Emit(event string, v ...interface{}) {
+	var data interface{}
+	if len(v) > 0 {
+		data = v[0]
 	}
-	// 发送POST请求
-	req, err := http.NewRequest("POST", cfg.Business.Notify.Ntfy.URL, bytes.NewBuffer(jsonData))
+	payload, err := json.Marshal(data)
 	if err != nil {
-		log.Error("创建推送请求失败: ", err)
+		log.Error("序列化WebSocket推送数据失败: ", err)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	w.writeFrame(wsFrame{Type: "push", Event: event, Data: payload})
+}
+
+func (w *wsClient) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	return nil
+}
+
+// 写入发送队列（队列满说明客户端消费过慢，直接断开）
+func (w *wsClient) writeFrame(frame wsFrame) {
+	payload, err := json.Marshal(frame)
 	if err != nil {
-		log.Error("发送推送请求失败: ", err)
+		log.Error("序列化WebSocket帧失败: ", err)
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Error("推送请求返回错误: ", string(body))
+	select {
+	case <-w.done:
+	case w.sendChan <- payload:
+	default:
+		log.Warnf("WebSocket发送队列已满，断开连接: conn_id=%s", w.id)
+		w.Close()
 	}
 }
 
-// VIP等级更新定时任务
-func vipLevelUpdateTask() {
-	ticker := time.NewTicker(time.Duration(cfg.Business.VIP.UpdateInterval) * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		log.Info("开始更新用户VIP等级")
-		// 1. 更新用户VIP经验
-		var users []User
-		db.Where("vip_start_time IS NOT NULL AND status = 1").Find(&users)
-		for _, user := range users {
-			// 计算在线时长（简化：此处假设用户在线状态通过Redis记录）
-			ctx := context.Background()
-			online, err := rdb.Exists(ctx, "online_user:"+user.FUID).Result()
-			if err != nil || online == 0 {
-				continue
+// 返回成功响应
+func (w *wsClient) ack(id string, data interface{}) {
+	payload, _ := json.Marshal(data)
+	w.writeFrame(wsFrame{Type: "ack", ID: id, Data: payload})
+}
+
+// 返回错误响应
+func (w *wsClient) replyError(id string, code int, msg string) {
+	payload, _ := json.Marshal(map[string]interface{}{"code": code, "msg": msg})
+	w.writeFrame(wsFrame{Type: "error", ID: id, Data: payload})
+}
+
+// 写协程：发送队列中的帧及心跳ping
+func (w *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		w.conn.Close()
+	}()
+	for {
+		select {
+		case <-w.done:
+			// 关闭前尽量发出队列中剩余的帧（如token_expired、device_kicked）
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			for len(w.sendChan) > 0 {
+				if err := w.conn.WriteMessage(gorillaWs.TextMessage, <-w.sendChan); err != nil {
+					return
+				}
 			}
-			// 添加经验
-			newExp := user.VIPExp + uint64(cfg.Business.VIP.ExpPerHour)
-			newLevel := uint8(newExp / 100) // 每100经验升1级，可配置
-			if newLevel > uint8(cfg.Business.VIP.LevelMax) {
-				newLevel = uint8(cfg.Business.VIP.LevelMax)
-				newExp = uint64(cfg.Business.VIP.LevelMax) * 100
+			w.conn.WriteMessage(gorillaWs.CloseMessage, gorillaWs.FormatCloseMessage(gorillaWs.CloseNormalClosure, ""))
+			return
+		case payload := <-w.sendChan:
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := w.conn.WriteMessage(gorillaWs.TextMessage, payload); err != nil {
+				w.Close()
+				return
 			}
-			// 更新
-			db.Model(&user).Updates(map[string]interface{}{
-				"vip_exp":   newExp,
-				"vip_level": newLevel,
-			})
-		}
-		// 2. 更新群聊VIP经验
-		var groups []Group
-		db.Where("vip_start_time IS NOT NULL AND status = 1").Find(&groups)
-		for _, group := range groups {
-			// 添加经验
-			newExp := group.VIPExp + uint64(cfg.Business.GroupVIP.ExpPerHour)
-			newLevel := uint8(newExp / 100)
-			if newLevel > uint8(cfg.Business.GroupVIP.LevelMax) {
-				newLevel = uint8(cfg.Business.GroupVIP.LevelMax)
-				newExp = uint64(cfg.Business.GroupVIP.LevelMax) * 100
+		case <-ticker.C:
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := w.conn.WriteMessage(gorillaWs.PingMessage, nil); err != nil {
+				w.Close()
+				return
 			}
-			// 更新
-			db.Model(&group).Updates(map[string]interface{}{
-				"vip_exp":   newExp,
-				"vip_level": newLevel,
-			})
 		}
-		log.Info("完成VIP等级更新")
 	}
 }
 
-// 消息自动清理定时任务
-func messageAutoCleanTask() {
-	if !cfg.Business.Message.AutoClean.Enable {
-		return
+// 认证（首次认证注册连接，已认证时续期）
+func (w *wsClient) authenticate(token, ticket string) (time.Time, *apiError) {
+	session, expiresAt, err := authenticateSocket(token, ticket)
+	if err != nil {
+		return time.Time{}, &apiError{401, err.Error()}
 	}
-	// 每天凌晨执行
-	ticker := time.NewTicker(24 * time.Hour)
-	defer ticker.Stop()
-	for range ticker.C {
-		log.Info("开始自动清理过期消息")
-		// 计算清理时间点
-		cleanTime := time.Now().AddDate(0, 0, -cfg.Business.Message.AutoClean.Days)
-		// 删除过期消息
-		result := db.Where("send_time < ?", cleanTime).Delete(&Message{})
-		if result.Error != nil {
-			log.Error("清理过期消息失败: ", result.Error)
-		} else {
-			log.Infof("清理过期消息成功，共删除%d条", result.RowsAffected)
+	if w.session != nil {
+		if session.FUID != w.session.FUID || session.DeviceID != w.session.DeviceID {
+			return time.Time{}, &apiError{403, "令牌与当前连接不匹配"}
 		}
-		// 删除关联的离线消息
-		db.Where("created_at < ?", cleanTime).Delete(&OfflineMessage{})
-	}
+		w.session.scheduleExpiry(w, expiresAt)
+		return expiresAt, nil
+	}
+	w.session = session
+	session.scheduleExpiry(w, expiresAt)
+	registerLiveConn(w, session)
+	w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	log.Infof("WebSocket connect: fuid=%s, device_id=%s, conn_id=%s", session.FUID, session.DeviceID, w.id)
+	return expiresAt, nil
 }
 
-// 发送语音消息接口（扩展现有消息类型）
-func sendVoiceMessageHandler(c *gin.Context) {
-	// 获取当前用户FUID
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
+// 处理客户端帧
+func (w *wsClient) handleFrame(frame wsFrame) {
+	if frame.Type == "ping" {
+		w.writeFrame(wsFrame{Type: "pong", ID: frame.ID})
 		return
 	}
-
-	// 参数绑定
-	var req struct {
-		ReceiverType uint8  `json:"receiver_type" binding:"required,oneof=1 2"` // 1:单聊 2:群聊
-		ReceiverID   string `json:"receiver_id" binding:"required"`             // 接收方ID
-		Duration     int    `json:"duration" binding:"required,min=1"`          // 语音时长(秒)
-		VoiceURL     string `json:"voice_url" binding:"required"`               // 加密后的语音文件URL
-		FontStyle    string `json:"font_style"`                                 // 可选文字样式
-		FontSize     int    `json:"font_size"`                                  // 可选文字大小
-		FontColor    string `json:"font_color"`                                 // 可选文字颜色
+	if frame.Type == "auth" {
+		var req struct {
+			Token  string `json:"token"`
+			Ticket string `json:"ticket"`
+		}
+		json.Unmarshal(frame.Data, &req)
+		expiresAt, apiErr := w.authenticate(req.Token, req.Ticket)
+		if apiErr != nil {
+			w.replyError(frame.ID, apiErr.Code, apiErr.Msg)
+			return
+		}
+		w.ack(frame.ID, map[string]interface{}{
+			"fuid":       w.session.FUID,
+			"device_id":  w.session.DeviceID,
+			"expires_at": expiresAt.Unix(),
+		})
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
+	if w.session == nil {
+		w.replyError(frame.ID, 401, "未认证，请先发送auth帧")
 		return
 	}
-
-	// 验证接收方合法性（复用单聊/群聊验证逻辑）
-	if req.ReceiverType == 1 {
-		// 单聊：检查好友关系
-		var friend Friend
-		if err := db.Where("user_fuid = ? AND friend_fuid = ? AND status = 1", currentFUID, req.ReceiverID).First(&friend).Error; err != nil {
-			fail(c, 400, "该用户不是你的好友，无法发送语音消息")
+	switch frame.Type {
+	case "send":
+		// 与HTTP发送接口共用连接维度限流
+		if !getMessageConnLimiter(w.ip).Allow() {
+			w.replyError(frame.ID, 429, "消息发送过于频繁，请稍后再试")
 			return
 		}
-		// 检查是否被对方拉黑
-		var reverseFriend Friend
-		if err := db.Where("user_fuid = ? AND friend_fuid = ? AND status = 2", req.ReceiverID, currentFUID).First(&reverseFriend).Error; err == nil {
-			fail(c, 403, "对方已将你加入黑名单，无法发送消息")
+		var req sendMessageRequest
+		if err := json.Unmarshal(frame.Data, &req); err != nil {
+			w.replyError(frame.ID, 400, "参数错误: "+err.Error())
 			return
 		}
-	} else if req.ReceiverType == 2 {
-		// 群聊：检查群成员身份及禁言状态
-		var member GroupMember
-		if err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.ReceiverID, currentFUID).First(&member).Error; err != nil {
-			fail(c, 403, "你不是该群成员，无法发送语音消息")
+		if err := binding.Validator.ValidateStruct(&req); err != nil {
+			w.replyError(frame.ID, 400, "参数错误: "+err.Error())
 			return
 		}
-		if member.MuteEndTime.After(time.Now()) {
-			fail(c, 403, fmt.Sprintf("你已被禁言，禁言结束时间：%s", member.MuteEndTime.Format("2006-01-02 15:04:05")))
+		message, apiErr := sendMessage(w.session.FUID, req)
+		if apiErr != nil {
+			w.replyError(frame.ID, apiErr.Code, apiErr.Msg)
+			return
+		}
+		w.ack(frame.ID, map[string]interface{}{
+			"msg_id":    message.MsgID,
+			"conv_id":   message.ConvID,
+			"seq":       message.Seq,
+			"send_time": message.SendTime.Format("2006-01-02 15:04:05"),
+		})
+	case "recall":
+		var req struct {
+			MsgID string `json:"msg_id"`
+		}
+		if err := json.Unmarshal(frame.Data, &req); err != nil || req.MsgID == "" {
+			w.replyError(frame.ID, 400, "消息ID不能为空")
+			return
+		}
+		if apiErr := recallMessage(w.session.FUID, req.MsgID); apiErr != nil {
+			w.replyError(frame.ID, apiErr.Code, apiErr.Msg)
+			return
+		}
+		w.ack(frame.ID, map[string]interface{}{"msg_id": req.MsgID})
+	case "typing":
+		var req typingRequest
+		if err := json.Unmarshal(frame.Data, &req); err != nil {
+			w.replyError(frame.ID, 400, "参数错误: "+err.Error())
+			return
+		}
+		if apiErr := sendTyping(w.session.FUID, req.ReceiverType, req.ReceiverID); apiErr != nil {
+			w.replyError(frame.ID, apiErr.Code, apiErr.Msg)
 			return
 		}
+		w.ack(frame.ID, nil)
+	default:
+		w.replyError(frame.ID, 400, "不支持的帧类型: "+frame.Type)
 	}
+}
 
-	// 生成消息ID
-	msgID, err := generateUniqueID(32)
+// 原生WebSocket接入接口
+func wsHandler(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		fail(c, 500, "生成消息ID失败: "+err.Error())
+		log.Error("WebSocket升级失败: ", err)
 		return
 	}
-
-	// 处理字体参数默认值
-	fontStyle := req.FontStyle
-	if fontStyle == "" {
-		fontStyle = "思源黑体"
-	}
-	fontSize := req.FontSize
-	if fontSize <= 0 {
-		fontSize = 14
-	}
-	fontColor := req.FontColor
-	if fontColor == "" {
-		fontColor = "#000000"
+	client := &wsClient{
+		id:       "ws-" + generateDeviceID(),
+		ip:       getRealIP(c),
+		conn:     conn,
+		sendChan: make(chan []byte, wsSendBuffer),
+		done:     make(chan struct{}),
 	}
+	go client.writePump()
+	defer func() {
+		if client.session != nil {
+			unregisterLiveConn(client, client.session)
+			log.Infof("WebSocket disconnect: fuid=%s, device_id=%s, conn_id=%s", client.session.FUID, client.session.DeviceID, client.id)
+		}
+		client.Close()
+	}()
 
-	// 保存语音消息（content_type=6表示语音消息）
-	message := Message{
-		MsgID:        msgID,
-		SenderFUID:   currentFUID,
-		ReceiverType: req.ReceiverType,
-		ReceiverID:   req.ReceiverID,
-		ContentType:  6, // 新增：6=语音消息
-		Content:      fmt.Sprintf(`{"url":"%s","duration":%d}`, req.VoiceURL, req.Duration), // 加密的JSON内容
-		FontStyle:    fontStyle,
-		FontSize:     fontSize,
-		FontColor:    fontColor,
-		IsRecalled:   false,
-		IsRead:       false,
-		SendTime:     time.Now(),
+	conn.SetReadLimit(wsMaxFrameSize)
+	// 未认证连接须在限定时间内完成认证
+	conn.SetReadDeadline(time.Now().Add(wsAuthWait))
+	conn.SetPongHandler(func(string) error {
+		if client.session != nil {
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		}
+		return nil
+	})
+	// 支持通过URL参数直接认证
+	if token, ticket := c.Query("token"), c.Query("ticket"); token != "" || ticket != "" {
+		if _, apiErr := client.authenticate(token, ticket); apiErr != nil {
+			client.replyError("", apiErr.Code, apiErr.Msg)
+			return
+		}
 	}
-	if err := db.Create(&message).Error; err != nil {
-		fail(c, 500, "保存语音消息失败: "+err.Error())
-		return
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if client.session != nil {
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		}
+		var frame wsFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			client.replyError("", 400, "帧格式错误: "+err.Error())
+			continue
+		}
+		client.handleFrame(frame)
 	}
+}
 
-	// 处理离线消息
-	go saveOfflineMessage(req.ReceiverType, req.ReceiverID, msgID)
-	// 推送消息给接收方
-	go pushMessageToClient(message)
+// SSE推送流（WebSocket被拦截时的降级方案）
+//
+// 事件名与Socket.IO相同，data为JSON；每个事件的id为续传游标，断线重连时通过 Last-Event-ID 请求头
+// （或 ?last_event_id= 参数）带回，服务端按会话序号补发期间遗漏的new_message。
+// 遗漏消息过多时推送resync事件，客户端应改用 /message/range 按会话拉取。
+const (
+	sseHeartbeat      = 25 * time.Second
+	sseEventBuffer    = 256
+	sseResumeLimit    = 500
+	sseCursorMaxConvs = 64
+	sseRetryMillis    = 3000
+)
 
-	success(c, map[string]interface{}{
-		"msg_id":    message.MsgID,
-		"send_time": message.SendTime.Format("2006-01-02 15:04:05"),
-		"duration":  req.Duration,
-	})
-	log.Infof("Send voice message: msg_id=%s, sender=%s, receiver_type=%d, receiver_id=%s, duration=%ds",
-		msgID, currentFUID, req.ReceiverType, req.ReceiverID, req.Duration)
+// SSE续传游标（t:游标生成时间 s:会话ID -> 已送达的最大序号）
+type sseCursor struct {
+	T int64             `json:"t"`
+	S map[string]uint64 `json:"s"`
 }
 
-// 发起语音/视频通话接口
-func initCallHandler(c *gin.Context) {
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
-	}
-
-	// 参数绑定
-	var req struct {
-		ReceiverType uint8  `json:"receiver_type" binding:"required,oneof=1 2"` // 1:单聊 2:群聊
-		ReceiverID   string `json:"receiver_id" binding:"required"`             // 接收方ID
-		CallType     uint8  `json:"call_type" binding:"required,oneof=1 2"`     // 1:语音 2:视频
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
-	}
+// 编码游标（作为事件id）
+func (cur *sseCursor) encode() string {
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
 
-	// 验证接收方合法性
-	if req.ReceiverType == 1 {
-		// 单聊：检查好友关系
-		var friend Friend
-		if err := db.Where("user_fuid = ? AND friend_fuid = ? AND status = 1", currentFUID, req.ReceiverID).First(&friend).Error; err != nil {
-			fail(c, 400, "该用户不是你的好友，无法发起通话")
-			return
-		}
-	} else if req.ReceiverType == 2 {
-		// 群聊：检查群成员身份
-		var member GroupMember
-		if err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", req.ReceiverID, currentFUID).First(&member).Error; err != nil {
-			fail(c, 403, "你不是该群成员，无法发起群通话")
-			return
-		}
+// 解析游标（格式错误时返回nil，不续传）
+func parseSSECursor(eventID string) *sseCursor {
+	if eventID == "" {
+		return nil
 	}
-
-	// 生成通话ID
-	callID, err := generateUniqueID(32)
+	raw, err := base64.RawURLEncoding.DecodeString(eventID)
 	if err != nil {
-		fail(c, 500, "生成通话ID失败: "+err.Error())
-		return
+		return nil
 	}
-
-	// 创建通话记录（初始状态：等待接听）
-	call := Call{
-		CallID:       callID,
-		SenderFUID:   currentFUID,
-		ReceiverType: req.ReceiverType,
-		ReceiverID:   req.ReceiverID,
-		CallType:     req.CallType,
-		Status:       0, // 0:等待接听
-		CreateTime:   time.Now(),
+	var cur sseCursor
+	if err := json.Unmarshal(raw, &cur); err != nil || cur.T <= 0 {
+		return nil
 	}
-	if err := db.Create(&call).Error; err != nil {
-		fail(c, 500, "创建通话记录失败: "+err.Error())
-		return
+	if cur.S == nil {
+		cur.S = make(map[string]uint64)
 	}
+	return &cur
+}
 
-	// 推送通话请求给接收方
-	go pushCallNotification(call, "incoming")
+// SSE事件
+type sseEvent struct {
+	Event string
+	Data  []byte
+}
 
-	success(c, map[string]interface{}{
-		"call_id":     call.CallID,
-		"create_time": call.CreateTime.Format("2006-01-02 15:04:05"),
-		"status":      "等待对方接听",
-	})
-	log.Infof("Init call: call_id=%s, sender=%s, type=%d, receiver_type=%d, receiver_id=%s",
-		callID, currentFUID, req.CallType, req.ReceiverType, req.ReceiverID)
+// SSE连接（实现liveConn）
+type sseClient struct {
+	id        string
+	session   *socketSession
+	events    chan sseEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	cursor    *sseCursor
+	convOrder []string // 游标中会话的更新顺序，超出上限时淘汰最早的
 }
 
-// 接听通话接口
-func acceptCallHandler(c *gin.Context) {
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
-	}
+func (sc *sseClient) ID() string {
+	return sc.id
+}
 
-	// 参数绑定
-	var req struct {
-		CallID string `json:"call_id" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
-	}
+func (sc *sseClient) Join(room string) {
+	localRooms.join(room, sc)
+}
 
-	// 查询通话记录并验证权限
-	var call Call
-	if err := db.Where("call_id = ?", req.CallID).First(&call).Error; err != nil {
-		fail(c, 400, "通话记录不存在")
-		return
-	}
+func (sc *sseClient) Leave(room string) {
+	localRooms.leave(room, sc)
+}
 
-	// 验证是否为通话接收方
-	if call.ReceiverType == 1 && call.ReceiverID != currentFUID {
-		fail(c, 403, "无权操作此通话")
-		return
-	}
-	if call.ReceiverType == 2 {
-		// 群聊需验证是否为群成员
-		var member GroupMember
-		if err := db.Where("group_quid = ? AND user_fuid = ? AND status = 1", call.ReceiverID, currentFUID).First(&member).Error; err != nil {
-			fail(c, 403, "你不是该群成员，无权接听")
-			return
-		}
-	}
+func (sc *sseClient) Context() interface{} {
+	return sc.session
+}
 
-	// 验证通话状态（必须为等待接听状态）
-	if call.Status != 0 {
-		fail(c, 400, "该通话状态不允许接听")
-		return
+func (sc *sseClient) Emit(event string, v ...interface{}) {
+	var data interface{}
+	if len(v) > 0 {
+		data = v[0]
 	}
-
-	// 更新通话状态为通话中
-	startTime := time.Now()
-	if err := db.Model(&call).Updates(map[string]interface{}{
-		"status":     1, // 1:通话中
-		"start_time": startTime,
-	}).Error; err != nil {
-		fail(c, 500, "更新通话状态失败: "+err.Error())
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Error("序列化SSE推送数据失败: ", err)
 		return
 	}
+	select {
+	case <-sc.done:
+	case sc.events <- sseEvent{Event: event, Data: payload}:
+	default:
+		log.Warnf("SSE发送队列已满，断开连接: conn_id=%s", sc.id)
+		sc.Close()
+	}
+}
 
-	// 推送接听通知给发起方
-	go pushCallNotification(call, "accepted")
-
-	success(c, map[string]interface{}{
-		"call_id":    call.CallID,
-		"start_time": startTime.Format("2006-01-02 15:04:05"),
-		"status":     "通话中",
+func (sc *sseClient) Close() error {
+	sc.closeOnce.Do(func() {
+		close(sc.done)
 	})
-	log.Infof("Accept call: call_id=%s, receiver=%s", req.CallID, currentFUID)
+	return nil
 }
 
-// 拒绝通话接口
-func rejectCallHandler(c *gin.Context) {
-	currentFUID := c.GetString("fuid")
-	if currentFUID == "" {
-		fail(c, 401, "未登录")
-		return
+// 记录已送达的会话序号，返回false表示该消息已送达过（续传与实时推送重叠）
+func (sc *sseClient) advance(convID string, seq uint64) bool {
+	if convID == "" || seq == 0 {
+		return true
 	}
-
-	// 参数绑定
-	var req struct {
-		CallID  string `json:"call_id" binding:"required"`
-		Reason  string `json:"reason" binding:"max=100"` // 拒绝原因（可选）
+	if last, ok := sc.cursor.S[convID]; ok {
+		if seq <= last {
+			return false
+		}
+		for i, id := range sc.convOrder {
+			if id == convID {
+				sc.convOrder = append(sc.convOrder[:i], sc.convOrder[i+1:]...)
+				break
+			}
+		}
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
+	sc.cursor.S[convID] = seq
+	sc.convOrder = append(sc.convOrder, convID)
+	if len(sc.convOrder) > sseCursorMaxConvs {
+		delete(sc.cursor.S, sc.convOrder[0])
+		sc.convOrder = sc.convOrder[1:]
 	}
+	return true
+}
 
-	// 查询通话记录并验证权限
-	var call Call
-	if err := db.Where("call_id = ?", req.CallID).First(&call).Error; err != nil {
-		fail(c, 400, "通话记录不存在")
-		return
+// 写出事件（new_message按会话序号去重并推进游标）
+func (sc *sseClient) render(c *gin.Context, ev sseEvent) {
+	if ev.Event == "new_message" {
+		var ref struct {
+			ConvID string `json:"conv_id"`
+			Seq    uint64 `json:"seq"`
+		}
+		json.Unmarshal(ev.Data, &ref)
+		if !sc.advance(ref.ConvID, ref.Seq) {
+			return
+		}
 	}
+	sc.cursor.T = time.Now().Unix()
+	c.Render(-1, sse.Event{Id: sc.cursor.encode(), Event: ev.Event, Data: ev.Data})
+	c.Writer.Flush()
+}
 
-	// 验证是否为通话接收方
-	if call.ReceiverType == 1 && call.ReceiverID != currentFUID {
-		fail(c, 403, "无权操作此通话")
-		return
+// 查询断线期间遗漏的消息（按发送时间粗筛，再按会话序号去重）
+func (sc *sseClient) missedMessages(since *sseCursor) ([]Message, bool) {
+	var groupQUIDs []string
+	db.Model(&GroupMember{}).Where("user_fuid = ? AND status = 1", sc.session.FUID).Pluck("group_quid", &groupQUIDs)
+	query := db.Where("send_time >= ? AND (shadow = 0 OR sender_fuid = ?)", time.Unix(since.T-1, 0), sc.session.FUID)
+	if len(groupQUIDs) > 0 {
+		query = query.Where("(receiver_type = 1 AND (receiver_id = ? OR sender_fuid = ?)) OR (receiver_type = 2 AND receiver_id IN ?)",
+			sc.session.FUID, sc.session.FUID, groupQUIDs)
+	} else {
+		query = query.Where("receiver_type = 1 AND (receiver_id = ? OR sender_fuid = ?)", sc.session.FUID, sc.session.FUID)
 	}
-
-	// 验证通话状态
-	if call.Status != 0 {
-		fail(c, 400, "该通话状态不允许拒绝")
-		return
+	var messages []Message
+	if err := query.Order("send_time ASC, id ASC").Limit(sseResumeLimit + 1).Find(&messages).Error; err != nil {
+		log.Error("查询SSE续传消息失败: ", err)
+		return nil, true
 	}
-
-	// 更新通话状态为已拒绝
-	if err := db.Model(&call).Updates(map[string]interface{}{
-		"status":    2, // 2:已拒绝
-		"end_time":  time.Now(),
-	}).Error; err != nil {
-		fail(c, 500, "更新通话状态失败: "+err.Error())
-		return
+	missed := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		if last, ok := since.S[msg.ConvID]; ok && msg.Seq <= last {
+			continue
+		}
+		missed = append(missed, msg)
+	}
+	if len(messages) > sseResumeLimit {
+		return missed[:0], true
 	}
-
-	// 推送拒绝通知给发起方
-	go pushCallNotification(call, "rejected", req.Reason)
-
-	success(c, map[string]string{
-		"msg": "已拒绝通话",
-	})
-	log.Infof("Reject call: call_id=%s, receiver=%s, reason=%s", req.CallID, currentFUID, req.Reason)
+	return missed, false
 }
 
-// 结束通话接口
-func endCallHandler(c *gin.Context) {
-	currentFUID := c.GetString("fuid")
+// SSE推送流接口
+func sseStreamHandler(c *gin.Context) {
+	currentFUID := currentIdentity(c).FUID
 	if currentFUID == "" {
 		fail(c, 401, "未登录")
 		return
 	}
+	session := &socketSession{FUID: currentFUID, DeviceID: currentIdentity(c).DeviceID}
+	client := &sseClient{
+		id:      "sse-" + generateDeviceID(),
+		session: session,
+		events:  make(chan sseEvent, sseEventBuffer),
+		done:    make(chan struct{}),
+		cursor:  &sseCursor{T: time.Now().Unix(), S: make(map[string]uint64)},
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	since := parseSSECursor(lastEventID)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	// 先注册再补发，补发期间到达的实时消息在队列中等待，按序号去重
+	session.scheduleExpiry(client, currentIdentity(c).ExpiresAt)
+	registerLiveConn(client, session)
+	log.Infof("SSE connect: fuid=%s, device_id=%s, conn_id=%s", session.FUID, session.DeviceID, client.id)
+	defer func() {
+		unregisterLiveConn(client, session)
+		client.Close()
+		log.Infof("SSE disconnect: fuid=%s, device_id=%s, conn_id=%s", session.FUID, session.DeviceID, client.id)
+	}()
 
-	// 参数绑定
-	var req struct {
-		CallID string `json:"call_id" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fail(c, 400, "参数错误: "+err.Error())
-		return
+	c.Render(-1, sse.Event{Id: client.cursor.encode(), Event: "connected", Retry: sseRetryMillis, Data: map[string]interface{}{
+		"conn_id": client.id,
+		"resumed": since != nil,
+	}})
+	c.Writer.Flush()
+	if since != nil {
+		for conv, seq := range since.S {
+			client.advance(conv, seq)
+		}
+		missed, truncated := client.missedMessages(since)
+		for _, msg := range missed {
+			payload, _ := json.Marshal(buildMessageData(msg))
+			client.render(c, sseEvent{Event: "new_message", Data: payload})
+		}
+		if truncated {
+			payload, _ := json.Marshal(map[string]interface{}{"reason": "too_many_missed_messages"})
+			client.render(c, sseEvent{Event: "resync", Data: payload})
+		}
 	}
 
-	// 查询通话记录并验证权限（发起者或接收者均可结束）
-	var call Call
-	if err := db.Where("call_id = ?", req.CallID).First(&call).Error; err != nil {
-		fail(c, 400, "通话记录不存在")
-		return
-	}
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev := <-client.events:
+			client.render(c, ev)
+			return true
+		case <-heartbeat.C:
+			io.WriteString(w, ": ping\n\n")
+			return true
+		case <-client.done:
+			// 关闭前发出队列中剩余的事件（如token_expired、device_kicked）
+			for len(client.events) > 0 {
+				client.render(c, <-client.events)
+			}
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
 
-	// 验证操作权限
-	isSender := call.SenderFUID == currentFUID
-	isReceiver := (call.ReceiverType == 1 && call.ReceiverID == currentFUID) || 
-	              (call.ReceiverType == 2 && isGroupMember(call.ReceiverID, currentFUID))
-	if !isSender && !isReceiver {
-		fail(c, 403, "无权结束此通话")
-		return
-	}
+// 集群消息（通过Redis发布订阅在节点间转发）
+type clusterMessage struct {
+	Type     string          `json:"type"` // broadcast:房间广播 room_join/room_leave:用户加入/离开房间 room_clear:清空房间 device_disconnect:断开设备连接
+	Node     string          `json:"node"` // 发送节点ID
+	FUID     string          `json:"fuid,omitempty"`
+	DeviceID string          `json:"device_id,omitempty"`
+	Room     string          `json:"room,omitempty"`
+	Event    string          `json:"event,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
 
-	// 验证通话状态（必须为通话中）
-	if call.Status != 1 {
-		fail(c, 400, "该通话状态不允许结束")
-		return
+// 实时连接（Socket.IO连接与原生WebSocket连接共用，socketio.Conn天然满足）
+type liveConn interface {
+	ID() string
+	Join(room string)
+	Leave(room string)
+	Emit(event string, v ...interface{})
+	Context() interface{}
+	Close() error
+}
+
+// 本节点连接注册表（fuid -> 连接ID -> 连接）
+type connRegistry struct {
+	mu    sync.RWMutex
+	conns map[string]map[string]liveConn
+}
+
+var localConns = &connRegistry{conns: make(map[string]map[string]liveConn)}
+
+// 注册连接
+func (r *connRegistry) add(fuid string, conn liveConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns[fuid] == nil {
+		r.conns[fuid] = make(map[string]liveConn)
 	}
+	r.conns[fuid][conn.ID()] = conn
+}
 
-	// 计算通话时长
-	endTime := time.Now()
-	duration := int(endTime.Sub(call.StartTime).Seconds())
+// 移除连接
+func (r *connRegistry) remove(fuid, connID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns[fuid], connID)
+	if len(r.conns[fuid]) == 0 {
+		delete(r.conns, fuid)
+	}
+}
 
-	// 更新通话状态为已结束
-	if err := db.Model(&call).Updates(map[string]interface{}{
-		"status":   3,        // 3:已结束
-		"end_time": endTime,
-		"duration": duration,
-	}).Error; err != nil {
-		fail(c, 500, "更新通话状态失败: "+err.Error())
-		return
+// 用户在本节点的所有连接
+func (r *connRegistry) userConns(fuid string) []liveConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	conns := make([]liveConn, 0, len(r.conns[fuid]))
+	for _, conn := range r.conns[fuid] {
+		conns = append(conns, conn)
 	}
+	return conns
+}
 
-	// 推送结束通知给相关方
-	go pushCallNotification(call, "ended", fmt.Sprintf("通话时长: %d秒", duration))
+// 本节点所有在线用户（连接ID列表）
+func (r *connRegistry) snapshot() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make(map[string][]string, len(r.conns))
+	for fuid, conns := range r.conns {
+		for connID := range conns {
+			result[fuid] = append(result[fuid], connID)
+		}
+	}
+	return result
+}
 
-	success(c, map[string]interface{}{
-		"msg":      "通话已结束",
-		"duration": duration,
-		"end_time": endTime.Format("2006-01-02 15:04:05"),
-	})
-	log.Infof("End call: call_id=%s, operator=%s, duration=%ds", req.CallID, currentFUID, duration)
+// 本节点房间表（原生WebSocket等非Socket.IO连接；Socket.IO连接的房间由go-socket.io维护）
+type roomHub struct {
+	mu    sync.RWMutex
+	rooms map[string]map[string]liveConn
 }
 
-// 推送通话通知（内部使用）
-func pushCallNotification(call Call, action string, extra ...string) {
-	// 构建通知内容
-	notification := map[string]interface{}{
-		"call_id":      call.CallID,
-		"sender_fuid":  call.SenderFUID,
-		"receiver_type": call.ReceiverType,
-		"receiver_id":  call.ReceiverID,
-		"call_type":    call.CallType,
-		"action":       action, // incoming/accepted/rejected/ended
-		"timestamp":    time.Now().Unix(),
+var localRooms = &roomHub{rooms: make(map[string]map[string]liveConn)}
+
+// 加入房间
+func (h *roomHub) join(room string, conn liveConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[string]liveConn)
 	}
-	if len(extra) > 0 {
-		notification["extra"] = extra[0]
+	h.rooms[room][conn.ID()] = conn
+}
+
+// 离开房间
+func (h *roomHub) leave(room string, conn liveConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.rooms[room], conn.ID())
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
 	}
+}
 
-	// 推送目标：单聊推送给接收者，群聊推送给所有群成员
-	var targetFUIDs []string
-	if call.ReceiverType == 1 {
-		targetFUIDs = []string{call.ReceiverID}
-	} else {
-		var members []GroupMember
-		db.Where("group_quid = ? AND status = 1", call.ReceiverID).Find(&members)
-		for _, m := range members {
-			targetFUIDs = append(targetFUIDs, m.UserFUID)
+// 离开所有房间
+func (h *roomHub) leaveAll(conn liveConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for room, conns := range h.rooms {
+		delete(conns, conn.ID())
+		if len(conns) == 0 {
+			delete(h.rooms, room)
 		}
 	}
 }
 
+// 清空房间
+func (h *roomHub) clear(room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.rooms, room)
+}
 
+// 向房间内所有连接推送事件
+func (h *roomHub) broadcast(room, event string, data interface{}) {
+	h.mu.RLock()
+	conns := make([]liveConn, 0, len(h.rooms[room]))
+	for _, conn := range h.rooms[room] {
+		conns = append(conns, conn)
+	}
+	h.mu.RUnlock()
+	for _, conn := range conns {
+		conn.Emit(event, data)
+	}
+}
 
-// 检查是否为群成员（内部使用）
-func isGroupMember(groupQUID, userFUID string) bool {
-	var count int64
-	db.Model(&GroupMember{}).Where("group_quid = ? AND user_fuid = ? AND status = 1", groupQUID, userFUID).Count(&count)
-	return count > 0
+// 投递到本节点房间（Socket.IO + 原生WebSocket）
+func deliverToLocalRoom(room, event string, data interface{}) {
+	socketServer.BroadcastToRoom("", room, event, data)
+	localRooms.broadcast(room, event, data)
 }
 
-// 日志分割定时任务
-func logRotateTask() {
-	ticker := time.NewTicker(24 * time.Hour)
-	defer ticker.Stop()
-	for range ticker.C {
-		log.Info("开始日志分割")
-		// 关闭当前日志文件
-		// 重新创建日志文件
-		logFileName := filepath.Join(cfg.Log.Path, time.Now().Format(cfg.Log.FileNameFormat)+".log")
-		file, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
-			log.Error("创建新日志文件失败: ", err)
-			continue
-		}
-		log.SetOutput(io.MultiWriter(os.Stdout, file))
-		// 清理旧日志文件
-		cleanOldLogs()
-		log.Info("完成日志分割")
+// 初始化集群（节点ID、跨节点广播订阅、在线状态心跳）
+func initCluster() {
+	nodeID = cfg.Cluster.NodeID
+	if nodeID == "" {
+		hostname, _ := os.Hostname()
+		nodeID = fmt.Sprintf("%s-%s", hostname, generateDeviceID()[:8])
+	}
+	if cfg.Cluster.BroadcastChannel == "" {
+		cfg.Cluster.BroadcastChannel = "im:broadcast"
 	}
+	if cfg.Cluster.PresenceTTL <= 0 {
+		cfg.Cluster.PresenceTTL = 120
+	}
+	go subscribeClusterMessages()
+	go presenceHeartbeatTask()
+	log.Infof("集群节点初始化成功: node_id=%s, channel=%s", nodeID, cfg.Cluster.BroadcastChannel)
 }
 
-// 清理旧日志文件
-func cleanOldLogs() {
-	files, err := os.ReadDir(cfg.Log.Path)
+// 广播到房间（本节点直接投递，其他节点经Redis转发）
+func broadcastToRoom(room, event string, data interface{}) {
+	deliverToLocalRoom(room, event, data)
+	payload, err := json.Marshal(data)
 	if err != nil {
-		log.Error("读取日志目录失败: ", err)
+		log.Error("序列化广播数据失败: ", err)
 		return
 	}
-	// 计算保留时间
-	keepTime := time.Now().AddDate(0, 0, -cfg.Log.MaxAge)
-	for _, file := range files {
-		if file.IsDir() {
+	publishClusterMessage(clusterMessage{Type: "broadcast", Room: room, Event: event, Data: payload})
+}
+
+// 发布集群消息
+func publishClusterMessage(msg clusterMessage) {
+	msg.Node = nodeID
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("序列化集群消息失败: ", err)
+		return
+	}
+	ctx := context.Background()
+	if err := rdb.Publish(ctx, cfg.Cluster.BroadcastChannel, payload).Err(); err != nil {
+		log.Error("发布集群消息失败: ", err)
+	}
+}
+
+// 订阅集群消息（断线由go-redis自动重连）
+func subscribeClusterMessages() {
+	ctx := context.Background()
+	sub := rdb.Subscribe(ctx, cfg.Cluster.BroadcastChannel)
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		var cm clusterMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &cm); err != nil {
+			log.Error("解析集群消息失败: ", err)
 			continue
 		}
-		// 检查文件名是否符合格式
-		if !strings.HasPrefix(file.Name(), "log_") {
+		// 忽略本节点发出的消息（已在本地投递）
+		if cm.Node == nodeID {
 			continue
 		}
-		// 检查文件修改时间
-		fileInfo, err := file.Info()
-		if err != nil {
-		log.Error("获取文件信息失败: ", err, " 文件名称: ", file.Name())
-		continue
-		}
-
-		// 检查文件修改时间是否早于保留时间
-		if fileInfo.ModTime().Before(keepTime) {
-		filePath := filepath.Join(cfg.Log.Path, file.Name())
-		if err := os.Remove(filePath); err != nil {
-		log.Error("删除旧日志文件失败: ", err, " 文件路径: ", filePath)
-		} else {
-		log.Infof("删除旧日志文件: %s", filePath)
-			}
-		}
+		handleClusterMessage(cm)
 	}
 }
 
-// 初始化Socket.IO服务
-func initSocketIO() (*socketio.Server, error) {
-	// 创建socket.io服务器
-	server := socketio.NewServer(&engineio.Options{
-		Transports: []transport.Transport{
-			&transportWs.Transport{
-				CheckOrigin: func(r *http.Request) bool {
-				origin := r.Header.Get("Origin")
-				for _, allowed := range cfg.App.CORS.AllowOrigins {
-				if origin == allowed || allowed == "*" {
-				return true
-				}
-				}
-				return false
-				}, 
-			},
-		},
-	})
-	// 连接事件
-	server.OnConnect("/", func(s socketio.Conn) error {
-		// 验证Token
-		u := s.URL()
-		token := (&u).Query().Get("token")
-		if token == "" {
-			return errors.New("未提供Token")
-		}
-		// 解码Token
-		encryptedPayload, err := base64.StdEncoding.DecodeString(token)
-		if err != nil {
-			return errors.New("Token无效")
+// 处理集群消息（其他节点转发或本节点直接调用）
+func handleClusterMessage(cm clusterMessage) {
+	switch cm.Type {
+	case "broadcast":
+		var data interface{}
+		if err := json.Unmarshal(cm.Data, &data); err != nil {
+			log.Error("解析广播数据失败: ", err)
+			return
 		}
-		// AES解密
-		aesKey := []byte(cfg.Crypto.JWT.Secret)
-		payloadBytes, err := aesDecrypt(encryptedPayload, aesKey)
-		if err != nil {
-			return errors.New("Token无效")
+		deliverToLocalRoom(cm.Room, cm.Event, data)
+	case "room_join":
+		for _, conn := range localConns.userConns(cm.FUID) {
+			conn.Join(cm.Room)
 		}
-		// 解析Payload
-		var payload map[string]interface{}
-		err = json.Unmarshal(payloadBytes, &payload)
-		if err != nil {
-			return errors.New("Token无效")
+	case "room_leave":
+		for _, conn := range localConns.userConns(cm.FUID) {
+			conn.Leave(cm.Room)
 		}
-		// 检查过期时间
-		exp, ok := payload["exp"].(float64)
-		if !ok || int64(exp) < time.Now().Unix() {
-			return errors.New("Token已过期")
+	case "room_clear":
+		socketServer.ClearRoom("", cm.Room)
+		localRooms.clear(cm.Room)
+	case "device_disconnect":
+		for _, conn := range localConns.userConns(cm.FUID) {
+			session, ok := conn.Context().(*socketSession)
+			if !ok || session.DeviceID != cm.DeviceID {
+				continue
+			}
+			// Event字段携带断开原因，通知客户端后关闭连接
+			conn.Emit(cm.Event, map[string]interface{}{"device_id": cm.DeviceID})
+			conn.Close()
 		}
-		fuid := payload["fuid"].(string)
-		// 记录用户在线状态
-		ctx := context.Background()
-		rdb.Set(ctx, "online_user:"+fuid, s.ID(), time.Duration(cfg.Crypto.JWT.Expire)*time.Second)
-		// 加入用户房间
-		s.Join("user:" + fuid)
-		// 加入所有群聊房间
-		var groupMembers []GroupMember
-		db.Where("user_fuid = ? AND status = 1", fuid).Find(&groupMembers)
-		for _, gm := range groupMembers {
-			s.Join("group:" + gm.GroupQUID)
-		}
-		log.Infof("Socket.IO connect: fuid=%s, conn_id=%s", fuid, s.ID())
-		return nil
-	})
-	// 断开连接事件
-	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
-		// 获取用户FUID
+	default:
+		log.Warnf("未知的集群消息类型: %s", cm.Type)
+	}
+}
+
+// 用户所有在线连接（全部节点）加入房间
+func joinUserToRoom(fuid, room string) {
+	handleClusterMessage(clusterMessage{Type: "room_join", FUID: fuid, Room: room})
+	publishClusterMessage(clusterMessage{Type: "room_join", FUID: fuid, Room: room})
+}
+
+// 用户所有在线连接（全部节点）离开房间
+func removeUserFromRoom(fuid, room string) {
+	handleClusterMessage(clusterMessage{Type: "room_leave", FUID: fuid, Room: room})
+	publishClusterMessage(clusterMessage{Type: "room_leave", FUID: fuid, Room: room})
+}
+
+// 清空房间（全部节点）
+func clearRoom(room string) {
+	handleClusterMessage(clusterMessage{Type: "room_clear", Room: room})
+	publishClusterMessage(clusterMessage{Type: "room_clear", Room: room})
+}
+
+// 标记用户在线（online_user:<fuid>为集合，成员为 节点ID/连接ID）
+func markUserOnline(fuid, connID string) {
+	ctx := context.Background()
+	key := "online_user:" + fuid
+	rdb.SAdd(ctx, key, nodeID+"/"+connID)
+	rdb.Expire(ctx, key, time.Duration(cfg.Cluster.PresenceTTL)*time.Second)
+}
+
+// 标记连接下线（集合为空时Redis自动删除键，即用户离线）
+func markUserOffline(fuid, connID string) {
+	ctx := context.Background()
+	rdb.SRem(ctx, "online_user:"+fuid, nodeID+"/"+connID)
+}
+
+// 在线状态心跳：定期续期本节点在线用户，节点宕机后由TTL自动清理
+func presenceHeartbeatTask() {
+	ticker := time.NewTicker(time.Duration(cfg.Cluster.PresenceTTL) * time.Second / 3)
+	defer ticker.Stop()
+	for range ticker.C {
 		ctx := context.Background()
-		var fuid string
-		// 遍历在线用户，找到对应的FUID
-		iter := rdb.Scan(ctx, 0, "online_user:*", 0).Iterator()
-		for iter.Next(ctx) {
-			key := iter.Val()
-			val, _ := rdb.Get(ctx, key).Result()
-			if val == s.ID() {
-				fuid = strings.TrimPrefix(key, "online_user:")
-				break
+		for fuid, connIDs := range localConns.snapshot() {
+			key := "online_user:" + fuid
+			for _, connID := range connIDs {
+				rdb.SAdd(ctx, key, nodeID+"/"+connID)
 			}
+			rdb.Expire(ctx, key, time.Duration(cfg.Cluster.PresenceTTL)*time.Second)
 		}
-		if fuid != "" {
-			// 删除在线状态
-			rdb.Del(ctx, "online_user:"+fuid)
-			log.Infof("Socket.IO disconnect: fuid=%s, conn_id=%s, reason=%s", fuid, s.ID(), reason)
+	}
+}
+
+// 清理本节点的在线状态（服务关闭时调用）
+func clearLocalPresence() {
+	for fuid, connIDs := range localConns.snapshot() {
+		for _, connID := range connIDs {
+			markUserOffline(fuid, connID)
 		}
-	})
-	// 错误事件
-	server.OnError("/", func(s socketio.Conn, err error) {
-		log.Error("Socket.IO error: conn_id=%s, err=%v", s.ID(), err)
-	})
-	return server, nil
+	}
 }
 
 func main() {
@@ -3527,22 +12014,76 @@ func main() {
 		log.Fatalf("初始化MySQL失败: %v", err)
 	}
 
+	// 初始化RSA
+	err = initRSA()
+	if err != nil {
+		log.Fatalf("初始化RSA失败: %v", err)
+	}
+	// 初始化内容信封密钥
+	err = initEnvelopeKey()
+	if err != nil {
+		log.Fatalf("初始化内容信封密钥失败: %v", err)
+	}
+
+	// 初始化静态加密
+	err = initAtRestEncryption()
+	if err != nil {
+		log.Fatalf("初始化静态加密失败: %v", err)
+	}
+
+	// 初始化JWT签名密钥
+	err = initJWTKeys()
+	if err != nil {
+		log.Fatalf("初始化JWT签名密钥失败: %v", err)
+	}
+
+	// 命令行子命令（执行后退出，不启动服务）
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "jwt-keys":
+			if err := jwtKeysCommand(os.Args[2:]); err != nil {
+				log.Fatalf("JWT密钥操作失败: %v", err)
+			}
+			return
+		case "migrate-envelope":
+			if err := migrateEnvelopeCommand(os.Args[2:]); err != nil {
+				log.Fatalf("迁移消息内容失败: %v", err)
+			}
+			return
+		case "keyring":
+			if err := keyringCommand(os.Args[2:]); err != nil {
+				log.Fatalf("密钥环操作失败: %v", err)
+			}
+			return
+		default:
+			log.Fatalf("未知命令: %s（可用命令: migrate-envelope、keyring、jwt-keys）", os.Args[1])
+		}
+	}
+
 	// 初始化Redis
 	err = initRedis()
 	if err != nil {
 		log.Fatalf("初始化Redis失败: %v", err)
 	}
 
+	// 初始化邮件发送
+	err = initMailer()
+	if err != nil {
+		log.Fatalf("初始化邮件发送失败: %v", err)
+	}
+
 	// 初始化MinIO
 	err = initMinIO()
 	if err != nil {
 		log.Fatalf("初始化MinIO失败: %v", err)
 	}
+	// 初始化文件存储后端
+	initStorage()
 
-	// 初始化RSA
-	err = initRSA()
+	// 初始化消息过滤器
+	err = initMessageFilters()
 	if err != nil {
-		log.Fatalf("初始化RSA失败: %v", err)
+		log.Fatalf("初始化消息过滤器失败: %v", err)
 	}
 
 	// 初始化Socket.IO
@@ -3550,6 +12091,14 @@ func main() {
 	if err != nil {
 		log.Fatalf("初始化Socket.IO失败: %v", err)
 	}
+	go func() {
+		if err := socketServer.Serve(); err != nil {
+			log.Errorf("Socket.IO服务异常退出: %v", err)
+		}
+	}()
+
+	// 初始化集群（跨节点广播）
+	initCluster()
 
 	// 设置Gin模式
 	if cfg.App.Mode == "release" {
@@ -3579,8 +12128,17 @@ func main() {
 	{
 		publicGroup.POST("/register", limiters["register_login_ip"], limiters["register_login_user"], registerHandler)
 		publicGroup.POST("/login", limiters["register_login_ip"], limiters["register_login_user"], loginHandler)
+		publicGroup.POST("/login/2fa", limiters["register_login_ip"], mfaLoginHandler)
+		publicGroup.POST("/login/passkey/begin", limiters["register_login_ip"], passkeyLoginBeginHandler)
+		publicGroup.POST("/login/passkey/finish", limiters["register_login_ip"], passkeyLoginFinishHandler)
+		publicGroup.POST("/token/refresh", limiters["register_login_ip"], refreshTokenHandler)
+		publicGroup.POST("/email/verify", limiters["register_login_ip"], verifyEmailHandler)
+		publicGroup.POST("/password/reset/request", limiters["register_login_ip"], requestPasswordResetHandler)
+		publicGroup.POST("/password/reset", limiters["register_login_ip"], resetPasswordHandler)
 		// 健康检查接口
         publicGroup.GET("/health", limiters["register_login_ip"], healthHandler)
+		// 服务端公钥（生成内容信封用）
+		publicGroup.GET("/crypto/keys", getCryptoKeysHandler)
 	}
 
 	// 私有接口（需要登录）
@@ -3590,6 +12148,36 @@ func main() {
 		// 设备管理
 		privateGroup.GET("/devices", getDevicesHandler)
 		privateGroup.POST("/devices/kick", kickDeviceHandler)
+		// 退出登录（吊销当前令牌并注销当前设备）
+		privateGroup.POST("/auth/logout", logoutHandler)
+		// 两步验证（TOTP）
+		privateGroup.GET("/auth/2fa", totpStatusHandler)
+		privateGroup.POST("/auth/2fa/enroll", totpEnrollHandler)
+		privateGroup.POST("/auth/2fa/confirm", totpConfirmHandler)
+		privateGroup.POST("/auth/2fa/disable", totpDisableHandler)
+		privateGroup.POST("/auth/2fa/recovery-codes", regenerateRecoveryCodesHandler)
+		// 通行密钥（WebAuthn）
+		privateGroup.GET("/auth/passkeys", listPasskeysHandler)
+		privateGroup.POST("/auth/passkeys/register/begin", passkeyRegisterBeginHandler)
+		privateGroup.POST("/auth/passkeys/register/finish", passkeyRegisterFinishHandler)
+		privateGroup.DELETE("/auth/passkeys/:id", deletePasskeyHandler)
+		// 个人资料
+		privateGroup.GET("/user/me", getMyProfileHandler)
+		privateGroup.PUT("/user/me", updateMyProfileHandler)
+		privateGroup.POST("/user/me/avatar", uploadAvatarHandler)
+		privateGroup.POST("/user/me/password", changePasswordHandler)
+		privateGroup.GET("/user/me/logins", getLoginHistoryHandler)
+		privateGroup.GET("/user/me/deletion", getAccountDeletionHandler)
+		privateGroup.POST("/user/me/deletion", requestAccountDeletionHandler)
+		privateGroup.DELETE("/user/me/deletion", cancelAccountDeletionHandler)
+		privateGroup.GET("/user/me/export", getDataExportHandler)
+		privateGroup.GET("/user/me/export/:export_id/download", downloadDataExportHandler)
+		privateGroup.POST("/user/me/export", requestDataExportHandler)
+		// 邮箱
+		privateGroup.POST("/email/verify/resend", resendVerificationHandler)
+		privateGroup.POST("/email/change", changeEmailHandler)
+		// 实时连接票据
+		privateGroup.POST("/socket/ticket", socketTicketHandler)
 		// 好友相关
 		privateGroup.GET("/friend/search", searchFriendHandler)
 		privateGroup.POST("/friend/add", addFriendHandler)
@@ -3599,6 +12187,10 @@ func main() {
 		privateGroup.POST("/friend/blacklist/remove/:fuid", removeBlacklistHandler)
 		privateGroup.GET("/friend/profile/:fuid", getFriendProfileHandler)
 
+		// 举报
+		privateGroup.POST("/report", createReportHandler)
+		privateGroup.GET("/report/mine", listMyReportsHandler)
+
 		// 群聊相关
 		privateGroup.POST("/group/create", createGroupHandler)
 		privateGroup.GET("/group/search", searchGroupHandler)
@@ -3610,31 +12202,82 @@ func main() {
 		privateGroup.DELETE("/group/dissolve/:quid", dissolveGroupHandler)
 		privateGroup.POST("/group/transfer", transferGroupHandler)
 		privateGroup.GET("/group/profile/:quid", getGroupProfileHandler)
+		privateGroup.GET("/group/audit/:quid", groupAuditHandler)
+		privateGroup.GET("/group/filter/:quid", getGroupFilterHandler)
+		privateGroup.PUT("/group/filter/:quid", updateGroupFilterHandler)
 
 		// 消息相关
 		privateGroup.POST("/message/send", limiters["message_conn"], limiters["group_user"], sendMessageHandler)
 		privateGroup.POST("/message/recall/:msg_id", recallMessageHandler)
 		privateGroup.GET("/message/offline", getOfflineMessageHandler)
 		privateGroup.GET("/message/unread/count", getUnreadMessageCountHandler)
+		privateGroup.GET("/message/range", getMessageRangeHandler)
+		privateGroup.GET("/stream", sseStreamHandler)
 		
-		privateGroup.POST("/message/voice", authMiddleware(), sendVoiceMessageHandler)
-		privateGroup.POST("/call/init", authMiddleware(), initCallHandler)
-		privateGroup.POST("/call/accept", authMiddleware(), acceptCallHandler)
-		privateGroup.POST("/call/reject", authMiddleware(), rejectCallHandler)
-		privateGroup.POST("/call/end", authMiddleware(), endCallHandler)
+		privateGroup.POST("/message/voice", sendVoiceMessageHandler)
+		privateGroup.POST("/call/init", initCallHandler)
+		privateGroup.POST("/call/accept", acceptCallHandler)
+		privateGroup.POST("/call/reject", rejectCallHandler)
+		privateGroup.POST("/call/end", endCallHandler)
 
 		// 文件上传
 		privateGroup.POST("/upload", uploadFileHandler)
+
+		// 端到端加密密钥目录
+		privateGroup.POST("/keys/upload", uploadDeviceKeysHandler)
+		privateGroup.POST("/keys/replenish", replenishPreKeysHandler)
+		privateGroup.GET("/keys/count", getPreKeyCountHandler)
+		privateGroup.GET("/keys/bundle/:fuid", getPreKeyBundleHandler)
+		privateGroup.POST("/group/keys/distribute", distributeSenderKeyHandler)
+		privateGroup.GET("/group/keys/pending", getPendingSenderKeysHandler)
+		privateGroup.POST("/group/keys/ack", ackSenderKeysHandler)
+		privateGroup.GET("/group/keys/missing", getMissingSenderKeysHandler)
+	}
+
+	// 管理接口（需要系统角色）
+	adminGroup := r.Group("/api/v1/admin")
+	adminGroup.Use(authMiddleware(defaultAuthPolicy, adminPolicyStaff))
+	{
+		// 用户管理
+		adminGroup.GET("/users", adminSearchUsersHandler)
+		adminGroup.GET("/users/:fuid", adminGetUserHandler)
+		adminGroup.POST("/users/:fuid/disable", requirePolicy(adminPolicyModerator), adminSetUserStatusHandler(false))
+		adminGroup.POST("/users/:fuid/enable", requirePolicy(adminPolicyModerator), adminSetUserStatusHandler(true))
+		adminGroup.POST("/users/:fuid/logout", adminLogoutUserHandler)
+		adminGroup.PUT("/users/:fuid/role", requirePolicy(adminPolicyAdmin), adminSetUserRoleHandler)
+		adminGroup.POST("/users/:fuid/restrictions", requirePolicy(adminPolicyModerator), adminSetRestrictionHandler)
+		adminGroup.DELETE("/users/:fuid/restrictions/:type", requirePolicy(adminPolicyModerator), adminLiftRestrictionHandler)
+		// 群聊管理
+		adminGroup.DELETE("/groups/:quid", requirePolicy(adminPolicyModerator), adminDissolveGroupHandler)
+		// 系统消息
+		adminGroup.POST("/system-messages", requirePolicy(adminPolicyAdmin), adminSendSystemMessageHandler)
+		// 举报
+		adminGroup.GET("/reports", adminListReportsHandler)
+		adminGroup.GET("/reports/:id", adminGetReportHandler)
+		adminGroup.POST("/reports/:id/claim", requirePolicy(adminPolicyModerator), adminClaimReportHandler)
+		adminGroup.POST("/reports/:id/resolve", requirePolicy(adminPolicyModerator), adminResolveReportHandler)
+		// 审计事件
+		adminGroup.GET("/audit", requirePolicy(adminPolicyAdmin), adminListAuditHandler)
 	}
 
 	// 注册Socket.IO路由
 	r.GET("/socket.io/*any", gin.WrapH(socketServer))
 	r.POST("/socket.io/*any", gin.WrapH(socketServer))
+	// 原生WebSocket路由
+	r.GET("/ws", wsHandler)
+	// JWT验证公钥（供其他服务验证令牌）
+	r.GET("/.well-known/jwks.json", jwksHandler)
 
 	// 启动定时任务
 	go vipLevelUpdateTask()
 	go messageAutoCleanTask()
 	go logRotateTask()
+	go atRestMaintenanceTask()
+	go jwtKeyReloadTask()
+	go refreshTokenCleanTask()
+	go accountLifecycleTask()
+	go loginHistoryCleanTask()
+	go auditRetentionTask()
 
 	// 处理系统信号
 	quit := make(chan os.Signal, 1)
@@ -3662,6 +12305,7 @@ func main() {
 	log.Info("开始关闭服务")
 
 	// 关闭资源
+	clearLocalPresence()
 	sqlDB, _ := db.DB()
 	_ = sqlDB.Close()
 	_ = rdb.Close()
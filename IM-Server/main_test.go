@@ -0,0 +1,3752 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/googollee/go-socket.io"
+	gorillaWs "github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMain(m *testing.M) {
+	log = logrus.New()
+	log.SetOutput(os.Stderr)
+	log.SetLevel(logrus.FatalLevel)
+	gin.SetMode(gin.TestMode)
+	socketServer = socketio.NewServer(nil)
+	os.Exit(m.Run())
+}
+
+// 测试用的内存Redis（实现RESP协议，只支持服务端用到的命令）
+type fakeRedis struct {
+	mu        sync.Mutex
+	ln        net.Listener
+	values    map[string]*fakeRedisValue
+	published map[string][]string // 频道 -> 已发布的消息
+}
+
+type fakeRedisValue struct {
+	str      string
+	hash     map[string]string
+	set      map[string]bool
+	expireAt time.Time
+}
+
+// 启动内存Redis并替换全局rdb，测试结束时关闭
+func setupFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{ln: ln, values: map[string]*fakeRedisValue{}, published: map[string][]string{}}
+	go fr.serve()
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	rdb = client
+	// 不恢复为nil：发送管道中的异步推送可能在测试结束后才执行
+	t.Cleanup(func() {
+		client.Close()
+		ln.Close()
+	})
+	return fr
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fr.handle(conn)
+	}
+}
+
+func (fr *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		switch cmd := strings.ToLower(args[0]); {
+		case cmd == "multi":
+			inMulti = true
+			buf.WriteString("+OK\r\n")
+		case cmd == "exec":
+			fmt.Fprintf(&buf, "*%d\r\n", len(queued))
+			for _, q := range queued {
+				buf.WriteString(fr.exec(q))
+			}
+			queued, inMulti = nil, false
+		case inMulti:
+			queued = append(queued, args)
+			buf.WriteString("+QUEUED\r\n")
+		default:
+			buf.WriteString(fr.exec(args))
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func respBulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+func respInt(n int64) string   { return fmt.Sprintf(":%d\r\n", n) }
+
+const respNil = "$-1\r\n"
+
+// 读取未过期的值（调用方持有锁）
+func (fr *fakeRedis) lookup(key string) *fakeRedisValue {
+	v, ok := fr.values[key]
+	if !ok {
+		return nil
+	}
+	if !v.expireAt.IsZero() && !v.expireAt.After(time.Now()) {
+		delete(fr.values, key)
+		return nil
+	}
+	return v
+}
+
+func (fr *fakeRedis) exec(args []string) string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	cmd := strings.ToLower(args[0])
+	switch cmd {
+	case "ping":
+		return "+PONG\r\n"
+	case "get", "getdel":
+		v := fr.lookup(args[1])
+		if v == nil {
+			return respNil
+		}
+		if cmd == "getdel" {
+			delete(fr.values, args[1])
+		}
+		return respBulk(v.str)
+	case "set", "setnx":
+		value := &fakeRedisValue{str: args[2]}
+		nx := cmd == "setnx"
+		for i := 3; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "nx":
+				nx = true
+			case "ex", "px":
+				n, _ := strconv.ParseInt(args[i+1], 10, 64)
+				unit := time.Second
+				if strings.ToLower(args[i]) == "px" {
+					unit = time.Millisecond
+				}
+				value.expireAt = time.Now().Add(time.Duration(n) * unit)
+				i++
+			}
+		}
+		if nx && fr.lookup(args[1]) != nil {
+			if cmd == "setnx" {
+				return respInt(0)
+			}
+			return respNil
+		}
+		fr.values[args[1]] = value
+		if cmd == "setnx" {
+			return respInt(1)
+		}
+		return "+OK\r\n"
+	case "del":
+		var n int64
+		for _, key := range args[1:] {
+			if fr.lookup(key) != nil {
+				delete(fr.values, key)
+				n++
+			}
+		}
+		return respInt(n)
+	case "exists":
+		var n int64
+		for _, key := range args[1:] {
+			if fr.lookup(key) != nil {
+				n++
+			}
+		}
+		return respInt(n)
+	case "incr", "incrby":
+		delta := int64(1)
+		if cmd == "incrby" {
+			delta, _ = strconv.ParseInt(args[2], 10, 64)
+		}
+		v := fr.lookup(args[1])
+		if v == nil {
+			v = &fakeRedisValue{str: "0"}
+			fr.values[args[1]] = v
+		}
+		n, err := strconv.ParseInt(v.str, 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		n += delta
+		v.str = strconv.FormatInt(n, 10)
+		return respInt(n)
+	case "expire":
+		v := fr.lookup(args[1])
+		if v == nil {
+			return respInt(0)
+		}
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		v.expireAt = time.Now().Add(time.Duration(n) * time.Second)
+		return respInt(1)
+	case "ttl":
+		v := fr.lookup(args[1])
+		if v == nil {
+			return respInt(-2)
+		}
+		if v.expireAt.IsZero() {
+			return respInt(-1)
+		}
+		return respInt(int64(time.Until(v.expireAt).Seconds() + 0.5))
+	case "hset":
+		v := fr.lookup(args[1])
+		if v == nil {
+			v = &fakeRedisValue{hash: map[string]string{}}
+			fr.values[args[1]] = v
+		}
+		var n int64
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := v.hash[args[i]]; !ok {
+				n++
+			}
+			v.hash[args[i]] = args[i+1]
+		}
+		return respInt(n)
+	case "hget":
+		v := fr.lookup(args[1])
+		if v == nil {
+			return respNil
+		}
+		field, ok := v.hash[args[2]]
+		if !ok {
+			return respNil
+		}
+		return respBulk(field)
+	case "hgetall":
+		v := fr.lookup(args[1])
+		if v == nil {
+			return "*0\r\n"
+		}
+		out := fmt.Sprintf("*%d\r\n", len(v.hash)*2)
+		for k, field := range v.hash {
+			out += respBulk(k) + respBulk(field)
+		}
+		return out
+	case "hdel":
+		v := fr.lookup(args[1])
+		var n int64
+		if v != nil {
+			for _, field := range args[2:] {
+				if _, ok := v.hash[field]; ok {
+					delete(v.hash, field)
+					n++
+				}
+			}
+		}
+		return respInt(n)
+	case "sadd":
+		v := fr.lookup(args[1])
+		if v == nil {
+			v = &fakeRedisValue{set: map[string]bool{}}
+			fr.values[args[1]] = v
+		}
+		var n int64
+		for _, member := range args[2:] {
+			if !v.set[member] {
+				v.set[member] = true
+				n++
+			}
+		}
+		return respInt(n)
+	case "srem":
+		v := fr.lookup(args[1])
+		var n int64
+		if v != nil {
+			for _, member := range args[2:] {
+				if v.set[member] {
+					delete(v.set, member)
+					n++
+				}
+			}
+			// 与Redis一致：集合为空时删除键
+			if len(v.set) == 0 {
+				delete(fr.values, args[1])
+			}
+		}
+		return respInt(n)
+	case "smembers":
+		v := fr.lookup(args[1])
+		if v == nil {
+			return "*0\r\n"
+		}
+		out := fmt.Sprintf("*%d\r\n", len(v.set))
+		for member := range v.set {
+			out += respBulk(member)
+		}
+		return out
+	case "sismember":
+		if v := fr.lookup(args[1]); v != nil && v.set[args[2]] {
+			return respInt(1)
+		}
+		return respInt(0)
+	case "publish":
+		fr.published[args[1]] = append(fr.published[args[1]], args[2])
+		return respInt(0)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+}
+
+// 返回频道上已发布的消息
+func (fr *fakeRedis) messages(channel string) []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return append([]string(nil), fr.published[channel]...)
+}
+
+// 测试用的SQL驱动：记录执行的语句，按正则返回预设结果（未匹配的查询返回空结果，写操作影响1行）
+type fakeSQL struct {
+	mu       sync.Mutex
+	handlers []fakeSQLHandler
+	log      []string
+}
+
+type fakeSQLHandler struct {
+	pattern *regexp.Regexp
+	result  fakeSQLResult
+}
+
+type fakeSQLResult struct {
+	Columns  []string
+	Rows     [][]driver.Value
+	Affected int64
+	Err      error
+}
+
+// 启动测试数据库并替换全局db（关闭默认事务，便于断言显式事务）
+func setupFakeDB(t *testing.T) *fakeSQL {
+	t.Helper()
+	fs := &fakeSQL{}
+	gormDB, err := gorm.Open(mysql.New(mysql.Config{
+		Conn:                      sql.OpenDB(fakeSQLConnector{fs}),
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = gormDB
+	return fs
+}
+
+// 注册预设结果（后注册的优先）
+func (fs *fakeSQL) on(pattern string, result fakeSQLResult) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.handlers = append([]fakeSQLHandler{{regexp.MustCompile(pattern), result}}, fs.handlers...)
+}
+
+// 返回匹配正则的已执行语句
+func (fs *fakeSQL) executed(pattern string) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	re := regexp.MustCompile(pattern)
+	var out []string
+	for _, stmt := range fs.log {
+		if re.MatchString(stmt) {
+			out = append(out, stmt)
+		}
+	}
+	return out
+}
+
+func (fs *fakeSQL) run(query string, args []driver.NamedValue) fakeSQLResult {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	stmt := query
+	for _, arg := range args {
+		stmt += fmt.Sprintf(" |%v", arg.Value)
+	}
+	fs.log = append(fs.log, stmt)
+	for _, h := range fs.handlers {
+		if h.pattern.MatchString(stmt) {
+			return h.result
+		}
+	}
+	return fakeSQLResult{Affected: 1}
+}
+
+type fakeSQLConnector struct{ fs *fakeSQL }
+
+func (c fakeSQLConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeSQLConn{c.fs}, nil
+}
+func (c fakeSQLConnector) Driver() driver.Driver { return nil }
+
+type fakeSQLConn struct{ fs *fakeSQL }
+
+func (c *fakeSQLConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeSQLConn) Close() error                        { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeSQLConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.fs.run("BEGIN", nil)
+	return fakeSQLTx{c.fs}, nil
+}
+
+func (c *fakeSQLConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c *fakeSQLConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res := c.fs.run(query, args)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return fakeSQLExecResult(res.Affected), nil
+}
+
+type fakeSQLExecResult int64
+
+func (r fakeSQLExecResult) LastInsertId() (int64, error) { return 1, nil }
+func (r fakeSQLExecResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func (c *fakeSQLConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res := c.fs.run(query, args)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return &fakeSQLRows{columns: res.Columns, rows: res.Rows}, nil
+}
+
+type fakeSQLTx struct{ fs *fakeSQL }
+
+func (tx fakeSQLTx) Commit() error {
+	tx.fs.run("COMMIT", nil)
+	return nil
+}
+
+func (tx fakeSQLTx) Rollback() error {
+	tx.fs.run("ROLLBACK", nil)
+	return nil
+}
+
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+// 单行结果
+func fakeRow(columns string, values ...driver.Value) fakeSQLResult {
+	return fakeSQLResult{Columns: strings.Split(columns, ","), Rows: [][]driver.Value{values}}
+}
+
+// 在请求上下文中设置已认证身份（未登录时不设置）
+func setTestIdentity(c *gin.Context, id authIdentity) {
+	if id.FUID != "" {
+		c.Set(identityContextKey, id)
+	}
+}
+
+// 以指定身份调用接口，返回解析后的统一响应
+func callHandler(t *testing.T, handler gin.HandlerFunc, method, target string, body interface{}, id authIdentity, params ...gin.Param) Response {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		reader = bytes.NewReader(encoded)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, reader)
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = params
+	setTestIdentity(c, id)
+	handler(c)
+	var res Response
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+	return res
+}
+
+// 响应数据转为map
+func responseData(t *testing.T, res Response) map[string]interface{} {
+	t.Helper()
+	data, ok := res.Data.(map[string]interface{})
+	if !ok {
+		t.Fatalf("response data is %T (code %d, msg %q)", res.Data, res.Code, res.Msg)
+	}
+	return data
+}
+
+func TestConversationIDIsSharedByBothSides(t *testing.T) {
+	if a, b := getConversationID(1, "u1", "u2"), getConversationID(1, "u2", "u1"); a != "single:u1:u2" || a != b {
+		t.Errorf("single chat conv ids %q %q", a, b)
+	}
+	if got := getConversationID(2, "u1", "q1"); got != "group:q1" {
+		t.Errorf("group conv id %q", got)
+	}
+}
+
+func TestConversationSeqSeedsFromStoredMessages(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	fs.on("MAX\\(seq\\)", fakeRow("max", 41))
+	for want := uint64(42); want <= 44; want++ {
+		seq, err := nextConversationSeq("single:u1:u2")
+		if err != nil || seq != want {
+			t.Fatalf("seq = %d, %v; want %d", seq, err, want)
+		}
+	}
+	// 只在Redis中无序号时读取一次数据库
+	if n := len(fs.executed("MAX\\(seq\\)")); n != 1 {
+		t.Errorf("seeded from the database %d times", n)
+	}
+	// 不同会话的序号相互独立
+	fs.on("MAX\\(seq\\)", fakeRow("max", 0))
+	if seq, err := nextConversationSeq("group:q1"); err != nil || seq != 1 {
+		t.Errorf("group seq = %d, %v; want 1", seq, err)
+	}
+}
+
+func TestMessageRangeHandler(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	rdb.Set(context.Background(), "conv_seq:single:u1:u2", 12, 0)
+	fs.on("FROM `messages`", fakeSQLResult{
+		Columns: []string{"msg_id", "conv_id", "seq", "sender_fuid", "receiver_type", "receiver_id", "content"},
+		Rows: [][]driver.Value{
+			{"m3", "single:u1:u2", 3, "u2", 1, "u1", "a"},
+			{"m4", "single:u1:u2", 4, "u1", 1, "u2", "b"},
+		},
+	})
+	res := callHandler(t, getMessageRangeHandler, "GET", "/message/range?receiver_type=1&receiver_id=u2&start_seq=3&end_seq=4", nil, authIdentity{FUID: "u1"})
+	data := responseData(t, res)
+	if data["conv_id"] != "single:u1:u2" || data["latest_seq"].(float64) != 12 {
+		t.Errorf("conv_id %v latest_seq %v", data["conv_id"], data["latest_seq"])
+	}
+	messages, _ := data["messages"].([]interface{})
+	if len(messages) != 2 || messages[0].(map[string]interface{})["seq"].(float64) != 3 {
+		t.Fatalf("messages = %v", data["messages"])
+	}
+	queries := fs.executed("FROM `messages` WHERE \\(?conv_id = \\? AND seq >= \\?")
+	if len(queries) != 1 || !strings.Contains(queries[0], "seq <= ?") || !strings.Contains(queries[0], "|single:u1:u2 |3") {
+		t.Errorf("range query = %v", queries)
+	}
+
+	if res := callHandler(t, getMessageRangeHandler, "GET", "/message/range?receiver_type=1&receiver_id=u2&start_seq=5&end_seq=4", nil, authIdentity{FUID: "u1"}); res.Code != 400 {
+		t.Errorf("end before start: code %d", res.Code)
+	}
+	if res := callHandler(t, getMessageRangeHandler, "GET", "/message/range?receiver_type=2&receiver_id=q1", nil, authIdentity{FUID: "u1"}); res.Code != 403 {
+		t.Errorf("non-member: code %d", res.Code)
+	}
+	if res := callHandler(t, getMessageRangeHandler, "GET", "/message/range?receiver_type=1&receiver_id=u2", nil, authIdentity{}); res.Code != 401 {
+		t.Errorf("anonymous: code %d", res.Code)
+	}
+}
+
+func TestMessageRangeClampsToJoinPointAndReportsVoidSeqs(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	convID := "group:q1"
+	rdb.Set(context.Background(), "conv_seq:"+convID, 10, 0)
+	voidConversationSeq(convID, 7)
+	voidConversationSeq(convID, 3) // 加入之前的作废序号不返回
+	fs.on("FROM `group_members`", fakeRow("group_quid,user_fuid,status,join_seq", "q1", "u1", 1, 5))
+	fs.on("FROM `messages`", fakeSQLResult{
+		Columns: []string{"msg_id", "conv_id", "seq", "sender_fuid", "receiver_type", "receiver_id"},
+		Rows: [][]driver.Value{
+			{"m6", convID, 6, "u2", 2, "q1"},
+			{"m8", convID, 8, "u2", 2, "q1"},
+			{"m9", convID, 9, "u2", 2, "q1"},
+			{"m10", convID, 10, "u2", 2, "q1"},
+		},
+	})
+	res := callHandler(t, getMessageRangeHandler, "GET", "/message/range?receiver_type=2&receiver_id=q1&start_seq=0", nil, authIdentity{FUID: "u1"})
+	data := responseData(t, res)
+	if data["min_seq"].(float64) != 6 || data["latest_seq"].(float64) != 10 {
+		t.Fatalf("min_seq %v latest_seq %v", data["min_seq"], data["latest_seq"])
+	}
+	if got := fmt.Sprint(data["empty_seqs"]); got != "[7]" {
+		t.Errorf("empty_seqs = %s, want [7]", got)
+	}
+	queries := fs.executed("FROM `messages` WHERE conv_id = \\? AND seq >= \\?")
+	if len(queries) != 1 || !strings.Contains(queries[0], "|group:q1 |6 |u1") {
+		t.Errorf("range query not clamped to join point: %v", queries)
+	}
+
+	fs.on("FROM `group_members`", fakeSQLResult{Columns: []string{"group_quid"}})
+	if res := callHandler(t, getMessageRangeHandler, "GET", "/message/range?receiver_type=2&receiver_id=q1", nil, authIdentity{FUID: "u3"}); res.Code != 403 {
+		t.Errorf("non-member got code %d", res.Code)
+	}
+}
+
+func TestSendMessageVoidsSeqWhenInsertFails(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	rdb.Set(context.Background(), "conv_seq:group:q1", 4, 0)
+	fs.on("FROM `group_members`", fakeRow("group_quid,user_fuid,status", "q1", "u1", 1))
+	fs.on("INSERT INTO `messages`", fakeSQLResult{Err: errors.New("duplicate entry")})
+	req := sendMessageRequest{ReceiverType: 2, ReceiverID: "q1", ContentType: 1, Content: "opaque", Encryption: 1}
+	if _, apiErr := sendMessage("u1", req); apiErr == nil || apiErr.Code != 500 {
+		t.Fatalf("apiErr = %v", apiErr)
+	}
+	if got := voidConversationSeqs("group:q1", 1, 10); !reflect.DeepEqual(got, []uint64{5}) {
+		t.Errorf("void seqs = %v, want [5]", got)
+	}
+	// 下一条消息使用新的序号，作废的序号不会被复用
+	fs.on("INSERT INTO `messages`", fakeSQLResult{Affected: 1})
+	message, apiErr := sendMessage("u1", req)
+	if apiErr != nil || message.Seq != 6 {
+		t.Fatalf("seq %v err %v", message, apiErr)
+	}
+}
+
+// 只实现ID的Socket.IO连接
+type stubConn struct {
+	socketio.Conn
+	id string
+}
+
+func (c stubConn) ID() string { return c.id }
+
+func setupClusterNode(t *testing.T, id string) {
+	t.Helper()
+	savedNode, savedCluster := nodeID, cfg.Cluster
+	t.Cleanup(func() { nodeID, cfg.Cluster = savedNode, savedCluster })
+	nodeID = id
+	cfg.Cluster.BroadcastChannel = "im:broadcast"
+	cfg.Cluster.PresenceTTL = 120
+}
+
+// 等待房间事件发布到集群频道（推送多为异步）
+func waitForClusterEvent(t *testing.T, fr *fakeRedis, room, event string) clusterMessage {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, payload := range fr.messages(cfg.Cluster.BroadcastChannel) {
+			var cm clusterMessage
+			if json.Unmarshal([]byte(payload), &cm) == nil && cm.Room == room && cm.Event == event {
+				return cm
+			}
+		}
+	}
+	t.Fatalf("%s not published to %s", event, room)
+	return clusterMessage{}
+}
+
+func TestPresenceTracksEveryConnection(t *testing.T) {
+	setupFakeRedis(t)
+	setupClusterNode(t, "node-a")
+	ctx := context.Background()
+
+	markUserOnline("u1", "c1")
+	markUserOnline("u1", "c2")
+	members, _ := rdb.SMembers(ctx, "online_user:u1").Result()
+	sort.Strings(members)
+	if !reflect.DeepEqual(members, []string{"node-a/c1", "node-a/c2"}) {
+		t.Fatalf("presence = %v", members)
+	}
+	if ttl, _ := rdb.TTL(ctx, "online_user:u1").Result(); ttl <= 0 || ttl > 120*time.Second {
+		t.Errorf("presence ttl = %v", ttl)
+	}
+	// 关闭一个连接后仍在线，全部关闭后离线
+	markUserOffline("u1", "c1")
+	if n, _ := rdb.Exists(ctx, "online_user:u1").Result(); n != 1 {
+		t.Fatal("user offline with a connection left")
+	}
+	markUserOffline("u1", "c2")
+	if n, _ := rdb.Exists(ctx, "online_user:u1").Result(); n != 0 {
+		t.Error("user still online after the last connection closed")
+	}
+}
+
+func TestConnRegistrySnapshot(t *testing.T) {
+	registry := &connRegistry{conns: make(map[string]map[string]liveConn)}
+	registry.add("u1", stubConn{id: "c1"})
+	registry.add("u1", stubConn{id: "c2"})
+	registry.add("u2", stubConn{id: "c3"})
+	registry.remove("u1", "c1")
+	registry.remove("u2", "c3")
+	if got := registry.snapshot(); !reflect.DeepEqual(got, map[string][]string{"u1": {"c2"}}) {
+		t.Errorf("snapshot = %v", got)
+	}
+}
+
+func TestBroadcastPublishesToOtherNodes(t *testing.T) {
+	fr := setupFakeRedis(t)
+	setupClusterNode(t, "node-a")
+
+	broadcastToRoom("user:u2", "new_message", map[string]interface{}{"msg_id": "m1"})
+	published := fr.messages("im:broadcast")
+	if len(published) != 1 {
+		t.Fatalf("published %d messages", len(published))
+	}
+	var cm clusterMessage
+	if err := json.Unmarshal([]byte(published[0]), &cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Type != "broadcast" || cm.Node != "node-a" || cm.Room != "user:u2" || cm.Event != "new_message" || string(cm.Data) != `{"msg_id":"m1"}` {
+		t.Errorf("cluster message = %+v (data %s)", cm, cm.Data)
+	}
+}
+
+// 记录加入/离开房间的Socket.IO连接
+type roomConn struct {
+	socketio.Conn
+	id    string
+	rooms map[string]bool
+}
+
+func (c *roomConn) ID() string        { return c.id }
+func (c *roomConn) Join(room string)  { c.rooms[room] = true }
+func (c *roomConn) Leave(room string) { delete(c.rooms, room) }
+
+func setupLocalConns(t *testing.T) {
+	t.Helper()
+	saved := localConns
+	t.Cleanup(func() { localConns = saved })
+	localConns = &connRegistry{conns: make(map[string]map[string]liveConn)}
+}
+
+func TestRoomMembershipFollowsGroupChanges(t *testing.T) {
+	fr := setupFakeRedis(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	phone, desktop := &roomConn{id: "c1", rooms: map[string]bool{}}, &roomConn{id: "c2", rooms: map[string]bool{}}
+	localConns.add("u1", phone)
+	localConns.add("u1", desktop)
+
+	joinUserToRoom("u1", "group:q1")
+	if !phone.rooms["group:q1"] || !desktop.rooms["group:q1"] {
+		t.Fatalf("rooms after join: %v %v", phone.rooms, desktop.rooms)
+	}
+	removeUserFromRoom("u1", "group:q1")
+	if len(phone.rooms) != 0 || len(desktop.rooms) != 0 {
+		t.Fatalf("rooms after leave: %v %v", phone.rooms, desktop.rooms)
+	}
+	// 其他节点上的连接通过集群消息同步
+	var types []string
+	for _, payload := range fr.messages("im:broadcast") {
+		var cm clusterMessage
+		json.Unmarshal([]byte(payload), &cm)
+		if cm.FUID != "u1" || cm.Room != "group:q1" {
+			t.Errorf("cluster message = %+v", cm)
+		}
+		types = append(types, cm.Type)
+	}
+	if !reflect.DeepEqual(types, []string{"room_join", "room_leave"}) {
+		t.Errorf("published %v", types)
+	}
+
+	// 其他节点发来的加入消息只影响本节点上该用户的连接
+	other := &roomConn{id: "c3", rooms: map[string]bool{}}
+	localConns.add("u2", other)
+	handleClusterMessage(clusterMessage{Type: "room_join", Node: "node-b", FUID: "u2", Room: "group:q2"})
+	if !other.rooms["group:q2"] || phone.rooms["group:q2"] {
+		t.Errorf("remote join: u2 %v, u1 %v", other.rooms, phone.rooms)
+	}
+}
+
+// 带会话上下文、记录推送事件的Socket.IO连接
+type sessionConn struct {
+	socketio.Conn
+	id      string
+	session *socketSession
+	emitted []string
+	closed  bool
+}
+
+func (c *sessionConn) ID() string                          { return c.id }
+func (c *sessionConn) Context() interface{}                { return c.session }
+func (c *sessionConn) Emit(event string, _ ...interface{}) { c.emitted = append(c.emitted, event) }
+func (c *sessionConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSocketTicketIsSingleUse(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	fs.on("FROM `users`", fakeRow("id,fuid,status", 1, "u1", 1))
+	fs.on("FROM `devices`", fakeRow("id,user_fuid,device_id,status", 1, "u1", "d1", 1))
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	rdb.Set(ctx, "socket_ticket:t1", fmt.Sprintf(`{"fuid":"u1","device_id":"d1","expires_at":%d}`, expiresAt), time.Minute)
+
+	session, exp, err := authenticateSocket("", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.FUID != "u1" || session.DeviceID != "d1" || exp.Unix() != expiresAt {
+		t.Errorf("session %+v expires %v", session, exp)
+	}
+	if _, _, err := authenticateSocket("", "t1"); err == nil {
+		t.Error("ticket accepted twice")
+	}
+
+	// 票据有效期不超过签发它的访问令牌
+	rdb.Set(ctx, "socket_ticket:t2", fmt.Sprintf(`{"fuid":"u1","device_id":"d1","expires_at":%d}`, time.Now().Add(-time.Second).Unix()), time.Minute)
+	if _, _, err := authenticateSocket("", "t2"); err != errTokenExpired {
+		t.Errorf("expired ticket: %v", err)
+	}
+	// 设备已下线
+	fs.on("FROM `devices`", fakeSQLResult{Columns: []string{"id"}})
+	rdb.Set(ctx, "socket_ticket:t3", fmt.Sprintf(`{"fuid":"u1","device_id":"d1","expires_at":%d}`, expiresAt), time.Minute)
+	if _, _, err := authenticateSocket("", "t3"); err == nil {
+		t.Error("ticket accepted for an offline device")
+	}
+	if _, _, err := authenticateSocket("", ""); err == nil {
+		t.Error("connection accepted without credentials")
+	}
+	if _, _, err := authenticateSocket("not-a-jwt", ""); err == nil {
+		t.Error("malformed token accepted")
+	}
+}
+
+func TestDisconnectDeviceSocketsClosesOnlyThatDevice(t *testing.T) {
+	setupFakeRedis(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	phone := &sessionConn{id: "c1", session: &socketSession{FUID: "u1", DeviceID: "phone"}}
+	desktop := &sessionConn{id: "c2", session: &socketSession{FUID: "u1", DeviceID: "desktop"}}
+	localConns.add("u1", phone)
+	localConns.add("u1", desktop)
+
+	disconnectDeviceSockets("u1", "phone", "device_kicked")
+	if !phone.closed || !reflect.DeepEqual(phone.emitted, []string{"device_kicked"}) {
+		t.Errorf("phone closed=%v emitted=%v", phone.closed, phone.emitted)
+	}
+	if desktop.closed || len(desktop.emitted) != 0 {
+		t.Errorf("desktop closed=%v emitted=%v", desktop.closed, desktop.emitted)
+	}
+}
+
+// 启动WebSocket测试服务并建立连接
+func dialTestWebSocket(t *testing.T, query string) *gorillaWs.Conn {
+	t.Helper()
+	// 升级后的连接不受server.Close管理，结束时须等待处理函数退出，避免其使用已恢复的全局状态
+	var handlers sync.WaitGroup
+	router := gin.New()
+	router.GET("/ws", func(c *gin.Context) {
+		handlers.Add(1)
+		defer handlers.Done()
+		wsHandler(c)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	conn, _, err := gorillaWs.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		handlers.Wait()
+	})
+	return conn
+}
+
+// 发送一帧并读取下一帧
+func wsRoundTrip(t *testing.T, conn *gorillaWs.Conn, frame wsFrame) wsFrame {
+	t.Helper()
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+	return wsReadFrame(t, conn)
+}
+
+func wsReadFrame(t *testing.T, conn *gorillaWs.Conn) wsFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply wsFrame
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestWebSocketRequiresAuthFrame(t *testing.T) {
+	setupFakeRedis(t)
+	setupFakeDB(t)
+	conn := dialTestWebSocket(t, "")
+
+	if reply := wsRoundTrip(t, conn, wsFrame{Type: "ping", ID: "1"}); reply.Type != "pong" || reply.ID != "1" {
+		t.Errorf("ping reply = %+v", reply)
+	}
+	reply := wsRoundTrip(t, conn, wsFrame{Type: "send", ID: "2", Data: json.RawMessage(`{"receiver_type":1,"receiver_id":"u2","content_type":1,"content":"x"}`)})
+	if reply.Type != "error" || reply.ID != "2" || !strings.Contains(string(reply.Data), `"code":401`) {
+		t.Errorf("unauthenticated send reply = %+v (%s)", reply, reply.Data)
+	}
+	reply = wsRoundTrip(t, conn, wsFrame{Type: "auth", ID: "3", Data: json.RawMessage(`{"ticket":"missing"}`)})
+	if reply.Type != "error" || !strings.Contains(string(reply.Data), `"code":401`) {
+		t.Errorf("bad ticket reply = %+v (%s)", reply, reply.Data)
+	}
+}
+
+func TestWebSocketSharesTypingPipeline(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	fs.on("FROM `users`", fakeRow("id,fuid,status", 1, "u1", 1))
+	fs.on("FROM `devices`", fakeRow("id,user_fuid,device_id,status", 1, "u1", "d1", 1))
+	fs.on("FROM `group_members`", fakeRow("id,group_quid,user_fuid,status", 1, "q1", "u1", 1))
+	rdb.Set(context.Background(), "socket_ticket:t1", fmt.Sprintf(`{"fuid":"u1","device_id":"d1","expires_at":%d}`, time.Now().Add(time.Hour).Unix()), time.Minute)
+	conn := dialTestWebSocket(t, "")
+
+	reply := wsRoundTrip(t, conn, wsFrame{Type: "auth", ID: "1", Data: json.RawMessage(`{"ticket":"t1"}`)})
+	if reply.Type != "ack" || !strings.Contains(string(reply.Data), `"fuid":"u1"`) {
+		t.Fatalf("auth reply = %+v (%s)", reply, reply.Data)
+	}
+	// 连接已加入所在群的房间，会收到自己在群内的输入状态推送
+	if err := conn.WriteJSON(wsFrame{Type: "typing", ID: "2", Data: json.RawMessage(`{"receiver_type":2,"receiver_id":"q1"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for i := 0; i < 2; i++ {
+		frame := wsReadFrame(t, conn)
+		events = append(events, frame.Type+":"+frame.Event+frame.ID)
+	}
+	sort.Strings(events)
+	if !reflect.DeepEqual(events, []string{"ack:2", "push:typing"}) {
+		t.Errorf("frames = %v", events)
+	}
+	if reply := wsRoundTrip(t, conn, wsFrame{Type: "bogus", ID: "3"}); reply.Type != "error" || !strings.Contains(string(reply.Data), `"code":400`) {
+		t.Errorf("unknown frame reply = %+v (%s)", reply, reply.Data)
+	}
+}
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	saved := cfg.App.CORS.AllowOrigins
+	t.Cleanup(func() { cfg.App.CORS.AllowOrigins = saved })
+	cfg.App.CORS.AllowOrigins = []string{"https://im.example.com"}
+	for origin, want := range map[string]bool{"": true, "https://im.example.com": true, "https://evil.example.com": false} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := checkWebSocketOrigin(r); got != want {
+			t.Errorf("origin %q allowed = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+type sseTestEvent struct {
+	ID, Event, Data string
+}
+
+// 读取下一个SSE事件（跳过心跳注释）
+func readSSEEvent(t *testing.T, r *bufio.Reader) sseTestEvent {
+	t.Helper()
+	var ev sseTestEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && ev.Event != "":
+			return ev
+		case strings.HasPrefix(line, "id:"):
+			ev.ID = strings.TrimSpace(line[3:])
+		case strings.HasPrefix(line, "event:"):
+			ev.Event = strings.TrimSpace(line[6:])
+		case strings.HasPrefix(line, "data:"):
+			ev.Data = strings.TrimSpace(line[5:])
+		}
+	}
+}
+
+func TestSSECursorDedupAndEviction(t *testing.T) {
+	if parseSSECursor("") != nil || parseSSECursor("not base64!") != nil {
+		t.Error("invalid cursor parsed")
+	}
+	cur := &sseCursor{T: 100, S: map[string]uint64{"group:q1": 7}}
+	if parsed := parseSSECursor(cur.encode()); parsed == nil || parsed.T != 100 || parsed.S["group:q1"] != 7 {
+		t.Fatalf("round trip = %+v", parsed)
+	}
+
+	client := &sseClient{cursor: &sseCursor{T: 1, S: map[string]uint64{}}}
+	if !client.advance("single:u1:u2", 5) || client.advance("single:u1:u2", 5) || client.advance("single:u1:u2", 4) {
+		t.Error("delivered seq not deduplicated")
+	}
+	// 游标只保留最近更新的会话
+	for i := 0; i < sseCursorMaxConvs; i++ {
+		client.advance(fmt.Sprintf("group:q%d", i), 1)
+	}
+	if _, ok := client.cursor.S["single:u1:u2"]; ok || len(client.cursor.S) != sseCursorMaxConvs {
+		t.Errorf("cursor holds %d conversations, oldest kept: %v", len(client.cursor.S), ok)
+	}
+}
+
+func TestSSEStreamResumesFromLastEventID(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	fs.on("FROM `messages`", fakeSQLResult{
+		Columns: []string{"msg_id", "conv_id", "seq", "sender_fuid", "receiver_type", "receiver_id", "content"},
+		Rows: [][]driver.Value{
+			{"m3", "single:u1:u2", 3, "u2", 1, "u1", "seen"},
+			{"m4", "single:u1:u2", 4, "u2", 1, "u1", "missed"},
+		},
+	})
+	router := gin.New()
+	router.GET("/stream", func(c *gin.Context) {
+		setTestIdentity(c, authIdentity{FUID: "u1", ExpiresAt: time.Now().Add(time.Hour)})
+		sseStreamHandler(c)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/stream", nil)
+	since := &sseCursor{T: time.Now().Add(-time.Minute).Unix(), S: map[string]uint64{"single:u1:u2": 3}}
+	req.Header.Set("Last-Event-ID", since.encode())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+
+	if ev := readSSEEvent(t, stream); ev.Event != "connected" || !strings.Contains(ev.Data, `"resumed":true`) {
+		t.Fatalf("first event = %+v", ev)
+	}
+	// 只补发游标之后的消息
+	if ev := readSSEEvent(t, stream); ev.Event != "new_message" || !strings.Contains(ev.Data, `"msg_id":"m4"`) {
+		t.Fatalf("resumed event = %+v", ev)
+	}
+	// 实时推送与补发重叠的消息不重复下发
+	broadcastToRoom("user:u1", "new_message", map[string]interface{}{"msg_id": "m4", "conv_id": "single:u1:u2", "seq": 4})
+	broadcastToRoom("user:u1", "new_message", map[string]interface{}{"msg_id": "m5", "conv_id": "single:u1:u2", "seq": 5})
+	ev := readSSEEvent(t, stream)
+	if ev.Event != "new_message" || !strings.Contains(ev.Data, `"msg_id":"m5"`) {
+		t.Fatalf("live event = %+v", ev)
+	}
+	if cur := parseSSECursor(ev.ID); cur == nil || cur.S["single:u1:u2"] != 5 {
+		t.Errorf("event id cursor = %+v", cur)
+	}
+}
+
+// 随机X25519公钥（base64）
+func testPublicKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestStoreSignedPreKeyVerifiesSignature(t *testing.T) {
+	fs := setupFakeDB(t)
+	signingPub, signingPriv, _ := ed25519.GenerateKey(rand.Reader)
+	publicKey := testPublicKey(t)
+	raw, _ := base64.StdEncoding.DecodeString(publicKey)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(signingPriv, raw))
+
+	if apiErr := storeSignedPreKey("u1", "d1", signingPub, signedPreKeyUpload{KeyID: 1, PublicKey: publicKey, Signature: signature}); apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	// 旧的签名预密钥在同一事务中标记为已轮换
+	if stmts := fs.executed("signed_prekeys|BEGIN|COMMIT"); len(stmts) != 4 || !strings.HasPrefix(stmts[1], "UPDATE `signed_prekeys` SET `status`") || !strings.HasPrefix(stmts[2], "INSERT INTO `signed_prekeys`") {
+		t.Errorf("statements = %v", stmts)
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	for name, spk := range map[string]signedPreKeyUpload{
+		"wrong signer":   {KeyID: 2, PublicKey: publicKey, Signature: signature},
+		"short key":      {KeyID: 2, PublicKey: base64.StdEncoding.EncodeToString(raw[:16]), Signature: signature},
+		"malformed sig":  {KeyID: 2, PublicKey: publicKey, Signature: "bm90IGEgc2lnbmF0dXJl"},
+		"non-base64 key": {KeyID: 2, PublicKey: "***", Signature: signature},
+	} {
+		signer := signingPub
+		if name == "wrong signer" {
+			signer = otherPub
+		}
+		if apiErr := storeSignedPreKey("u1", "d1", signer, spk); apiErr == nil || apiErr.Code != 400 {
+			t.Errorf("%s: apiErr = %v", name, apiErr)
+		}
+	}
+	if n := len(fs.executed("INSERT INTO `signed_prekeys`")); n != 1 {
+		t.Errorf("%d signed prekeys inserted", n)
+	}
+}
+
+func TestPreKeyBundleClaimsOneTimeKey(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	fs.on("FROM `device_identity_keys`", fakeRow("id,user_fuid,device_id,identity_key,signing_key,identity_signature", 1, "u2", "d2", "ik", "sk", "sig"))
+	fs.on("FROM `signed_prekeys`", fakeRow("id,user_fuid,device_id,key_id,public_key,signature,status", 1, "u2", "d2", 3, "spk", "spksig", 1))
+	fs.on("FROM `one_time_prekeys`", fakeRow("id,user_fuid,device_id,key_id,public_key", 9, "u2", "d2", 7, "otpk"))
+
+	res := callHandler(t, getPreKeyBundleHandler, "GET", "/keys/bundle/u2", nil, authIdentity{FUID: "u1"}, gin.Param{Key: "fuid", Value: "u2"})
+	if res.Code != 403 {
+		t.Fatalf("stranger: code %d", res.Code)
+	}
+
+	fs.on("SELECT count\\(\\*\\) FROM `friends`", fakeRow("count", 1))
+	res = callHandler(t, getPreKeyBundleHandler, "GET", "/keys/bundle/u2", nil, authIdentity{FUID: "u1"}, gin.Param{Key: "fuid", Value: "u2"})
+	devices, _ := responseData(t, res)["devices"].([]interface{})
+	if len(devices) != 1 {
+		t.Fatalf("devices = %v", responseData(t, res)["devices"])
+	}
+	bundle := devices[0].(map[string]interface{})
+	otpk, _ := bundle["one_time_prekey"].(map[string]interface{})
+	if bundle["identity_key"] != "ik" || otpk["key_id"].(float64) != 7 {
+		t.Errorf("bundle = %v", bundle)
+	}
+	// 一次性预密钥领取后删除，剩余不足时提醒设备补充
+	if len(fs.executed("^DELETE FROM `one_time_prekeys` WHERE `one_time_prekeys`.`id` = \\? \\|9$")) != 1 {
+		t.Errorf("claimed key not deleted: %v", fs.executed("one_time_prekeys"))
+	}
+	if cm := waitForClusterEvent(t, fr, "user:u2", "prekey_low"); string(cm.Data) != `{"device_id":"d2","remaining":0}` {
+		t.Errorf("prekey_low = %s", cm.Data)
+	}
+
+	rdb.Set(context.Background(), "prekey_fetch:u1:u2", 20, time.Minute)
+	res = callHandler(t, getPreKeyBundleHandler, "GET", "/keys/bundle/u2", nil, authIdentity{FUID: "u1"}, gin.Param{Key: "fuid", Value: "u2"})
+	if res.Code != 429 {
+		t.Errorf("over the fetch limit: code %d", res.Code)
+	}
+}
+
+func TestStoreOneTimePreKeysRejectsMissingAndDuplicateIDs(t *testing.T) {
+	fs := setupFakeDB(t)
+	pub := make([]byte, 32)
+	pub[0] = 9
+	key := base64.StdEncoding.EncodeToString(pub)
+	cases := []struct {
+		name string
+		keys []oneTimePreKeyUpload
+		ok   bool
+	}{
+		{"distinct ids", []oneTimePreKeyUpload{{KeyID: 1, PublicKey: key}, {KeyID: 2, PublicKey: key}}, true},
+		{"missing id", []oneTimePreKeyUpload{{KeyID: 1, PublicKey: key}, {PublicKey: key}}, false},
+		{"duplicate id", []oneTimePreKeyUpload{{KeyID: 3, PublicKey: key}, {KeyID: 4, PublicKey: key}, {KeyID: 3, PublicKey: key}}, false},
+	}
+	for _, tc := range cases {
+		before := len(fs.executed("INSERT INTO `one_time_prekeys`"))
+		_, apiErr := storeOneTimePreKeys("u1", "d1", tc.keys)
+		if (apiErr == nil) != tc.ok {
+			t.Errorf("%s: apiErr = %v", tc.name, apiErr)
+		}
+		if inserted := len(fs.executed("INSERT INTO `one_time_prekeys`")) > before; inserted != tc.ok {
+			t.Errorf("%s: inserted = %v", tc.name, inserted)
+		}
+		if !tc.ok && apiErr != nil && apiErr.Code != 400 {
+			t.Errorf("%s: code %d, want 400", tc.name, apiErr.Code)
+		}
+	}
+
+	// 请求绑定同样拒绝缺少key_id的一次性预密钥
+	var req struct {
+		OneTimePreKeys []oneTimePreKeyUpload `json:"one_time_prekeys" binding:"max=100,dive"`
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/keys/prekeys", strings.NewReader(`{"one_time_prekeys":[{"public_key":"`+key+`"}]}`))
+	if err := c.ShouldBindJSON(&req); err == nil {
+		t.Error("binding accepted a one-time prekey without key_id")
+	}
+}
+
+func TestDistributeSenderKeyChecksEpochAndRecipients(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	fs.on("SELECT count\\(\\*\\) FROM `group_members`", fakeRow("count", 1))
+	fs.on("FROM `groups`", fakeRow("id,quid,status,key_epoch", 1, "q1", 1, 3))
+	fs.on("FROM device_identity_keys AS k", fakeSQLResult{
+		Columns: []string{"user_fuid", "device_id"},
+		Rows:    [][]driver.Value{{"u1", "d1"}, {"u2", "d2"}},
+	})
+	sender := authIdentity{FUID: "u1", DeviceID: "d1"}
+	distribute := func(epoch int, recipients ...string) Response {
+		var list []map[string]string
+		for _, r := range recipients {
+			parts := strings.Split(r, "/")
+			list = append(list, map[string]string{"recipient_fuid": parts[0], "recipient_device_id": parts[1], "payload": "sealed"})
+		}
+		body := map[string]interface{}{"group_quid": "q1", "epoch": epoch, "distributions": list}
+		return callHandler(t, distributeSenderKeyHandler, "POST", "/group/keys/distribute", body, sender)
+	}
+
+	// 版本已变更时返回当前版本，客户端重新生成
+	res := distribute(2, "u2/d2")
+	if res.Code != 409 || responseData(t, res)["epoch"].(float64) != 3 {
+		t.Fatalf("stale epoch: code %d data %v", res.Code, res.Data)
+	}
+	if res := distribute(3, "u3/d3"); res.Code != 400 {
+		t.Errorf("non-member device: code %d", res.Code)
+	}
+	if len(fs.executed("INSERT INTO `sender_key_distributions`")) != 0 {
+		t.Fatal("rejected distribution stored")
+	}
+	// 发给自己当前设备的记录被跳过
+	res = distribute(3, "u2/d2", "u1/d1")
+	if res.Code != 200 || res.Count != 1 {
+		t.Fatalf("distribute: code %d count %d (%s)", res.Code, res.Count, res.Msg)
+	}
+	inserts := fs.executed("INSERT INTO `sender_key_distributions`")
+	if len(inserts) != 1 || !strings.Contains(inserts[0], "|q1 |3 |u1 |d1 |u2 |d2 |sealed") {
+		t.Errorf("inserts = %v", inserts)
+	}
+	// 通知接收方拉取
+	if cm := waitForClusterEvent(t, fr, "user:u2", "sender_key_distribution"); !strings.Contains(string(cm.Data), `"sender_device_id":"d1"`) {
+		t.Errorf("notification = %s", cm.Data)
+	}
+}
+
+func TestRotateGroupSenderKeyBumpsEpoch(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	fs.on("FROM `groups`", fakeRow("key_epoch", 4))
+
+	rotateGroupSenderKey("q1", "member_quit")
+	if len(fs.executed("^UPDATE `groups` SET `key_epoch`=key_epoch \\+ 1,.* \\|q1$")) != 1 {
+		t.Errorf("epoch not incremented: %v", fs.executed("groups"))
+	}
+	if cm := waitForClusterEvent(t, fr, "group:q1", "group_key_rotate"); string(cm.Data) != `{"epoch":4,"group_quid":"q1","reason":"member_quit"}` {
+		t.Errorf("rotate event = %s", cm.Data)
+	}
+}
+
+// 生成测试用的服务端RSA与X25519密钥
+func setupEnvelopeKeys(t *testing.T) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivateKey, rsaPublicKey, x25519PrivateKey = rsaKey, &rsaKey.PublicKey, x25519Key
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	setupEnvelopeKeys(t)
+	cases := []struct {
+		name    string
+		version byte
+		plain   string
+	}{
+		{"v1", envelopeV1, "你好，世界"},
+		{"v2", envelopeV2, "你好，世界"},
+		{"v1 empty", envelopeV1, ""},
+		{"v2 long", envelopeV2, string(make([]byte, 4096))},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sealed, err := sealEnvelope(tc.version, []byte(tc.plain), "msg0001", "single:a:b")
+			if err != nil {
+				t.Fatalf("seal: %v", err)
+			}
+			if !isVersionedEnvelope(sealed) {
+				t.Fatalf("sealed content not recognised as envelope")
+			}
+			plain, version, err := openEnvelope(sealed, "msg0001", "single:a:b")
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if version != tc.version || string(plain) != tc.plain {
+				t.Fatalf("got version %d plain %q, want %d %q", version, plain, tc.version, tc.plain)
+			}
+		})
+	}
+}
+
+func TestEnvelopeRejectsTamperAndMismatch(t *testing.T) {
+	setupEnvelopeKeys(t)
+	for _, version := range []byte{envelopeV1, envelopeV2} {
+		sealed, err := sealEnvelope(version, []byte("secret"), "msg0001", "group:q1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := base64.StdEncoding.DecodeString(sealed)
+		tampered := append([]byte{}, raw...)
+		tampered[len(tampered)-1] ^= 0x01
+		cases := []struct {
+			name    string
+			content string
+			msgID   string
+			convID  string
+		}{
+			{"tampered ciphertext", base64.StdEncoding.EncodeToString(tampered), "msg0001", "group:q1"},
+			{"msg_id mismatch", sealed, "msg0002", "group:q1"},
+			{"conv_id mismatch", sealed, "msg0001", "group:q2"},
+			{"truncated", base64.StdEncoding.EncodeToString(raw[:20]), "msg0001", "group:q1"},
+			{"not base64", "!!!", "msg0001", "group:q1"},
+		}
+		for _, tc := range cases {
+			if _, _, err := openEnvelope(tc.content, tc.msgID, tc.convID); err == nil {
+				t.Errorf("v%d %s: expected error", version, tc.name)
+			}
+		}
+	}
+}
+
+func TestEnvelopeLegacyRSA(t *testing.T) {
+	setupEnvelopeKeys(t)
+	cipherText, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublicKey, []byte("legacy"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(cipherText)
+	if isVersionedEnvelope(encoded) {
+		t.Fatal("legacy content recognised as envelope")
+	}
+	plain, version, err := openEnvelope(encoded, "any", "any")
+	if err != nil || version != 0 || string(plain) != "legacy" {
+		t.Fatalf("got %q version %d err %v", plain, version, err)
+	}
+}
+
+func TestKeyringRotationAndOldKeys(t *testing.T) {
+	kr, err := loadKeyring(filepath.Join(t.TempDir(), "keyring.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStored, oldKeyID, err := kr.Seal([]byte("旧密钥内容"), []byte("messages|m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeyID, err := kr.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKeyID == oldKeyID || kr.ActiveKeyID() != newKeyID {
+		t.Fatalf("active key %s after rotate, old %s, new %s", kr.ActiveKeyID(), oldKeyID, newKeyID)
+	}
+	newStored, keyID, err := kr.Seal([]byte("新密钥内容"), []byte("messages|m2"))
+	if err != nil || keyID != newKeyID {
+		t.Fatalf("seal after rotate: key %s err %v", keyID, err)
+	}
+	// 重新加载文件后旧密钥仍可解密
+	reloaded, err := loadKeyring(kr.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		stored string
+		keyID  string
+		ad     string
+		want   string
+	}{
+		{"old key", oldStored, oldKeyID, "messages|m1", "旧密钥内容"},
+		{"new key", newStored, newKeyID, "messages|m2", "新密钥内容"},
+	}
+	for _, tc := range cases {
+		plain, err := reloaded.Open(tc.stored, tc.keyID, []byte(tc.ad))
+		if err != nil || string(plain) != tc.want {
+			t.Errorf("%s: got %q err %v", tc.name, plain, err)
+		}
+	}
+}
+
+func TestKeyringRejectsWrongADOrKey(t *testing.T) {
+	kr, err := loadKeyring(filepath.Join(t.TempDir(), "keyring.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, keyID, err := kr.Seal([]byte("内容"), []byte("messages|m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		stored string
+		keyID  string
+		ad     string
+	}{
+		{"ad mismatch", stored, keyID, "messages|m2"},
+		{"unknown key id", stored, "k-missing", "messages|m1"},
+		{"missing prefix", stored[len(atRestPrefix):], keyID, "messages|m1"},
+	}
+	for _, tc := range cases {
+		if _, err := kr.Open(tc.stored, tc.keyID, []byte(tc.ad)); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestGroupNoticeADBindsRow(t *testing.T) {
+	kr, err := loadKeyring(filepath.Join(t.TempDir(), "keyring.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	atRestCipher = kr
+	defer func() { atRestCipher = nil }()
+	first := &GroupNotice{NoticeID: "n1", GroupQUID: "q1", Content: "第一条"}
+	second := &GroupNotice{NoticeID: "n2", GroupQUID: "q1", Content: "第二条"}
+	for _, notice := range []*GroupNotice{first, second} {
+		if err := notice.BeforeCreate(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 同群公告互换密文后解密失败
+	if _, err := openAtRest(second.Content, second.ContentKeyID, first.atRestAD()); err == nil {
+		t.Fatal("ciphertext moved between notices of the same group still decrypts")
+	}
+	plain, err := openAtRest(first.Content, first.ContentKeyID, first.atRestAD())
+	if err != nil || plain != "第一条" {
+		t.Fatalf("got %q err %v", plain, err)
+	}
+	if err := (&GroupNotice{GroupQUID: "q1", Content: "x"}).BeforeCreate(nil); err == nil {
+		t.Fatal("notice without notice_id sealed")
+	}
+}
+
+// 使用临时Ed25519签名密钥，测试结束时恢复
+func setupTestJWTKeys(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key := &jwtKey{kid: "test", method: jwt.SigningMethodEdDSA, signer: priv, public: pub}
+	saved := jwtKeys
+	t.Cleanup(func() { jwtKeys = saved })
+	jwtKeys = &jwtKeySet{active: key, keys: map[string]*jwtKey{"test": key}}
+}
+
+func TestJWTKeyRotationKeepsOldTokensValid(t *testing.T) {
+	saved := jwtKeys
+	t.Cleanup(func() { jwtKeys = saved })
+	ks := &jwtKeySet{dir: t.TempDir()}
+	oldKID, err := ks.generate("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.reload(); err != nil {
+		t.Fatal(err)
+	}
+	jwtKeys = ks
+	token, err := signJWT(jwt.RegisteredClaims{Subject: "access_token", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 新密钥生成后自动成为签名密钥，旧令牌仍可验证
+	newKID, err := ks.generate("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(ks.dir, newKID+".pem"), time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if err := ks.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ks.activeKey().kid != newKID {
+		t.Fatalf("active kid = %s, want %s", ks.activeKey().kid, newKID)
+	}
+	if err := ks.retire(newKID); err == nil {
+		t.Error("retired the active key")
+	}
+	if err := ks.retire(oldKID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := ks.lookup(oldKID); !ok || key.signer != nil {
+		t.Fatalf("retired key = %+v, %v", key, ok)
+	}
+	if _, err := jwt.Parse(token, jwtKeyFunc); err != nil {
+		t.Errorf("token signed by the retired key: %v", err)
+	}
+}
+
+func TestJWTKeyFuncRejectsUnknownKeys(t *testing.T) {
+	setupTestJWTKeys(t)
+	savedJWT := cfg.Crypto.JWT
+	t.Cleanup(func() { cfg.Crypto.JWT = savedJWT })
+	cfg.Crypto.JWT.Secret = "legacy-secret"
+	claims := jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("legacy-secret"))
+	if _, err := jwt.Parse(legacy, jwtKeyFunc); err == nil {
+		t.Error("HS256 token accepted without accept_legacy_hs256")
+	}
+	cfg.Crypto.JWT.AcceptLegacyHS256 = true
+	if _, err := jwt.Parse(legacy, jwtKeyFunc); err != nil {
+		t.Errorf("legacy HS256 token: %v", err)
+	}
+
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	unknown := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	unknown.Header["kid"] = "missing"
+	signed, _ := unknown.SignedString(otherPriv)
+	if _, err := jwt.Parse(signed, jwtKeyFunc); err == nil {
+		t.Error("token with an unknown kid accepted")
+	}
+	// 伪造kid为已知密钥，但签名密钥不同
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	forged.Header["kid"] = "test"
+	signed, _ = forged.SignedString(otherPriv)
+	if _, err := jwt.Parse(signed, jwtKeyFunc); err == nil {
+		t.Error("token signed by another key accepted")
+	}
+}
+
+func TestJWKSHandlerPublishesPublicKeys(t *testing.T) {
+	setupTestJWTKeys(t)
+	rsaPriv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwtKeys.keys["old-rsa"] = &jwtKey{kid: "old-rsa", method: jwt.SigningMethodRS256, public: &rsaPriv.PublicKey}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	jwksHandler(c)
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("keys = %v", jwks.Keys)
+	}
+	rsaJWK, edJWK := jwks.Keys[0], jwks.Keys[1]
+	if rsaJWK["kid"] != "old-rsa" || rsaJWK["kty"] != "RSA" || rsaJWK["alg"] != "RS256" || rsaJWK["e"] != "AQAB" {
+		t.Errorf("rsa jwk = %v", rsaJWK)
+	}
+	pub := jwtKeys.active.public.(ed25519.PublicKey)
+	if edJWK["kid"] != "test" || edJWK["crv"] != "Ed25519" || edJWK["x"] != base64.RawURLEncoding.EncodeToString(pub) {
+		t.Errorf("ed25519 jwk = %v", edJWK)
+	}
+	if _, leaked := edJWK["d"]; leaked {
+		t.Error("private key published")
+	}
+}
+
+func TestIssueRefreshTokenStoresOnlyHash(t *testing.T) {
+	fs := setupFakeDB(t)
+	token, err := issueRefreshToken(dbRefreshTokens, "u1", "d1", "f1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserts := fs.executed("^INSERT INTO `refresh_tokens`")
+	if len(inserts) != 1 || !strings.Contains(inserts[0], "|"+hashRefreshToken(token)+" |f1 |u1 |d1 |1 ") {
+		t.Fatalf("inserts = %v", inserts)
+	}
+	if strings.Contains(inserts[0], token) {
+		t.Error("raw refresh token stored")
+	}
+}
+
+// 刷新令牌测试数据：有效设备和用户，令牌记录由调用方设置
+func stubRefreshSession(fs *fakeSQL, status int, rotatedAt interface{}) {
+	fs.on("FROM `refresh_tokens`", fakeRow("id,token_hash,family_id,user_fuid,device_id,status,expires_at,rotated_at",
+		5, hashRefreshToken("old-token"), "f1", "u1", "d1", status, time.Now().Add(time.Hour), rotatedAt))
+	fs.on("FROM `devices`", fakeRow("id,user_fuid,device_id,status", 1, "u1", "d1", 1))
+	fs.on("FROM `users`", fakeRow("id,fuid,username,status", 1, "u1", "alice", 1))
+}
+
+func TestRefreshTokenHandlerRotates(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupTestJWTKeys(t)
+	stubRefreshSession(fs, 1, nil)
+
+	res := callHandler(t, refreshTokenHandler, "POST", "/token/refresh", map[string]string{"refresh_token": "old-token"}, authIdentity{})
+	data := responseData(t, res)
+	next, _ := data["refresh_token"].(string)
+	if next == "" || next == "old-token" || data["access_token"] == "" {
+		t.Fatalf("refresh response = %v", data)
+	}
+	if len(fs.executed("^UPDATE `refresh_tokens` SET .*`status`=.*WHERE id = \\? AND status = 1")) != 1 {
+		t.Errorf("old token not marked rotated: %v", fs.executed("refresh_tokens"))
+	}
+	if inserts := fs.executed("^INSERT INTO `refresh_tokens`"); len(inserts) != 1 || !strings.Contains(inserts[0], hashRefreshToken(next)+" |f1 |u1 |d1 ") {
+		t.Errorf("next token not issued in the same family: %v", inserts)
+	}
+	if len(fs.executed("UPDATE `devices` SET .*`status`")) != 0 {
+		t.Error("device revoked on a normal rotation")
+	}
+}
+
+func TestRefreshTokenReuseRevokesDevice(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupTestJWTKeys(t)
+	// 已轮换的令牌再次使用
+	stubRefreshSession(fs, 2, time.Now().Add(-time.Hour))
+	res := callHandler(t, refreshTokenHandler, "POST", "/token/refresh", map[string]string{"refresh_token": "old-token"}, authIdentity{})
+	if res.Code != 401 {
+		t.Fatalf("reused token: code %d", res.Code)
+	}
+	if len(fs.executed("^UPDATE `devices` SET .*`status`=.* \\|0 .*\\|u1 \\|d1$")) != 1 {
+		t.Errorf("device not revoked: %v", fs.executed("devices"))
+	}
+	if len(fs.executed("^UPDATE `refresh_tokens` SET `status`=.*WHERE family_id = .* \\|3 \\|f1 ")) == 0 {
+		t.Errorf("token family not revoked: %v", fs.executed("refresh_tokens"))
+	}
+	if len(fs.executed("^INSERT INTO `refresh_tokens`")) != 0 {
+		t.Error("new token issued for a reused token")
+	}
+
+	// 并发请求中另一方已完成轮换
+	fs = setupFakeDB(t)
+	stubRefreshSession(fs, 1, nil)
+	fs.on("^UPDATE `refresh_tokens` SET .*WHERE id = \\? AND status = 1", fakeSQLResult{Affected: 0})
+	res = callHandler(t, refreshTokenHandler, "POST", "/token/refresh", map[string]string{"refresh_token": "old-token"}, authIdentity{})
+	if res.Code != 401 || len(fs.executed("^UPDATE `devices` SET .*`status`")) != 1 {
+		t.Errorf("lost rotation race: code %d, device updates %v", res.Code, fs.executed("^UPDATE `devices`"))
+	}
+}
+
+// 内存刷新令牌存储（测试用）
+type memRefreshTokenStore struct {
+	tokens []*RefreshToken
+}
+
+func (m *memRefreshTokenStore) FindByHash(hash string) (*RefreshToken, error) {
+	for _, t := range m.tokens {
+		if t.TokenHash == hash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (m *memRefreshTokenStore) Create(token *RefreshToken) error {
+	token.ID = uint64(len(m.tokens) + 1)
+	m.tokens = append(m.tokens, token)
+	return nil
+}
+
+func (m *memRefreshTokenStore) Rotate(oldID uint64, next *RefreshToken, now time.Time) error {
+	old := m.tokens[oldID-1]
+	if old.Status != 1 {
+		return errRefreshTokenRaced
+	}
+	old.Status, old.RotatedAt = 2, &now
+	return m.Create(next)
+}
+
+func (m *memRefreshTokenStore) RevokeFamily(familyID string) error {
+	for _, t := range m.tokens {
+		if t.FamilyID == familyID && t.Status != 3 {
+			t.Status = 3
+		}
+	}
+	return nil
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	cfg.Crypto.JWT.RefreshExpire = 3600
+	store := &memRefreshTokenStore{}
+	now := time.Now()
+	first, err := issueRefreshToken(store, "u1", "d1", "f1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := checkRefreshToken(store, first, now)
+	if err != nil {
+		t.Fatalf("check first: %v", err)
+	}
+	second, err := rotateRefreshToken(store, stored, now)
+	if err != nil || second == first {
+		t.Fatalf("rotate: %q err %v", second, err)
+	}
+	if store.tokens[0].Status != 2 || store.tokens[0].RotatedAt == nil {
+		t.Fatalf("old token status %d after rotation", store.tokens[0].Status)
+	}
+	next, err := checkRefreshToken(store, second, now)
+	if err != nil || next.FamilyID != "f1" || next.DeviceID != "d1" {
+		t.Fatalf("check second: %+v err %v", next, err)
+	}
+	if store.tokens[1].TokenHash == second {
+		t.Fatal("token stored in plaintext")
+	}
+	if _, err := checkRefreshToken(store, "unknown", now); !errors.Is(err, errRefreshTokenInvalid) {
+		t.Fatalf("unknown token: %v", err)
+	}
+	if _, err := checkRefreshToken(store, second, now.Add(2*time.Hour)); !errors.Is(err, errRefreshTokenExpired) {
+		t.Fatalf("expired token: %v", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	cfg.Crypto.JWT.RefreshExpire = 3600
+	now := time.Now()
+	cases := []struct {
+		name  string
+		reuse func(store *memRefreshTokenStore, first string, stale *RefreshToken) error
+	}{
+		{"rotated token presented after the grace period", func(store *memRefreshTokenStore, first string, stale *RefreshToken) error {
+			_, err := checkRefreshToken(store, first, now.Add(refreshGracePeriod()+time.Second))
+			return err
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &memRefreshTokenStore{}
+			first, _ := issueRefreshToken(store, "u1", "d1", "f1", now)
+			other, _ := issueRefreshToken(store, "u1", "d2", "f2", now)
+			stale, _ := checkRefreshToken(store, first, now)
+			second, err := rotateRefreshToken(store, stale, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.reuse(store, first, stale); !errors.Is(err, errRefreshTokenReused) {
+				t.Fatalf("expected reuse error, got %v", err)
+			}
+			for _, tok := range store.tokens {
+				if tok.FamilyID == "f1" && tok.Status != 3 {
+					t.Errorf("token %d of reused family has status %d", tok.ID, tok.Status)
+				}
+			}
+			if _, err := checkRefreshToken(store, second, now); !errors.Is(err, errRefreshTokenExpired) {
+				t.Errorf("latest token of revoked family still valid: %v", err)
+			}
+			if _, err := checkRefreshToken(store, other, now); err != nil {
+				t.Errorf("other family affected: %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenGraceWindow(t *testing.T) {
+	cfg.Crypto.JWT.RefreshExpire = 3600
+	now := time.Now()
+	store := &memRefreshTokenStore{}
+	first, _ := issueRefreshToken(store, "u1", "d1", "f1", now)
+	stale, _ := checkRefreshToken(store, first, now)
+	if _, err := rotateRefreshToken(store, stale, now); err != nil {
+		t.Fatal(err)
+	}
+	// 并发轮换与宽限期内再次提交都不吊销令牌族
+	if _, err := rotateRefreshToken(store, stale, now); !errors.Is(err, errRefreshTokenRotated) {
+		t.Errorf("concurrent rotation: %v", err)
+	}
+	if _, err := checkRefreshToken(store, first, now.Add(refreshGracePeriod()-time.Second)); !errors.Is(err, errRefreshTokenRotated) {
+		t.Errorf("within grace period: %v", err)
+	}
+	for _, tok := range store.tokens {
+		if tok.Status == 3 {
+			t.Errorf("token %d revoked within the grace period", tok.ID)
+		}
+	}
+}
+
+func TestRefreshHandlerReturnsSamePairWithinGrace(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupTestJWTKeys(t)
+	cfg.Crypto.JWT.RefreshExpire = 3600
+	store := &memRefreshTokenStore{}
+	saved := dbRefreshTokens
+	t.Cleanup(func() { dbRefreshTokens = saved })
+	dbRefreshTokens = store
+	fs.on("FROM `devices`", fakeRow("user_fuid,device_id,status", "u1", "d1", 1))
+	fs.on("FROM `users`", fakeRow("fuid,username,status", "u1", "alice", 1))
+
+	now := time.Now()
+	first, _ := issueRefreshToken(store, "u1", "d1", "f1", now)
+	refresh := func(token string) Response {
+		return callHandler(t, refreshTokenHandler, "POST", "/token/refresh", map[string]string{"refresh_token": token}, authIdentity{})
+	}
+	a := refresh(first)
+	b := refresh(first) // 如另一个标签页同时刷新
+	if a.Code != 200 || b.Code != 200 {
+		t.Fatalf("codes %d %d (%s)", a.Code, b.Code, b.Msg)
+	}
+	pairA, pairB := responseData(t, a), responseData(t, b)
+	if pairA["refresh_token"] != pairB["refresh_token"] || pairA["access_token"] != pairB["access_token"] {
+		t.Error("second refresh within grace returned a different pair")
+	}
+	if len(fs.executed("UPDATE `devices` SET .*status")) != 0 {
+		t.Error("device session revoked within the grace period")
+	}
+	// 新令牌照常可用
+	if c := refresh(pairA["refresh_token"].(string)); c.Code != 200 {
+		t.Errorf("rotated token: code %d", c.Code)
+	}
+
+	// 宽限期结束后再次使用旧令牌按重用处理
+	rdb.Del(context.Background(), "refresh_grace:"+hashRefreshToken(first))
+	rotatedAt := time.Now().Add(-refreshGracePeriod() - time.Second)
+	store.tokens[0].RotatedAt = &rotatedAt
+	if res := refresh(first); res.Code != 401 {
+		t.Errorf("reuse after grace: code %d", res.Code)
+	}
+	for _, tok := range store.tokens {
+		if tok.Status != 3 {
+			t.Errorf("token %d not revoked after reuse", tok.ID)
+		}
+	}
+}
+
+func TestAccessTokenDenylist(t *testing.T) {
+	setupFakeRedis(t)
+	setupTestJWTKeys(t)
+	savedJWT := cfg.Crypto.JWT
+	t.Cleanup(func() { cfg.Crypto.JWT = savedJWT })
+	cfg.Crypto.JWT.Expire = 900
+	issue := func(deviceID string) *CustomClaims {
+		token, _, err := generateAccessToken("u1", "alice", "Alice", deviceID, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := parseAccessToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.ID == "" {
+			t.Fatal("access token without jti")
+		}
+		return claims
+	}
+
+	// 吊销单个令牌，有效期内保留吊销记录
+	first, second := issue("d1"), issue("d1")
+	if err := revokeAccessToken(first.ID, first.ExpiresAt.Time); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := isAccessTokenRevoked(first); !revoked {
+		t.Error("revoked token still accepted")
+	}
+	if ttl, _ := rdb.TTL(context.Background(), denylistJTIKey(first.ID)).Result(); ttl <= 0 || ttl > 900*time.Second {
+		t.Errorf("jti denylist ttl = %v", ttl)
+	}
+	if revoked, _ := isAccessTokenRevoked(second); revoked {
+		t.Error("another token of the device revoked")
+	}
+
+	// 吊销设备的全部访问令牌
+	other := issue("d2")
+	if err := revokeDeviceAccessTokens("u1", "d1", "device_kicked"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := isAccessTokenRevoked(second); !revoked {
+		t.Error("device token still accepted after device revocation")
+	}
+	if revoked, _ := isAccessTokenRevoked(other); revoked {
+		t.Error("other device revoked")
+	}
+}
+
+func TestLogoutRevokesTokenAndSession(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	expiresAt := time.Now().Add(10 * time.Minute)
+	res := callHandler(t, logoutHandler, "POST", "/auth/logout", nil, authIdentity{FUID: "u1", DeviceID: "d1", JTI: "j1", ExpiresAt: expiresAt})
+	if res.Code != 200 {
+		t.Fatalf("logout: code %d (%s)", res.Code, res.Msg)
+	}
+	ctx := context.Background()
+	if n, _ := rdb.Exists(ctx, denylistJTIKey("j1"), denylistDeviceKey("u1", "d1")).Result(); n != 2 {
+		t.Errorf("denylist entries = %d, want 2", n)
+	}
+	if len(fs.executed("^UPDATE `devices` SET .*`status`=.* \\|0 .*\\|u1 \\|d1$")) != 1 {
+		t.Errorf("device session not revoked: %v", fs.executed("devices"))
+	}
+}
+
+func TestAuthPolicyAllows(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy authPolicy
+		id     authIdentity
+		want   bool
+	}{
+		{"empty policy", authPolicy{}, authIdentity{}, true},
+		{"default policy with im scope", defaultAuthPolicy, authIdentity{Scopes: []string{scopeIM}}, true},
+		{"default policy without scope", defaultAuthPolicy, authIdentity{}, false},
+		{"all scopes required", authPolicy{Scopes: []string{"a", "b"}}, authIdentity{Scopes: []string{"a"}}, false},
+		{"all scopes present", authPolicy{Scopes: []string{"a", "b"}}, authIdentity{Scopes: []string{"b", "a"}}, true},
+		{"any role suffices", authPolicy{Roles: []string{"admin", "moderator"}}, authIdentity{Role: "moderator"}, true},
+		{"role missing", authPolicy{Roles: []string{"admin"}}, authIdentity{Role: "support"}, false},
+		{"no role", authPolicy{Roles: []string{"admin"}}, authIdentity{}, false},
+		{"scope and role", authPolicy{Scopes: []string{scopeIM}, Roles: []string{"admin"}}, authIdentity{Scopes: []string{scopeIM}, Role: "admin"}, true},
+		{"role without scope", authPolicy{Scopes: []string{scopeIM}, Roles: []string{"admin"}}, authIdentity{Role: "admin"}, false},
+	}
+	for _, tc := range cases {
+		if got := tc.policy.allows(tc.id); got != tc.want {
+			t.Errorf("%s: allows = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAuthMiddlewareRejectsMissingScopeOrRole(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupTestJWTKeys(t)
+	fs.on("FROM `users`", fakeRow("fuid,username,status,role", "u1", "alice", 1, ""))
+	fs.on("FROM `devices`", fakeRow("user_fuid,device_id,status", "u1", "d1", 1))
+
+	sign := func(scope string) string {
+		now := time.Now()
+		token, err := signJWT(CustomClaims{
+			FUID: "u1", DeviceID: "d1", Scope: scope,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer: cfg.App.Name, Subject: "access_token", ID: scope + "-jti",
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)), IssuedAt: jwt.NewNumericDate(now),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	request := func(token string, policies ...authPolicy) Response {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+		authMiddleware(policies...)(c)
+		if !c.IsAborted() {
+			success(c, currentIdentity(c).FUID)
+		}
+		var res Response
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	if res := request(sign("")); res.Code != 200 || res.Data != "u1" {
+		t.Errorf("token without scope claim: code %d", res.Code)
+	}
+	if res := request(sign("other")); res.Code != 403 {
+		t.Errorf("token missing im scope: code %d, want 403", res.Code)
+	}
+	if res := request(sign("im"), authPolicy{Scopes: []string{scopeIM, "admin"}}); res.Code != 403 {
+		t.Errorf("token missing extra scope: code %d, want 403", res.Code)
+	}
+	if res := request(sign("im"), defaultAuthPolicy, authPolicy{Roles: []string{"admin"}}); res.Code != 403 {
+		t.Errorf("user without admin role: code %d, want 403", res.Code)
+	}
+	fs.on("FROM `users`", fakeRow("fuid,username,status,role", "u1", "alice", 1, "admin"))
+	if res := request(sign("im"), defaultAuthPolicy, authPolicy{Roles: []string{"admin"}}); res.Code != 200 {
+		t.Errorf("admin: code %d (%s)", res.Code, res.Msg)
+	}
+	if res := request("not-a-token"); res.Code != 401 {
+		t.Errorf("malformed token: code %d, want 401", res.Code)
+	}
+}
+
+func TestGroupUserLimiterCapsBody(t *testing.T) {
+	limiters := initRateLimiters()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body := `{"receiver_type":2,"receiver_id":"q1","content":"` + strings.Repeat("a", 8<<10) + `"}`
+	c.Request = httptest.NewRequest("POST", "/message/send", strings.NewReader(body))
+	c.Set(identityContextKey, authIdentity{FUID: "u1"})
+	limiters["group_user"](c)
+	var res Response
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if !c.IsAborted() || res.Code != 413 {
+		t.Errorf("oversized body: aborted %v code %d", c.IsAborted(), res.Code)
+	}
+}
+
+// RFC 6238 附录B的SHA-1测试向量（取8位结果的后6位）
+func TestTOTPRFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range cases {
+		if got := totpCode(secret, tc.unix/totpPeriod); got != tc.code {
+			t.Errorf("t=%d: got %s, want %s", tc.unix, got, tc.code)
+		}
+		step, ok := matchTOTP(secretBase32, tc.code, 0, time.Unix(tc.unix, 0))
+		if !ok || step != tc.unix/totpPeriod {
+			t.Errorf("t=%d: matchTOTP step %d ok %v", tc.unix, step, ok)
+		}
+	}
+}
+
+func TestTOTPSkewAndReplay(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	cases := []struct {
+		name     string
+		step     int64
+		lastStep int64
+		ok       bool
+	}{
+		{"current step", current, 0, true},
+		{"previous step within skew", current - 1, 0, true},
+		{"next step within skew", current + 1, 0, true},
+		{"two steps behind", current - 2, 0, false},
+		{"two steps ahead", current + 2, 0, false},
+		{"replay of used step", current, current, false},
+		{"earlier step after newer use", current - 1, current, false},
+		{"later step after earlier use", current + 1, current, true},
+	}
+	for _, tc := range cases {
+		step, ok := matchTOTP(secretBase32, totpCode(secret, tc.step), tc.lastStep, now)
+		if ok != tc.ok || (ok && step != tc.step) {
+			t.Errorf("%s: got step %d ok %v", tc.name, step, ok)
+		}
+	}
+	if _, ok := matchTOTP(secretBase32, "12345", 0, now); ok {
+		t.Error("short code accepted")
+	}
+	if _, ok := matchTOTP("not base32!", totpCode(secret, current), 0, now); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestMFAAttemptsExpireWithDefaultTokenLifetime(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	saved := cfg.Crypto.TOTP.LoginTokenExpire
+	t.Cleanup(func() { cfg.Crypto.TOTP.LoginTokenExpire = saved })
+	cfg.Crypto.TOTP.LoginTokenExpire = 0 // 未配置时令牌有效期为默认的300秒
+	fs.on("FROM `users`", fakeRow("fuid,status", "u1", 1))
+
+	token, expire, err := issueMFALoginToken("u1", "laptop", "pc")
+	if err != nil || expire != 300 {
+		t.Fatalf("expire %d err %v", expire, err)
+	}
+	res := callHandler(t, mfaLoginHandler, "POST", "/login/2fa", map[string]string{"mfa_token": token, "code": "000000"}, authIdentity{})
+	if res.Code != 401 {
+		t.Fatalf("code %d", res.Code)
+	}
+	ttl, _ := rdb.TTL(context.Background(), "mfa_login_attempts:"+token).Result()
+	if ttl < 300*time.Second {
+		t.Errorf("attempts key expires in %v, before the token (300s)", ttl)
+	}
+}
+
+// 测试用的最小CBOR编码（与cborDecode支持的类型一致）
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
+
+func cborInt(v int64) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte { return append(cborHead(2, uint64(len(b))), b...) }
+
+func cborText(s string) []byte { return append(cborHead(3, uint64(len(s))), s...) }
+
+// 按给定顺序编码映射（键值交替）
+func cborMap(pairs ...[]byte) []byte {
+	out := cborHead(5, uint64(len(pairs)/2))
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// ES256公钥的COSE_Key编码
+func es256COSEKey(pub *ecdsa.PublicKey) []byte {
+	x := pub.X.FillBytes(make([]byte, 32))
+	y := pub.Y.FillBytes(make([]byte, 32))
+	return cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(coseAlgES256), cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y))
+}
+
+// 构造authenticatorData，coseKey非空时附带凭证数据
+func buildAuthData(rpID string, flags byte, signCount uint32, credentialID, coseKey []byte) []byte {
+	rpHash := sha256.Sum256([]byte(rpID))
+	out := append(rpHash[:], flags)
+	out = binary.BigEndian.AppendUint32(out, signCount)
+	if coseKey != nil {
+		out = append(out, make([]byte, 16)...) // AAGUID
+		out = binary.BigEndian.AppendUint16(out, uint16(len(credentialID)))
+		out = append(append(out, credentialID...), coseKey...)
+	}
+	return out
+}
+
+func TestCBORDecode(t *testing.T) {
+	nested := func(n int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, n), 0x00)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+		err  bool
+	}{
+		{name: "small uint", in: []byte{0x17}, want: int64(23)},
+		{name: "uint8", in: []byte{0x18, 0xff}, want: int64(255)},
+		{name: "uint32", in: []byte{0x1a, 0x00, 0x01, 0x00, 0x00}, want: int64(65536)},
+		{name: "negative", in: []byte{0x38, 0x18}, want: int64(-25)},
+		{name: "cose alg RS256", in: cborInt(coseAlgRS256), want: int64(-257)},
+		{name: "bytes", in: []byte{0x42, 0x01, 0x02}, want: []byte{1, 2}},
+		{name: "text", in: cborText("none"), want: "none"},
+		{name: "array", in: []byte{0x82, 0x01, 0x61, 'a'}, want: []interface{}{int64(1), "a"}},
+		{name: "map", in: cborMap(cborText("fmt"), cborText("none"), cborInt(-1), cborInt(1)),
+			want: map[interface{}]interface{}{"fmt": "none", int64(-1): int64(1)}},
+		{name: "simple values", in: []byte{0x83, 0xf4, 0xf5, 0xf6}, want: []interface{}{false, true, nil}},
+		{name: "max depth", in: nested(16), want: func() interface{} {
+			var v interface{} = int64(0)
+			for i := 0; i < 16; i++ {
+				v = []interface{}{v}
+			}
+			return v
+		}()},
+
+		{name: "empty", in: nil, err: true},
+		{name: "truncated uint16 head", in: []byte{0x19, 0x01}, err: true},
+		{name: "truncated uint64 head", in: []byte{0x1b, 0, 0, 0, 0}, err: true},
+		{name: "truncated bytes", in: []byte{0x43, 0x01, 0x02}, err: true},
+		{name: "truncated array", in: []byte{0x82, 0x01}, err: true},
+		{name: "truncated map value", in: []byte{0xa1, 0x01}, err: true},
+		{name: "oversized bytes length", in: []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}, err: true},
+		{name: "oversized text length", in: []byte{0x7a, 0x7f, 0xff, 0xff, 0xff, 'a'}, err: true},
+		{name: "oversized array count", in: []byte{0x9a, 0xff, 0xff, 0xff, 0xff, 0x00}, err: true},
+		{name: "oversized map count", in: []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, err: true},
+		{name: "integer overflow", in: []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, err: true},
+		{name: "too deep", in: nested(17), err: true},
+		{name: "indefinite length", in: []byte{0x5f, 0x41, 0x00, 0xff}, err: true},
+		{name: "reserved additional info", in: []byte{0x1c}, err: true},
+		{name: "float", in: []byte{0xfa, 0x3f, 0x80, 0x00, 0x00}, err: true},
+		{name: "tag", in: []byte{0xc0, 0x00}, err: true},
+		{name: "bytes map key", in: []byte{0xa1, 0x41, 0x00, 0x00}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rest, err := cborDecode(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(rest) != 0 {
+				t.Errorf("%d bytes left over", len(rest))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	// 深度从调用方传入的层数起算
+	if _, _, err := cborDecodeDepth([]byte{0x00}, 17); err == nil {
+		t.Error("cborDecodeDepth accepted depth 17")
+	}
+	// 返回剩余数据，供authenticatorData定位公钥结尾
+	if _, rest, err := cborDecode([]byte{0x01, 0xaa, 0xbb}); err != nil || !bytes.Equal(rest, []byte{0xaa, 0xbb}) {
+		t.Errorf("rest = %x, err = %v", rest, err)
+	}
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := priv.X.FillBytes(make([]byte, 32))
+	y := priv.Y.FillBytes(make([]byte, 32))
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ec2 := func(kty, alg, crv int64, x, y []byte) []byte {
+		return cborMap(cborInt(1), cborInt(kty), cborInt(3), cborInt(alg), cborInt(-1), cborInt(crv),
+			cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y))
+	}
+	offCurve := append([]byte(nil), y...)
+	offCurve[31] ^= 1
+
+	tests := []struct {
+		name string
+		raw  []byte
+		alg  int64
+		err  bool
+	}{
+		{name: "ES256", raw: es256COSEKey(&priv.PublicKey), alg: coseAlgES256},
+		{name: "EdDSA", raw: cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgEdDSA), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(edPub)), alg: coseAlgEdDSA},
+		{name: "ES384 alg on P-256", raw: ec2(2, -35, 1, x, y), err: true},
+		{name: "ES256 on P-384 curve", raw: ec2(2, coseAlgES256, 2, x, y), err: true},
+		{name: "ES256 with OKP kty", raw: ec2(1, coseAlgES256, 1, x, y), err: true},
+		{name: "EdDSA on X25519 curve", raw: cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgEdDSA), cborInt(-1), cborInt(4), cborInt(-2), cborBytes(edPub)), err: true},
+		{name: "point not on curve", raw: ec2(2, coseAlgES256, 1, x, offCurve), err: true},
+		{name: "short coordinate", raw: ec2(2, coseAlgES256, 1, x[:31], y), err: true},
+		{name: "short EdDSA key", raw: cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgEdDSA), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(edPub[:31])), err: true},
+		{name: "RS256 modulus too small", raw: cborMap(cborInt(1), cborInt(3), cborInt(3), cborInt(coseAlgRS256), cborInt(-1), cborBytes(make([]byte, 128)), cborInt(-2), cborBytes([]byte{1, 0, 1})), err: true},
+		{name: "missing alg", raw: cborMap(cborInt(1), cborInt(2), cborInt(-1), cborInt(1)), err: true},
+		{name: "not a map", raw: cborBytes(x), err: true},
+		{name: "truncated", raw: es256COSEKey(&priv.PublicKey)[:40], err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseCOSEKey(tt.raw)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if key.alg != tt.alg {
+				t.Errorf("alg = %d, want %d", key.alg, tt.alg)
+			}
+		})
+	}
+
+	// 解析出的公钥能验证对应私钥的签名
+	message := []byte("authenticatorData||clientDataHash")
+	digest := sha256.Sum256(message)
+	sig, _ := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	key, _ := parseCOSEKey(es256COSEKey(&priv.PublicKey))
+	if !key.verify(message, sig) || key.verify([]byte("other"), sig) {
+		t.Error("ES256 verification mismatch")
+	}
+	edKey, _ := parseCOSEKey(cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgEdDSA), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(edPub)))
+	if !edKey.verify(message, ed25519.Sign(edPriv, message)) {
+		t.Error("EdDSA verification failed")
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	coseKey := es256COSEKey(&priv.PublicKey)
+	credentialID := []byte("credential-0001")
+	registration := buildAuthData("localhost", authDataFlagUP|authDataFlagUV|authDataFlagAT, 7, credentialID, coseKey)
+
+	// none与packed格式的注册数据都能解码出authData
+	attestations := map[string][]byte{
+		"none": cborMap(cborText("fmt"), cborText("none"), cborText("attStmt"), cborMap(), cborText("authData"), cborBytes(registration)),
+		"packed": cborMap(cborText("fmt"), cborText("packed"),
+			cborText("attStmt"), cborMap(cborText("alg"), cborInt(coseAlgES256), cborText("sig"), cborBytes(make([]byte, 70))),
+			cborText("authData"), cborBytes(registration)),
+	}
+	for format, raw := range attestations {
+		value, rest, err := cborDecode(raw)
+		attestation, ok := value.(map[interface{}]interface{})
+		if err != nil || !ok || len(rest) != 0 {
+			t.Fatalf("%s: decode attestation: %v", format, err)
+		}
+		if attestation["fmt"] != format {
+			t.Errorf("%s: fmt = %v", format, attestation["fmt"])
+		}
+		authDataRaw, _ := attestation["authData"].([]byte)
+		ad, err := parseAuthenticatorData(authDataRaw)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if ad.signCount != 7 || !bytes.Equal(ad.credentialID, credentialID) || !bytes.Equal(ad.publicKey, coseKey) {
+			t.Errorf("%s: parsed %+v", format, ad)
+		}
+		if err := checkAuthenticatorData(ad); err != nil {
+			t.Errorf("%s: check: %v", format, err)
+		}
+	}
+
+	// 登录断言不含凭证数据，可带扩展等尾随数据
+	assertion := buildAuthData("localhost", authDataFlagUP, 8, nil, nil)
+	if ad, err := parseAuthenticatorData(assertion); err != nil || ad.signCount != 8 || ad.credentialID != nil {
+		t.Errorf("assertion parsed %+v, err %v", ad, err)
+	}
+
+	longID := buildAuthData("localhost", authDataFlagUP|authDataFlagAT, 0, make([]byte, 1024), coseKey)
+	overstated := append([]byte(nil), registration...)
+	binary.BigEndian.PutUint16(overstated[53:55], 0xffff)
+	zeroID := append([]byte(nil), registration...)
+	binary.BigEndian.PutUint16(zeroID[53:55], 0)
+	malformed := []struct {
+		name string
+		raw  []byte
+	}{
+		{"shorter than header", registration[:36]},
+		{"attested data missing", registration[:37]},
+		{"truncated credential id length", registration[:54]},
+		{"credential id length beyond data", overstated},
+		{"zero credential id length", zeroID},
+		{"credential id too long", longID},
+		{"truncated public key", registration[:len(registration)-10]},
+	}
+	for _, tt := range malformed {
+		if _, err := parseAuthenticatorData(tt.raw); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+
+	saved := cfg.Crypto.WebAuthn
+	t.Cleanup(func() { cfg.Crypto.WebAuthn = saved })
+	checks := []struct {
+		name   string
+		rpID   string
+		flags  byte
+		uv     string
+		wantOK bool
+	}{
+		{"matching rp and user present", "localhost", authDataFlagUP, "preferred", true},
+		{"rpIdHash of another site", "evil.example", authDataFlagUP, "preferred", false},
+		{"user not present", "localhost", authDataFlagUV, "preferred", false},
+		{"verification required but missing", "localhost", authDataFlagUP, "required", false},
+		{"verification required and present", "localhost", authDataFlagUP | authDataFlagUV, "required", true},
+	}
+	for _, tt := range checks {
+		cfg.Crypto.WebAuthn.UserVerification = tt.uv
+		ad, err := parseAuthenticatorData(buildAuthData(tt.rpID, tt.flags, 1, nil, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := checkAuthenticatorData(ad); (err == nil) != tt.wantOK {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestPasskeyManagementRequiresReauthentication(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	hash, _ := encryptPassword("secret123")
+	fs.on("FROM `users`", fakeRow("fuid,username,nickname,password", "u1", "alice", "Alice", hash))
+	id := authIdentity{FUID: "u1"}
+
+	if res := callHandler(t, passkeyRegisterBeginHandler, "POST", "/auth/passkeys/register/begin", map[string]string{}, id); res.Code != 400 {
+		t.Errorf("begin without password: code %d", res.Code)
+	}
+	if res := callHandler(t, passkeyRegisterBeginHandler, "POST", "/auth/passkeys/register/begin", map[string]string{"password": "wrong"}, id); res.Code != 401 {
+		t.Errorf("begin with wrong password: code %d", res.Code)
+	}
+	res := callHandler(t, passkeyRegisterBeginHandler, "POST", "/auth/passkeys/register/begin", map[string]string{"password": "secret123"}, id)
+	if res.Code != 200 || responseData(t, res)["challenge"] == "" {
+		t.Errorf("begin with password: code %d", res.Code)
+	}
+	finish := map[string]string{"password": "wrong", "client_data_json": "e30", "attestation_object": "oA"}
+	if res := callHandler(t, passkeyRegisterFinishHandler, "POST", "/auth/passkeys/register/finish", finish, id); res.Code != 401 {
+		t.Errorf("finish with wrong password: code %d", res.Code)
+	}
+	del := gin.Param{Key: "id", Value: "1"}
+	if res := callHandler(t, deletePasskeyHandler, "DELETE", "/auth/passkeys/1", map[string]string{"password": "wrong"}, id, del); res.Code != 401 {
+		t.Errorf("delete with wrong password: code %d", res.Code)
+	}
+	if len(fs.executed("DELETE FROM `webauthn_credentials`")) != 0 {
+		t.Error("credential deleted without reauthentication")
+	}
+
+	// 开启两步验证后还须提供动态码或恢复码
+	fs.on("SELECT count\\(\\*\\) FROM `user_totp`", fakeRow("count", 1))
+	if res := callHandler(t, passkeyRegisterBeginHandler, "POST", "/auth/passkeys/register/begin", map[string]string{"password": "secret123"}, id); res.Code != 401 {
+		t.Errorf("begin without second factor: code %d", res.Code)
+	}
+	if res := callHandler(t, deletePasskeyHandler, "DELETE", "/auth/passkeys/1", map[string]string{"password": "secret123", "code": "000000"}, id, del); res.Code != 401 {
+		t.Errorf("delete with bad code: code %d", res.Code)
+	}
+	fs.on("UPDATE `recovery_codes`", fakeSQLResult{Affected: 1})
+	if res := callHandler(t, deletePasskeyHandler, "DELETE", "/auth/passkeys/1", map[string]string{"password": "secret123", "recovery_code": "abcd-efgh"}, id, del); res.Code != 200 {
+		t.Errorf("delete with recovery code: code %d (%s)", res.Code, res.Msg)
+	}
+}
+
+func TestPasskeyLoginRejectsLostSignCountRace(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	saved := cfg.Crypto.WebAuthn
+	t.Cleanup(func() { cfg.Crypto.WebAuthn = saved })
+	cfg.Crypto.WebAuthn.Origins = []string{"https://im.example"}
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fs.on("FROM `webauthn_credentials`", fakeRow("id,user_fuid,credential_id,public_key,algorithm,sign_count",
+		9, "u1", "Y3JlZA", base64.StdEncoding.EncodeToString(es256COSEKey(&priv.PublicKey)), coseAlgES256, 4))
+	fs.on("FROM `users`", fakeRow("fuid,status", "u1", 1))
+	// 另一次登录已抢先把计数器更新为5
+	fs.on("UPDATE `webauthn_credentials`", fakeSQLResult{Affected: 0})
+
+	challenge, _, err := newWebAuthnChallenge("login", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientData, _ := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": challenge, "origin": "https://im.example"})
+	authData := buildAuthData("localhost", authDataFlagUP, 5, nil, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	body := map[string]string{
+		"credential_id":      "Y3JlZA",
+		"client_data_json":   base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticator_data": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":          base64.RawURLEncoding.EncodeToString(sig),
+		"device_name":        "test",
+		"device_type":        "web",
+	}
+	res := callHandler(t, passkeyLoginFinishHandler, "POST", "/login/passkey/finish", body, authIdentity{})
+	if res.Code != 401 {
+		t.Fatalf("code %d (%s), want 401", res.Code, res.Msg)
+	}
+	updates := fs.executed("UPDATE `webauthn_credentials` SET .* WHERE id = \\? AND sign_count < \\?")
+	if len(updates) != 1 || !strings.Contains(updates[0], "|9 |5") {
+		t.Errorf("sign_count not updated conditionally: %v", updates)
+	}
+}
+
+// 等待日志邮件写入目录，返回解码后的正文
+func readLoggedMail(t *testing.T, dir string) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+		if len(files) > 0 {
+			raw, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 文件可能尚未写完，读到完整的头部和正文后再解码
+			parts := strings.SplitN(string(raw), "\r\n\r\n", 2)
+			if len(parts) == 2 {
+				body, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(parts[1], "\r\n", ""))
+				if err == nil {
+					return string(body)
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no complete mail written by the log mailer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVerificationMailTokenLifecycle(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	dir := t.TempDir()
+	mailSender = &logMailer{dir: dir, from: "no-reply@example.com"}
+	t.Cleanup(func() { mailSender = &logMailer{} })
+	mailTokenKey = []byte("mail-token-test-key")
+	savedMail := cfg.Mail
+	t.Cleanup(func() { cfg.Mail = savedMail })
+	cfg.Mail.LinkBase = "https://im.example"
+
+	user := &User{FUID: "u1", Nickname: "Alice", Email: "alice@example.com"}
+	if err := sendVerificationMail(user, mailPurposeVerify, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	body := readLoggedMail(t, dir)
+	match := regexp.MustCompile(`https://im\.example/verify-email\?token=(\S+)`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("mail body has no verification link:\n%s", body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+
+	fs.on("FROM `users`", fakeRow("id,fuid,nickname,email,status", 1, "u1", "Alice", "alice@example.com", 1))
+	verify := func(token string) Response {
+		return callHandler(t, verifyEmailHandler, "POST", "/email/verify", map[string]string{"token": token}, authIdentity{})
+	}
+	if res := verify(token); res.Code != 200 {
+		t.Fatalf("verify: code %d (%s)", res.Code, res.Msg)
+	}
+	if len(fs.executed("UPDATE `users` SET .*`email_verified`")) != 1 {
+		t.Error("email not marked verified")
+	}
+	// 令牌单次有效
+	if res := verify(token); res.Code != 400 {
+		t.Errorf("reused token: code %d, want 400", res.Code)
+	}
+
+	// 过期的令牌即使签名正确也被拒绝
+	payload, _ := json.Marshal(mailTokenClaims{Purpose: mailPurposeVerify, FUID: "u1", Email: user.Email, Nonce: "n1", Exp: time.Now().Add(-time.Minute).Unix()})
+	rdb.Set(context.Background(), "mail_token:n1", mailPurposeVerify, time.Minute)
+	rdb.Set(context.Background(), "mail_token_latest:verify_email:u1", "n1", time.Minute)
+	expired := base64.RawURLEncoding.EncodeToString(payload) + "." + signMailToken(payload)
+	if _, err := consumeMailToken(expired, mailPurposeVerify); !errors.Is(err, errMailToken) {
+		t.Errorf("expired token: %v", err)
+	}
+	if res := verify(expired); res.Code != 400 {
+		t.Errorf("expired token via handler: code %d, want 400", res.Code)
+	}
+
+	// 只有最新签发的令牌有效，且不能用于其他用途
+	older, _ := issueMailToken(mailPurposeVerify, "u1", user.Email, time.Hour)
+	newer, _ := issueMailToken(mailPurposeVerify, "u1", user.Email, time.Hour)
+	if _, err := consumeMailToken(older, mailPurposeVerify); err == nil {
+		t.Error("superseded token accepted")
+	}
+	if _, err := consumeMailToken(newer, mailPurposeReset); err == nil {
+		t.Error("token accepted for another purpose")
+	}
+	if _, err := consumeMailToken(newer+"x", mailPurposeVerify); err == nil {
+		t.Error("tampered token accepted")
+	}
+	if _, err := consumeMailToken(newer, mailPurposeVerify); err != nil {
+		t.Errorf("latest token: %v", err)
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	cases := []struct {
+		in         string
+		singleLine bool
+		want       string
+	}{
+		{"  Alice \t Smith ", true, "Alice Smith"},
+		{"line1\nline2", true, "line1 line2"},
+		{"line1\nline2\r", false, "line1\nline2"},
+		{"a​b\x00c‮", true, "abc"},
+	}
+	for _, tc := range cases {
+		if got := sanitizeText(tc.in, tc.singleLine); got != tc.want {
+			t.Errorf("sanitizeText(%q, %v) = %q, want %q", tc.in, tc.singleLine, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateMyProfileValidates(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	fs.on("FROM `users`", fakeRow("id,fuid,username,nickname,signature,status", 1, "u1", "alice", "Alice", "", 1))
+	me := authIdentity{FUID: "u1", DeviceID: "d1"}
+
+	for _, body := range []map[string]interface{}{
+		{},
+		{"nickname": " ​ "},
+		{"nickname": strings.Repeat("长", 21)},
+		{"signature": strings.Repeat("s", 81)},
+	} {
+		if res := callHandler(t, updateMyProfileHandler, "PUT", "/profile", body, me); res.Code != 400 {
+			t.Errorf("update %v: code %d, want 400", body, res.Code)
+		}
+	}
+	if len(fs.executed("^UPDATE `users`")) != 0 {
+		t.Fatal("invalid profile written")
+	}
+
+	res := callHandler(t, updateMyProfileHandler, "PUT", "/profile", map[string]string{"nickname": " Ali\tce "}, me)
+	if res.Code != 200 {
+		t.Fatalf("update: code %d (%s)", res.Code, res.Msg)
+	}
+	if data := responseData(t, res); data["nickname"] != "Ali ce" {
+		t.Errorf("nickname = %v", data["nickname"])
+	}
+	if updates := fs.executed("^UPDATE `users` SET `nickname`=.* \\|Ali ce "); len(updates) != 1 {
+		t.Errorf("updates = %v", fs.executed("^UPDATE `users`"))
+	}
+	if got := waitForClusterEvent(t, fr, "user:u1", "profile_updated"); got.Room != "user:u1" {
+		t.Errorf("profile_updated = %+v", got)
+	}
+}
+
+func TestUploadAvatarChecksContent(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	root := t.TempDir()
+	savedStorage, savedImage := fileStorage, cfg.Storage.Image
+	t.Cleanup(func() { fileStorage, cfg.Storage.Image = savedStorage, savedImage })
+	fileStorage = &localStorage{root: root, domain: "http://files"}
+	cfg.Storage.Image.MaxSize = 1024
+	cfg.Storage.Image.AllowTypes = []string{"png", "jpg"}
+	fs.on("FROM `users`", fakeRow("id,fuid,nickname,avatar,status", 1, "u1", "Alice", "", 1))
+
+	upload := func(name string, content []byte) Response {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write(content)
+		mw.Close()
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/profile/avatar", &buf)
+		c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+		setTestIdentity(c, authIdentity{FUID: "u1", DeviceID: "d1"})
+		uploadAvatarHandler(c)
+		var res Response
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("decode response %q: %v", w.Body.String(), err)
+		}
+		return res
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+
+	if res := upload("a.gif", png); res.Code != 400 {
+		t.Errorf("disallowed extension: code %d", res.Code)
+	}
+	if res := upload("a.png", []byte("<html><script>alert(1)</script></html>")); res.Code != 400 {
+		t.Errorf("html disguised as png: code %d", res.Code)
+	}
+	if res := upload("a.png", append(png, make([]byte, 1024)...)); res.Code != 400 {
+		t.Errorf("oversized avatar: code %d", res.Code)
+	}
+	if len(fs.executed("^UPDATE `users`")) != 0 {
+		t.Fatal("rejected avatar written")
+	}
+
+	res := upload("a.png", png)
+	if res.Code != 200 {
+		t.Fatalf("upload: code %d (%s)", res.Code, res.Msg)
+	}
+	avatar, _ := responseData(t, res)["avatar"].(string)
+	if !strings.HasPrefix(avatar, "http://files/avatar/u1_") {
+		t.Fatalf("avatar url = %q", avatar)
+	}
+	if _, err := os.Stat(filepath.Join(root, "avatar", strings.TrimPrefix(avatar, "http://files/avatar/"))); err != nil {
+		t.Errorf("avatar not stored: %v", err)
+	}
+	if len(fs.executed("^UPDATE `users` SET `avatar`=")) != 1 {
+		t.Errorf("avatar updates = %v", fs.executed("^UPDATE `users`"))
+	}
+}
+
+func TestAccountDeletionRequestAndCancel(t *testing.T) {
+	fs := setupFakeDB(t)
+	savedUser := cfg.Business.User
+	t.Cleanup(func() { cfg.Business.User = savedUser })
+	cfg.Business.User.DeletionGraceDays = 3
+	dir := t.TempDir()
+	mailSender = &logMailer{dir: dir, from: "no-reply@example.com"}
+	t.Cleanup(func() { mailSender = &logMailer{} })
+	hash, _ := encryptPassword("secret1")
+	fs.on("FROM `users`", fakeRow("id,fuid,nickname,email,password,status", 1, "u1", "Alice", "alice@example.com", hash, 1))
+	me := authIdentity{FUID: "u1", DeviceID: "d1"}
+
+	res := callHandler(t, requestAccountDeletionHandler, "POST", "/account/deletion", map[string]string{"password": "wrong1"}, me)
+	if res.Code != 401 || len(fs.executed("account_deletions")) != 0 {
+		t.Fatalf("wrong password: code %d, statements %v", res.Code, fs.executed("account_deletions"))
+	}
+
+	before := time.Now()
+	res = callHandler(t, requestAccountDeletionHandler, "POST", "/account/deletion", map[string]string{"password": "secret1"}, me)
+	if res.Code != 200 {
+		t.Fatalf("request deletion: code %d (%s)", res.Code, res.Msg)
+	}
+	executeAt, err := time.ParseInLocation("2006-01-02 15:04:05", responseData(t, res)["execute_at"].(string), time.Local)
+	if err != nil || executeAt.Before(before.Add(72*time.Hour).Truncate(time.Second)) || executeAt.After(time.Now().Add(72*time.Hour)) {
+		t.Errorf("execute_at = %v (%v)", executeAt, err)
+	}
+	if body := readLoggedMail(t, dir); !strings.Contains(body, executeAt.Format("2006-01-02 15:04")) {
+		t.Errorf("mail does not mention the execution time:\n%s", body)
+	}
+	// 重复申请时重置冷静期
+	if inserts := fs.executed("^INSERT INTO `account_deletions`.*ON DUPLICATE KEY UPDATE"); len(inserts) != 1 {
+		t.Errorf("inserts = %v", fs.executed("account_deletions"))
+	}
+
+	fs.on("^UPDATE `account_deletions`", fakeSQLResult{Affected: 0})
+	if res := callHandler(t, cancelAccountDeletionHandler, "DELETE", "/account/deletion", nil, me); res.Code != 404 {
+		t.Errorf("cancel without request: code %d", res.Code)
+	}
+	fs.on("^UPDATE `account_deletions`", fakeSQLResult{Affected: 1})
+	if res := callHandler(t, cancelAccountDeletionHandler, "DELETE", "/account/deletion", nil, me); res.Code != 200 {
+		t.Errorf("cancel: code %d (%s)", res.Code, res.Msg)
+	}
+	if len(fs.executed("^UPDATE `account_deletions` SET `status`=.* \\|2 .*\\|u1 \\|1$")) != 2 {
+		t.Errorf("cancel updates = %v", fs.executed("^UPDATE `account_deletions`"))
+	}
+}
+
+// 读取导出ZIP中的全部文件
+func readExportZip(t *testing.T, key string) map[string]string {
+	t.Helper()
+	reader, err := privateStorage.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestDataExportContents(t *testing.T) {
+	fs := setupFakeDB(t)
+	savedPrivate := privateStorage
+	t.Cleanup(func() { privateStorage = savedPrivate })
+	privateStorage = &localStorage{root: t.TempDir()}
+
+	fs.on("FROM `users`", fakeRow("id,fuid,username,nickname,email,status", 1, "u1", "alice", "Alice", "alice@example.com", 1))
+	fs.on("FROM `friends`", fakeRow("id,user_fuid,friend_fuid,remark,status", 1, "u1", "u2", "Bob", 1))
+	fs.on("FROM `group_members`", fakeRow("id,group_quid,user_fuid,role,status,join_seq", 1, "g1", "u1", 0, 1, 10))
+	fs.on("FROM `groups`", fakeRow("id,quid,name,status", 1, "g1", "Team", 1))
+	fs.on("FROM `messages`", fakeSQLResult{
+		Columns: []string{"id", "msg_id", "conv_id", "seq", "sender_fuid", "receiver_type", "receiver_id", "content_type", "content"},
+		Rows: [][]driver.Value{
+			{1, "m1", "single:u1:u2", 1, "u1", 1, "u2", 1, "sent"},
+			{2, "m2", "single:u1:u2", 2, "u2", 1, "u1", 1, "received"},
+			{3, "m3", "group:g1", 11, "u3", 2, "g1", 1, "group"},
+		},
+	})
+
+	size, err := buildDataExport("u1", "exports/u1.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size <= 0 {
+		t.Errorf("export size %d", size)
+	}
+	files := readExportZip(t, "exports/u1.zip")
+	for _, name := range []string{"profile.json", "friends.json", "groups.json", "messages.jsonl"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("export is missing %s", name)
+		}
+	}
+	var profile map[string]interface{}
+	if err := json.Unmarshal([]byte(files["profile.json"]), &profile); err != nil || profile["fuid"] != "u1" {
+		t.Errorf("profile.json = %s", files["profile.json"])
+	}
+	if !strings.Contains(files["friends.json"], `"u2"`) || !strings.Contains(files["groups.json"], `"Team"`) {
+		t.Errorf("friends/groups: %s %s", files["friends.json"], files["groups.json"])
+	}
+	lines := strings.Split(strings.TrimSpace(files["messages.jsonl"]), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("messages.jsonl has %d lines, want 3:\n%s", len(lines), files["messages.jsonl"])
+	}
+	var groupMsg map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[2]), &groupMsg); err != nil || groupMsg["msg_id"] != "m3" || groupMsg["content"] != "group" {
+		t.Errorf("group message line = %s", lines[2])
+	}
+
+	// 消息查询包含本人发送、单聊收到和所在群加入之后收到的消息，均排除影子消息
+	queries := fs.executed("FROM `messages`")
+	if len(queries) != 1 {
+		t.Fatalf("message queries: %v", queries)
+	}
+	for _, want := range []string{
+		"sender_fuid = ?",
+		"receiver_type = 1 AND receiver_id = ? AND shadow = 0",
+		"receiver_type = 2 AND shadow = 0 AND EXISTS (SELECT 1 FROM `group_members`",
+		"group_members.user_fuid = ? AND group_members.status = 1 AND messages.seq > group_members.join_seq",
+	} {
+		if !strings.Contains(queries[0], want) {
+			t.Errorf("message query lacks %q: %s", want, queries[0])
+		}
+	}
+}
+
+// 注销测试的公共数据：一个有继任者的群、一个无其他成员的群、一个好友和一份导出文件
+func stubAccountDeletion(t *testing.T, fs *fakeSQL) string {
+	t.Helper()
+	savedPrivate := privateStorage
+	t.Cleanup(func() { privateStorage = savedPrivate })
+	root := t.TempDir()
+	privateStorage = &localStorage{root: root}
+	exportPath := filepath.Join(root, "exports", "u1.zip")
+	os.MkdirAll(filepath.Dir(exportPath), 0o755)
+	os.WriteFile(exportPath, []byte("zip"), 0o600)
+
+	fs.on("FROM `users`", fakeRow("id,fuid,status", 1, "u1", 1))
+	fs.on("FROM `groups` WHERE owner_fuid = ", fakeSQLResult{
+		Columns: []string{"id", "quid", "owner_fuid", "status"},
+		Rows:    [][]driver.Value{{1, "g1", "u1", 1}, {2, "g2", "u1", 1}},
+	})
+	fs.on("FROM `group_members` WHERE group_quid = \\? AND user_fuid <> \\?.* \\|g1 ", fakeRow("id,group_quid,user_fuid,role,status", 7, "g1", "u2", 2, 1))
+	fs.on("SELECT `user_fuid` FROM `friends`", fakeRow("user_fuid", "u3"))
+	fs.on("FROM `data_exports`", fakeRow("id,export_id,user_fuid,status,file_key", 1, "e1", "u1", 1, "exports/u1.zip"))
+	return exportPath
+}
+
+func TestAccountDeletionRunsInOneTransaction(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	exportPath := stubAccountDeletion(t, fs)
+
+	if err := executeAccountDeletion("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fs.executed("^BEGIN$")); n != 1 {
+		t.Fatalf("BEGIN executed %d times, want 1", n)
+	}
+	if len(fs.executed("^COMMIT$")) != 1 || len(fs.executed("^ROLLBACK$")) != 0 {
+		t.Fatalf("transaction not committed: %v", fs.executed("^(COMMIT|ROLLBACK)$"))
+	}
+	// 全部写操作都在BEGIN与COMMIT之间
+	inTx := false
+	for _, stmt := range fs.executed("") {
+		switch {
+		case stmt == "BEGIN":
+			inTx = true
+		case stmt == "COMMIT":
+			inTx = false
+		case strings.HasPrefix(stmt, "UPDATE") || strings.HasPrefix(stmt, "DELETE") || strings.HasPrefix(stmt, "INSERT"):
+			if !inTx && !strings.Contains(stmt, "audit") {
+				t.Errorf("write outside the transaction: %s", stmt)
+			}
+		}
+	}
+	for _, want := range []string{
+		"UPDATE `groups` SET `owner_fuid`=.* \\|u2 ",
+		"UPDATE `groups` SET `status`=.* \\|0 \\|.* \\|2$",
+		"UPDATE `group_members` SET `status`=.*WHERE group_quid = \\? \\|0 \\|.* \\|g2$",
+		"UPDATE `group_members` SET `status`=.*WHERE user_fuid = \\? AND status = 1 \\|0 \\|.* \\|u1$",
+		"DELETE FROM `sender_key_distributions` WHERE recipient_fuid = \\? \\|u1$",
+		"UPDATE `friends` SET `status`=",
+		"DELETE FROM `devices` WHERE user_fuid = \\? \\|u1$",
+		"DELETE FROM `one_time_prekeys` WHERE user_fuid = \\? \\|u1$",
+		"DELETE FROM `refresh_tokens` WHERE user_fuid = \\? \\|u1$",
+		"DELETE FROM `data_exports` WHERE user_fuid = \\? \\|u1$",
+		"UPDATE `messages` SET .*`is_recalled`",
+		"UPDATE `users` SET .*`username`=.*deleted_u1",
+	} {
+		if len(fs.executed(want)) == 0 {
+			t.Errorf("missing statement %q", want)
+		}
+	}
+	// 提交后删除导出文件
+	if _, err := os.Stat(exportPath); !os.IsNotExist(err) {
+		t.Errorf("export file not deleted after commit: %v", err)
+	}
+}
+
+func TestAccountDeletionRollsBackOnError(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	exportPath := stubAccountDeletion(t, fs)
+	fs.on("^UPDATE `friends`", fakeSQLResult{Err: errors.New("lock wait timeout")})
+
+	if err := executeAccountDeletion("u1"); err == nil {
+		t.Fatal("deletion succeeded despite a failed statement")
+	}
+	if len(fs.executed("^ROLLBACK$")) != 1 || len(fs.executed("^COMMIT$")) != 0 {
+		t.Fatalf("transaction not rolled back: %v", fs.executed("^(COMMIT|ROLLBACK)$"))
+	}
+	if len(fs.executed("UPDATE `users` SET")) != 0 {
+		t.Error("user anonymized despite the rollback")
+	}
+	if len(fs.executed("INTO `audit_events`")) != 0 {
+		t.Error("account_deleted audited despite the rollback")
+	}
+	// 回滚后不执行副作用，导出文件保留到下次重试
+	if _, err := os.Stat(exportPath); err != nil {
+		t.Errorf("export file removed despite the rollback: %v", err)
+	}
+}
+
+// 登录请求上下文（记录IP与User-Agent）
+func loginTestContext(ip string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/login", nil)
+	c.Request.RemoteAddr = ip + ":50000"
+	c.Request.Header.Set("User-Agent", "im-test")
+	return c
+}
+
+func TestLoginFailuresLockAccount(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	saved := cfg.LoginRisk
+	t.Cleanup(func() { cfg.LoginRisk = saved })
+	cfg.LoginRisk.Enable = true
+	cfg.LoginRisk.FailureWindow = 900
+	cfg.LoginRisk.Lockout.Enable = true
+	cfg.LoginRisk.Lockout.MaxFailures = 3
+	cfg.LoginRisk.Lockout.Duration = 600
+	dir := t.TempDir()
+	mailSender = &logMailer{dir: dir, from: "no-reply@example.com"}
+	t.Cleanup(func() { mailSender = &logMailer{} })
+	user := &User{FUID: "u1", Nickname: "Alice", Email: "alice@example.com"}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		recordLoginFailure(loginTestContext("203.0.113.7"), user, "laptop", "pc", "password", "wrong_password")
+	}
+	if failures, _ := rdb.Get(ctx, loginFailKey("u1")).Int64(); failures != 2 {
+		t.Errorf("failures = %d, want 2", failures)
+	}
+	if ttl, _ := rdb.TTL(ctx, loginFailKey("u1")).Result(); ttl <= 0 || ttl > 900*time.Second {
+		t.Errorf("failure window ttl = %v", ttl)
+	}
+	if loginLockedFor("u1") != 0 {
+		t.Fatal("account locked before reaching max failures")
+	}
+
+	recordLoginFailure(loginTestContext("203.0.113.7"), user, "laptop", "pc", "password", "wrong_password")
+	if locked := loginLockedFor("u1"); locked <= 0 || locked > 600*time.Second {
+		t.Fatalf("locked for %v", locked)
+	}
+	if n, _ := rdb.Exists(ctx, loginFailKey("u1")).Result(); n != 0 {
+		t.Error("failure counter kept after lockout")
+	}
+	if inserts := fs.executed("^INSERT INTO `login_history`.*\\|wrong_password "); len(inserts) != 3 {
+		t.Errorf("login history = %v", fs.executed("login_history"))
+	}
+	// 锁定提醒通过系统消息和邮件送达
+	waitForClusterEvent(t, fr, "user:u1", "system_message")
+	if body := readLoggedMail(t, dir); !strings.Contains(body, "锁定10分钟") {
+		t.Errorf("lockout mail:\n%s", body)
+	}
+}
+
+func TestEvaluateLoginRisk(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	saved := cfg.LoginRisk
+	t.Cleanup(func() { cfg.LoginRisk = saved })
+	cfg.LoginRisk.FailureAlert = 3
+
+	// 首次登录不提示风险
+	if risks := evaluateLoginRisk("u1", "laptop", "pc", "203.0.113.7"); risks != nil {
+		t.Errorf("first login risks = %v", risks)
+	}
+
+	fs.on("SELECT count\\(\\*\\) FROM `login_history` WHERE user_fuid = \\? AND result = \\?", fakeRow("count", 4))
+	fs.on("SELECT count\\(\\*\\) FROM `login_history` .*device_name = \\?", fakeRow("count", 0))
+	fs.on("SELECT count\\(\\*\\) FROM `login_history` .*ip = \\?", fakeRow("count", 2))
+	if risks := evaluateLoginRisk("u1", "phone", "android", "203.0.113.7"); !reflect.DeepEqual(risks, []string{riskNewDevice}) {
+		t.Errorf("new device risks = %v", risks)
+	}
+
+	rdb.Set(context.Background(), loginFailKey("u1"), 3, time.Minute)
+	fs.on("SELECT count\\(\\*\\) FROM `login_history` .*device_name = \\?", fakeRow("count", 1))
+	fs.on("SELECT count\\(\\*\\) FROM `login_history` .*ip = \\?", fakeRow("count", 0))
+	if risks := evaluateLoginRisk("u1", "laptop", "pc", "198.51.100.2"); !reflect.DeepEqual(risks, []string{riskNewIP, riskRapidFailures}) {
+		t.Errorf("new ip risks = %v", risks)
+	}
+}
+
+func TestMFALoginCountsFailuresAndHonoursLockout(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	saved := cfg.LoginRisk
+	t.Cleanup(func() { cfg.LoginRisk = saved })
+	cfg.LoginRisk.Enable = false
+	cfg.LoginRisk.Lockout.Enable = true
+	cfg.LoginRisk.Lockout.MaxFailures = 2
+	cfg.LoginRisk.Lockout.Duration = 600
+	mailSender = &logMailer{} // 锁定提醒邮件异步发送，不恢复为nil
+	fs.on("FROM `users`", fakeRow("fuid,username,status", "u1", "alice", 1))
+
+	token, _, err := issueMFALoginToken("u1", "laptop", "pc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempt := func(code string) Response {
+		return callHandler(t, mfaLoginHandler, "POST", "/login/2fa", map[string]string{"mfa_token": token, "code": code}, authIdentity{})
+	}
+	// 错误的动态码计入登录失败次数，达到上限后锁定账号
+	for i := 0; i < 2; i++ {
+		if res := attempt("000000"); res.Code != 401 {
+			t.Fatalf("attempt %d: code %d", i+1, res.Code)
+		}
+	}
+	if loginLockedFor("u1") <= 0 {
+		t.Fatal("wrong TOTP codes did not lock the account")
+	}
+	if res := attempt("123456"); res.Code != 423 {
+		t.Errorf("locked account: code %d, want 423", res.Code)
+	}
+	if n, _ := rdb.Exists(context.Background(), "mfa_login:"+token).Result(); n != 0 {
+		t.Error("MFA token still valid after lockout")
+	}
+
+	// 密码验证通过后才被锁定的账号，第二步同样被拒绝
+	token, _, _ = issueMFALoginToken("u1", "laptop", "pc")
+	if res := attempt("123456"); res.Code != 423 {
+		t.Errorf("token issued before lockout: code %d, want 423", res.Code)
+	}
+}
+
+func TestAdminCanManage(t *testing.T) {
+	admin := authIdentity{FUID: "a1", Role: roleAdmin}
+	moderator := authIdentity{FUID: "m1", Role: roleModerator}
+	cases := []struct {
+		actor  authIdentity
+		target User
+		ok     bool
+	}{
+		{moderator, User{FUID: "u1"}, true},
+		{moderator, User{FUID: "m1", Role: roleModerator}, false},
+		{moderator, User{FUID: "m2", Role: roleModerator}, false},
+		{admin, User{FUID: "m2", Role: roleModerator}, true},
+		{admin, User{FUID: "a1", Role: roleAdmin}, false},
+	}
+	for _, tc := range cases {
+		if err := adminCanManage(tc.actor, &tc.target); (err == nil) != tc.ok {
+			t.Errorf("%s managing %s(%q): err %v", tc.actor.FUID, tc.target.FUID, tc.target.Role, err)
+		}
+	}
+}
+
+func TestAdminSetUserStatus(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	moderator := authIdentity{FUID: "m1", Role: roleModerator}
+	disable, enable := adminSetUserStatusHandler(false), adminSetUserStatusHandler(true)
+
+	fs.on("FROM `users`", fakeRow("id,fuid,role,status", 2, "a2", roleAdmin, 1))
+	if res := callHandler(t, disable, "POST", "/admin/users/a2/disable", nil, moderator, gin.Param{Key: "fuid", Value: "a2"}); res.Code != 403 {
+		t.Errorf("moderator disabling an admin: code %d, want 403", res.Code)
+	}
+
+	fs.on("FROM `users`", fakeRow("id,fuid,role,status", 1, "u1", "", 1))
+	fs.on("FROM `devices`", fakeRow("id,user_fuid,device_id,status", 1, "u1", "d1", 1))
+	res := callHandler(t, disable, "POST", "/admin/users/u1/disable", map[string]string{"reason": "spam"}, moderator, gin.Param{Key: "fuid", Value: "u1"})
+	if res.Code != 200 {
+		t.Fatalf("disable: code %d (%s)", res.Code, res.Msg)
+	}
+	if len(fs.executed("^UPDATE `users` SET `status`=.* \\|0 ")) != 1 {
+		t.Errorf("user not disabled: %v", fs.executed("^UPDATE `users`"))
+	}
+	if len(fs.executed("^UPDATE `devices` SET .*`status`=.* \\|0 .*\\|u1 \\|d1$")) != 1 {
+		t.Errorf("device session not revoked: %v", fs.executed("devices"))
+	}
+	if audits := fs.executed("^INSERT INTO `audit_events`.*\\|m1 \\|moderator \\|user_disabled \\|user \\|u1 "); len(audits) != 1 || !strings.Contains(audits[0], `"reason":"spam"`) {
+		t.Errorf("audit = %v", fs.executed("audit_events"))
+	}
+
+	// 已注销的账号不能重新启用
+	fs.on("SELECT count\\(\\*\\) FROM `account_deletions`", fakeRow("count", 1))
+	if res := callHandler(t, enable, "POST", "/admin/users/u1/enable", nil, moderator, gin.Param{Key: "fuid", Value: "u1"}); res.Code != 400 {
+		t.Errorf("enabling a deleted account: code %d, want 400", res.Code)
+	}
+	if len(fs.executed("^UPDATE `users` SET `status`=.* \\|1 ")) != 0 {
+		t.Error("deleted account enabled")
+	}
+}
+
+func TestAdminSetUserRole(t *testing.T) {
+	fs := setupFakeDB(t)
+	admin := authIdentity{FUID: "a1", Role: roleAdmin}
+	fs.on("FROM `users`", fakeRow("id,fuid,role,status", 1, "u1", "", 1))
+
+	if res := callHandler(t, adminSetUserRoleHandler, "POST", "/admin/users/u1/role", map[string]string{"role": "root"}, admin, gin.Param{Key: "fuid", Value: "u1"}); res.Code != 400 {
+		t.Errorf("unknown role: code %d, want 400", res.Code)
+	}
+	res := callHandler(t, adminSetUserRoleHandler, "POST", "/admin/users/u1/role", map[string]string{"role": roleModerator}, admin, gin.Param{Key: "fuid", Value: "u1"})
+	if res.Code != 200 {
+		t.Fatalf("set role: code %d (%s)", res.Code, res.Msg)
+	}
+	if len(fs.executed("^UPDATE `users` SET `role`=.* \\|moderator ")) != 1 {
+		t.Errorf("role updates = %v", fs.executed("^UPDATE `users`"))
+	}
+	if audits := fs.executed("^INSERT INTO `audit_events`.*\\|user_role_changed \\|user \\|u1 "); len(audits) != 1 || !strings.Contains(audits[0], `"to":"moderator"`) {
+		t.Errorf("audit = %v", fs.executed("audit_events"))
+	}
+}
+
+// 记录审计事件的测试实现
+type recordingAuditLog struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (r *recordingAuditLog) Record(event AuditEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recordingAuditLog) actions() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for _, event := range r.events {
+		out = append(out, event.Action+":"+event.TargetID)
+	}
+	return out
+}
+
+func setupRecordingAuditLog(t *testing.T) *recordingAuditLog {
+	t.Helper()
+	saved := auditLog
+	t.Cleanup(func() { auditLog = saved })
+	rec := &recordingAuditLog{}
+	auditLog = rec
+	return rec
+}
+
+func TestAuditEventsRouteThroughAuditLog(t *testing.T) {
+	audits := setupRecordingAuditLog(t)
+
+	// 未认证的登录请求：操作者即账号本人
+	c := loginTestContext("203.0.113.7")
+	auditSecurityEvent(c, "u1", "login_failed", map[string]interface{}{"reason": "wrong_password"})
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/group/kick", nil)
+	setTestIdentity(c, authIdentity{FUID: "owner", Role: roleModerator})
+	recordGroupAudit(c, "q1", "member_kicked", "user", "u2", nil)
+	recordAudit(nil, "report_expired", "report", "r1", nil)
+
+	if got := audits.actions(); !reflect.DeepEqual(got, []string{"login_failed:u1", "member_kicked:u2", "report_expired:r1"}) {
+		t.Fatalf("audits = %v", got)
+	}
+	login, kick, task := audits.events[0], audits.events[1], audits.events[2]
+	if login.ActorFUID != "u1" || login.TargetType != "user" || login.IP != "203.0.113.7" || login.Payload != `{"reason":"wrong_password"}` {
+		t.Errorf("login event = %+v", login)
+	}
+	if kick.ActorFUID != "owner" || kick.ActorRole != roleModerator || kick.GroupQUID != "q1" || kick.Payload != "" {
+		t.Errorf("group event = %+v", kick)
+	}
+	if task.ActorFUID != "" || task.IP != "" {
+		t.Errorf("background event = %+v", task)
+	}
+}
+
+func TestAdminListAuditFilters(t *testing.T) {
+	fs := setupFakeDB(t)
+	admin := authIdentity{FUID: "admin", Role: roleAdmin}
+
+	res := callHandler(t, adminListAuditHandler, "GET", "/admin/audit?from=yesterday", nil, admin)
+	if res.Code != 400 {
+		t.Errorf("bad time filter: code %d, want 400", res.Code)
+	}
+	res = callHandler(t, adminListAuditHandler, "GET", "/admin/audit?actor_fuid=m1&action=user_disabled&from=2026-01-01&to=2026-01-02&size=500", nil, admin)
+	if res.Code != 200 {
+		t.Fatalf("list: code %d (%s)", res.Code, res.Msg)
+	}
+	queries := fs.executed("^SELECT \\* FROM `audit_events`")
+	if len(queries) != 1 {
+		t.Fatalf("queries = %v", fs.executed("audit_events"))
+	}
+	for _, want := range []string{
+		"actor_fuid = ? AND action = ? AND created_at >= ? AND created_at <= ?",
+		"ORDER BY id DESC LIMIT ?",
+		"|m1 |user_disabled |2026-01-01 00:00:00 ",
+		"|2026-01-02 23:59:59 ",
+		" |20",
+	} {
+		if !strings.Contains(queries[0], want) {
+			t.Errorf("query lacks %q: %s", want, queries[0])
+		}
+	}
+}
+
+func TestGroupAuditOwnerViewHidesIPAndContent(t *testing.T) {
+	fs := setupFakeDB(t)
+	fs.on("FROM `groups`", fakeRow("quid,owner_fuid,status", "q1", "owner", 1))
+	fs.on("FROM `audit_events`", fakeRow("id,actor_fuid,action,target_type,target_id,group_quid,ip,payload",
+		1, "u2", "message_blocked", "group", "q1", "q1", "203.0.113.9",
+		`{"filter":"sensitive_word","reason":"消息包含敏感词","detail":"badword","content_type":1}`))
+	fs.on("SELECT count\\(\\*\\) FROM `audit_events`", fakeRow("count", 1))
+	res := callHandler(t, groupAuditHandler, "GET", "/group/audit/q1", nil, authIdentity{FUID: "owner"}, gin.Param{Key: "quid", Value: "q1"})
+	list, ok := res.Data.([]interface{})
+	if res.Code != 200 || !ok || len(list) != 1 {
+		t.Fatalf("code %d data %#v", res.Code, res.Data)
+	}
+	event := list[0].(map[string]interface{})
+	if _, ok := event["ip"]; ok {
+		t.Error("owner view includes ip")
+	}
+	payload := event["payload"].(map[string]interface{})
+	if payload["filter"] != "sensitive_word" || payload["reason"] == nil {
+		t.Errorf("payload = %v", payload)
+	}
+	for _, key := range []string{"detail", "content_type"} {
+		if _, ok := payload[key]; ok {
+			t.Errorf("owner view includes %s", key)
+		}
+	}
+
+	// 管理员视图保留完整信息
+	res = callHandler(t, adminListAuditHandler, "GET", "/admin/audit?group_quid=q1", nil, authIdentity{FUID: "admin", Role: "admin"})
+	event = res.Data.([]interface{})[0].(map[string]interface{})
+	if event["ip"] != "203.0.113.9" || event["payload"].(map[string]interface{})["detail"] != "badword" {
+		t.Errorf("admin view = %v", event)
+	}
+
+	fs.on("FROM `groups`", fakeSQLResult{Columns: []string{"quid"}})
+	if res := callHandler(t, groupAuditHandler, "GET", "/group/audit/q1", nil, authIdentity{FUID: "u2"}, gin.Param{Key: "quid", Value: "q1"}); res.Code != 403 {
+		t.Errorf("non-owner got code %d", res.Code)
+	}
+}
+
+func TestCreateReportValidatesTarget(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	me := authIdentity{FUID: "u1"}
+	report := func(targetType int, targetID string) Response {
+		body := map[string]interface{}{"target_type": targetType, "target_id": targetID, "reason": "abuse"}
+		return callHandler(t, createReportHandler, "POST", "/report", body, me)
+	}
+
+	if res := report(1, "u1"); res.Code != 400 {
+		t.Errorf("reporting yourself: code %d, want 400", res.Code)
+	}
+	if res := report(1, "ghost"); res.Code != 404 {
+		t.Errorf("unknown user: code %d, want 404", res.Code)
+	}
+	if res := report(3, "q404"); res.Code != 404 {
+		t.Errorf("unknown group: code %d, want 404", res.Code)
+	}
+	// 举报人看不到的群消息与本人发送的消息
+	fs.on("FROM `messages`", fakeRow("id,msg_id,conv_id,sender_fuid,receiver_type,receiver_id", 1, "m1", "group:q1", "u2", 2, "q1"))
+	if res := report(2, "m1"); res.Code != 404 {
+		t.Errorf("message outside the reporter's groups: code %d, want 404", res.Code)
+	}
+	fs.on("FROM `messages`", fakeRow("id,msg_id,conv_id,sender_fuid,receiver_type,receiver_id", 2, "m2", "single:u1:u2", "u1", 1, "u2"))
+	if res := report(2, "m2"); res.Code != 400 {
+		t.Errorf("own message: code %d, want 400", res.Code)
+	}
+	if len(fs.executed("INSERT INTO `reports`")) != 0 {
+		t.Error("invalid report stored")
+	}
+
+	fs.on("FROM `messages`", fakeRow("id,msg_id,conv_id,sender_fuid,receiver_type,receiver_id", 3, "m3", "single:u1:u2", "u2", 1, "u1"))
+	res := report(2, "m3")
+	if res.Code != 200 {
+		t.Fatalf("report message: code %d (%s)", res.Code, res.Msg)
+	}
+	if inserts := fs.executed("^INSERT INTO `reports`.*\\|u1 \\|2 \\|m3 \\|abuse "); len(inserts) != 1 {
+		t.Errorf("inserts = %v", fs.executed("reports"))
+	}
+}
+
+func TestResolveReportRespectsClaim(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	audits := setupRecordingAuditLog(t)
+	moderator := authIdentity{FUID: "mod1", Role: roleModerator}
+	resolve := func(id authIdentity, action string) Response {
+		return callHandler(t, adminResolveReportHandler, "POST", "/admin/reports/r1/resolve", map[string]string{"action": action}, id,
+			gin.Param{Key: "id", Value: "r1"})
+	}
+
+	fs.on("^UPDATE `reports`", fakeSQLResult{Affected: 0})
+	if res := callHandler(t, adminClaimReportHandler, "POST", "/admin/reports/r1/claim", nil, moderator, gin.Param{Key: "id", Value: "r1"}); res.Code != 409 {
+		t.Errorf("claiming a claimed report: code %d, want 409", res.Code)
+	}
+	fs.on("^UPDATE `reports`", fakeSQLResult{Affected: 1})
+
+	// 已由其他审核员认领，只有认领人或管理员可以处理
+	fs.on("FROM `reports`", fakeRow("id,report_id,reporter_fuid,target_type,target_id,reason,status,handler_fuid", 1, "r1", "u1", 1, "u2", "abuse", 1, "mod2"))
+	if res := resolve(moderator, "disable"); res.Code != 403 {
+		t.Errorf("resolving another moderator's report: code %d, want 403", res.Code)
+	}
+
+	fs.on("FROM `users`", fakeRow("id,fuid,role,status", 2, "u2", "", 1))
+	res := resolve(authIdentity{FUID: "mod2", Role: roleModerator}, "disable")
+	if res.Code != 200 {
+		t.Fatalf("resolve: code %d (%s)", res.Code, res.Msg)
+	}
+	if len(fs.executed("^UPDATE `users` SET `status`=.* \\|0 .*\\|u2$")) != 1 {
+		t.Errorf("reported user not disabled: %v", fs.executed("^UPDATE `users`"))
+	}
+	if len(fs.executed("^UPDATE `reports` SET .*`action`=.*\\|disable ")) != 1 {
+		t.Errorf("report not resolved: %v", fs.executed("^UPDATE `reports`"))
+	}
+	if got := audits.actions(); !reflect.DeepEqual(got, []string{"user_disabled:u2", "report_resolved:r1"}) {
+		t.Errorf("audits = %v", got)
+	}
+	waitForClusterEvent(t, fr, "user:u1", "system_message")
+}
+
+func TestAdminGetReportRecordsView(t *testing.T) {
+	fs := setupFakeDB(t)
+	audits := setupRecordingAuditLog(t)
+	admin := authIdentity{FUID: "mod1", Role: roleModerator}
+
+	res := callHandler(t, adminGetReportHandler, "GET", "/reports/r404", nil, admin, gin.Param{Key: "id", Value: "r404"})
+	if res.Code != 404 || len(audits.actions()) != 0 {
+		t.Fatalf("missing report: code %d, audits %v", res.Code, audits.actions())
+	}
+
+	fs.on("FROM `reports`", fakeRow("id,report_id,reporter_fuid,target_type,target_id,reason,status", 1, "r1", "u1", 1, "u2", "spam", 0))
+	res = callHandler(t, adminGetReportHandler, "GET", "/reports/r1", nil, admin, gin.Param{Key: "id", Value: "r1"})
+	if res.Code != 200 {
+		t.Fatalf("get report: code %d (%s)", res.Code, res.Msg)
+	}
+	if got := audits.actions(); !reflect.DeepEqual(got, []string{"report_viewed:r1"}) {
+		t.Fatalf("audits = %v", got)
+	}
+	if audits.events[0].ActorFUID != "mod1" || audits.events[0].TargetType != "report" {
+		t.Errorf("audit event = %+v", audits.events[0])
+	}
+}
+
+func TestCreateReportDuplicateAndDailyLimit(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	savedReport := cfg.Business.Report
+	t.Cleanup(func() { cfg.Business.Report = savedReport })
+	cfg.Business.Report.DailyLimit = 2
+	fs.on("SELECT count\\(\\*\\) FROM `users`", fakeRow("count", 1))
+
+	reporter := authIdentity{FUID: "u1"}
+	report := func() Response {
+		body := map[string]interface{}{"target_type": 1, "target_id": "u2", "reason": "spam"}
+		return callHandler(t, createReportHandler, "POST", "/report", body, reporter)
+	}
+	dailyCount := func() int64 {
+		count, _ := rdb.Get(context.Background(), "report_daily:u1:"+time.Now().Format("20060102")).Int64()
+		return count
+	}
+
+	if res := report(); res.Code != 200 {
+		t.Fatalf("first report: code %d (%s)", res.Code, res.Msg)
+	}
+	inserts := fs.executed("^INSERT INTO `reports`")
+	if len(inserts) != 1 || !strings.Contains(inserts[0], "`open_key`") || !strings.Contains(inserts[0], "ON DUPLICATE KEY UPDATE") {
+		t.Fatalf("insert = %v", inserts)
+	}
+	if key := reportOpenKey("u1", 1, "u2"); *key != "u1|1|u2" {
+		t.Errorf("open key = %q", *key)
+	}
+	if dailyCount() != 1 {
+		t.Errorf("daily count = %d, want 1", dailyCount())
+	}
+
+	// 并发提交：预检查未发现未结案举报，但唯一索引冲突未插入
+	fs.on("^INSERT INTO `reports`", fakeSQLResult{Affected: 0})
+	if res := report(); res.Code != 409 {
+		t.Errorf("conflicting insert: code %d, want 409", res.Code)
+	}
+	// 写入失败
+	fs.on("^INSERT INTO `reports`", fakeSQLResult{Err: errors.New("connection reset")})
+	if res := report(); res.Code != 500 {
+		t.Errorf("failed insert: code %d, want 500", res.Code)
+	}
+	// 已有未结案举报
+	fs.on("SELECT count\\(\\*\\) FROM `reports`", fakeRow("count", 1))
+	if res := report(); res.Code != 409 {
+		t.Errorf("open report: code %d, want 409", res.Code)
+	}
+	if dailyCount() != 1 {
+		t.Fatalf("daily count after rejected reports = %d, want 1", dailyCount())
+	}
+
+	fs.on("SELECT count\\(\\*\\) FROM `reports`", fakeRow("count", 0))
+	fs.on("^INSERT INTO `reports`", fakeSQLResult{Affected: 1})
+	if res := report(); res.Code != 200 {
+		t.Fatalf("second report: code %d (%s)", res.Code, res.Msg)
+	}
+	before := len(fs.executed("^INSERT INTO `reports`"))
+	if res := report(); res.Code != 429 {
+		t.Errorf("over the daily limit: code %d, want 429", res.Code)
+	}
+	if len(fs.executed("^INSERT INTO `reports`")) != before {
+		t.Error("report inserted over the daily limit")
+	}
+	if dailyCount() != 2 {
+		t.Errorf("daily count = %d, want 2", dailyCount())
+	}
+}
+
+func TestResolveReportReleasesOpenKey(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	setupRecordingAuditLog(t)
+	fs.on("FROM `reports`", fakeRow("id,report_id,reporter_fuid,target_type,target_id,reason,status,open_key", 1, "r1", "u1", 1, "u2", "spam", 0, "u1|1|u2"))
+
+	admin := authIdentity{FUID: "admin1", Role: roleAdmin}
+	res := callHandler(t, adminResolveReportHandler, "POST", "/reports/r1/resolve", map[string]string{"action": "reject"}, admin,
+		gin.Param{Key: "id", Value: "r1"})
+	if res.Code != 200 {
+		t.Fatalf("resolve: code %d (%s)", res.Code, res.Msg)
+	}
+	updates := fs.executed("^UPDATE `reports` SET .*`open_key`=NULL")
+	if len(updates) != 1 {
+		t.Fatalf("open_key not cleared on resolve: %v", fs.executed("^UPDATE `reports`"))
+	}
+	waitForClusterEvent(t, fr, "user:u1", "system_message")
+}
+
+func TestACMatcherOverlappingMatches(t *testing.T) {
+	cases := []struct {
+		name  string
+		words []string
+		text  string
+		want  [][2]int
+	}{
+		{"classic overlap", []string{"he", "she", "his", "hers"}, "ushers", [][2]int{{1, 4}, {2, 4}, {2, 6}}},
+		{"nested words", []string{"a", "ab", "abc", "bc"}, "abc", [][2]int{{0, 1}, {0, 2}, {0, 3}, {1, 3}}},
+		{"repeated word", []string{"aa"}, "aaaa", [][2]int{{0, 2}, {1, 3}, {2, 4}}},
+		{"case insensitive", []string{"Spam"}, "SPAM spam", [][2]int{{0, 4}, {5, 9}}},
+		{"chinese", []string{"敏感", "感词"}, "含敏感词", [][2]int{{1, 3}, {2, 4}}},
+		{"blank words ignored", []string{"", "  "}, "abc", nil},
+		{"no match", []string{"xyz"}, "abc", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := newACMatcher(tc.words).find([]rune(tc.text))
+			sort.Slice(got, func(i, j int) bool {
+				if got[i][0] != got[j][0] {
+					return got[i][0] < got[j][0]
+				}
+				return got[i][1] < got[j][1]
+			})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSensitiveWordReplaceAndBlock(t *testing.T) {
+	saved := cfg.MessageFilter.SensitiveWords
+	defer func() { cfg.MessageFilter.SensitiveWords = saved }()
+	cfg.MessageFilter.SensitiveWords.Replacement = "*"
+	filter := &sensitiveWordFilter{matcher: newACMatcher([]string{"she", "hers"})}
+	cases := []struct {
+		name     string
+		global   string
+		group    groupFilterConfig
+		text     string
+		blocked  bool
+		wantText string
+	}{
+		{"replace masks overlapping matches", "replace", groupFilterConfig{}, "ushers!", false, "u*****!"},
+		{"replace without match", "replace", groupFilterConfig{}, "hello", false, "hello"},
+		{"block", "block", groupFilterConfig{}, "ushers", true, "ushers"},
+		{"group tightens replace to block", "replace", groupFilterConfig{WordAction: "block"}, "she", true, "she"},
+		{"group cannot loosen block to replace", "block", groupFilterConfig{WordAction: "replace"}, "she", true, "she"},
+		{"group extra words", "replace", groupFilterConfig{ExtraWords: []string{"foo"}}, "foo she", false, "*** ***"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.MessageFilter.SensitiveWords.Action = tc.global
+			msg := filterMessage{ReceiverType: 2, ReceiverID: tc.name, Text: tc.text, Inspectable: true, Group: tc.group}
+			block := filter.Apply(&msg)
+			if (block != nil) != tc.blocked {
+				t.Fatalf("blocked = %v, want %v", block != nil, tc.blocked)
+			}
+			if msg.Text != tc.wantText {
+				t.Errorf("text = %q, want %q", msg.Text, tc.wantText)
+			}
+		})
+	}
+	msg := filterMessage{Text: "she", Inspectable: false}
+	if filter.Apply(&msg) != nil || msg.Text != "she" {
+		t.Error("uninspectable message was filtered")
+	}
+}
+
+// 可在群内停用的测试过滤器
+type optionalTestFilter struct{}
+
+func (optionalTestFilter) Name() string                      { return "optional_test" }
+func (optionalTestFilter) Apply(*filterMessage) *filterBlock { return nil }
+func (optionalTestFilter) GroupOptional() bool               { return true }
+
+func TestGroupFilterConfigOnlyTightens(t *testing.T) {
+	savedFilters, savedWords := messageFilters, cfg.MessageFilter.SensitiveWords
+	defer func() { messageFilters, cfg.MessageFilter.SensitiveWords = savedFilters, savedWords }()
+	messageFilters = []messageFilter{floodFilter{}, &sensitiveWordFilter{matcher: newACMatcher(nil)}, optionalTestFilter{}}
+	cfg.MessageFilter.SensitiveWords.Action = "block"
+	cases := []struct {
+		name   string
+		config groupFilterConfig
+		ok     bool
+	}{
+		{"empty", groupFilterConfig{}, true},
+		{"disable optional filter", groupFilterConfig{Disabled: []string{"optional_test"}}, true},
+		{"disable global filter", groupFilterConfig{Disabled: []string{"sensitive_words"}}, false},
+		{"disable unknown filter", groupFilterConfig{Disabled: []string{"nope"}}, false},
+		{"loosen word action", groupFilterConfig{WordAction: "replace"}, false},
+		{"keep word action", groupFilterConfig{WordAction: "block"}, true},
+	}
+	for _, tc := range cases {
+		if err := validateGroupFilterConfig(tc.config); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+	stored := groupFilterConfig{Disabled: []string{"flood", "optional_test"}}
+	if stored.disabled(floodFilter{}) || !stored.disabled(optionalTestFilter{}) {
+		t.Error("stored config disabled a global filter")
+	}
+
+	limits := []struct{ global, group, want int }{
+		{20, 0, 0},
+		{20, 5, 5},
+		{20, 50, 20},
+		{0, 5, 5},
+	}
+	for _, tc := range limits {
+		if got := groupFloodLimit(tc.global, tc.group); got != tc.want {
+			t.Errorf("groupFloodLimit(%d, %d) = %d, want %d", tc.global, tc.group, got, tc.want)
+		}
+	}
+}
+
+func TestLinkFilterMatchesBareDomains(t *testing.T) {
+	saved := cfg.MessageFilter.Link
+	defer func() { cfg.MessageFilter.Link = saved }()
+	cfg.MessageFilter.Link.AllowDomains = []string{"example.com"}
+	cases := []struct {
+		name     string
+		action   string
+		text     string
+		blocked  bool
+		wantText string
+	}{
+		{"bare domain with path", "block", "see evil.com/x", true, ""},
+		{"bare domain", "block", "evil.com", true, ""},
+		{"bare subdomain with port", "replace", "go to a.b.evil.org:8080/login now", false, "go to [链接已屏蔽] now"},
+		{"bare domain after chinese text", "replace", "访问evil.com/x了解", false, "访问[链接已屏蔽]"},
+		{"bare allowed domain", "block", "docs at example.com/guide", false, "docs at example.com/guide"},
+		{"bare allowed subdomain", "block", "cdn.example.com", false, "cdn.example.com"},
+		{"lookalike of allowed domain", "block", "badexample.com", true, ""},
+		{"scheme link", "replace", "https://evil.com/x", false, "[链接已屏蔽]"},
+		{"www link", "replace", "www.evil.com", false, "[链接已屏蔽]"},
+		{"version number is not a link", "block", "upgrade to 1.2.3", false, "upgrade to 1.2.3"},
+		{"word.word reads as a bare domain", "block", "done.ok", true, ""},
+		{"single letter tld is not a link", "block", "e.g this", false, "e.g this"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.MessageFilter.Link.Action = tc.action
+			msg := filterMessage{ReceiverType: 1, Text: tc.text, Inspectable: true}
+			block := linkFilter{}.Apply(&msg)
+			if (block != nil) != tc.blocked {
+				t.Fatalf("blocked = %v, want %v", block != nil, tc.blocked)
+			}
+			if !tc.blocked && msg.Text != tc.wantText {
+				t.Errorf("text = %q, want %q", msg.Text, tc.wantText)
+			}
+		})
+	}
+}
+
+func TestFilterRejectsUnopenableTransportContent(t *testing.T) {
+	savedEnable, savedFilters := cfg.MessageFilter.Enable, messageFilters
+	defer func() { cfg.MessageFilter.Enable, messageFilters = savedEnable, savedFilters }()
+	cfg.MessageFilter.Enable = true
+	messageFilters = []messageFilter{linkFilter{}}
+	for _, content := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte{0x7f, 1, 2, 3})} {
+		req := sendMessageRequest{ReceiverType: 1, ReceiverID: "u2", ContentType: 1, Content: content, Encryption: 0}
+		if apiErr := filterOutgoingMessage("u1", &req, "m1"); apiErr == nil || apiErr.Code != 400 {
+			t.Errorf("content %q: apiErr = %v, want 400", content, apiErr)
+		}
+	}
+	// 端到端加密及非文字消息服务端本就无法检查，照常放行
+	for _, req := range []sendMessageRequest{
+		{ReceiverType: 1, ReceiverID: "u2", ContentType: 1, Content: "opaque", Encryption: 1},
+		{ReceiverType: 1, ReceiverID: "u2", ContentType: 2, Content: "opaque", Encryption: 0},
+	} {
+		if apiErr := filterOutgoingMessage("u1", &req, "m1"); apiErr != nil {
+			t.Errorf("%+v: apiErr = %v", req, apiErr)
+		}
+	}
+}
+
+func TestCheckSendRestrictions(t *testing.T) {
+	fs := setupFakeDB(t)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	forever := restrictionForever
+
+	if err := checkSendRestrictions("u1", sendRestrictions{MuteUntil: &past, FriendsOnlyUntil: &past}, 2, "q1"); err != nil {
+		t.Errorf("expired restrictions: %+v", err)
+	}
+	if err := checkSendRestrictions("u1", sendRestrictions{MuteUntil: &future}, 1, "u2"); err == nil || err.Code != 403 || !strings.Contains(err.Msg, future.Format("2006-01-02 15:04:05")) {
+		t.Errorf("timed mute: %+v", err)
+	}
+	if err := checkSendRestrictions("u1", sendRestrictions{MuteUntil: &forever}, 1, "u2"); err == nil || !strings.Contains(err.Msg, "永久") {
+		t.Errorf("permanent mute: %+v", err)
+	}
+	// 影子封禁不拦截发送
+	if err := checkSendRestrictions("u1", sendRestrictions{ShadowBanUntil: &future}, 2, "q1"); err != nil {
+		t.Errorf("shadow ban rejected the message: %+v", err)
+	}
+
+	friendsOnly := sendRestrictions{FriendsOnlyUntil: &future}
+	if err := checkSendRestrictions("u1", friendsOnly, 2, "q1"); err == nil || err.Code != 403 {
+		t.Errorf("friends-only group message: %+v", err)
+	}
+	if err := checkSendRestrictions("u1", friendsOnly, 1, "u2"); err == nil || err.Code != 403 {
+		t.Errorf("friends-only stranger: %+v", err)
+	}
+	fs.on("SELECT count\\(\\*\\) FROM `friends` .*\\|u2 \\|u1$", fakeRow("count", 1))
+	if err := checkSendRestrictions("u1", friendsOnly, 1, "u2"); err != nil {
+		t.Errorf("friends-only friend: %+v", err)
+	}
+}
+
+func TestAdminSetRestriction(t *testing.T) {
+	fr := setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	setupClusterNode(t, "node-a")
+	setupLocalConns(t)
+	audits := setupRecordingAuditLog(t)
+	moderator := authIdentity{FUID: "mod1", Role: roleModerator}
+	restrict := func(body map[string]interface{}) Response {
+		return callHandler(t, adminSetRestrictionHandler, "POST", "/admin/users/u2/restrictions", body, moderator, gin.Param{Key: "fuid", Value: "u2"})
+	}
+	fs.on("FROM `users`", fakeRow("id,fuid,role,status", 2, "u2", "", 1))
+
+	if res := restrict(map[string]interface{}{"type": "ban", "duration": 60}); res.Code != 400 {
+		t.Errorf("unknown restriction: code %d, want 400", res.Code)
+	}
+	res := restrict(map[string]interface{}{"type": "mute", "duration": 3600, "reason": "spam"})
+	if res.Code != 200 {
+		t.Fatalf("mute: code %d (%s)", res.Code, res.Msg)
+	}
+	until, err := time.ParseInLocation("2006-01-02 15:04:05", responseData(t, res)["until"].(string), time.Local)
+	if err != nil || until.Before(time.Now().Add(59*time.Minute)) || until.After(time.Now().Add(time.Hour)) {
+		t.Errorf("until = %v (%v)", until, err)
+	}
+	if len(fs.executed("^UPDATE `users` SET `mute_until`=.*\\|u2$")) != 1 {
+		t.Errorf("updates = %v", fs.executed("^UPDATE `users`"))
+	}
+	if got := audits.actions(); !reflect.DeepEqual(got, []string{"user_restricted:u2"}) || !strings.Contains(audits.events[0].Payload, `"reason":"spam"`) {
+		t.Errorf("audits = %v", audits.events)
+	}
+	waitForClusterEvent(t, fr, "user:u2", "system_message")
+
+	// 影子封禁不通知本人
+	res = restrict(map[string]interface{}{"type": "shadow_ban", "duration": 3600})
+	if res.Code != 200 || len(fs.executed("^UPDATE `users` SET `shadow_ban_until`=.*\\|u2$")) != 1 {
+		t.Fatalf("shadow ban: code %d, updates %v", res.Code, fs.executed("^UPDATE `users`"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(fs.executed("INSERT INTO `system_messages`")); n != 1 {
+		t.Errorf("system messages = %d, want 1 (mute notice only)", n)
+	}
+}
+
+func TestShadowMessageDoesNotConsumeConversationSeq(t *testing.T) {
+	setupFakeRedis(t)
+	fs := setupFakeDB(t)
+	convID := "group:q1"
+	rdb.Set(context.Background(), "conv_seq:"+convID, 4, 0)
+	fs.on("FROM `group_members`", fakeRow("group_quid,user_fuid,status,join_seq", "q1", "u1", 1, 0))
+	fs.on("FROM `users`", fakeRow("fuid,shadow_ban_until", "u1", time.Now().Add(time.Hour)))
+	req := sendMessageRequest{ReceiverType: 2, ReceiverID: "q1", ContentType: 1, Content: "opaque", Encryption: 1}
+	shadow, apiErr := sendMessage("u1", req)
+	if apiErr != nil || !shadow.Shadow {
+		t.Fatalf("shadow send: %v %v", shadow, apiErr)
+	}
+	if shadow.Seq != 4 {
+		t.Errorf("shadow seq = %d, want anchor 4", shadow.Seq)
+	}
+	// 其他成员的下一条消息紧接在4之后，接收方看不到空洞
+	fs.on("FROM `users`", fakeRow("fuid", "u2"))
+	normal, apiErr := sendMessage("u2", req)
+	if apiErr != nil || normal.Shadow || normal.Seq != 5 {
+		t.Fatalf("normal send: %v %v", normal, apiErr)
+	}
+
+	fs.on("FROM `messages`", fakeSQLResult{
+		Columns: []string{"msg_id", "conv_id", "seq", "sender_fuid", "receiver_type", "receiver_id"},
+		Rows:    [][]driver.Value{{"m4", convID, 4, "u3", 2, "q1"}, {normal.MsgID, convID, 5, "u2", 2, "q1"}},
+	})
+	res := callHandler(t, getMessageRangeHandler, "GET", "/message/range?receiver_type=2&receiver_id=q1&start_seq=4", nil, authIdentity{FUID: "u3"})
+	data := responseData(t, res)
+	if data["latest_seq"].(float64) != 5 {
+		t.Errorf("latest_seq = %v, want 5", data["latest_seq"])
+	}
+	if got := fmt.Sprint(data["empty_seqs"]); got != "[]" {
+		t.Errorf("empty_seqs = %s, want []", got)
+	}
+	queries := fs.executed("FROM `messages` WHERE conv_id = \\? AND seq >= \\? AND \\(shadow = 0 OR sender_fuid = \\?\\)")
+	if len(queries) != 1 || !strings.Contains(queries[0], "|u3") {
+		t.Errorf("recipient range query does not hide shadow messages: %v", queries)
+	}
+}